@@ -36,16 +36,22 @@ func (f Arch) String() string {
 	return names[f]
 }
 
+// CloudProvider selects cloud specific defaults, such as the annotations of
+// a LoadBalancer Service. The values are stored as is, so AWS stays the zero
+// value and new providers are appended.
+// +kubebuilder:validation:Enum=0;1;2
 type CloudProvider int
 
 const (
 	AWS CloudProvider = iota
 	GCP
+	// CloudNone applies no cloud specific defaults
+	CloudNone
 )
 
 func (f CloudProvider) String() string {
-	names := [...]string{"aws", "gcp"}
-	if f < AWS || f > GCP {
+	names := [...]string{"aws", "gcp", "none"}
+	if f < AWS || f > CloudNone {
 		return "Unknown"
 	}
 	return names[f]
@@ -56,7 +62,7 @@ func (f CloudProvider) String() string {
 
 // BuildkitSpec defines the desired state of Buildkit
 type BuildkitSpec struct {
-	// CloudProvider
+	// CloudProvider is 0 for AWS, the default, 1 for GCP and 2 for none
 	CloudProvider CloudProvider `json:"cloud,omitempty"`
 
 	Arch []Arch `json:"arch,omitempty"`
@@ -72,6 +78,108 @@ type BuildkitSpec struct {
 	DaemonCertsSecretName string `json:"daemon_certs,omitempty"`
 
 	Rootless bool `json:"rootless,omitempty"`
+
+	// RootlessOptions tune the rootless profile, only used with Rootless
+	RootlessOptions *RootlessOptions `json:"rootless_options,omitempty"`
+
+	// Access restricts which clients may reach buildkitd. When set, a
+	// NetworkPolicy is created for the buildkitd pods.
+	Access *BuildkitAccess `json:"access,omitempty"`
+
+	// Expose controls how buildkitd is reachable from outside the cluster
+	Expose *BuildkitExpose `json:"expose,omitempty"`
+
+	// PodTemplate is strategically merged onto the generated buildkitd pod
+	// template. Operator owned fields, such as the certs volume, the
+	// buildkitd image, args and ports, the selector labels and the security
+	// contexts and host namespaces of the profile, are kept.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	PodTemplate *corev1.PodTemplateSpec `json:"pod_template,omitempty"`
+}
+
+// RootlessOptions configure the sandboxing of rootless buildkitd
+type RootlessOptions struct {
+	// UserNamespaces runs the pod in its own user namespace (hostUsers: false).
+	// Requires a cluster with user namespace support.
+	UserNamespaces bool `json:"user_namespaces,omitempty"`
+
+	// SeccompProfile of the buildkitd container, Unconfined by default
+	SeccompProfile *corev1.SeccompProfile `json:"seccomp_profile,omitempty"`
+
+	// AppArmorProfile of the buildkitd container, e.g. localhost/buildkitd.
+	// Defaults to unconfined.
+	AppArmorProfile string `json:"apparmor_profile,omitempty"`
+}
+
+// BuildkitAccess lists the clients allowed to connect to buildkitd
+type BuildkitAccess struct {
+	// Namespaces whose pods may connect to buildkitd
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// PodSelectors select pods in the Buildkit namespace that may connect to buildkitd
+	PodSelectors []metav1.LabelSelector `json:"pod_selectors,omitempty"`
+
+	// LinkNamespaces may hold Buildkite stacks linking to this Buildkit with
+	// buildkit_ref. Linked stacks get a client certificate and are admitted
+	// by the NetworkPolicy. Stacks in the Buildkit namespace may always link.
+	LinkNamespaces []string `json:"link_namespaces,omitempty"`
+
+	// RouterNamespace is the namespace of the router pods dispatching builds
+	// to buildkitd, the Buildkit namespace by default
+	RouterNamespace string `json:"router_namespace,omitempty"`
+}
+
+// ExposeMode is the way buildkitd is exposed
+// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer;TLSRoute
+type ExposeMode string
+
+const (
+	ExposeClusterIP    ExposeMode = "ClusterIP"
+	ExposeNodePort     ExposeMode = "NodePort"
+	ExposeLoadBalancer ExposeMode = "LoadBalancer"
+	ExposeTLSRoute     ExposeMode = "TLSRoute"
+)
+
+// BuildkitExpose describes the external exposure of buildkitd
+type BuildkitExpose struct {
+	Mode ExposeMode `json:"mode,omitempty"`
+
+	// Hostname clients use to reach buildkitd. It is added to the server
+	// certificate and required for TLSRoute.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Annotations added to the Service on top of the cloud profile defaults
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// SourceRanges limit the client CIDRs of a LoadBalancer or NodePort. They
+	// are required for those modes when access is set, the NetworkPolicy
+	// admits external clients from these ranges only.
+	SourceRanges []string `json:"source_ranges,omitempty"`
+
+	// Gateway the TLSRoute attaches to
+	Gateway *GatewayReference `json:"gateway,omitempty"`
+}
+
+// GatewayReference points at a Gateway API Gateway listener
+type GatewayReference struct {
+	Name string `json:"name"`
+
+	Namespace string `json:"namespace,omitempty"`
+
+	SectionName string `json:"section_name,omitempty"`
+
+	// Port of the Gateway listener, 443 by default
+	Port int32 `json:"port,omitempty"`
+
+	// PodNamespace is the namespace of the Gateway pods, admitted by the
+	// NetworkPolicy when access is set. The Gateway namespace by default.
+	PodNamespace string `json:"pod_namespace,omitempty"`
+
+	// PodSelector selects the Gateway pods, by default on the
+	// gateway.networking.k8s.io/gateway-name label set by most implementations
+	PodSelector *metav1.LabelSelector `json:"pod_selector,omitempty"`
 }
 
 // BuildkitStatus defines the observed state of Buildkit
@@ -83,6 +191,9 @@ type BuildkitStatus struct {
 	State string `json:"state"`
 
 	Nodes []string `json:"nodes"`
+
+	// Endpoint is the external address of buildkitd, when exposed
+	Endpoint string `json:"endpoint,omitempty"`
 }
 
 //+kubebuilder:object:root=true
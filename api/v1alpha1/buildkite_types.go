@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,13 +31,394 @@ type BuildkiteSpec struct {
 	Secret    string `json:"secret,omitempty"`
 	GitSecret string `json:"git_secret,omitempty"`
 
+	// GitKnownHosts are known_hosts lines trusted for SSH checkouts with
+	// GitSecret. They are required with an SSH key: checkouts never trust an
+	// unknown host key.
+	GitKnownHosts []string `json:"git_known_hosts,omitempty"`
+
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Agent is rendered into the controller config.yaml
+	Agent BuildkiteAgentConfig `json:"agent,omitempty"`
+
+	// BuildkitRef links the agents to a Buildkit. Job pods get BUILDKIT_HOST
+	// and a client certificate, and the builder admits them. A Buildkit in
+	// another namespace must list this one in access.link_namespaces.
+	BuildkitRef *BuildkitReference `json:"buildkit_ref,omitempty"`
+
+	// RBAC of the controller ServiceAccount
+	RBAC BuildkiteRBAC `json:"rbac,omitempty"`
+
+	// Autoscaling scales the agent capacity with the jobs of the queue
+	Autoscaling *BuildkiteAutoscaling `json:"autoscaling,omitempty"`
+
+	// ManagedToken lets the operator create and rotate the agent token
+	// instead of reading it from agent.token_secret
+	ManagedToken *BuildkiteManagedToken `json:"managed_token,omitempty"`
+
+	// Hooks are agent hooks run by every job
+	Hooks *BuildkiteHooks `json:"hooks,omitempty"`
+
+	// PluginAllowlist restricts the plugins jobs may use to the ones matching
+	// one of these regular expressions, e.g. "github.com/acme/.*". The
+	// kubernetes plugin is refused when set. Every plugin is allowed when
+	// empty.
+	PluginAllowlist []string `json:"plugin_allowlist,omitempty"`
+
+	// Pools run one controller per queue, each with its own config.yaml,
+	// sharing the ServiceAccount and RBAC. Agent.Queue, Agent.Tags and
+	// Agent.MaxInFlight are replaced by the ones of the pool when set.
+	Pools []BuildkitePool `json:"pools,omitempty"`
+
+	// JobTemplate shapes the job pods launched by the controller
+	JobTemplate *BuildkiteJobTemplate `json:"job_template,omitempty"`
+
+	// Artifacts stores the artifacts of jobs in an S3 compatible bucket
+	Artifacts *BuildkiteArtifacts `json:"artifacts,omitempty"`
+}
+
+// BuildkiteArtifacts is the S3 compatible bucket artifacts are uploaded to,
+// passed to the command containers of job pods
+type BuildkiteArtifacts struct {
+	Bucket string `json:"bucket"`
+
+	// Prefix of the artifact keys in the bucket
+	Prefix string `json:"prefix,omitempty"`
+
+	Region string `json:"region,omitempty"`
+
+	// Endpoint of an S3 compatible service such as MinIO, e.g.
+	// "http://minio.storage.svc:9000". AWS S3 when unset.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name, as most S3 compatible services expect
+	PathStyle bool `json:"path_style,omitempty"`
+
+	// CredentialsSecret holds the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY keys. Job pods use their ambient credentials,
+	// e.g. from their service account, when unset.
+	CredentialsSecret string `json:"credentials_secret,omitempty"`
+}
+
+// BuildkiteJobTemplate is rendered into the pod-spec-patch of config.yaml.
+// Container, volume and mount names used by the controller or the operator
+// are reserved.
+type BuildkiteJobTemplate struct {
+	// Sidecars run next to the step containers
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+
+	// InitContainers run before the agent starts
+	InitContainers []corev1.Container `json:"init_containers,omitempty"`
+
+	// Volumes of job pods, e.g. a shared docker config
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// VolumeMounts of the command container
+	VolumeMounts []corev1.VolumeMount `json:"volume_mounts,omitempty"`
+
+	SecurityContext *corev1.PodSecurityContext `json:"security_context,omitempty"`
+
+	// Resources are the default resources of the command container, pools
+	// override them
 	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// ActiveDeadlineSeconds bounds the run time of job pods
+	ActiveDeadlineSeconds *int64 `json:"active_deadline_seconds,omitempty"`
+
+	// TTLAfterFinished is how long finished jobs are kept, in place of
+	// agent.job_ttl
+	TTLAfterFinished metav1.Duration `json:"ttl_after_finished,omitempty"`
+
+	// ServiceAccountName of job pods
+	ServiceAccountName string `json:"service_account_name,omitempty"`
 }
 
+// BuildkitePool is a queue served by its own controller, rendered into the
+// <name>-pool-<pool> ConfigMap and Deployment
+type BuildkitePool struct {
+	// Name of the pool, a DNS label unique within the Buildkite
+	Name string `json:"name"`
+
+	// Queue the agents of the pool listen on
+	Queue string `json:"queue"`
+
+	// Tags are additional agent tags in key=value form
+	Tags []string `json:"tags,omitempty"`
+
+	// Resources are the default resources of the command container of
+	// job pods
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// NodeSelector of job pods
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+
+	// Tolerations of job pods
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// MaxInFlight limits the number of jobs of the pool running at once,
+	// 0 is unlimited
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+}
+
+// BuildkiteHooks are the agent hooks of the jobs, rendered into the
+// <name>-hooks ConfigMap and mounted as the hooks path of the agent
+type BuildkiteHooks struct {
+	Environment *BuildkiteHook `json:"environment,omitempty"`
+
+	PreCheckout *BuildkiteHook `json:"pre_checkout,omitempty"`
+
+	PreCommand *BuildkiteHook `json:"pre_command,omitempty"`
+
+	PostCommand *BuildkiteHook `json:"post_command,omitempty"`
+}
+
+// BuildkiteHook is a hook script, inline or from a ConfigMap in the
+// namespace of the Buildkite. Exactly one must be set.
+type BuildkiteHook struct {
+	Script string `json:"script,omitempty"`
+
+	ConfigMapRef *corev1.ConfigMapKeySelector `json:"config_map_ref,omitempty"`
+}
+
+// RotateAgentTokenAnnotation requests a rotation of the managed agent token
+// when its value changes, e.g. set to the current date.
+const RotateAgentTokenAnnotation = "thecops.dev/rotate-agent-token"
+
+// BuildkiteManagedToken is a cluster agent token created through the
+// Buildkite GraphQL API and stored in the <name>-agent-token Secret. Tokens
+// replaced by a rotation are revoked once the controller runs with the new
+// one.
+type BuildkiteManagedToken struct {
+	// Organization slug the cluster belongs to
+	Organization string `json:"organization"`
+
+	// ClusterID is the GraphQL ID of the Buildkite cluster
+	ClusterID string `json:"cluster_id"`
+
+	// APITokenSecret holds a Buildkite API token allowed to manage cluster
+	// agent tokens
+	APITokenSecret corev1.SecretKeySelector `json:"api_token_secret"`
+
+	// RotationPeriod is how long a token is used before it is replaced,
+	// tokens are not rotated on a schedule when unset
+	RotationPeriod metav1.Duration `json:"rotation_period,omitempty"`
+
+	// RevocationGracePeriod is how long a replaced token stays valid after
+	// the rotation, so jobs started with it can finish, 1h by default. It is
+	// only revoked once agents connect with the new token.
+	RevocationGracePeriod metav1.Duration `json:"revocation_grace_period,omitempty"`
+}
+
+// Autoscaling targets
+const (
+	// AutoscalingMaxInFlight scales agent.max_in_flight of the controller
+	AutoscalingMaxInFlight = "max_in_flight"
+
+	// AutoscalingWarmPool scales a Deployment of idle pods that keep the
+	// job images pulled on the nodes
+	AutoscalingWarmPool = "warm_pool"
+)
+
+// BuildkiteAutoscaling scales the agent capacity from the scheduled and
+// running jobs of the queue, as reported by the Buildkite agent metrics API
+// with the agent token
+type BuildkiteAutoscaling struct {
+	// Target is what is scaled, max_in_flight by default
+	// +kubebuilder:validation:Enum=max_in_flight;warm_pool
+	Target string `json:"target,omitempty"`
+
+	// Min is the lowest capacity. max_in_flight never goes below 1 since 0
+	// means unlimited.
+	// +kubebuilder:validation:Minimum=0
+	Min int32 `json:"min,omitempty"`
+
+	// Max is the highest capacity
+	// +kubebuilder:validation:Minimum=1
+	Max int32 `json:"max"`
+
+	// CoolDown is how long the capacity is kept after a change before it
+	// is lowered, 5m by default. Raising it is never delayed.
+	CoolDown metav1.Duration `json:"cool_down,omitempty"`
+
+	// Interval between two reads of the metrics, 30s by default
+	Interval metav1.Duration `json:"interval,omitempty"`
+
+	// WarmPoolImages are kept pulled by the warm pool, the agent image by
+	// default. Each image needs a shell.
+	WarmPoolImages []string `json:"warm_pool_images,omitempty"`
+}
+
+// BuildkiteRBAC configures the permissions of the controller ServiceAccount
+type BuildkiteRBAC struct {
+	// ExtraRules are appended to the default rules. They may only grant
+	// permissions the operator holds, without wildcards, never on
+	// rbac.authorization.k8s.io, and never on secrets when cluster scoped.
+	ExtraRules []rbacv1.PolicyRule `json:"extra_rules,omitempty"`
+
+	// ClusterScoped grants the rules through a ClusterRole, for controllers
+	// that launch jobs in other namespaces. Only honoured in the namespaces
+	// listed in the operator --cluster-scoped-namespaces flag.
+	ClusterScoped bool `json:"cluster_scoped,omitempty"`
+}
+
+// BuildkitReference points at a Buildkit
+type BuildkitReference struct {
+	Name string `json:"name"`
+
+	// Namespace of the Buildkit, defaults to the Buildkite namespace
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// BuildkiteAgentConfig configures the agent stack controller
+type BuildkiteAgentConfig struct {
+	// Queue the agents listen on, added as the queue tag
+	Queue string `json:"queue,omitempty"`
+
+	// Tags are additional agent tags in key=value form
+	Tags []string `json:"tags,omitempty"`
+
+	// MaxInFlight limits the number of jobs running at once, 0 is unlimited
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// JobTTL is how long finished jobs are kept
+	JobTTL metav1.Duration `json:"job_ttl,omitempty"`
+
+	// Image of the agent container in job pods
+	Image string `json:"image,omitempty"`
+
+	// TokenSecret is the Secret holding the agent token under the "token"
+	// key. Defaults to Secret.
+	TokenSecret string `json:"token_secret,omitempty"`
+
+	// Checkout holds the default checkout settings of job pods
+	Checkout *BuildkiteCheckoutConfig `json:"checkout,omitempty"`
+}
+
+// BuildkiteCheckoutConfig holds the default git checkout settings
+type BuildkiteCheckoutConfig struct {
+	CleanFlags string `json:"clean_flags,omitempty"`
+
+	CloneFlags string `json:"clone_flags,omitempty"`
+
+	FetchFlags string `json:"fetch_flags,omitempty"`
+
+	NoSubmodules bool `json:"no_submodules,omitempty"`
+}
+
+// Condition types reported on a Buildkite
+const (
+	// ConditionGitCredentials reports whether GitSecret exists and holds
+	// an SSH key or HTTPS credentials.
+	ConditionGitCredentials = "GitCredentialsReady"
+
+	// ConditionBuildkitReady reports whether the Buildkit in BuildkitRef
+	// exists and is available.
+	ConditionBuildkitReady = "BuildkitReady"
+
+	// ConditionAgentMetrics reports whether the autoscaler can read the
+	// agent metrics of the queue.
+	ConditionAgentMetrics = "AgentMetricsAvailable"
+
+	// ConditionAgentToken reports whether the managed agent token exists.
+	ConditionAgentToken = "AgentTokenReady"
+
+	// ConditionReady reports whether the config and the agent token are
+	// valid and every controller replica is available.
+	ConditionReady = "Ready"
+
+	// ConditionTokenValid reports whether the agent token Secret holds a
+	// token, and whether Buildkite accepts it when the agent metrics API is
+	// read.
+	ConditionTokenValid = "TokenValid"
+
+	// ConditionConfigValid reports whether the spec renders a valid
+	// config.yaml.
+	ConditionConfigValid = "ConfigValid"
+)
+
 // BuildkiteStatus defines the observed state of Buildkite
 type BuildkiteStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Buildkit is the namespace/name of the bound Buildkit
+	Buildkit string `json:"buildkit,omitempty"`
+
+	// BuildkitReady is true when the bound Buildkit is available
+	BuildkitReady bool `json:"buildkit_ready,omitempty"`
+
+	// Autoscaling is the state of the autoscaler
+	Autoscaling *BuildkiteAutoscalingStatus `json:"autoscaling,omitempty"`
+
+	// AgentToken is the managed agent token
+	AgentToken *BuildkiteAgentTokenStatus `json:"agent_token,omitempty"`
+
+	// Pools is the state of the controller of each pool
+	Pools []BuildkitePoolStatus `json:"pools,omitempty"`
+
+	// ReadyReplicas counts the ready controller pods, of every pool
+	ReadyReplicas int32 `json:"ready_replicas,omitempty"`
+
+	// ConnectedAgents counts the agents connected to the queues of the
+	// Buildkite, read from the agent metrics API when it is enabled
+	ConnectedAgents *int32 `json:"connected_agents,omitempty"`
+
+	// RunningJobs and PendingJobs count the job pods of the queues
+	RunningJobs int32 `json:"running_jobs,omitempty"`
+
+	PendingJobs int32 `json:"pending_jobs,omitempty"`
+
+	// LastSuccessfulJob is the completion time of the last job that
+	// succeeded
+	LastSuccessfulJob *metav1.Time `json:"last_successful_job,omitempty"`
+}
+
+// BuildkitePoolStatus is the state of the controller of a pool
+type BuildkitePoolStatus struct {
+	Name string `json:"name"`
+
+	Queue string `json:"queue"`
+
+	// Deployment running the controller of the pool
+	Deployment string `json:"deployment"`
+
+	ReadyReplicas int32 `json:"ready_replicas"`
+
+	// Ready is true when every controller replica of the pool is available
+	Ready bool `json:"ready"`
+}
+
+// BuildkiteAgentTokenStatus tracks the managed agent token
+type BuildkiteAgentTokenStatus struct {
+	// ID of the token in Buildkite
+	ID string `json:"id"`
+
+	CreatedAt metav1.Time `json:"created_at"`
+
+	// RotationRequest is the last handled value of the rotate annotation
+	RotationRequest string `json:"rotation_request,omitempty"`
+
+	// Revoking are the IDs of replaced tokens, revoked once the controller
+	// rolled out with the current one and the grace period elapsed
+	Revoking []string `json:"revoking,omitempty"`
+}
+
+// BuildkiteAutoscalingStatus is the last decision of the autoscaler
+type BuildkiteAutoscalingStatus struct {
+	// Queue the job counts were read for
+	Queue string `json:"queue"`
+
+	ScheduledJobs int32 `json:"scheduled_jobs"`
+
+	RunningJobs int32 `json:"running_jobs"`
+
+	// Desired is the capacity applied to the target
+	Desired int32 `json:"desired"`
+
+	// LastScaleTime is when Desired last changed
+	LastScaleTime *metav1.Time `json:"last_scale_time,omitempty"`
 }
 
 //+kubebuilder:object:root=true
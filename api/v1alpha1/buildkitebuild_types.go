@@ -0,0 +1,133 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BuildkiteBuildSpec defines the build to create. The spec is only read when
+// the build is created in Buildkite, later changes have no effect.
+type BuildkiteBuildSpec struct {
+	// PipelineRef names the BuildkitePipeline to build, in the same namespace
+	PipelineRef corev1.LocalObjectReference `json:"pipeline_ref"`
+
+	// Commit to build, HEAD by default
+	Commit string `json:"commit,omitempty"`
+
+	// Branch to build, the default branch of the pipeline by default
+	Branch string `json:"branch,omitempty"`
+
+	// Message of the build, defaults to the resource name
+	Message string `json:"message,omitempty"`
+
+	Env map[string]string `json:"env,omitempty"`
+
+	// MetaData is made available to the steps with buildkite-agent meta-data get
+	MetaData map[string]string `json:"meta_data,omitempty"`
+
+	// TTLSecondsAfterFinished deletes the resource this long after the build
+	// finished. The resource is kept when unset.
+	// +kubebuilder:validation:Minimum=0
+	TTLSecondsAfterFinished *int32 `json:"ttl_seconds_after_finished,omitempty"`
+}
+
+// BuildkiteJobStatus mirrors a job of the build
+type BuildkiteJobStatus struct {
+	ID string `json:"id"`
+
+	// Type of the job, e.g. script, waiter, manual or trigger
+	Type string `json:"type,omitempty"`
+
+	Name string `json:"name,omitempty"`
+
+	State string `json:"state,omitempty"`
+
+	ExitStatus *int32 `json:"exit_status,omitempty"`
+
+	WebURL string `json:"web_url,omitempty"`
+
+	StartedAt *metav1.Time `json:"started_at,omitempty"`
+
+	FinishedAt *metav1.Time `json:"finished_at,omitempty"`
+}
+
+// Condition types reported on a BuildkiteBuild
+const (
+	// ConditionBuildCreated reports whether the build was created in Buildkite
+	ConditionBuildCreated = "Created"
+)
+
+// BuildkiteBuildStatus mirrors the build in Buildkite
+type BuildkiteBuildStatus struct {
+	// ID of the build in Buildkite
+	ID string `json:"id,omitempty"`
+
+	// Number of the build in its pipeline
+	Number int64 `json:"number,omitempty"`
+
+	// State of the build, e.g. scheduled, running, passed or failed
+	State string `json:"state,omitempty"`
+
+	WebURL string `json:"web_url,omitempty"`
+
+	// Commit resolved by Buildkite
+	Commit string `json:"commit,omitempty"`
+
+	CreatedAt *metav1.Time `json:"created_at,omitempty"`
+
+	StartedAt *metav1.Time `json:"started_at,omitempty"`
+
+	FinishedAt *metav1.Time `json:"finished_at,omitempty"`
+
+	Jobs []BuildkiteJobStatus `json:"jobs,omitempty"`
+
+	// CreationKey is recorded before the build is created and sent as its
+	// meta-data, so a retried creation finds the build instead of creating
+	// another one.
+	CreationKey string `json:"creation_key,omitempty"`
+
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Pipeline",type=string,JSONPath=`.spec.pipeline_ref.name`
+// +kubebuilder:printcolumn:name="Number",type=integer,JSONPath=`.status.number`
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// BuildkiteBuild is the Schema for the buildkitebuilds API
+type BuildkiteBuild struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BuildkiteBuildSpec   `json:"spec,omitempty"`
+	Status BuildkiteBuildStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// BuildkiteBuildList contains a list of BuildkiteBuild
+type BuildkiteBuildList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BuildkiteBuild `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BuildkiteBuild{}, &BuildkiteBuildList{})
+}
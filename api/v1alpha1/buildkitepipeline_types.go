@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -24,17 +25,184 @@ import (
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 // BuildkitePipelineSpec defines the desired state of BuildkitePipeline
 type BuildkitePipelineSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Organization slug the pipeline belongs to
+	Organization string `json:"organization"`
 
-	// Foo is an example field of BuildkitePipeline. Edit buildkitepipeline_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Slug of the pipeline, defaults to the resource name. Buildkite derives
+	// the slug from the name, so the name defaults to the slug.
+	Slug string `json:"slug,omitempty"`
+
+	// Name of the pipeline, defaults to the slug
+	Name string `json:"name,omitempty"`
+
+	// Description of the pipeline. The operator appends a marker naming the
+	// resource managing the pipeline to it.
+	Description string `json:"description,omitempty"`
+
+	// Repository cloned by the pipeline
+	Repository string `json:"repository"`
+
+	DefaultBranch string `json:"default_branch,omitempty"`
+
+	// BranchConfiguration filters the branches that trigger builds, e.g. "main release/*"
+	BranchConfiguration string `json:"branch_configuration,omitempty"`
+
+	// Steps is the inline pipeline YAML
+	Steps string `json:"steps,omitempty"`
+
+	// PipelineFile is uploaded from the repository when Steps is empty,
+	// .buildkite/pipeline.yml by default
+	PipelineFile string `json:"pipeline_file,omitempty"`
+
+	// TemplateRef renders the steps from a BuildkitePipelineTemplate, in
+	// place of Steps and PipelineFile
+	TemplateRef *PipelineTemplateRef `json:"template_ref,omitempty"`
+
+	ProviderSettings *PipelineProviderSettings `json:"provider_settings,omitempty"`
+
+	// Schedules create builds on a cron schedule
+	Schedules []PipelineSchedule `json:"schedules,omitempty"`
+
+	// DriftPolicy decides what happens when the pipeline was changed in
+	// Buildkite, e.g. in the UI. Enforce overwrites it with the spec, Observe
+	// only reports the difference. Enforce by default.
+	// +kubebuilder:validation:Enum=Enforce;Observe
+	DriftPolicy DriftPolicy `json:"drift_policy,omitempty"`
+
+	// DeletionPolicy decides what happens to the pipeline in Buildkite when
+	// the resource is deleted. Archive by default.
+	// +kubebuilder:validation:Enum=Archive;Delete;Retain
+	DeletionPolicy DeletionPolicy `json:"deletion_policy,omitempty"`
+
+	// AdoptionPolicy decides what happens when a pipeline with the slug
+	// already exists in Buildkite and no resource manages it. Fail by
+	// default. Pipelines managed from another resource or cluster are never
+	// adopted.
+	// +kubebuilder:validation:Enum=Fail;Adopt
+	AdoptionPolicy AdoptionPolicy `json:"adoption_policy,omitempty"`
+
+	// TokenSecret holds the Buildkite API token
+	TokenSecret corev1.SecretKeySelector `json:"token_secret"`
+}
+
+// DriftPolicy decides how changes made to a pipeline in Buildkite are handled
+type DriftPolicy string
+
+const (
+	// DriftPolicyEnforce overwrites the pipeline in Buildkite with the spec
+	DriftPolicyEnforce DriftPolicy = "Enforce"
+	// DriftPolicyObserve reports the pipeline as drifted and leaves it alone
+	DriftPolicyObserve DriftPolicy = "Observe"
+)
+
+// PipelineProviderSettings control which source events trigger builds
+type PipelineProviderSettings struct {
+	// +kubebuilder:validation:Enum=code;deployment;fork;none
+	TriggerMode string `json:"trigger_mode,omitempty"`
+
+	BuildPullRequests *bool `json:"build_pull_requests,omitempty"`
+
+	BuildBranches *bool `json:"build_branches,omitempty"`
+
+	BuildTags *bool `json:"build_tags,omitempty"`
+
+	PublishCommitStatus *bool `json:"publish_commit_status,omitempty"`
+
+	FilterEnabled *bool `json:"filter_enabled,omitempty"`
+
+	FilterCondition string `json:"filter_condition,omitempty"`
+}
+
+// PipelineSchedule creates builds of the pipeline on a cron schedule
+type PipelineSchedule struct {
+	// Label identifies the schedule, it must be unique within the pipeline
+	Label string `json:"label"`
+
+	// Cron is the schedule in cron syntax, e.g. "0 2 * * 1-5", "@daily" or
+	// "0 2 * * * Europe/Berlin"
+	Cron string `json:"cron"`
+
+	// Branch to build, the default branch of the pipeline by default
+	Branch string `json:"branch,omitempty"`
+
+	// Commit to build, HEAD by default
+	Commit string `json:"commit,omitempty"`
+
+	Message string `json:"message,omitempty"`
+
+	Env map[string]string `json:"env,omitempty"`
+
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
 }
 
+// PipelineScheduleStatus is a schedule created in Buildkite
+type PipelineScheduleStatus struct {
+	Label string `json:"label"`
+
+	// ID of the schedule in Buildkite
+	ID string `json:"id"`
+
+	// NextBuildAt is when the schedule creates its next build
+	NextBuildAt *metav1.Time `json:"next_build_at,omitempty"`
+}
+
+// DeletionPolicy decides what happens to a pipeline in Buildkite when its
+// resource is deleted
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyArchive archives the pipeline, its builds are kept
+	DeletionPolicyArchive DeletionPolicy = "Archive"
+	// DeletionPolicyDelete deletes the pipeline and its builds
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain leaves the pipeline, free to be adopted again
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// AdoptionPolicy decides whether an existing pipeline is taken over
+type AdoptionPolicy string
+
+const (
+	// AdoptionPolicyFail refuses to manage a pipeline created outside the resource
+	AdoptionPolicyFail AdoptionPolicy = "Fail"
+	// AdoptionPolicyAdopt takes over a pipeline no resource manages
+	AdoptionPolicyAdopt AdoptionPolicy = "Adopt"
+)
+
+// Condition types reported on a BuildkitePipeline
+const (
+	// ConditionPipelineSynced reports whether the pipeline matches the spec in Buildkite
+	ConditionPipelineSynced = "Synced"
+	// ConditionPipelineDrifted reports whether the pipeline was changed in
+	// Buildkite since it was last applied, the message lists the fields
+	ConditionPipelineDrifted = "Drifted"
+)
+
 // BuildkitePipelineStatus defines the observed state of BuildkitePipeline
 type BuildkitePipelineStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ID of the pipeline in Buildkite
+	ID string `json:"id,omitempty"`
+
+	// Slug of the pipeline in Buildkite
+	Slug string `json:"slug,omitempty"`
+
+	WebURL string `json:"web_url,omitempty"`
+
+	ObservedGeneration int64 `json:"observed_generation,omitempty"`
+
+	// Schedules managed by the operator. Only these are pruned when they
+	// are removed from the spec.
+	Schedules []PipelineScheduleStatus `json:"schedules,omitempty"`
+
+	// StepsHash is the SHA-256 of the steps last rendered from the template.
+	// The pipeline is applied again when the template renders other steps.
+	StepsHash string `json:"steps_hash,omitempty"`
+
+	// DriftCheckedAt is when the pipeline was last compared with Buildkite
+	DriftCheckedAt *metav1.Time `json:"drift_checked_at,omitempty"`
+
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,113 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var buildkitepipelinelog = logf.Log.WithName("buildkitepipeline-resource")
+
+// SetupWebhookWithManager will setup the manager to manage the webhooks
+func (r *BuildkitePipeline) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-thecops-dev-v1alpha1-buildkitepipeline,mutating=false,failurePolicy=fail,sideEffects=None,groups=thecops.dev,resources=buildkitepipelines,verbs=create;update,versions=v1alpha1,name=vbuildkitepipeline.thecops.dev,admissionReviewVersions=v1
+
+var _ webhook.Validator = &BuildkitePipeline{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *BuildkitePipeline) ValidateCreate() (admission.Warnings, error) {
+	buildkitepipelinelog.Info("validate create", "name", r.Name)
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *BuildkitePipeline) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	buildkitepipelinelog.Info("validate update", "name", r.Name)
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *BuildkitePipeline) ValidateDelete() (admission.Warnings, error) {
+	return nil, nil
+}
+
+// ValidateSpec checks the spec of the pipeline, including the inline steps.
+// It needs no cluster access and is shared by the webhook and the CLI.
+func (r *BuildkitePipeline) ValidateSpec() (admission.Warnings, field.ErrorList) {
+	var warnings admission.Warnings
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	if r.Spec.Steps != "" {
+		allErrs = append(allErrs, ValidatePipelineSteps([]byte(r.Spec.Steps), specPath.Child("steps"))...)
+		if r.Spec.PipelineFile != "" {
+			warnings = append(warnings, "spec.pipeline_file is ignored when spec.steps is set")
+		}
+	}
+	if ref := r.Spec.TemplateRef; ref != nil {
+		refPath := specPath.Child("template_ref")
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), ""))
+		}
+		if r.Spec.Steps != "" {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("steps"), "steps are rendered from spec.template_ref"))
+		}
+		if r.Spec.PipelineFile != "" {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("pipeline_file"), "steps are rendered from spec.template_ref"))
+		}
+	}
+	allErrs = append(allErrs, validateSchedules(r.Spec.Schedules, specPath.Child("schedules"))...)
+	return warnings, allErrs
+}
+
+func validateSchedules(schedules []PipelineSchedule, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	labels := map[string]bool{}
+	for i, s := range schedules {
+		idxPath := fldPath.Index(i)
+		switch {
+		case s.Label == "":
+			allErrs = append(allErrs, field.Required(idxPath.Child("label"), ""))
+		case labels[s.Label]:
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("label"), s.Label))
+		}
+		labels[s.Label] = true
+		if err := ValidateCron(s.Cron); err != nil {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("cron"), s.Cron, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+func (r *BuildkitePipeline) validate() (admission.Warnings, error) {
+	warnings, allErrs := r.ValidateSpec()
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(GroupVersion.WithKind("BuildkitePipeline").GroupKind(), r.Name, allErrs)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BuildkitePipelineTemplateSpec defines steps shared by many pipelines
+type BuildkitePipelineTemplateSpec struct {
+	// Steps is the pipeline YAML as a Go template. The values of the
+	// parameters are available as {{ .Values.<name> }}, quote renders a
+	// string as a YAML string, e.g. {{ quote .Values.queue }}.
+	Steps string `json:"steps"`
+
+	// Parameters the pipelines referencing the template set
+	Parameters []PipelineTemplateParameter `json:"parameters,omitempty"`
+}
+
+// ParameterType is the type of a template parameter
+type ParameterType string
+
+const (
+	ParameterTypeString  ParameterType = "string"
+	ParameterTypeInteger ParameterType = "integer"
+	ParameterTypeBoolean ParameterType = "boolean"
+)
+
+// PipelineTemplateParameter declares a value of the template
+type PipelineTemplateParameter struct {
+	// Name of the parameter, usable as {{ .Values.<name> }}
+	// +kubebuilder:validation:Pattern=`^[A-Za-z_][A-Za-z0-9_]*$`
+	Name string `json:"name"`
+
+	// Type of the value, string by default
+	// +kubebuilder:validation:Enum=string;integer;boolean
+	Type ParameterType `json:"type,omitempty"`
+
+	Description string `json:"description,omitempty"`
+
+	// Default is used when a pipeline sets no value. Parameters without a
+	// default are required.
+	Default *string `json:"default,omitempty"`
+
+	// Enum restricts the value to one of these
+	Enum []string `json:"enum,omitempty"`
+}
+
+// PipelineTemplateRef names the template rendering the steps of a pipeline
+type PipelineTemplateRef struct {
+	// Name of the BuildkitePipelineTemplate, in the same namespace
+	Name string `json:"name"`
+
+	// Values of the template parameters
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// BuildkitePipelineTemplate is the Schema for the buildkitepipelinetemplates API
+type BuildkitePipelineTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec BuildkitePipelineTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// BuildkitePipelineTemplateList contains a list of BuildkitePipelineTemplate
+type BuildkitePipelineTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BuildkitePipelineTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BuildkitePipelineTemplate{}, &BuildkitePipelineTemplateList{})
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands accepted by Buildkite in place of the fields.
+var cronMacros = map[string]bool{
+	"@yearly":   true,
+	"@annually": true,
+	"@monthly":  true,
+	"@weekly":   true,
+	"@daily":    true,
+	"@midnight": true,
+	"@hourly":   true,
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// ValidateCron checks a Buildkite schedule cronline: five cron fields or a
+// macro such as @daily, optionally followed by a time zone.
+func ValidateCron(expr string) error {
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return fmt.Errorf("cron expression is empty")
+	}
+
+	var zone string
+	switch {
+	case cronMacros[strings.ToLower(fields[0])]:
+		if len(fields) > 2 {
+			return fmt.Errorf("unexpected %q after %s", strings.Join(fields[2:], " "), fields[0])
+		}
+		if len(fields) == 2 {
+			zone = fields[1]
+		}
+	case len(fields) == 5 || len(fields) == 6:
+		for i, f := range cronFields {
+			if err := f.validate(fields[i]); err != nil {
+				return err
+			}
+		}
+		if len(fields) == 6 {
+			zone = fields[5]
+		}
+	default:
+		return fmt.Errorf("expected 5 fields and an optional time zone, got %d fields", len(fields))
+	}
+
+	if zone != "" {
+		if _, err := time.LoadLocation(zone); err != nil {
+			return fmt.Errorf("unknown time zone %q", zone)
+		}
+	}
+	return nil
+}
+
+func (f cronField) validate(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if err := f.validateItem(item); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", f.name, value, err)
+		}
+	}
+	return nil
+}
+
+func (f cronField) validateItem(item string) error {
+	// Last day of the month and nth weekday of the month.
+	if f.name == "day of month" && strings.EqualFold(item, "L") {
+		return nil
+	}
+	if f.name == "day of week" {
+		if day, nth, ok := strings.Cut(item, "#"); ok {
+			n, err := strconv.Atoi(nth)
+			if err != nil || n < 1 || n > 5 {
+				return fmt.Errorf("%q is not a week of the month", nth)
+			}
+			_, err = f.value(day)
+			return err
+		}
+	}
+
+	rng, step, hasStep := strings.Cut(item, "/")
+	if hasStep {
+		n, err := strconv.Atoi(step)
+		if err != nil || n < 1 {
+			return fmt.Errorf("%q is not a step", step)
+		}
+	}
+	if rng == "*" {
+		return nil
+	}
+	lo, hi, isRange := strings.Cut(rng, "-")
+	from, err := f.value(lo)
+	if err != nil {
+		return err
+	}
+	if !isRange {
+		return nil
+	}
+	to, err := f.value(hi)
+	if err != nil {
+		return err
+	}
+	if from > to {
+		return fmt.Errorf("range %s is reversed", rng)
+	}
+	return nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if n < f.min || n > f.max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", n, f.min, f.max)
+	}
+	return n, nil
+}
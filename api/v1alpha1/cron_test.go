@@ -0,0 +1,57 @@
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCron(t *testing.T) {
+	valid := []string{
+		"0 2 * * 1-5",
+		"*/15 * * * *",
+		"0 0 L * *",
+		"30 8 * jan-jun MON#1",
+		"0,30 9-17 * * *",
+		"@daily",
+		"@weekly UTC",
+		"0 2 * * * Europe/Berlin",
+	}
+	for _, expr := range valid {
+		if err := ValidateCron(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"":                       "empty",
+		"0 2 * *":                "expected 5 fields",
+		"60 * * * *":             "out of range",
+		"0 5-2 * * *":            "reversed",
+		"*/0 * * * *":            "not a step",
+		"0 0 * foo *":            "not a number",
+		"0 0 * * mon#6":          "week of the month",
+		"0 2 * * * Mars/Olympus": "unknown time zone",
+		"@daily UTC extra":       "unexpected",
+	}
+	for expr, want := range invalid {
+		err := ValidateCron(expr)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", expr, err, want)
+		}
+	}
+}
+
+func TestValidateSchedules(t *testing.T) {
+	p := &BuildkitePipeline{Spec: BuildkitePipelineSpec{Schedules: []PipelineSchedule{
+		{Label: "nightly", Cron: "@daily"},
+		{Label: "nightly", Cron: "0 2 * * *"},
+		{Cron: "0 25 * * *"},
+	}}}
+	_, errs := p.ValidateSpec()
+	got := errs.ToAggregate().Error()
+	for _, want := range []string{"spec.schedules[1].label: Duplicate", "spec.schedules[2].label: Required", "spec.schedules[2].cron: Invalid"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %v, want %q", got, want)
+		}
+	}
+}
@@ -16,7 +16,7 @@ limitations under the License.
 
 // Package v1alpha1 contains API Schema definitions for the buildkit v1alpha1 API group
 // +kubebuilder:object:generate=true
-// +groupName=buildkit.thecops.dev
+// +groupName=thecops.dev
 package v1alpha1
 
 import (
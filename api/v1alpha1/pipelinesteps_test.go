@@ -0,0 +1,223 @@
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const validPipeline = `
+env:
+  LANG: C.UTF-8
+steps:
+  - label: ":go: test"
+    key: test
+    command: go test ./...
+    plugins:
+      - docker#v5.10.0:
+          image: golang:1.21
+    agents:
+      queue: default
+    retry:
+      automatic:
+        - exit_status: -1
+          limit: 2
+      manual: false
+    concurrency: 1
+    concurrency_group: cops/test
+  - wait
+  - block: ":rocket: Release?"
+    key: approve
+    fields:
+      - select: Channel
+        key: channel
+        options:
+          - label: Stable
+            value: stable
+  - group: Deploy
+    key: deploy
+    depends_on: [test, approve]
+    steps:
+      - command: make deploy
+        key: deploy-app
+        if: build.branch == "main"
+        soft_fail:
+          - exit_status: 2
+      - trigger: cops-smoke
+        depends_on:
+          - step: deploy-app
+            allow_failure: true
+        build:
+          branch: main
+`
+
+func TestParsePipelineDefinition(t *testing.T) {
+	p, err := ParsePipelineDefinition([]byte(validPipeline))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := p.Validate(nil); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	kinds := []string{}
+	for _, s := range p.Steps {
+		kinds = append(kinds, s.Kind())
+	}
+	if got := strings.Join(kinds, ","); got != "command,wait,block,group" {
+		t.Errorf("kinds = %s", got)
+	}
+	cmd := p.Steps[0].Command
+	if cmd.Plugins[0].Name != "docker#v5.10.0" || cmd.Agents["queue"] != "default" {
+		t.Errorf("plugins or agents not decoded: %+v", cmd)
+	}
+	if rules := cmd.Retry.Automatic.Rules; len(rules) != 1 || rules[0].ExitStatus != "-1" || rules[0].Limit != 2 {
+		t.Errorf("automatic retry not decoded: %+v", cmd.Retry.Automatic)
+	}
+	if *cmd.Retry.Manual.Allowed {
+		t.Error("manual retry should be disallowed")
+	}
+	deps := p.Steps[3].Group.Steps[1].Trigger.DependsOn
+	if len(deps) != 1 || deps[0].Step != "deploy-app" || !deps[0].AllowFailure {
+		t.Errorf("depends_on not decoded: %+v", deps)
+	}
+
+	// Round trip through the typed model.
+	out, err := yaml.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePipelineDefinition(out); err != nil {
+		t.Fatalf("re-parse: %v\n%s", err, out)
+	}
+}
+
+func TestParsePipelineDefinitionErrors(t *testing.T) {
+	cases := map[string]struct {
+		pipeline string
+		want     string
+	}{
+		"unknown step key": {
+			pipeline: "steps:\n  - command: make\n    comand: make\n",
+			want:     `unknown key "comand" in command step`,
+		},
+		"unknown step type": {
+			pipeline: "steps:\n  - label: nothing\n",
+			want:     "unknown step type",
+		},
+		"unknown top-level key": {
+			pipeline: "stepz:\n  - wait\n",
+			want:     `unknown key "stepz" in pipeline`,
+		},
+		"duplicate key": {
+			pipeline: "steps:\n  - command: make\n    key: a\n    key: b\n",
+			want:     `"key" already defined`,
+		},
+		"duplicate plugin config key": {
+			pipeline: "steps:\n  - plugins:\n      - docker#v5:\n          image: a\n          image: b\n",
+			want:     `"image" already defined`,
+		},
+		"ambiguous step": {
+			pipeline: "steps:\n  - command: make\n    wait: ~\n",
+			want:     "both a command and a wait step",
+		},
+	}
+	for name, c := range cases {
+		_, err := ParsePipelineDefinition([]byte(c.pipeline))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %q", name, err, c.want)
+		}
+	}
+}
+
+func TestValidatePipelineSteps(t *testing.T) {
+	cases := map[string]struct {
+		pipeline string
+		want     []string
+	}{
+		"cycle": {
+			pipeline: `
+steps:
+  - {command: a, key: a, depends_on: c}
+  - {command: b, key: b, depends_on: a}
+  - {command: c, key: c, depends_on: b}
+`,
+			want: []string{"cyclic depends_on: a -> c -> b -> a"},
+		},
+		"self dependency": {
+			pipeline: "steps:\n  - {command: a, key: a, depends_on: a}\n",
+			want:     []string{"cyclic depends_on: a -> a"},
+		},
+		"missing dependency": {
+			pipeline: "steps:\n  - {command: a, depends_on: nope}\n",
+			want:     []string{`spec.steps.steps[0].depends_on[0]: Not found: "nope"`},
+		},
+		"duplicate step key": {
+			pipeline: "steps:\n  - {command: a, key: a}\n  - group: g\n    steps:\n      - {command: b, key: a}\n",
+			want:     []string{`spec.steps.steps[1].steps[0].key: Duplicate value: "a"`},
+		},
+		"concurrency without group": {
+			pipeline: "steps:\n  - {command: a, concurrency: 1}\n",
+			want:     []string{"concurrency_group: Required value"},
+		},
+		"nested group": {
+			pipeline: "steps:\n  - group: outer\n    steps:\n      - group: inner\n        steps: [wait]\n",
+			want:     []string{"groups cannot be nested"},
+		},
+		"input field": {
+			pipeline: "steps:\n  - input: Details\n    fields:\n      - {text: Name, select: Name, key: name}\n",
+			want:     []string{"a field is either text or select"},
+		},
+	}
+	for name, c := range cases {
+		errs := ValidatePipelineSteps([]byte(c.pipeline), field.NewPath("spec", "steps"))
+		got := errs.ToAggregate()
+		if got == nil {
+			t.Errorf("%s: expected errors", name)
+			continue
+		}
+		for _, want := range c.want {
+			if !strings.Contains(got.Error(), want) {
+				t.Errorf("%s: got %v, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestBuildkitePipelineValidateCreate(t *testing.T) {
+	p := &BuildkitePipeline{Spec: BuildkitePipelineSpec{
+		Steps:        "steps:\n  - {command: a, key: a, depends_on: a}\n",
+		PipelineFile: ".buildkite/other.yml",
+	}}
+	warnings, err := p.ValidateCreate()
+	if err == nil || !strings.Contains(err.Error(), "cyclic depends_on") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected a pipeline_file warning, got %v", warnings)
+	}
+
+	p.Spec.Steps = ""
+	if _, err := p.ValidateCreate(); err != nil {
+		t.Errorf("pipeline without inline steps: %v", err)
+	}
+}
+
+func TestBuildkitePipelineValidateTemplateRef(t *testing.T) {
+	p := &BuildkitePipeline{Spec: BuildkitePipelineSpec{
+		Steps:       "steps:\n  - command: make\n",
+		TemplateRef: &PipelineTemplateRef{},
+	}}
+	_, errs := p.ValidateSpec()
+	if len(errs) != 2 || errs[0].Field != "spec.template_ref.name" || errs[1].Field != "spec.steps" {
+		t.Errorf("expected name and steps errors, got %v", errs)
+	}
+
+	p.Spec.Steps = ""
+	p.Spec.TemplateRef.Name = "service"
+	if _, errs := p.ValidateSpec(); len(errs) != 0 {
+		t.Errorf("pipeline with a template: %v", errs)
+	}
+}
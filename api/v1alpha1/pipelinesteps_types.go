@@ -0,0 +1,650 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The types in this file model the Buildkite pipeline YAML carried in
+// BuildkitePipelineSpec.Steps. They are decoded from YAML rather than stored
+// in the CRD schema, so no deepcopy is generated for them.
+
+// PipelineDefinition is a Buildkite pipeline as uploaded by the agent
+// +kubebuilder:object:generate=false
+type PipelineDefinition struct {
+	Env    map[string]string `yaml:"env,omitempty"`
+	Agents Agents            `yaml:"agents,omitempty"`
+	Notify []interface{}     `yaml:"notify,omitempty"`
+	Steps  []Step            `yaml:"steps"`
+}
+
+// Step holds exactly one of the Buildkite step types
+// +kubebuilder:object:generate=false
+type Step struct {
+	Command *CommandStep
+	Wait    *WaitStep
+	Block   *BlockStep
+	Input   *InputStep
+	Trigger *TriggerStep
+	Group   *GroupStep
+}
+
+// StepCommon holds the attributes shared by every step type
+// +kubebuilder:object:generate=false
+type StepCommon struct {
+	Key        string `yaml:"key,omitempty"`
+	ID         string `yaml:"id,omitempty"`
+	Identifier string `yaml:"identifier,omitempty"`
+
+	DependsOn              Dependencies `yaml:"depends_on,omitempty"`
+	AllowDependencyFailure bool         `yaml:"allow_dependency_failure,omitempty"`
+
+	If       string     `yaml:"if,omitempty"`
+	Branches StringList `yaml:"branches,omitempty"`
+}
+
+// CommandStep runs one or more shell commands on an agent
+// +kubebuilder:object:generate=false
+type CommandStep struct {
+	StepCommon `yaml:",inline"`
+
+	Label    string     `yaml:"label,omitempty"`
+	Name     string     `yaml:"name,omitempty"`
+	Command  StringList `yaml:"command,omitempty"`
+	Commands StringList `yaml:"commands,omitempty"`
+
+	Plugins Plugins           `yaml:"plugins,omitempty"`
+	Agents  Agents            `yaml:"agents,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Retry   *Retry            `yaml:"retry,omitempty"`
+
+	Concurrency       int    `yaml:"concurrency,omitempty"`
+	ConcurrencyGroup  string `yaml:"concurrency_group,omitempty"`
+	ConcurrencyMethod string `yaml:"concurrency_method,omitempty"`
+
+	ArtifactPaths        StringList  `yaml:"artifact_paths,omitempty"`
+	Parallelism          int         `yaml:"parallelism,omitempty"`
+	Priority             int         `yaml:"priority,omitempty"`
+	TimeoutInMinutes     int         `yaml:"timeout_in_minutes,omitempty"`
+	SoftFail             *SoftFail   `yaml:"soft_fail,omitempty"`
+	Skip                 string      `yaml:"skip,omitempty"`
+	CancelOnBuildFailing bool        `yaml:"cancel_on_build_failing,omitempty"`
+	Matrix               interface{} `yaml:"matrix,omitempty"`
+	Notify               interface{} `yaml:"notify,omitempty"`
+}
+
+// WaitStep waits for all previous steps to finish
+// +kubebuilder:object:generate=false
+type WaitStep struct {
+	StepCommon `yaml:",inline"`
+
+	Wait              *string `yaml:"wait"`
+	ContinueOnFailure bool    `yaml:"continue_on_failure,omitempty"`
+}
+
+// BlockStep pauses the build until it is unblocked
+// +kubebuilder:object:generate=false
+type BlockStep struct {
+	StepCommon `yaml:",inline"`
+
+	Block        string       `yaml:"block"`
+	Prompt       string       `yaml:"prompt,omitempty"`
+	Fields       []InputField `yaml:"fields,omitempty"`
+	BlockedState string       `yaml:"blocked_state,omitempty"`
+}
+
+// InputStep collects information from a user without blocking later steps
+// +kubebuilder:object:generate=false
+type InputStep struct {
+	StepCommon `yaml:",inline"`
+
+	Input  string       `yaml:"input"`
+	Prompt string       `yaml:"prompt,omitempty"`
+	Fields []InputField `yaml:"fields,omitempty"`
+}
+
+// InputField is a text or select field of a block or input step
+// +kubebuilder:object:generate=false
+type InputField struct {
+	Text     string         `yaml:"text,omitempty"`
+	Select   string         `yaml:"select,omitempty"`
+	Key      string         `yaml:"key"`
+	Hint     string         `yaml:"hint,omitempty"`
+	Required *bool          `yaml:"required,omitempty"`
+	Default  StringList     `yaml:"default,omitempty"`
+	Format   string         `yaml:"format,omitempty"`
+	Multiple bool           `yaml:"multiple,omitempty"`
+	Options  []SelectOption `yaml:"options,omitempty"`
+}
+
+// SelectOption is one choice of a select field
+// +kubebuilder:object:generate=false
+type SelectOption struct {
+	Label string `yaml:"label"`
+	Value string `yaml:"value"`
+}
+
+// TriggerStep creates a build on another pipeline
+// +kubebuilder:object:generate=false
+type TriggerStep struct {
+	StepCommon `yaml:",inline"`
+
+	Trigger  string        `yaml:"trigger"`
+	Label    string        `yaml:"label,omitempty"`
+	Async    bool          `yaml:"async,omitempty"`
+	Build    *TriggerBuild `yaml:"build,omitempty"`
+	Skip     string        `yaml:"skip,omitempty"`
+	SoftFail *SoftFail     `yaml:"soft_fail,omitempty"`
+}
+
+// TriggerBuild describes the build created by a trigger step
+// +kubebuilder:object:generate=false
+type TriggerBuild struct {
+	Message  string            `yaml:"message,omitempty"`
+	Commit   string            `yaml:"commit,omitempty"`
+	Branch   string            `yaml:"branch,omitempty"`
+	MetaData map[string]string `yaml:"meta_data,omitempty"`
+	Env      map[string]string `yaml:"env,omitempty"`
+}
+
+// GroupStep runs its steps as a single unit
+// +kubebuilder:object:generate=false
+type GroupStep struct {
+	StepCommon `yaml:",inline"`
+
+	Group  *string     `yaml:"group"`
+	Label  string      `yaml:"label,omitempty"`
+	Notify interface{} `yaml:"notify,omitempty"`
+	Steps  []Step      `yaml:"steps"`
+}
+
+// Retry configures automatic and manual retries of a command step
+// +kubebuilder:object:generate=false
+type Retry struct {
+	Automatic *AutomaticRetry `yaml:"automatic,omitempty"`
+	Manual    *ManualRetry    `yaml:"manual,omitempty"`
+}
+
+// AutomaticRetry is either enabled with the defaults or a list of rules
+// +kubebuilder:object:generate=false
+type AutomaticRetry struct {
+	Enabled bool
+	Rules   []AutomaticRetryRule
+}
+
+// AutomaticRetryRule retries jobs matching an exit status or signal
+// +kubebuilder:object:generate=false
+type AutomaticRetryRule struct {
+	ExitStatus   string `yaml:"exit_status,omitempty"`
+	Signal       string `yaml:"signal,omitempty"`
+	SignalReason string `yaml:"signal_reason,omitempty"`
+	Limit        int    `yaml:"limit,omitempty"`
+}
+
+// ManualRetry controls the retry button of a job
+// +kubebuilder:object:generate=false
+type ManualRetry struct {
+	Allowed        *bool  `yaml:"allowed,omitempty"`
+	PermitOnPassed *bool  `yaml:"permit_on_passed,omitempty"`
+	Reason         string `yaml:"reason,omitempty"`
+}
+
+// SoftFail is either true for every exit status or a list of exit statuses
+// +kubebuilder:object:generate=false
+type SoftFail struct {
+	All          bool
+	ExitStatuses []string
+}
+
+// Dependency is a step key listed in depends_on
+// +kubebuilder:object:generate=false
+type Dependency struct {
+	Step         string `yaml:"step"`
+	AllowFailure bool   `yaml:"allow_failure,omitempty"`
+}
+
+// Dependencies accepts a single key, a list of keys or a list of dependencies
+// +kubebuilder:object:generate=false
+type Dependencies []Dependency
+
+// Plugin is a plugin reference such as docker#v5.10.0 with its configuration
+// +kubebuilder:object:generate=false
+type Plugin struct {
+	Name   string
+	Config interface{}
+}
+
+// Plugins accepts the list form and the legacy map form
+// +kubebuilder:object:generate=false
+type Plugins []Plugin
+
+// Agents are the agent query rules, as a map or a list of key=value
+// +kubebuilder:object:generate=false
+type Agents map[string]string
+
+// StringList accepts a single string or a list of strings
+// +kubebuilder:object:generate=false
+type StringList []string
+
+// stepKinds maps the key identifying a step to its type. A command step
+// made only of plugins has none of them and is detected separately.
+var stepKinds = map[string]string{
+	"command":  "command",
+	"commands": "command",
+	"wait":     "wait",
+	"block":    "block",
+	"input":    "input",
+	"trigger":  "trigger",
+	"group":    "group",
+}
+
+// Key returns the key other steps use in depends_on
+func (s *Step) Key() string {
+	c := s.common()
+	if c == nil {
+		return ""
+	}
+	switch {
+	case c.Key != "":
+		return c.Key
+	case c.ID != "":
+		return c.ID
+	}
+	return c.Identifier
+}
+
+// Kind returns the step type, e.g. "command"
+func (s *Step) Kind() string {
+	switch {
+	case s.Command != nil:
+		return "command"
+	case s.Wait != nil:
+		return "wait"
+	case s.Block != nil:
+		return "block"
+	case s.Input != nil:
+		return "input"
+	case s.Trigger != nil:
+		return "trigger"
+	case s.Group != nil:
+		return "group"
+	}
+	return ""
+}
+
+func (s *Step) common() *StepCommon {
+	switch {
+	case s.Command != nil:
+		return &s.Command.StepCommon
+	case s.Wait != nil:
+		return &s.Wait.StepCommon
+	case s.Block != nil:
+		return &s.Block.StepCommon
+	case s.Input != nil:
+		return &s.Input.StepCommon
+	case s.Trigger != nil:
+		return &s.Trigger.StepCommon
+	case s.Group != nil:
+		return &s.Group.StepCommon
+	}
+	return nil
+}
+
+// UnmarshalYAML detects the step type from its keys and decodes it strictly
+func (s *Step) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		switch n.Value {
+		case "wait":
+			s.Wait = &WaitStep{}
+		case "block":
+			s.Block = &BlockStep{}
+		case "input":
+			s.Input = &InputStep{}
+		default:
+			return fmt.Errorf("line %d: unknown step %q", n.Line, n.Value)
+		}
+		return nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: step must be a mapping", n.Line)
+	}
+
+	kind := ""
+	for i := 0; i < len(n.Content); i += 2 {
+		k, ok := stepKinds[n.Content[i].Value]
+		if !ok {
+			continue
+		}
+		if kind != "" && kind != k {
+			return fmt.Errorf("line %d: step is both a %s and a %s step", n.Line, kind, k)
+		}
+		kind = k
+	}
+	if kind == "" && mappingHasKey(n, "plugins") {
+		kind = "command"
+	}
+
+	switch kind {
+	case "command":
+		s.Command = &CommandStep{}
+		return n.Decode(s.Command)
+	case "wait":
+		s.Wait = &WaitStep{}
+		return n.Decode(s.Wait)
+	case "block":
+		s.Block = &BlockStep{}
+		return n.Decode(s.Block)
+	case "input":
+		s.Input = &InputStep{}
+		return n.Decode(s.Input)
+	case "trigger":
+		s.Trigger = &TriggerStep{}
+		return n.Decode(s.Trigger)
+	case "group":
+		s.Group = &GroupStep{}
+		return n.Decode(s.Group)
+	}
+	return fmt.Errorf("line %d: unknown step type, expected one of command, wait, block, input, trigger or group", n.Line)
+}
+
+// MarshalYAML writes the step it holds
+func (s Step) MarshalYAML() (interface{}, error) {
+	switch {
+	case s.Command != nil:
+		return s.Command, nil
+	case s.Wait != nil:
+		if reflect.ValueOf(*s.Wait).IsZero() {
+			return "wait", nil
+		}
+		return s.Wait, nil
+	case s.Block != nil:
+		return s.Block, nil
+	case s.Input != nil:
+		return s.Input, nil
+	case s.Trigger != nil:
+		return s.Trigger, nil
+	case s.Group != nil:
+		return s.Group, nil
+	}
+	return nil, fmt.Errorf("empty step")
+}
+
+func (p *PipelineDefinition) UnmarshalYAML(n *yaml.Node) error {
+	type plain PipelineDefinition
+	return decodeKnown(n, "pipeline", (*plain)(p))
+}
+
+func (s *CommandStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain CommandStep
+	return decodeKnown(n, "command step", (*plain)(s))
+}
+
+func (s *WaitStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain WaitStep
+	return decodeKnown(n, "wait step", (*plain)(s))
+}
+
+func (s *BlockStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain BlockStep
+	return decodeKnown(n, "block step", (*plain)(s))
+}
+
+func (s *InputStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain InputStep
+	return decodeKnown(n, "input step", (*plain)(s))
+}
+
+func (f *InputField) UnmarshalYAML(n *yaml.Node) error {
+	type plain InputField
+	return decodeKnown(n, "field", (*plain)(f))
+}
+
+func (o *SelectOption) UnmarshalYAML(n *yaml.Node) error {
+	type plain SelectOption
+	return decodeKnown(n, "option", (*plain)(o))
+}
+
+func (s *TriggerStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain TriggerStep
+	return decodeKnown(n, "trigger step", (*plain)(s))
+}
+
+func (b *TriggerBuild) UnmarshalYAML(n *yaml.Node) error {
+	type plain TriggerBuild
+	return decodeKnown(n, "trigger build", (*plain)(b))
+}
+
+func (s *GroupStep) UnmarshalYAML(n *yaml.Node) error {
+	type plain GroupStep
+	return decodeKnown(n, "group step", (*plain)(s))
+}
+
+func (r *Retry) UnmarshalYAML(n *yaml.Node) error {
+	type plain Retry
+	return decodeKnown(n, "retry", (*plain)(r))
+}
+
+func (r *AutomaticRetry) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Decode(&r.Enabled)
+	case yaml.MappingNode:
+		r.Enabled = true
+		r.Rules = make([]AutomaticRetryRule, 1)
+		return n.Decode(&r.Rules[0])
+	}
+	r.Enabled = true
+	return n.Decode(&r.Rules)
+}
+
+func (r AutomaticRetry) MarshalYAML() (interface{}, error) {
+	if len(r.Rules) == 0 {
+		return r.Enabled, nil
+	}
+	return r.Rules, nil
+}
+
+func (r *AutomaticRetryRule) UnmarshalYAML(n *yaml.Node) error {
+	type plain AutomaticRetryRule
+	return decodeKnown(n, "automatic retry", (*plain)(r))
+}
+
+func (r *ManualRetry) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		r.Allowed = new(bool)
+		return n.Decode(r.Allowed)
+	}
+	type plain ManualRetry
+	return decodeKnown(n, "manual retry", (*plain)(r))
+}
+
+func (f *SoftFail) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&f.All)
+	}
+	rules := []struct {
+		ExitStatus string `yaml:"exit_status"`
+	}{}
+	if err := n.Decode(&rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		f.ExitStatuses = append(f.ExitStatuses, rule.ExitStatus)
+	}
+	return nil
+}
+
+func (f SoftFail) MarshalYAML() (interface{}, error) {
+	if len(f.ExitStatuses) == 0 {
+		return f.All, nil
+	}
+	rules := make([]map[string]string, len(f.ExitStatuses))
+	for i, status := range f.ExitStatuses {
+		rules[i] = map[string]string{"exit_status": status}
+	}
+	return rules, nil
+}
+
+func (d *Dependency) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&d.Step)
+	}
+	type plain Dependency
+	return decodeKnown(n, "dependency", (*plain)(d))
+}
+
+func (d *Dependencies) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*d = Dependencies{{Step: n.Value}}
+		return nil
+	}
+	return n.Decode((*[]Dependency)(d))
+}
+
+func (p *Plugins) UnmarshalYAML(n *yaml.Node) error {
+	var nodes []*yaml.Node
+	switch n.Kind {
+	case yaml.MappingNode:
+		nodes = []*yaml.Node{n}
+	case yaml.SequenceNode:
+		nodes = n.Content
+	default:
+		return fmt.Errorf("line %d: plugins must be a list", n.Line)
+	}
+	for _, item := range nodes {
+		if item.Kind == yaml.ScalarNode {
+			*p = append(*p, Plugin{Name: item.Value})
+			continue
+		}
+		if item.Kind != yaml.MappingNode {
+			return fmt.Errorf("line %d: plugin must be a name or a mapping", item.Line)
+		}
+		if err := checkDuplicates(item); err != nil {
+			return err
+		}
+		for i := 0; i < len(item.Content); i += 2 {
+			plugin := Plugin{Name: item.Content[i].Value}
+			if err := item.Content[i+1].Decode(&plugin.Config); err != nil {
+				return err
+			}
+			*p = append(*p, plugin)
+		}
+	}
+	return nil
+}
+
+func (p Plugins) MarshalYAML() (interface{}, error) {
+	out := make([]interface{}, len(p))
+	for i, plugin := range p {
+		if plugin.Config == nil {
+			out[i] = plugin.Name
+			continue
+		}
+		out[i] = map[string]interface{}{plugin.Name: plugin.Config}
+	}
+	return out, nil
+}
+
+func (a *Agents) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.SequenceNode {
+		return n.Decode((*map[string]string)(a))
+	}
+	items := []string{}
+	if err := n.Decode(&items); err != nil {
+		return err
+	}
+	*a = Agents{}
+	for _, item := range items {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("line %d: agent rule %q must be key=value", n.Line, item)
+		}
+		if _, dup := (*a)[k]; dup {
+			return fmt.Errorf("line %d: agent rule %q already defined", n.Line, k)
+		}
+		(*a)[k] = v
+	}
+	return nil
+}
+
+func (l *StringList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = StringList{n.Value}
+		return nil
+	}
+	return n.Decode((*[]string)(l))
+}
+
+func mappingHasKey(n *yaml.Node, key string) bool {
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+func checkDuplicates(n *yaml.Node) error {
+	seen := map[string]int{}
+	for i := 0; i < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if line, ok := seen[k.Value]; ok {
+			return fmt.Errorf("line %d: key %q already defined at line %d", k.Line, k.Value, line)
+		}
+		seen[k.Value] = k.Line
+	}
+	return nil
+}
+
+// decodeKnown decodes the mapping n into out, rejecting keys that have no
+// matching yaml tag on out. Duplicate keys are rejected by the decoder.
+func decodeKnown(n *yaml.Node, what string, out interface{}) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s must be a mapping", n.Line, what)
+	}
+	known := yamlKeys(reflect.TypeOf(out).Elem())
+	for i := 0; i < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if !known[k.Value] {
+			return fmt.Errorf("line %d: unknown key %q in %s", k.Line, k.Value, what)
+		}
+	}
+	return n.Decode(out)
+}
+
+func yamlKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if opts == "inline" {
+			for k := range yamlKeys(f.Type) {
+				keys[k] = true
+			}
+			continue
+		}
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ParsePipelineDefinition decodes Buildkite pipeline YAML. Unknown and
+// duplicate keys are errors.
+func ParsePipelineDefinition(data []byte) (*PipelineDefinition, error) {
+	p := &PipelineDefinition{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ValidatePipelineSteps parses and validates Buildkite pipeline YAML,
+// reporting errors under fldPath.
+func ValidatePipelineSteps(data []byte, fldPath *field.Path) field.ErrorList {
+	p, err := ParsePipelineDefinition(data)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, field.OmitValueType{}, err.Error())}
+	}
+	return p.Validate(fldPath)
+}
+
+// Validate checks every step and the depends_on graph: step keys must be
+// unique, dependencies must exist and must not form a cycle.
+func (p *PipelineDefinition) Validate(fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	stepsPath := fldPath.Child("steps")
+	if len(p.Steps) == 0 {
+		allErrs = append(allErrs, field.Required(stepsPath, "a pipeline needs at least one step"))
+	}
+
+	keys := map[string]*field.Path{}
+	graph := map[string][]string{}
+	var visit func(steps []Step, path *field.Path, nested bool)
+	visit = func(steps []Step, path *field.Path, nested bool) {
+		for i := range steps {
+			step := &steps[i]
+			stepPath := path.Index(i)
+			allErrs = append(allErrs, validateStep(step, stepPath)...)
+			if key := step.Key(); key != "" {
+				if _, dup := keys[key]; dup {
+					allErrs = append(allErrs, field.Duplicate(stepPath.Child("key"), key))
+				} else {
+					keys[key] = stepPath
+				}
+				for _, dep := range step.common().DependsOn {
+					graph[key] = append(graph[key], dep.Step)
+				}
+			}
+			if step.Group != nil {
+				if nested {
+					allErrs = append(allErrs, field.Forbidden(stepPath, "groups cannot be nested"))
+					continue
+				}
+				visit(step.Group.Steps, stepPath.Child("steps"), true)
+			}
+		}
+	}
+	visit(p.Steps, stepsPath, false)
+
+	var check func(steps []Step, path *field.Path)
+	check = func(steps []Step, path *field.Path) {
+		for i := range steps {
+			stepPath := path.Index(i)
+			for j, dep := range steps[i].common().DependsOn {
+				if dep.Step == "" {
+					allErrs = append(allErrs, field.Required(stepPath.Child("depends_on").Index(j), "step key is required"))
+				} else if _, ok := keys[dep.Step]; !ok {
+					allErrs = append(allErrs, field.NotFound(stepPath.Child("depends_on").Index(j), dep.Step))
+				}
+			}
+			if steps[i].Group != nil {
+				check(steps[i].Group.Steps, stepPath.Child("steps"))
+			}
+		}
+	}
+	check(p.Steps, stepsPath)
+
+	for _, cycle := range findCycles(graph) {
+		allErrs = append(allErrs, field.Invalid(keys[cycle[0]].Child("depends_on"), cycle[0],
+			"cyclic depends_on: "+strings.Join(cycle, " -> ")))
+	}
+	return allErrs
+}
+
+func validateStep(s *Step, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch {
+	case s.Command != nil:
+		c := s.Command
+		if len(c.Command) > 0 && len(c.Commands) > 0 {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("commands"), "command and commands are mutually exclusive"))
+		}
+		if len(c.Command) == 0 && len(c.Commands) == 0 && len(c.Plugins) == 0 {
+			allErrs = append(allErrs, field.Required(fldPath.Child("command"), "a command step needs a command or plugins"))
+		}
+		if c.Concurrency < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("concurrency"), c.Concurrency, "must be positive"))
+		}
+		if c.Concurrency > 0 && c.ConcurrencyGroup == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("concurrency_group"), "required with concurrency"))
+		}
+		if c.ConcurrencyGroup != "" && c.Concurrency == 0 {
+			allErrs = append(allErrs, field.Required(fldPath.Child("concurrency"), "required with concurrency_group"))
+		}
+		if c.ConcurrencyMethod != "" && c.ConcurrencyMethod != "ordered" && c.ConcurrencyMethod != "eager" {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("concurrency_method"), c.ConcurrencyMethod, []string{"ordered", "eager"}))
+		}
+		if c.Parallelism < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("parallelism"), c.Parallelism, "must be positive"))
+		}
+		if c.TimeoutInMinutes < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("timeout_in_minutes"), c.TimeoutInMinutes, "must be positive"))
+		}
+		for i, plugin := range c.Plugins {
+			if plugin.Name == "" {
+				allErrs = append(allErrs, field.Required(fldPath.Child("plugins").Index(i), "plugin name is required"))
+			}
+		}
+		if c.Retry != nil && c.Retry.Automatic != nil {
+			for i, rule := range c.Retry.Automatic.Rules {
+				if rule.Limit < 0 || rule.Limit > 10 {
+					allErrs = append(allErrs, field.Invalid(fldPath.Child("retry", "automatic").Index(i).Child("limit"), rule.Limit, "must be between 0 and 10"))
+				}
+			}
+		}
+	case s.Block != nil:
+		allErrs = append(allErrs, validateFields(s.Block.Fields, fldPath.Child("fields"))...)
+		switch s.Block.BlockedState {
+		case "", "passed", "failed", "running":
+		default:
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("blocked_state"), s.Block.BlockedState, []string{"passed", "failed", "running"}))
+		}
+	case s.Input != nil:
+		allErrs = append(allErrs, validateFields(s.Input.Fields, fldPath.Child("fields"))...)
+	case s.Trigger != nil:
+		if s.Trigger.Trigger == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("trigger"), "the slug of the pipeline to trigger is required"))
+		}
+	case s.Group != nil:
+		if len(s.Group.Steps) == 0 {
+			allErrs = append(allErrs, field.Required(fldPath.Child("steps"), "a group needs at least one step"))
+		}
+	}
+	return allErrs
+}
+
+func validateFields(fields []InputField, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	keys := map[string]bool{}
+	for i, f := range fields {
+		path := fldPath.Index(i)
+		if f.Key == "" {
+			allErrs = append(allErrs, field.Required(path.Child("key"), ""))
+		} else if keys[f.Key] {
+			allErrs = append(allErrs, field.Duplicate(path.Child("key"), f.Key))
+		}
+		keys[f.Key] = true
+		if (f.Text == "") == (f.Select == "") {
+			allErrs = append(allErrs, field.Invalid(path, f.Key, "a field is either text or select"))
+		}
+		if f.Select != "" && len(f.Options) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("options"), "a select field needs options"))
+		}
+	}
+	return allErrs
+}
+
+// findCycles returns every depends_on cycle once, as the list of keys
+// walked, ending with the key it started from.
+func findCycles(graph map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	stack := []string{}
+	cycles := [][]string{}
+
+	var walk func(key string)
+	walk = func(key string) {
+		state[key] = visiting
+		stack = append(stack, key)
+		for _, dep := range graph[key] {
+			switch state[dep] {
+			case unvisited:
+				walk(dep)
+			case visiting:
+				for i := range stack {
+					if stack[i] == dep {
+						cycle := append([]string{}, stack[i:]...)
+						cycles = append(cycles, append(cycle, dep))
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = done
+	}
+
+	keys := make([]string, 0, len(graph))
+	for key := range graph {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if state[key] == unvisited {
+			walk(key)
+		}
+	}
+	return cycles
+}
@@ -21,6 +21,9 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -51,6 +54,70 @@ func (in *Buildkit) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitAccess) DeepCopyInto(out *BuildkitAccess) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PodSelectors != nil {
+		in, out := &in.PodSelectors, &out.PodSelectors
+		*out = make([]metav1.LabelSelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LinkNamespaces != nil {
+		in, out := &in.LinkNamespaces, &out.LinkNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitAccess.
+func (in *BuildkitAccess) DeepCopy() *BuildkitAccess {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitAccess)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitExpose) DeepCopyInto(out *BuildkitExpose) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.SourceRanges != nil {
+		in, out := &in.SourceRanges, &out.SourceRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Gateway != nil {
+		in, out := &in.Gateway, &out.Gateway
+		*out = new(GatewayReference)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitExpose.
+func (in *BuildkitExpose) DeepCopy() *BuildkitExpose {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitExpose)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BuildkitList) DeepCopyInto(out *BuildkitList) {
 	*out = *in
@@ -83,6 +150,21 @@ func (in *BuildkitList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitReference) DeepCopyInto(out *BuildkitReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitReference.
+func (in *BuildkitReference) DeepCopy() *BuildkitReference {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BuildkitSpec) DeepCopyInto(out *BuildkitSpec) {
 	*out = *in
@@ -92,6 +174,26 @@ func (in *BuildkitSpec) DeepCopyInto(out *BuildkitSpec) {
 		copy(*out, *in)
 	}
 	in.Resources.DeepCopyInto(&out.Resources)
+	if in.RootlessOptions != nil {
+		in, out := &in.RootlessOptions, &out.RootlessOptions
+		*out = new(RootlessOptions)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Access != nil {
+		in, out := &in.Access, &out.Access
+		*out = new(BuildkitAccess)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Expose != nil {
+		in, out := &in.Expose, &out.Expose
+		*out = new(BuildkitExpose)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(corev1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitSpec.
@@ -130,7 +232,7 @@ func (in *Buildkite) DeepCopyInto(out *Buildkite) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Buildkite.
@@ -152,58 +254,129 @@ func (in *Buildkite) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkiteList) DeepCopyInto(out *BuildkiteList) {
+func (in *BuildkiteAgentConfig) DeepCopyInto(out *BuildkiteAgentConfig) {
 	*out = *in
-	out.TypeMeta = in.TypeMeta
-	in.ListMeta.DeepCopyInto(&out.ListMeta)
-	if in.Items != nil {
-		in, out := &in.Items, &out.Items
-		*out = make([]Buildkite, len(*in))
-		for i := range *in {
-			(*in)[i].DeepCopyInto(&(*out)[i])
-		}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.JobTTL = in.JobTTL
+	if in.Checkout != nil {
+		in, out := &in.Checkout, &out.Checkout
+		*out = new(BuildkiteCheckoutConfig)
+		**out = **in
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteList.
-func (in *BuildkiteList) DeepCopy() *BuildkiteList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteAgentConfig.
+func (in *BuildkiteAgentConfig) DeepCopy() *BuildkiteAgentConfig {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkiteList)
+	out := new(BuildkiteAgentConfig)
 	in.DeepCopyInto(out)
 	return out
 }
 
-// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *BuildkiteList) DeepCopyObject() runtime.Object {
-	if c := in.DeepCopy(); c != nil {
-		return c
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteAgentTokenStatus) DeepCopyInto(out *BuildkiteAgentTokenStatus) {
+	*out = *in
+	in.CreatedAt.DeepCopyInto(&out.CreatedAt)
+	if in.Revoking != nil {
+		in, out := &in.Revoking, &out.Revoking
+		*out = make([]string, len(*in))
+		copy(*out, *in)
 	}
-	return nil
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteAgentTokenStatus.
+func (in *BuildkiteAgentTokenStatus) DeepCopy() *BuildkiteAgentTokenStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteAgentTokenStatus)
+	in.DeepCopyInto(out)
+	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkitePipeline) DeepCopyInto(out *BuildkitePipeline) {
+func (in *BuildkiteArtifacts) DeepCopyInto(out *BuildkiteArtifacts) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteArtifacts.
+func (in *BuildkiteArtifacts) DeepCopy() *BuildkiteArtifacts {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteArtifacts)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteAutoscaling) DeepCopyInto(out *BuildkiteAutoscaling) {
+	*out = *in
+	out.CoolDown = in.CoolDown
+	out.Interval = in.Interval
+	if in.WarmPoolImages != nil {
+		in, out := &in.WarmPoolImages, &out.WarmPoolImages
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteAutoscaling.
+func (in *BuildkiteAutoscaling) DeepCopy() *BuildkiteAutoscaling {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteAutoscaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteAutoscalingStatus) DeepCopyInto(out *BuildkiteAutoscalingStatus) {
+	*out = *in
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteAutoscalingStatus.
+func (in *BuildkiteAutoscalingStatus) DeepCopy() *BuildkiteAutoscalingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteAutoscalingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteBuild) DeepCopyInto(out *BuildkiteBuild) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipeline.
-func (in *BuildkitePipeline) DeepCopy() *BuildkitePipeline {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteBuild.
+func (in *BuildkiteBuild) DeepCopy() *BuildkiteBuild {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkitePipeline)
+	out := new(BuildkiteBuild)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *BuildkitePipeline) DeepCopyObject() runtime.Object {
+func (in *BuildkiteBuild) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -211,31 +384,31 @@ func (in *BuildkitePipeline) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkitePipelineList) DeepCopyInto(out *BuildkitePipelineList) {
+func (in *BuildkiteBuildList) DeepCopyInto(out *BuildkiteBuildList) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ListMeta.DeepCopyInto(&out.ListMeta)
 	if in.Items != nil {
 		in, out := &in.Items, &out.Items
-		*out = make([]BuildkitePipeline, len(*in))
+		*out = make([]BuildkiteBuild, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineList.
-func (in *BuildkitePipelineList) DeepCopy() *BuildkitePipelineList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteBuildList.
+func (in *BuildkiteBuildList) DeepCopy() *BuildkiteBuildList {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkitePipelineList)
+	out := new(BuildkiteBuildList)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *BuildkitePipelineList) DeepCopyObject() runtime.Object {
+func (in *BuildkiteBuildList) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -243,62 +416,841 @@ func (in *BuildkitePipelineList) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkitePipelineSpec) DeepCopyInto(out *BuildkitePipelineSpec) {
+func (in *BuildkiteBuildSpec) DeepCopyInto(out *BuildkiteBuildSpec) {
 	*out = *in
+	out.PipelineRef = in.PipelineRef
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MetaData != nil {
+		in, out := &in.MetaData, &out.MetaData
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineSpec.
-func (in *BuildkitePipelineSpec) DeepCopy() *BuildkitePipelineSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteBuildSpec.
+func (in *BuildkiteBuildSpec) DeepCopy() *BuildkiteBuildSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkitePipelineSpec)
+	out := new(BuildkiteBuildSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkitePipelineStatus) DeepCopyInto(out *BuildkitePipelineStatus) {
+func (in *BuildkiteBuildStatus) DeepCopyInto(out *BuildkiteBuildStatus) {
 	*out = *in
+	if in.CreatedAt != nil {
+		in, out := &in.CreatedAt, &out.CreatedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.StartedAt != nil {
+		in, out := &in.StartedAt, &out.StartedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.FinishedAt != nil {
+		in, out := &in.FinishedAt, &out.FinishedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Jobs != nil {
+		in, out := &in.Jobs, &out.Jobs
+		*out = make([]BuildkiteJobStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineStatus.
-func (in *BuildkitePipelineStatus) DeepCopy() *BuildkitePipelineStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteBuildStatus.
+func (in *BuildkiteBuildStatus) DeepCopy() *BuildkiteBuildStatus {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkitePipelineStatus)
+	out := new(BuildkiteBuildStatus)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkiteSpec) DeepCopyInto(out *BuildkiteSpec) {
+func (in *BuildkiteCheckoutConfig) DeepCopyInto(out *BuildkiteCheckoutConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteCheckoutConfig.
+func (in *BuildkiteCheckoutConfig) DeepCopy() *BuildkiteCheckoutConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteCheckoutConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteHook) DeepCopyInto(out *BuildkiteHook) {
+	*out = *in
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(corev1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteHook.
+func (in *BuildkiteHook) DeepCopy() *BuildkiteHook {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteHook)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteHooks) DeepCopyInto(out *BuildkiteHooks) {
+	*out = *in
+	if in.Environment != nil {
+		in, out := &in.Environment, &out.Environment
+		*out = new(BuildkiteHook)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreCheckout != nil {
+		in, out := &in.PreCheckout, &out.PreCheckout
+		*out = new(BuildkiteHook)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreCommand != nil {
+		in, out := &in.PreCommand, &out.PreCommand
+		*out = new(BuildkiteHook)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PostCommand != nil {
+		in, out := &in.PostCommand, &out.PostCommand
+		*out = new(BuildkiteHook)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteHooks.
+func (in *BuildkiteHooks) DeepCopy() *BuildkiteHooks {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteHooks)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteJobStatus) DeepCopyInto(out *BuildkiteJobStatus) {
+	*out = *in
+	if in.ExitStatus != nil {
+		in, out := &in.ExitStatus, &out.ExitStatus
+		*out = new(int32)
+		**out = **in
+	}
+	if in.StartedAt != nil {
+		in, out := &in.StartedAt, &out.StartedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.FinishedAt != nil {
+		in, out := &in.FinishedAt, &out.FinishedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteJobStatus.
+func (in *BuildkiteJobStatus) DeepCopy() *BuildkiteJobStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteJobStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteJobTemplate) DeepCopyInto(out *BuildkiteJobTemplate) {
 	*out = *in
+	if in.Sidecars != nil {
+		in, out := &in.Sidecars, &out.Sidecars
+		*out = make([]corev1.Container, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.InitContainers != nil {
+		in, out := &in.InitContainers, &out.InitContainers
+		*out = make([]corev1.Container, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]corev1.Volume, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VolumeMounts != nil {
+		in, out := &in.VolumeMounts, &out.VolumeMounts
+		*out = make([]corev1.VolumeMount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
 	in.Resources.DeepCopyInto(&out.Resources)
+	if in.ActiveDeadlineSeconds != nil {
+		in, out := &in.ActiveDeadlineSeconds, &out.ActiveDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	out.TTLAfterFinished = in.TTLAfterFinished
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteSpec.
-func (in *BuildkiteSpec) DeepCopy() *BuildkiteSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteJobTemplate.
+func (in *BuildkiteJobTemplate) DeepCopy() *BuildkiteJobTemplate {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkiteSpec)
+	out := new(BuildkiteJobTemplate)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *BuildkiteStatus) DeepCopyInto(out *BuildkiteStatus) {
+func (in *BuildkiteList) DeepCopyInto(out *BuildkiteList) {
 	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Buildkite, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteStatus.
-func (in *BuildkiteStatus) DeepCopy() *BuildkiteStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteList.
+func (in *BuildkiteList) DeepCopy() *BuildkiteList {
 	if in == nil {
 		return nil
 	}
-	out := new(BuildkiteStatus)
+	out := new(BuildkiteList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BuildkiteList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteManagedToken) DeepCopyInto(out *BuildkiteManagedToken) {
+	*out = *in
+	in.APITokenSecret.DeepCopyInto(&out.APITokenSecret)
+	out.RotationPeriod = in.RotationPeriod
+	out.RevocationGracePeriod = in.RevocationGracePeriod
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteManagedToken.
+func (in *BuildkiteManagedToken) DeepCopy() *BuildkiteManagedToken {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteManagedToken)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipeline) DeepCopyInto(out *BuildkitePipeline) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipeline.
+func (in *BuildkitePipeline) DeepCopy() *BuildkitePipeline {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipeline)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BuildkitePipeline) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineList) DeepCopyInto(out *BuildkitePipelineList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BuildkitePipeline, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineList.
+func (in *BuildkitePipelineList) DeepCopy() *BuildkitePipelineList {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BuildkitePipelineList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineSpec) DeepCopyInto(out *BuildkitePipelineSpec) {
+	*out = *in
+	if in.TemplateRef != nil {
+		in, out := &in.TemplateRef, &out.TemplateRef
+		*out = new(PipelineTemplateRef)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ProviderSettings != nil {
+		in, out := &in.ProviderSettings, &out.ProviderSettings
+		*out = new(PipelineProviderSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Schedules != nil {
+		in, out := &in.Schedules, &out.Schedules
+		*out = make([]PipelineSchedule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.TokenSecret.DeepCopyInto(&out.TokenSecret)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineSpec.
+func (in *BuildkitePipelineSpec) DeepCopy() *BuildkitePipelineSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineStatus) DeepCopyInto(out *BuildkitePipelineStatus) {
+	*out = *in
+	if in.Schedules != nil {
+		in, out := &in.Schedules, &out.Schedules
+		*out = make([]PipelineScheduleStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DriftCheckedAt != nil {
+		in, out := &in.DriftCheckedAt, &out.DriftCheckedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineStatus.
+func (in *BuildkitePipelineStatus) DeepCopy() *BuildkitePipelineStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineTemplate) DeepCopyInto(out *BuildkitePipelineTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineTemplate.
+func (in *BuildkitePipelineTemplate) DeepCopy() *BuildkitePipelineTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BuildkitePipelineTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineTemplateList) DeepCopyInto(out *BuildkitePipelineTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BuildkitePipelineTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineTemplateList.
+func (in *BuildkitePipelineTemplateList) DeepCopy() *BuildkitePipelineTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BuildkitePipelineTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePipelineTemplateSpec) DeepCopyInto(out *BuildkitePipelineTemplateSpec) {
+	*out = *in
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = make([]PipelineTemplateParameter, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePipelineTemplateSpec.
+func (in *BuildkitePipelineTemplateSpec) DeepCopy() *BuildkitePipelineTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePipelineTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePool) DeepCopyInto(out *BuildkitePool) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePool.
+func (in *BuildkitePool) DeepCopy() *BuildkitePool {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkitePoolStatus) DeepCopyInto(out *BuildkitePoolStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkitePoolStatus.
+func (in *BuildkitePoolStatus) DeepCopy() *BuildkitePoolStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkitePoolStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteRBAC) DeepCopyInto(out *BuildkiteRBAC) {
+	*out = *in
+	if in.ExtraRules != nil {
+		in, out := &in.ExtraRules, &out.ExtraRules
+		*out = make([]rbacv1.PolicyRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteRBAC.
+func (in *BuildkiteRBAC) DeepCopy() *BuildkiteRBAC {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteRBAC)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteSpec) DeepCopyInto(out *BuildkiteSpec) {
+	*out = *in
+	if in.GitKnownHosts != nil {
+		in, out := &in.GitKnownHosts, &out.GitKnownHosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	in.Agent.DeepCopyInto(&out.Agent)
+	if in.BuildkitRef != nil {
+		in, out := &in.BuildkitRef, &out.BuildkitRef
+		*out = new(BuildkitReference)
+		**out = **in
+	}
+	in.RBAC.DeepCopyInto(&out.RBAC)
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(BuildkiteAutoscaling)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ManagedToken != nil {
+		in, out := &in.ManagedToken, &out.ManagedToken
+		*out = new(BuildkiteManagedToken)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = new(BuildkiteHooks)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PluginAllowlist != nil {
+		in, out := &in.PluginAllowlist, &out.PluginAllowlist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Pools != nil {
+		in, out := &in.Pools, &out.Pools
+		*out = make([]BuildkitePool, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.JobTemplate != nil {
+		in, out := &in.JobTemplate, &out.JobTemplate
+		*out = new(BuildkiteJobTemplate)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Artifacts != nil {
+		in, out := &in.Artifacts, &out.Artifacts
+		*out = new(BuildkiteArtifacts)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteSpec.
+func (in *BuildkiteSpec) DeepCopy() *BuildkiteSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildkiteStatus) DeepCopyInto(out *BuildkiteStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(BuildkiteAutoscalingStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AgentToken != nil {
+		in, out := &in.AgentToken, &out.AgentToken
+		*out = new(BuildkiteAgentTokenStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Pools != nil {
+		in, out := &in.Pools, &out.Pools
+		*out = make([]BuildkitePoolStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.ConnectedAgents != nil {
+		in, out := &in.ConnectedAgents, &out.ConnectedAgents
+		*out = new(int32)
+		**out = **in
+	}
+	if in.LastSuccessfulJob != nil {
+		in, out := &in.LastSuccessfulJob, &out.LastSuccessfulJob
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildkiteStatus.
+func (in *BuildkiteStatus) DeepCopy() *BuildkiteStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildkiteStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GatewayReference) DeepCopyInto(out *GatewayReference) {
+	*out = *in
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GatewayReference.
+func (in *GatewayReference) DeepCopy() *GatewayReference {
+	if in == nil {
+		return nil
+	}
+	out := new(GatewayReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PipelineProviderSettings) DeepCopyInto(out *PipelineProviderSettings) {
+	*out = *in
+	if in.BuildPullRequests != nil {
+		in, out := &in.BuildPullRequests, &out.BuildPullRequests
+		*out = new(bool)
+		**out = **in
+	}
+	if in.BuildBranches != nil {
+		in, out := &in.BuildBranches, &out.BuildBranches
+		*out = new(bool)
+		**out = **in
+	}
+	if in.BuildTags != nil {
+		in, out := &in.BuildTags, &out.BuildTags
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PublishCommitStatus != nil {
+		in, out := &in.PublishCommitStatus, &out.PublishCommitStatus
+		*out = new(bool)
+		**out = **in
+	}
+	if in.FilterEnabled != nil {
+		in, out := &in.FilterEnabled, &out.FilterEnabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PipelineProviderSettings.
+func (in *PipelineProviderSettings) DeepCopy() *PipelineProviderSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(PipelineProviderSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PipelineSchedule) DeepCopyInto(out *PipelineSchedule) {
+	*out = *in
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PipelineSchedule.
+func (in *PipelineSchedule) DeepCopy() *PipelineSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(PipelineSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PipelineScheduleStatus) DeepCopyInto(out *PipelineScheduleStatus) {
+	*out = *in
+	if in.NextBuildAt != nil {
+		in, out := &in.NextBuildAt, &out.NextBuildAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PipelineScheduleStatus.
+func (in *PipelineScheduleStatus) DeepCopy() *PipelineScheduleStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PipelineScheduleStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PipelineTemplateParameter) DeepCopyInto(out *PipelineTemplateParameter) {
+	*out = *in
+	if in.Default != nil {
+		in, out := &in.Default, &out.Default
+		*out = new(string)
+		**out = **in
+	}
+	if in.Enum != nil {
+		in, out := &in.Enum, &out.Enum
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PipelineTemplateParameter.
+func (in *PipelineTemplateParameter) DeepCopy() *PipelineTemplateParameter {
+	if in == nil {
+		return nil
+	}
+	out := new(PipelineTemplateParameter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PipelineTemplateRef) DeepCopyInto(out *PipelineTemplateRef) {
+	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PipelineTemplateRef.
+func (in *PipelineTemplateRef) DeepCopy() *PipelineTemplateRef {
+	if in == nil {
+		return nil
+	}
+	out := new(PipelineTemplateRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RootlessOptions) DeepCopyInto(out *RootlessOptions) {
+	*out = *in
+	if in.SeccompProfile != nil {
+		in, out := &in.SeccompProfile, &out.SeccompProfile
+		*out = new(corev1.SeccompProfile)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootlessOptions.
+func (in *RootlessOptions) DeepCopy() *RootlessOptions {
+	if in == nil {
+		return nil
+	}
+	out := new(RootlessOptions)
 	in.DeepCopyInto(out)
 	return out
 }
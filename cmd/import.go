@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cops/internal/buildkiteapi"
+	"cops/internal/pipeline"
+)
+
+// runImport implements the "import" subcommand. It writes a BuildkitePipeline
+// for every pipeline of an organization, so existing pipelines can be adopted
+// by the operator. The API token is read from $BUILDKITE_API_TOKEN.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var org, apiURL, output string
+	opts := pipeline.ImportOptions{}
+	fs.StringVar(&org, "org", "", "Slug of the Buildkite organization to import.")
+	fs.StringVar(&apiURL, "buildkite-api-url", buildkiteapi.DefaultURL, "The base URL of the Buildkite REST API.")
+	fs.StringVar(&output, "o", "-", "Directory to write one <slug>.yaml file per pipeline to, - for stdout.")
+	fs.StringVar(&opts.Namespace, "namespace", "", "Namespace of the written resources.")
+	fs.StringVar(&opts.TokenSecret.Name, "token-secret", "buildkite-api-token",
+		"Secret holding the Buildkite API token the operator uses for the pipelines.")
+	fs.StringVar(&opts.TokenSecret.Key, "token-key", "token", "Key of the API token in the secret.")
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	token := os.Getenv("BUILDKITE_API_TOKEN")
+	if org == "" || token == "" {
+		fmt.Fprintln(os.Stderr, "-org and $BUILDKITE_API_TOKEN are required")
+		return 1
+	}
+
+	api := buildkiteapi.New(apiURL, token)
+	pipelines, err := pipeline.Import(context.Background(), api, org, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i := range pipelines {
+		manifest, err := pipeline.Manifest(&pipelines[i])
+		if err == nil {
+			err = writeManifest(output, pipelines[i].Name, manifest)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", pipelines[i].Name, err)
+			return 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "imported %d pipelines\n", len(pipelines))
+	return 0
+}
+
+// writeManifest writes a manifest to dir/name.yaml, or to stdout as a YAML
+// document when dir is -.
+func writeManifest(dir, name string, manifest []byte) error {
+	if dir == "-" {
+		_, err := io.WriteString(os.Stdout, "---\n"+string(manifest))
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".yaml"), manifest, 0o644)
+}
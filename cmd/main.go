@@ -17,18 +17,27 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"os"
+	"strings"
+	"time"
+	// Embed the time zone database, the distroless image has none and
+	// schedule cron lines may name a time zone.
+	_ "time/tzdata"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -37,6 +46,9 @@ import (
 	buildkitv1alpha1 "cops/api/v1alpha1"
 	copsbuildkitv1alpha1 "cops/api/v1alpha1"
 	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkiteapi"
+	"cops/internal/buildkitewebhook"
 	"cops/internal/controller"
 	//+kubebuilder:scaffold:imports
 )
@@ -56,11 +68,29 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(runRender(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var buildkiteAPIURL string
+	var enableWebhooks bool
+	var buildkiteWebhookAddr string
+	var buildPollInterval time.Duration
+	var agentMetricsURL string
+	var statusAgentMetrics bool
+	var clusterID string
+	var clusterScopedNamespaces string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -70,6 +100,27 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&buildkiteAPIURL, "buildkite-api-url", buildkiteapi.DefaultURL,
+		"The base URL of the Buildkite REST API.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the admission webhooks. Requires a serving certificate, see config/webhook.")
+	flag.StringVar(&buildkiteWebhookAddr, "buildkite-webhook-bind-address", "0",
+		"The address the Buildkite webhook receiver binds to, 0 to disable it. "+
+			"Requests are verified with $BUILDKITE_WEBHOOK_TOKEN or $BUILDKITE_WEBHOOK_SIGNING_SECRET.")
+	flag.DurationVar(&buildPollInterval, "build-poll-interval", 15*time.Second,
+		"How often unfinished BuildkiteBuilds are refreshed from the Buildkite API. "+
+			"Can be raised when the Buildkite webhook receiver is enabled.")
+	flag.StringVar(&agentMetricsURL, "agent-metrics-url", agentmetrics.DefaultURL,
+		"The base URL of the Buildkite agent API read by the autoscaler.")
+	flag.BoolVar(&statusAgentMetrics, "status-agent-metrics", true,
+		"Verify agent tokens and count the connected agents of each Buildkite in its status "+
+			"through the agent API.")
+	flag.StringVar(&clusterID, "cluster-id", "",
+		"Identifies this cluster in the ownership marker of the pipelines it manages in Buildkite, "+
+			"so two clusters never manage the same pipeline. Defaults to the UID of the kube-system namespace.")
+	flag.StringVar(&clusterScopedNamespaces, "cluster-scoped-namespaces", "",
+		"Comma separated namespaces whose Buildkites may set rbac.cluster_scoped. "+
+			"Cluster scope is refused everywhere by default.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -98,8 +149,17 @@ func main() {
 		TLSOpts: tlsOpts,
 	})
 
+	jobCache, err := controller.JobCacheOptions()
+	if err != nil {
+		setupLog.Error(err, "unable to build the cache options")
+		os.Exit(1)
+	}
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		Cache:  cache.Options{ByObject: jobCache},
+		// Secrets are read from the API server rather than cached, so the
+		// operator does not hold every Secret of the cluster in memory.
+		Client: client.Options{Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.Secret{}}}},
 		Metrics: metricsserver.Options{
 			BindAddress:   metricsAddr,
 			SecureServing: secureMetrics,
@@ -126,6 +186,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if clusterID == "" {
+		// The cache is not started yet, read the namespace directly.
+		ns := &corev1.Namespace{}
+		if err := mgr.GetAPIReader().Get(context.Background(), client.ObjectKey{Name: "kube-system"}, ns); err != nil {
+			setupLog.Error(err, "unable to identify the cluster, set --cluster-id")
+			os.Exit(1)
+		}
+		clusterID = string(ns.UID)
+	}
+
 	if err = (&controller.BuildkitReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
@@ -134,21 +204,88 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&controller.BuildkiteReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		NewBuildkiteClient:      buildkiteapi.NewFactory(buildkiteAPIURL),
+		NewMetricsClient:        agentmetrics.NewFactory(agentMetricsURL),
+		ClusterScopedNamespaces: splitList(clusterScopedNamespaces),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Buildkite")
 		os.Exit(1)
 	}
 	if err = (&controller.BuildkitePipelineReconciler{
+		Client:             mgr.GetClient(),
+		Scheme:             mgr.GetScheme(),
+		NewBuildkiteClient: buildkiteapi.NewFactory(buildkiteAPIURL),
+		Recorder:           mgr.GetEventRecorderFor("buildkitepipeline-controller"),
+		ClusterID:          clusterID,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BuildkitePipeline")
+		os.Exit(1)
+	}
+	if err = (&controller.BuildkiteBuildReconciler{
+		Client:             mgr.GetClient(),
+		Scheme:             mgr.GetScheme(),
+		NewBuildkiteClient: buildkiteapi.NewFactory(buildkiteAPIURL),
+		PollInterval:       buildPollInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BuildkiteBuild")
+		os.Exit(1)
+	}
+	if err = (&controller.BuildkiteBuildTTLReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "BuildkitePipeline")
+		setupLog.Error(err, "unable to create controller", "controller", "BuildkiteBuildTTL")
+		os.Exit(1)
+	}
+	if err = (&controller.BuildkiteAutoscalerReconciler{
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		NewMetricsClient: agentmetrics.NewFactory(agentMetricsURL),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BuildkiteAutoscaler")
 		os.Exit(1)
 	}
+	statusReconciler := &controller.BuildkiteStatusReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}
+	if statusAgentMetrics {
+		statusReconciler.NewMetricsClient = agentmetrics.NewFactory(agentMetricsURL)
+	}
+	if err = statusReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BuildkiteStatus")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		if err = (&copsv1alpha1.BuildkitePipeline{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "BuildkitePipeline")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	if buildkiteWebhookAddr != "0" {
+		receiver, err := buildkitewebhook.New(mgr.GetClient(), mgr.GetEventRecorderFor("buildkite-webhook"), buildkitewebhook.Options{
+			BindAddress:   buildkiteWebhookAddr,
+			Token:         os.Getenv("BUILDKITE_WEBHOOK_TOKEN"),
+			SigningSecret: os.Getenv("BUILDKITE_WEBHOOK_SIGNING_SECRET"),
+		})
+		if err != nil {
+			setupLog.Error(err, "unable to create Buildkite webhook receiver")
+			os.Exit(1)
+		}
+		if err := buildkitewebhook.SetupIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+			setupLog.Error(err, "unable to index resources for the Buildkite webhook receiver")
+			os.Exit(1)
+		}
+		if err := mgr.Add(receiver); err != nil {
+			setupLog.Error(err, "unable to add Buildkite webhook receiver")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -164,3 +301,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+// runValidate implements the "validate" subcommand. It checks BuildkitePipeline
+// resources, or a plain Buildkite pipeline.yml, with the same rules as the
+// admission webhook.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var filename string
+	fs.StringVar(&filename, "f", "-", "File containing BuildkitePipeline resources or a Buildkite pipeline, - for stdin.")
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var in io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	failed := false
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		name, warnings, errs := validateDocument(doc)
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", name, w)
+		}
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, e)
+		}
+		failed = failed || len(errs) > 0
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// validateDocument validates a BuildkitePipeline, or a Buildkite pipeline
+// when the document has no kind. Other kinds are skipped.
+func validateDocument(doc []byte) (string, []string, []error) {
+	meta := metav1.TypeMeta{}
+	if err := yaml.Unmarshal(doc, &meta); err != nil {
+		return "document", nil, []error{err}
+	}
+	switch meta.Kind {
+	case "":
+		p, err := buildkitv1alpha1.ParsePipelineDefinition(doc)
+		if err != nil {
+			return "pipeline", nil, []error{err}
+		}
+		return "pipeline", nil, fieldErrors(p.Validate(nil))
+	case "BuildkitePipeline":
+		instance := buildkitv1alpha1.BuildkitePipeline{}
+		if err := yaml.Unmarshal(doc, &instance); err != nil {
+			return "BuildkitePipeline", nil, []error{err}
+		}
+		warnings, allErrs := instance.ValidateSpec()
+		return "BuildkitePipeline/" + instance.Name, warnings, fieldErrors(allErrs)
+	}
+	return meta.Kind, nil, nil
+}
+
+func fieldErrors(list field.ErrorList) []error {
+	errs := make([]error, len(list))
+	for i, e := range list {
+		errs[i] = e
+	}
+	return errs
+}
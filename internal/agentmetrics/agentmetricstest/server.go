@@ -0,0 +1,101 @@
+// Package agentmetricstest provides an in-memory Buildkite agent metrics API
+// for tests.
+package agentmetricstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"cops/internal/agentmetrics"
+)
+
+// Token is the agent token accepted by the fake server.
+const Token = "test-agent-token"
+
+// Server is a fake agent metrics API backed by httptest.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	queues map[string]agentmetrics.QueueJobs
+	agents map[string]agentmetrics.QueueAgents
+}
+
+// NewServer starts a fake agent metrics API. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		queues: map[string]agentmetrics.QueueJobs{},
+		agents: map[string]agentmetrics.QueueAgents{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Client returns a Client for the fake server.
+func (s *Server) Client() agentmetrics.Client {
+	return agentmetrics.New(s.URL, Token)
+}
+
+// Factory returns a Factory for the fake server.
+func (s *Server) Factory() agentmetrics.Factory {
+	return agentmetrics.NewFactory(s.URL)
+}
+
+// SetQueue sets the scheduled and running jobs of a queue.
+func (s *Server) SetQueue(queue string, scheduled, running int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[queue] = agentmetrics.QueueJobs{
+		Scheduled: scheduled,
+		Running:   running,
+		Total:     scheduled + running,
+	}
+}
+
+// SetAgents sets the idle and busy agents connected to a queue.
+func (s *Server) SetAgents(queue string, idle, busy int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agents[queue] = agentmetrics.QueueAgents{
+		Idle:  idle,
+		Busy:  busy,
+		Total: idle + busy,
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Token "+Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "Authentication required"})
+		return
+	}
+	if r.URL.Path != "/metrics" || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "Not Found"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := agentmetrics.Metrics{
+		Agents:       agentmetrics.AgentCounts{Queues: map[string]agentmetrics.QueueAgents{}},
+		Jobs:         agentmetrics.JobCounts{Queues: map[string]agentmetrics.QueueJobs{}},
+		Organization: agentmetrics.Organization{Slug: "acme"},
+	}
+	for name, a := range s.agents {
+		m.Agents.Queues[name] = a
+		m.Agents.Idle += a.Idle
+		m.Agents.Busy += a.Busy
+		m.Agents.Total += a.Total
+	}
+	for name, q := range s.queues {
+		m.Jobs.Queues[name] = q
+		m.Jobs.Scheduled += q.Scheduled
+		m.Jobs.Running += q.Running
+		m.Jobs.Total += q.Total
+	}
+	_ = json.NewEncoder(w).Encode(m)
+}
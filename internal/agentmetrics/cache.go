@@ -0,0 +1,66 @@
+package agentmetrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache remembers the metrics, or the error, read with each agent token for
+// a while, so a controller woken up by every job pod event does not call
+// the API each time. The cached Metrics are shared and must not be modified.
+type Cache struct {
+	factory Factory
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	metrics *Metrics
+	err     error
+	read    time.Time
+}
+
+// NewCache returns a Cache reading through factory, keeping results for ttl.
+func NewCache(factory Factory, ttl time.Duration) *Cache {
+	return &Cache{factory: factory, ttl: ttl, entries: map[string]cacheEntry{}}
+}
+
+// Factory returns a Client answering from the cache. Its method value is a
+// Factory.
+func (c *Cache) Factory(token string) Client {
+	return &cachedClient{cache: c, token: token}
+}
+
+type cachedClient struct {
+	cache *Cache
+	token string
+}
+
+func (c *cachedClient) Metrics(ctx context.Context) (*Metrics, error) {
+	cache := c.cache
+	cache.mu.Lock()
+	entry, ok := cache.entries[c.token]
+	cache.mu.Unlock()
+	if ok && time.Since(entry.read) < cache.ttl {
+		return entry.metrics, entry.err
+	}
+
+	m, err := cache.factory(c.token).Metrics(ctx)
+	if ctx.Err() != nil {
+		return m, err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := time.Now()
+	for token, e := range cache.entries {
+		if now.Sub(e.read) >= cache.ttl {
+			delete(cache.entries, token)
+		}
+	}
+	cache.entries[c.token] = cacheEntry{metrics: m, err: err, read: now}
+	return m, err
+}
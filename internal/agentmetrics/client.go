@@ -0,0 +1,125 @@
+// Package agentmetrics reads job and agent counts from the Buildkite agent
+// metrics API, which is authenticated with an agent token.
+package agentmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cops/internal/buildkiteapi"
+)
+
+// DefaultURL is the base URL of the Buildkite agent API.
+const DefaultURL = "https://agent.buildkite.com/v3"
+
+// Metrics are the counts of the organization the agent token belongs to.
+type Metrics struct {
+	Agents       AgentCounts  `json:"agents"`
+	Jobs         JobCounts    `json:"jobs"`
+	Organization Organization `json:"organization"`
+}
+
+// AgentCounts counts the connected agents, in total and per queue.
+type AgentCounts struct {
+	Idle   int32                  `json:"idle"`
+	Busy   int32                  `json:"busy"`
+	Total  int32                  `json:"total"`
+	Queues map[string]QueueAgents `json:"queues,omitempty"`
+}
+
+// QueueAgents counts the agents of a queue.
+type QueueAgents struct {
+	Idle  int32 `json:"idle"`
+	Busy  int32 `json:"busy"`
+	Total int32 `json:"total"`
+}
+
+// JobCounts counts the unfinished jobs, in total and per queue.
+type JobCounts struct {
+	Scheduled int32                `json:"scheduled"`
+	Running   int32                `json:"running"`
+	Waiting   int32                `json:"waiting"`
+	Total     int32                `json:"total"`
+	Queues    map[string]QueueJobs `json:"queues,omitempty"`
+}
+
+// QueueJobs counts the jobs of a queue. Scheduled jobs wait for an agent,
+// waiting jobs wait for their dependencies.
+type QueueJobs struct {
+	Scheduled int32 `json:"scheduled"`
+	Running   int32 `json:"running"`
+	Waiting   int32 `json:"waiting"`
+	Total     int32 `json:"total"`
+}
+
+// Organization the metrics belong to.
+type Organization struct {
+	Slug string `json:"slug"`
+}
+
+// Queue returns the job counts of a queue, zero when it has no jobs.
+func (m *Metrics) Queue(name string) QueueJobs {
+	return m.Jobs.Queues[name]
+}
+
+// Client is the agent metrics API.
+type Client interface {
+	Metrics(ctx context.Context) (*Metrics, error)
+}
+
+// Factory builds a Client authenticated with the given agent token.
+type Factory func(token string) Client
+
+type httpClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// New returns a Client talking to the agent API at baseURL.
+func New(baseURL, token string) Client {
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return &httpClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// NewFactory returns a Factory for the agent API at baseURL.
+func NewFactory(baseURL string) Factory {
+	return func(token string) Client {
+		return New(baseURL, token)
+	}
+}
+
+func (c *httpClient) Metrics(ctx context.Context) (*Metrics, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, &buildkiteapi.APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	m := &Metrics{}
+	if err := json.NewDecoder(resp.Body).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
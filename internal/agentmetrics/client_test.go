@@ -0,0 +1,64 @@
+package agentmetrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cops/internal/agentmetrics"
+	"cops/internal/agentmetrics/agentmetricstest"
+	"cops/internal/buildkiteapi"
+)
+
+func TestMetrics(t *testing.T) {
+	server := agentmetricstest.NewServer()
+	defer server.Close()
+	server.SetQueue("builders", 3, 2)
+	ctx := context.Background()
+
+	m, err := server.Client().Metrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := m.Queue("builders"); q.Scheduled != 3 || q.Running != 2 {
+		t.Errorf("unexpected queue counts %+v", q)
+	}
+	if q := m.Queue("other"); q != (agentmetrics.QueueJobs{}) {
+		t.Errorf("unknown queue must have no jobs, got %+v", q)
+	}
+
+	_, err = agentmetrics.New(server.URL, "wrong").Metrics(ctx)
+	if e, ok := err.(*buildkiteapi.APIError); !ok || e.StatusCode != 401 {
+		t.Errorf("expected a 401, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	server := agentmetricstest.NewServer()
+	defer server.Close()
+	server.SetQueue("builders", 3, 2)
+	ctx := context.Background()
+
+	cache := agentmetrics.NewCache(server.Factory(), time.Hour)
+	if _, err := cache.Factory(agentmetricstest.Token).Metrics(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.SetQueue("builders", 0, 0)
+	m, err := cache.Factory(agentmetricstest.Token).Metrics(ctx)
+	if err != nil || m.Queue("builders").Scheduled != 3 {
+		t.Errorf("expected the cached metrics, got %+v %v", m, err)
+	}
+	if _, err := cache.Factory("wrong").Metrics(ctx); err == nil {
+		t.Error("another token must not read the cached metrics")
+	}
+
+	cache = agentmetrics.NewCache(server.Factory(), time.Millisecond)
+	if _, err := cache.Factory(agentmetricstest.Token).Metrics(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.SetQueue("builders", 1, 0)
+	time.Sleep(5 * time.Millisecond)
+	if m, err := cache.Factory(agentmetricstest.Token).Metrics(ctx); err != nil || m.Queue("builders").Scheduled != 1 {
+		t.Errorf("expected fresh metrics after the ttl, got %+v %v", m, err)
+	}
+}
@@ -0,0 +1,125 @@
+package build
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+const (
+	// DefaultCommit is built when the spec names no commit.
+	DefaultCommit = "HEAD"
+
+	// CreationKeyMetaData is the build meta-data holding the creation key of
+	// the BuildkiteBuild.
+	CreationKeyMetaData = "thecops.dev/creation-key"
+)
+
+// Request builds the create build body. The branch defaults to the default
+// branch of the pipeline and the message to the resource name. The creation
+// key is added to the meta-data.
+func Request(b *buildkitv1alpha1.BuildkiteBuild, p *buildkitv1alpha1.BuildkitePipeline) *buildkiteapi.BuildRequest {
+	req := &buildkiteapi.BuildRequest{
+		Commit:  b.Spec.Commit,
+		Branch:  b.Spec.Branch,
+		Message: b.Spec.Message,
+		Env:     b.Spec.Env,
+	}
+	if len(b.Spec.MetaData) > 0 || b.Status.CreationKey != "" {
+		req.MetaData = map[string]string{}
+		for k, v := range b.Spec.MetaData {
+			req.MetaData[k] = v
+		}
+		if b.Status.CreationKey != "" {
+			req.MetaData[CreationKeyMetaData] = b.Status.CreationKey
+		}
+	}
+	if req.Commit == "" {
+		req.Commit = DefaultCommit
+	}
+	if req.Branch == "" {
+		req.Branch = p.Spec.DefaultBranch
+	}
+	if req.Message == "" {
+		req.Message = b.Name
+	}
+	return req
+}
+
+// Create creates the build in Buildkite. A build created before with the same
+// creation key, by an attempt whose status was lost, is returned instead.
+func Create(ctx context.Context, api buildkiteapi.Client, org, slug string, b *buildkitv1alpha1.BuildkiteBuild, p *buildkitv1alpha1.BuildkitePipeline) (*buildkiteapi.Build, error) {
+	if b.Status.CreationKey != "" {
+		remote, err := api.FindBuild(ctx, org, slug, CreationKeyMetaData, b.Status.CreationKey)
+		if err == nil {
+			return remote, nil
+		}
+		if !buildkiteapi.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return api.CreateBuild(ctx, org, slug, Request(b, p))
+}
+
+// SetStatus mirrors the build reported by Buildkite into status. Conditions
+// are left untouched.
+func SetStatus(status *buildkitv1alpha1.BuildkiteBuildStatus, build *buildkiteapi.Build) {
+	status.ID = build.ID
+	status.Number = build.Number
+	status.State = build.State
+	status.WebURL = build.WebURL
+	status.Commit = build.Commit
+	status.CreatedAt = timeOf(build.CreatedAt)
+	status.StartedAt = timeOf(build.StartedAt)
+	status.FinishedAt = timeOf(build.FinishedAt)
+
+	status.Jobs = make([]buildkitv1alpha1.BuildkiteJobStatus, 0, len(build.Jobs))
+	for i := range build.Jobs {
+		status.Jobs = append(status.Jobs, JobStatus(&build.Jobs[i]))
+	}
+}
+
+// JobStatus mirrors a job reported by Buildkite.
+func JobStatus(job *buildkiteapi.Job) buildkitv1alpha1.BuildkiteJobStatus {
+	return buildkitv1alpha1.BuildkiteJobStatus{
+		ID:         job.ID,
+		Type:       job.Type,
+		Name:       job.Name,
+		State:      job.State,
+		ExitStatus: job.ExitStatus,
+		WebURL:     job.WebURL,
+		StartedAt:  timeOf(job.StartedAt),
+		FinishedAt: timeOf(job.FinishedAt),
+	}
+}
+
+// Finished reports whether the build reached a final state.
+func Finished(b *buildkitv1alpha1.BuildkiteBuild) bool {
+	return b.Status.Number != 0 && buildkiteapi.BuildFinished(b.Status.State)
+}
+
+// Expiry returns when a finished build should be deleted. ok is false when
+// the build is not finished or has no TTL.
+func Expiry(b *buildkitv1alpha1.BuildkiteBuild) (expiry time.Time, ok bool) {
+	ttl := b.Spec.TTLSecondsAfterFinished
+	if ttl == nil || !Finished(b) {
+		return time.Time{}, false
+	}
+	finished := b.CreationTimestamp.Time
+	if b.Status.FinishedAt != nil {
+		finished = b.Status.FinishedAt.Time
+	}
+	return finished.Add(time.Duration(*ttl) * time.Second), true
+}
+
+func timeOf(t *time.Time) *metav1.Time {
+	if t == nil {
+		return nil
+	}
+	mt := metav1.NewTime(*t)
+	return &mt
+}
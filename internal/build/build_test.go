@@ -0,0 +1,116 @@
+package build
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+	"cops/internal/buildkiteapi/buildkiteapitest"
+)
+
+func TestRequestDefaults(t *testing.T) {
+	b := &buildkitv1alpha1.BuildkiteBuild{ObjectMeta: metav1.ObjectMeta{Name: "release-1"}}
+	p := &buildkitv1alpha1.BuildkitePipeline{Spec: buildkitv1alpha1.BuildkitePipelineSpec{DefaultBranch: "main"}}
+
+	req := Request(b, p)
+	if req.Commit != DefaultCommit || req.Branch != "main" || req.Message != "release-1" {
+		t.Errorf("unexpected defaults: %+v", req)
+	}
+
+	b.Spec.Commit, b.Spec.Branch = "abc123", "release/1"
+	req = Request(b, p)
+	if req.Commit != "abc123" || req.Branch != "release/1" {
+		t.Errorf("spec not used: %+v", req)
+	}
+}
+
+func TestCreateFindsBuildByCreationKey(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	server.PutPipeline("acme", buildkiteapi.Pipeline{Slug: "web", DefaultBranch: "main"})
+	api := server.Client()
+	p := &buildkitv1alpha1.BuildkitePipeline{Spec: buildkitv1alpha1.BuildkitePipelineSpec{DefaultBranch: "main"}}
+	b := &buildkitv1alpha1.BuildkiteBuild{
+		ObjectMeta: metav1.ObjectMeta{Name: "release-1"},
+		Spec:       buildkitv1alpha1.BuildkiteBuildSpec{MetaData: map[string]string{"release": "1"}},
+		Status:     buildkitv1alpha1.BuildkiteBuildStatus{CreationKey: "uid-1"},
+	}
+
+	first, err := Create(context.Background(), api, "acme", "web", b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.MetaData[CreationKeyMetaData] != "uid-1" || first.MetaData["release"] != "1" {
+		t.Errorf("creation key not sent: %v", first.MetaData)
+	}
+	if _, ok := b.Spec.MetaData[CreationKeyMetaData]; ok {
+		t.Error("spec meta-data modified")
+	}
+
+	// The status of the first attempt was lost, the retry finds the build.
+	retried, err := Create(context.Background(), api, "acme", "web", b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Number != first.Number || server.Build("acme", "web", 2) != nil {
+		t.Errorf("retry created build %d", retried.Number)
+	}
+
+	b.Status.CreationKey = "uid-2"
+	other, err := Create(context.Background(), api, "acme", "web", b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Number != 2 {
+		t.Errorf("another key got build %d", other.Number)
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	finished := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	exit := int32(1)
+	status := buildkitv1alpha1.BuildkiteBuildStatus{}
+	SetStatus(&status, &buildkiteapi.Build{
+		ID:         "b1",
+		Number:     7,
+		State:      buildkiteapi.BuildStateFailed,
+		FinishedAt: &finished,
+		Jobs: []buildkiteapi.Job{
+			{ID: "j1", Type: "script", State: "failed", ExitStatus: &exit, FinishedAt: &finished},
+			{ID: "j2", Type: "waiter", State: "broken"},
+		},
+	})
+	if status.Number != 7 || status.State != "failed" || !status.FinishedAt.Time.Equal(finished) {
+		t.Errorf("build not mirrored: %+v", status)
+	}
+	if len(status.Jobs) != 2 || *status.Jobs[0].ExitStatus != 1 || status.Jobs[1].ExitStatus != nil {
+		t.Errorf("jobs not mirrored: %+v", status.Jobs)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	finished := metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	ttl := int32(3600)
+	b := &buildkitv1alpha1.BuildkiteBuild{
+		Spec:   buildkitv1alpha1.BuildkiteBuildSpec{TTLSecondsAfterFinished: &ttl},
+		Status: buildkitv1alpha1.BuildkiteBuildStatus{Number: 1, State: "running"},
+	}
+	if _, ok := Expiry(b); ok {
+		t.Error("a running build must not expire")
+	}
+
+	b.Status.State, b.Status.FinishedAt = "passed", &finished
+	expiry, ok := Expiry(b)
+	if !ok || !expiry.Equal(finished.Add(time.Hour)) {
+		t.Errorf("got %v %v, want an hour after %v", expiry, ok, finished)
+	}
+
+	b.Spec.TTLSecondsAfterFinished = nil
+	if _, ok := Expiry(b); ok {
+		t.Error("a build without a TTL must be kept")
+	}
+}
@@ -1,28 +1,46 @@
 package buildkit
 
 import (
+	"bytes"
 	"context"
 	buildkitv1alpha1 "cops/api/v1alpha1"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"math/big"
+	goerrors "errors"
+	"fmt"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// LinkLabel is set on client pods, such as Buildkite agents, that are linked
+// to a Buildkit. Its value is the name of the Buildkit.
+const LinkLabel = "thecops.dev/buildkit"
+
+// JobLabel is set by the Buildkite agent stack on every job pod.
+const JobLabel = "buildkite.com/job-uuid"
+
+// GatewayNameLabel is set on the pods of a Gateway by most Gateway API
+// implementations. Its value is the name of the Gateway.
+const GatewayNameLabel = "gateway.networking.k8s.io/gateway-name"
+
+// RouterLabels select the router pods that dispatch builds to buildkitd.
+var RouterLabels = map[string]string{
+	"service": "buildkit-router",
+}
+
 type Buildkit struct {
 	Name         string
 	Namespace    string
@@ -32,11 +50,142 @@ type Buildkit struct {
 	Image        string
 	NodeSelector map[string]string
 	Rootless     bool
+	RootlessOpts *buildkitv1alpha1.RootlessOptions
 	MaxReplica   int64
 	Resource     corev1.ResourceRequirements
+	Access       *buildkitv1alpha1.BuildkitAccess
+	Expose       *buildkitv1alpha1.BuildkitExpose
+	PodTemplate  *corev1.PodTemplateSpec
+	// AgentNamespaces are the namespaces of Buildkite stacks linked to this
+	// Buildkit, whose job pods are admitted by the NetworkPolicy.
+	AgentNamespaces []string
 	client.Client
 }
 
+// TLSRouteGVK is the Gateway API kind used for TLS passthrough exposure.
+var TLSRouteGVK = schema.GroupVersionKind{
+	Group:   "gateway.networking.k8s.io",
+	Version: "v1alpha2",
+	Kind:    "TLSRoute",
+}
+
+// New builds a Buildkit from the given custom resource.
+func New(instance *buildkitv1alpha1.Buildkit, c client.Client) *Buildkit {
+	return &Buildkit{
+		Name:         instance.Name,
+		Namespace:    instance.Namespace,
+		Labels:       map[string]string{},
+		NodeSelector: map[string]string{},
+		Cloud:        instance.Spec.CloudProvider,
+		Arch:         instance.Spec.Arch,
+		Rootless:     instance.Spec.Rootless,
+		RootlessOpts: instance.Spec.RootlessOptions,
+		Image:        instance.Spec.Image,
+		MaxReplica:   instance.Spec.MaxReplica,
+		Resource:     instance.Spec.Resources,
+		Access:       instance.Spec.Access,
+		Expose:       instance.Spec.Expose,
+		PodTemplate:  instance.Spec.PodTemplate,
+		Client:       c,
+	}
+}
+
+// ErrLinkNotAllowed is returned when a Buildkite stack links to a Buildkit
+// that does not admit its namespace.
+var ErrLinkNotAllowed = goerrors.New("buildkit does not allow links from this namespace")
+
+// LinkAllowed reports whether Buildkite stacks in namespace may link to the
+// Buildkit. Stacks in its own namespace always may, others only when their
+// namespace is listed in access.link_namespaces.
+func LinkAllowed(instance *buildkitv1alpha1.Buildkit, namespace string) bool {
+	if namespace == instance.Namespace {
+		return true
+	}
+	if instance.Spec.Access == nil {
+		return false
+	}
+	for _, ns := range instance.Spec.Access.LinkNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Manifests returns every child object of the Buildkit, in the order the
+// controller applies them, without talking to the cluster. The certificate
+// Secret is a placeholder with empty keys so the output stays deterministic.
+func (b *Buildkit) Manifests() ([]client.Object, error) {
+	deployment, err := b.deployment()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := b.service()
+	if err != nil {
+		return nil, err
+	}
+	hpa, err := b.horizontalPodAutoscalerionBudget()
+	if err != nil {
+		return nil, err
+	}
+	objects := []client.Object{deployment, svc, b.secretPlaceholder(), hpa}
+	if b.Access != nil {
+		np, err := b.networkPolicy()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, np)
+	}
+	if b.ExposeMode() == buildkitv1alpha1.ExposeTLSRoute {
+		route, err := b.tlsRoute()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, route)
+	}
+	return objects, nil
+}
+
+// ExposeMode returns the configured expose mode, ClusterIP by default.
+func (b *Buildkit) ExposeMode() buildkitv1alpha1.ExposeMode {
+	if b.Expose == nil || b.Expose.Mode == "" {
+		return buildkitv1alpha1.ExposeClusterIP
+	}
+	return b.Expose.Mode
+}
+
+// Hosts returns the names buildkitd is reachable under, which end up in the
+// server certificate SANs.
+func (b *Buildkit) Hosts() []string {
+	hosts := []string{
+		b.Name,
+		fmt.Sprintf("%s.%s", b.Name, b.Namespace),
+		fmt.Sprintf("%s.%s.svc", b.Name, b.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", b.Name, b.Namespace),
+	}
+	if b.Expose != nil && b.Expose.Hostname != "" {
+		hosts = append(hosts, b.Expose.Hostname)
+	}
+	return hosts
+}
+
+// loadBalancerAnnotations are the cloud profile defaults for a LoadBalancer
+// Service. buildkitd terminates TLS itself, so a layer 4 balancer is required.
+func (b *Buildkit) loadBalancerAnnotations() map[string]string {
+	switch b.Cloud {
+	case buildkitv1alpha1.AWS:
+		return map[string]string{
+			"service.beta.kubernetes.io/aws-load-balancer-type":   "nlb",
+			"service.beta.kubernetes.io/aws-load-balancer-scheme": "internet-facing",
+		}
+	case buildkitv1alpha1.GCP:
+		return map[string]string{
+			"cloud.google.com/l4-rbs": "enabled",
+		}
+	}
+	return map[string]string{}
+}
+
 // TODO:// Create Spec of each resource of buildkit
 // example https://github.com/andrcuns/charts/blob/main/charts/buildkit-service/templates
 func (b *Buildkit) service() (*corev1.Service, error) {
@@ -44,15 +193,41 @@ func (b *Buildkit) service() (*corev1.Service, error) {
 		"app": b.Name,
 	}
 
+	serviceType := corev1.ServiceTypeClusterIP
+	annotations := map[string]string{}
+	var sourceRanges []string
+	var trafficPolicy corev1.ServiceExternalTrafficPolicy
+
+	switch b.ExposeMode() {
+	case buildkitv1alpha1.ExposeNodePort:
+		serviceType = corev1.ServiceTypeNodePort
+	case buildkitv1alpha1.ExposeLoadBalancer:
+		serviceType = corev1.ServiceTypeLoadBalancer
+		annotations = b.loadBalancerAnnotations()
+		sourceRanges = b.Expose.SourceRanges
+	}
+	if b.Expose != nil {
+		for k, v := range b.Expose.Annotations {
+			annotations[k] = v
+		}
+	}
+	// The NetworkPolicy admits external clients by source range, which only
+	// holds when nodes do not SNAT the traffic.
+	if serviceType != corev1.ServiceTypeClusterIP && b.Access != nil {
+		trafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+	}
+
 	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        b.Name,
 			Namespace:   b.Namespace,
 			Labels:      labels,
-			Annotations: map[string]string{},
+			Annotations: annotations,
 		},
 		Spec: corev1.ServiceSpec{
-			Type: "ClusterIP", // Replace with your actual service type
+			Type:                     serviceType,
+			LoadBalancerSourceRanges: sourceRanges,
+			ExternalTrafficPolicy:    trafficPolicy,
 			Ports: []corev1.ServicePort{
 				{
 					Port:       1234, // Replace with your actual port number
@@ -73,11 +248,20 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 		"app":     b.Name,
 		"service": "buildkit",
 	}
+	profile, err := b.profile()
+	if err != nil {
+		return nil, err
+	}
 	args := []string{
 		"--addr",
-		"unix:///run/buildkit/buildkitd.sock",
+		"unix://" + profile.runDir + "/buildkitd.sock",
 		"--addr",
 		"tcp://0.0.0.0:1234",
+	}
+	if b.Rootless {
+		args = append(args, "--oci-worker-no-process-sandbox")
+	}
+	args = append(args,
 		"--debug",
 		"--tlscacert",
 		"/certs/ca.pem",
@@ -85,40 +269,7 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 		"/certs/cert.pem",
 		"--tlskey",
 		"/certs/key.pem",
-	}
-
-	if b.Rootless {
-		args = []string{
-			"--addr",
-			"unix:///run/user/1000/buildkit/buildkitd.sock",
-			"--addr",
-			"tcp://0.0.0.0:1234",
-			"--oci-worker-no-process-sandbox",
-			"--debug",
-			"--tlscacert",
-			"/certs/ca.pem",
-			"--tlscert",
-			"/certs/cert.pem",
-			"--tlskey",
-			"/certs/key.pem",
-		}
-
-	}
-	var privileged bool = true
-	var user int64 = 1000
-	sc := corev1.SecurityContext{
-		Privileged: &privileged,
-	}
-
-	if b.Rootless {
-		sc = corev1.SecurityContext{
-			SeccompProfile: &corev1.SeccompProfile{
-				Type: corev1.SeccompProfileTypeUnconfined,
-			},
-			RunAsUser:  &user,
-			RunAsGroup: &user,
-		}
-	}
+	)
 
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -133,16 +284,16 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
-					Annotations: map[string]string{
-						"container.apparmor.security.beta.kubernetes.io/buildkitd": "unconfined",
-					},
+					Labels:      labels,
+					Annotations: profile.annotations,
 				},
 				Spec: corev1.PodSpec{
+					HostUsers:       profile.hostUsers,
+					SecurityContext: profile.podSecurityContext,
 					Containers: []corev1.Container{
 						{
 							Name:  "buildkitd",
-							Image: b.Image,
+							Image: profile.image,
 							Ports: []corev1.ContainerPort{
 								{
 									Name:          "tcp",
@@ -159,13 +310,17 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 								},
 								{
 									Name:      "buildkitd",
-									MountPath: "/home/user/.local/share/buildkit",
+									MountPath: profile.stateDir,
+								},
+								{
+									Name:      "run",
+									MountPath: profile.runDir,
 								},
 							},
 							ReadinessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
 									Exec: &corev1.ExecAction{
-										Command: []string{"buildctl", "debug", "workers"},
+										Command: []string{"buildctl", "--addr", "unix://" + profile.runDir + "/buildkitd.sock", "debug", "workers"},
 									},
 								},
 								InitialDelaySeconds: 5,
@@ -174,14 +329,14 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 							LivenessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
 									Exec: &corev1.ExecAction{
-										Command: []string{"buildctl", "debug", "workers"},
+										Command: []string{"buildctl", "--addr", "unix://" + profile.runDir + "/buildkitd.sock", "debug", "workers"},
 									},
 								},
 								InitialDelaySeconds: 5,
 								PeriodSeconds:       30,
 							},
 							Resources:       b.Resource,
-							SecurityContext: &sc,
+							SecurityContext: profile.securityContext,
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -199,6 +354,12 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 								EmptyDir: &corev1.EmptyDirVolumeSource{},
 							},
 						},
+						{
+							Name: "run",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
 					},
 					NodeSelector: b.NodeSelector,
 				},
@@ -206,14 +367,86 @@ func (b *Buildkit) deployment() (*appsv1.Deployment, error) {
 		},
 	}
 
+	template, err := mergePodTemplate(deployment.Spec.Template, b.PodTemplate, "buildkitd")
+	if err != nil {
+		return nil, err
+	}
+	deployment.Spec.Template = template
+
 	return deployment, nil
 }
 
-func (b *Buildkit) secret() (*corev1.Secret, error) {
-	certs, key, ca, err := generateCertificate()
+func (b *Buildkit) tlsRoute() (*unstructured.Unstructured, error) {
+	if b.Expose == nil || b.Expose.Hostname == "" {
+		return nil, fmt.Errorf("expose.hostname is required for %s", buildkitv1alpha1.ExposeTLSRoute)
+	}
+	if b.Expose.Gateway == nil || b.Expose.Gateway.Name == "" {
+		return nil, fmt.Errorf("expose.gateway is required for %s", buildkitv1alpha1.ExposeTLSRoute)
+	}
+
+	parent := map[string]interface{}{
+		"name": b.Expose.Gateway.Name,
+	}
+	if b.Expose.Gateway.Namespace != "" {
+		parent["namespace"] = b.Expose.Gateway.Namespace
+	}
+	if b.Expose.Gateway.SectionName != "" {
+		parent["sectionName"] = b.Expose.Gateway.SectionName
+	}
+	if b.Expose.Gateway.Port != 0 {
+		parent["port"] = int64(b.Expose.Gateway.Port)
+	}
+
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(TLSRouteGVK)
+	route.SetName(b.Name)
+	route.SetNamespace(b.Namespace)
+	route.SetLabels(map[string]string{
+		"app": b.Name,
+	})
+	route.Object["spec"] = map[string]interface{}{
+		"parentRefs": []interface{}{parent},
+		"hostnames":  []interface{}{b.Expose.Hostname},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"backendRefs": []interface{}{
+					map[string]interface{}{
+						"name": b.Name,
+						"port": int64(1234),
+					},
+				},
+			},
+		},
+	}
+	return route, nil
+}
+
+func (b *Buildkit) secret(ca *authority) (*corev1.Secret, error) {
+	certs, key, err := ca.issue(b.Name, b.Hosts(), x509.ExtKeyUsageServerAuth)
 	if err != nil {
 		return nil, err
 	}
+	labels := map[string]string{
+		"app": b.Name,
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.Name,
+			Namespace: b.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				hostsAnnotation: strings.Join(b.Hosts(), ","),
+			},
+		},
+		Data: map[string][]byte{
+			"cert.pem": certs,
+			"key.pem":  key,
+			"ca.pem":   ca.certPEM,
+		},
+	}, nil
+}
+
+func (b *Buildkit) secretPlaceholder() *corev1.Secret {
 	labels := map[string]string{
 		"app": b.Name,
 	}
@@ -225,13 +458,144 @@ func (b *Buildkit) secret() (*corev1.Secret, error) {
 			Annotations: map[string]string{},
 		},
 		Data: map[string][]byte{
-			"cert.pem": certs,
-			"key.pem":  key,
-			"ca.pem":   ca,
+			"cert.pem": {},
+			"key.pem":  {},
+			"ca.pem":   {},
+		},
+	}
+}
+
+func (b *Buildkit) networkPolicy() (*networkingv1.NetworkPolicy, error) {
+	labels := map[string]string{
+		"app": b.Name,
+	}
+	port := intstr.FromInt32(1234)
+	protocol := corev1.ProtocolTCP
+
+	routerNamespace := b.Namespace
+	if b.Access != nil && b.Access.RouterNamespace != "" {
+		routerNamespace = b.Access.RouterNamespace
+	}
+	peers := []networkingv1.NetworkPolicyPeer{
+		{
+			NamespaceSelector: namespaceSelector(routerNamespace),
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: RouterLabels,
+			},
+		},
+	}
+	if b.Access != nil {
+		if len(b.Access.Namespaces) > 0 {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{
+				NamespaceSelector: namespaceSelector(b.Access.Namespaces...),
+			})
+		}
+		for i := range b.Access.PodSelectors {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{
+				PodSelector: &b.Access.PodSelectors[i],
+			})
+		}
+	}
+	if len(b.AgentNamespaces) > 0 {
+		peers = append(peers,
+			networkingv1.NetworkPolicyPeer{
+				NamespaceSelector: namespaceSelector(b.AgentNamespaces...),
+				PodSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{LinkLabel: b.Name},
+				},
+			},
+			networkingv1.NetworkPolicyPeer{
+				NamespaceSelector: namespaceSelector(b.AgentNamespaces...),
+				PodSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{
+							Key:      JobLabel,
+							Operator: metav1.LabelSelectorOpExists,
+						},
+					},
+				},
+			},
+		)
+	}
+	switch mode := b.ExposeMode(); mode {
+	case buildkitv1alpha1.ExposeNodePort, buildkitv1alpha1.ExposeLoadBalancer:
+		if len(b.Expose.SourceRanges) == 0 {
+			return nil, fmt.Errorf("expose.source_ranges is required for %s when access is set", mode)
+		}
+		for _, cidr := range b.Expose.SourceRanges {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{
+				IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+			})
+		}
+	case buildkitv1alpha1.ExposeTLSRoute:
+		if b.Expose.Gateway != nil {
+			peers = append(peers, b.gatewayPeer())
+		}
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        b.Name,
+			Namespace:   b.Namespace,
+			Labels:      labels,
+			Annotations: map[string]string{},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{
+							Protocol: &protocol,
+							Port:     &port,
+						},
+					},
+					From: peers,
+				},
+			},
 		},
 	}, nil
 }
 
+// gatewayPeer admits the pods of the Gateway the TLSRoute attaches to.
+func (b *Buildkit) gatewayPeer() networkingv1.NetworkPolicyPeer {
+	gateway := b.Expose.Gateway
+	namespace := gateway.PodNamespace
+	if namespace == "" {
+		namespace = gateway.Namespace
+	}
+	if namespace == "" {
+		namespace = b.Namespace
+	}
+	pods := gateway.PodSelector
+	if pods == nil {
+		pods = &metav1.LabelSelector{
+			MatchLabels: map[string]string{GatewayNameLabel: gateway.Name},
+		}
+	}
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: namespaceSelector(namespace),
+		PodSelector:       pods,
+	}
+}
+
+// namespaceSelector selects the namespaces with the given names. Pod labels
+// alone are not trusted across namespaces, anyone may set them.
+func namespaceSelector(names ...string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      corev1.LabelMetadataName,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   names,
+			},
+		},
+	}
+}
+
 func (b *Buildkit) podDisruptionBudget() (*policyv1.PodDisruptionBudget, error) {
 	labels := map[string]string{
 		"app": b.Name,
@@ -358,32 +722,48 @@ func (b *Buildkit) CreateOrUpdateService(ctx context.Context) error {
 	return nil
 }
 
-func (b *Buildkit) CreateOrUpdateSecret(ctx context.Context) error {
+// CreateOrUpdateSecret issues the buildkitd server certificate. An existing
+// certificate is kept as long as it was issued by the current CA for the
+// current hosts and is not due for renewal, so linked clients stay valid
+// across reconciles. It returns when the certificate is due for renewal.
+func (b *Buildkit) CreateOrUpdateSecret(ctx context.Context) (time.Time, error) {
 
-	secret, err := b.secret()
+	ca, err := b.authority(ctx, true)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
+	existing := &corev1.Secret{}
 	err = b.Client.Get(ctx, types.NamespacedName{
 		Name:      b.Name,
 		Namespace: b.Namespace,
-	}, &corev1.Secret{})
+	}, existing)
+	if err == nil &&
+		existing.Annotations[hostsAnnotation] == strings.Join(b.Hosts(), ",") &&
+		bytes.Equal(existing.Data["ca.pem"], ca.certPEM) &&
+		time.Now().Before(RenewalTime(existing.Data["cert.pem"])) {
+		return RenewalTime(existing.Data["cert.pem"]), nil
+	}
+
+	secret, secretErr := b.secret(ca)
+	if secretErr != nil {
+		return time.Time{}, secretErr
+	}
 
 	if err != nil {
 		if errors.IsNotFound(err) {
 
 			if err := b.Client.Create(ctx, secret); err != nil {
-				return err
+				return time.Time{}, err
 			}
-			return nil
+			return RenewalTime(secret.Data["cert.pem"]), nil
 		}
-		return err
+		return time.Time{}, err
 	}
 	if err := b.Client.Update(ctx, secret); err != nil {
-		return err
+		return time.Time{}, err
 	}
-	return nil
+	return RenewalTime(secret.Data["cert.pem"]), nil
 }
 
 func (b *Buildkit) CreateOrUpdatePodDisruptionBudget(ctx context.Context) error {
@@ -442,56 +822,133 @@ func (b *Buildkit) CreateOrUpdateHorizontalPodAutoscalerionBudget(ctx context.Co
 	return nil
 }
 
-func generateCertificate() (certs []byte, key []byte, ca []byte, err error) {
-	// Generate a new private key
-	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+func (b *Buildkit) CreateOrUpdateNetworkPolicy(ctx context.Context) error {
+
+	np, err := b.networkPolicy()
+	if err != nil {
+		return err
+	}
+
+	err = b.Client.Get(ctx, types.NamespacedName{
+		Name:      b.Name,
+		Namespace: b.Namespace,
+	}, &networkingv1.NetworkPolicy{})
+
 	if err != nil {
-		return nil, nil, nil, err
+		if errors.IsNotFound(err) {
+
+			if err := b.Client.Create(ctx, np); err != nil {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	if err := b.Client.Update(ctx, np); err != nil {
+		return err
 	}
+	return nil
+}
 
-	// Create a self-signed certificate
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"Your Organization"},
+// DeleteNetworkPolicy removes the NetworkPolicy once access is no longer restricted.
+func (b *Buildkit) DeleteNetworkPolicy(ctx context.Context) error {
+	np := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.Name,
+			Namespace: b.Namespace,
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0), // Valid for 1 year
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
 	}
-	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
-	if err != nil {
-		return nil, nil, nil, err
+	if err := b.Client.Delete(ctx, np); err != nil && !errors.IsNotFound(err) {
+		return err
 	}
+	return nil
+}
+
+func (b *Buildkit) CreateOrUpdateTLSRoute(ctx context.Context) error {
 
-	// Encode the certificate and private key to PEM format
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	route, err := b.tlsRoute()
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
 
-	// Generate a CA certificate (self-signed)
-	caTemplate := x509.Certificate{
-		SerialNumber: big.NewInt(2),
-		Subject: pkix.Name{
-			Organization: []string{"Your CA Organization"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0), // Valid for 10 years
-		KeyUsage:              x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-	caBytes, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &privateKey.PublicKey, privateKey)
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(TLSRouteGVK)
+	err = b.Client.Get(ctx, types.NamespacedName{
+		Name:      b.Name,
+		Namespace: b.Namespace,
+	}, existing)
+
 	if err != nil {
-		return nil, nil, nil, err
+		if errors.IsNotFound(err) {
+
+			if err := b.Client.Create(ctx, route); err != nil {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	route.SetResourceVersion(existing.GetResourceVersion())
+	if err := b.Client.Update(ctx, route); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteTLSRoute removes the TLSRoute once buildkitd is no longer exposed through a Gateway.
+func (b *Buildkit) DeleteTLSRoute(ctx context.Context) error {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(TLSRouteGVK)
+	route.SetName(b.Name)
+	route.SetNamespace(b.Namespace)
+	if err := b.Client.Delete(ctx, route); err != nil && !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return err
+	}
+	return nil
+}
+
+// Endpoint returns the external address of buildkitd, or an empty string
+// while it is not exposed or the load balancer is still being provisioned.
+func (b *Buildkit) Endpoint(ctx context.Context) (string, error) {
+	mode := b.ExposeMode()
+	if mode == buildkitv1alpha1.ExposeClusterIP {
+		return "", nil
+	}
+	if mode == buildkitv1alpha1.ExposeTLSRoute {
+		port := int32(443)
+		if b.Expose.Gateway != nil && b.Expose.Gateway.Port != 0 {
+			port = b.Expose.Gateway.Port
+		}
+		return fmt.Sprintf("tcp://%s:%d", b.Expose.Hostname, port), nil
 	}
-	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes})
 
-	return certPEM, keyPEM, caPEM, nil
+	svc := &corev1.Service{}
+	if err := b.Client.Get(ctx, types.NamespacedName{
+		Name:      b.Name,
+		Namespace: b.Namespace,
+	}, svc); err != nil {
+		return "", err
+	}
+
+	port := int32(1234)
+	host := b.Expose.Hostname
+	if mode == buildkitv1alpha1.ExposeNodePort && len(svc.Spec.Ports) > 0 {
+		port = svc.Spec.Ports[0].NodePort
+	}
+	if host == "" && mode == buildkitv1alpha1.ExposeLoadBalancer {
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.Hostname != "" {
+				host = ingress.Hostname
+				break
+			}
+			if ingress.IP != "" {
+				host = ingress.IP
+				break
+			}
+		}
+	}
+	if host == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("tcp://%s:%d", host, port), nil
 }
@@ -0,0 +1,383 @@
+package buildkit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+func TestService(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cloud       buildkitv1alpha1.CloudProvider
+		expose      *buildkitv1alpha1.BuildkitExpose
+		typ         corev1.ServiceType
+		annotations map[string]string
+		ranges      []string
+	}{
+		"default": {
+			typ:         corev1.ServiceTypeClusterIP,
+			annotations: map[string]string{},
+		},
+		"node port": {
+			expose:      &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeNodePort, SourceRanges: []string{"10.0.0.0/8"}},
+			typ:         corev1.ServiceTypeNodePort,
+			annotations: map[string]string{},
+		},
+		"load balancer without cloud": {
+			cloud:       buildkitv1alpha1.CloudNone,
+			expose:      &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer, SourceRanges: []string{"10.0.0.0/8"}},
+			typ:         corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{},
+			ranges:      []string{"10.0.0.0/8"},
+		},
+		"load balancer on AWS": {
+			cloud:  buildkitv1alpha1.AWS,
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			typ:    corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{
+				"service.beta.kubernetes.io/aws-load-balancer-type":   "nlb",
+				"service.beta.kubernetes.io/aws-load-balancer-scheme": "internet-facing",
+			},
+		},
+		"load balancer with unset cloud is on AWS": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			typ:    corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{
+				"service.beta.kubernetes.io/aws-load-balancer-type":   "nlb",
+				"service.beta.kubernetes.io/aws-load-balancer-scheme": "internet-facing",
+			},
+		},
+		"load balancer on GCP with annotations": {
+			cloud: buildkitv1alpha1.GCP,
+			expose: &buildkitv1alpha1.BuildkitExpose{
+				Mode:        buildkitv1alpha1.ExposeLoadBalancer,
+				Annotations: map[string]string{"cloud.google.com/l4-rbs": "disabled", "team": "ci"},
+			},
+			typ:         corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{"cloud.google.com/l4-rbs": "disabled", "team": "ci"},
+		},
+		"cloud ignored for ClusterIP": {
+			cloud:       buildkitv1alpha1.AWS,
+			typ:         corev1.ServiceTypeClusterIP,
+			annotations: map[string]string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := &Buildkit{Name: "bk", Namespace: "ci", Cloud: tc.cloud, Expose: tc.expose}
+			svc, err := b.service()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.Spec.Type != tc.typ {
+				t.Errorf("type = %s, want %s", svc.Spec.Type, tc.typ)
+			}
+			if !reflect.DeepEqual(svc.Annotations, tc.annotations) {
+				t.Errorf("annotations = %v, want %v", svc.Annotations, tc.annotations)
+			}
+			if !reflect.DeepEqual(svc.Spec.LoadBalancerSourceRanges, tc.ranges) {
+				t.Errorf("source ranges = %v, want %v", svc.Spec.LoadBalancerSourceRanges, tc.ranges)
+			}
+		})
+	}
+}
+
+func TestHosts(t *testing.T) {
+	b := &Buildkit{Name: "bk", Namespace: "ci"}
+	want := []string{"bk", "bk.ci", "bk.ci.svc", "bk.ci.svc.cluster.local"}
+	if got := b.Hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Hosts() = %v, want %v", got, want)
+	}
+	b.Expose = &buildkitv1alpha1.BuildkitExpose{Hostname: "buildkit.example.com"}
+	if got := b.Hosts(); !reflect.DeepEqual(got, append(want, "buildkit.example.com")) {
+		t.Errorf("Hosts() = %v, want the hostname added", got)
+	}
+}
+
+func TestTLSRoute(t *testing.T) {
+	b := &Buildkit{Name: "bk", Namespace: "ci", Expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeTLSRoute}}
+	if _, err := b.tlsRoute(); err == nil {
+		t.Error("expected an error without a hostname")
+	}
+	b.Expose.Hostname = "buildkit.example.com"
+	if _, err := b.tlsRoute(); err == nil {
+		t.Error("expected an error without a gateway")
+	}
+
+	b.Expose.Gateway = &buildkitv1alpha1.GatewayReference{Name: "edge", Namespace: "gateways", SectionName: "tls", Port: 8443}
+	route, err := b.tlsRoute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	wantParent := map[string]interface{}{"name": "edge", "namespace": "gateways", "sectionName": "tls", "port": int64(8443)}
+	if len(parents) != 1 || !reflect.DeepEqual(parents[0], wantParent) {
+		t.Errorf("parentRefs = %v, want %v", parents, wantParent)
+	}
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	if !reflect.DeepEqual(hostnames, []string{"buildkit.example.com"}) {
+		t.Errorf("hostnames = %v", hostnames)
+	}
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	backend := rules[0].(map[string]interface{})["backendRefs"].([]interface{})[0]
+	if !reflect.DeepEqual(backend, map[string]interface{}{"name": "bk", "port": int64(1234)}) {
+		t.Errorf("backendRefs = %v", backend)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for name, tc := range map[string]struct {
+		expose *buildkitv1alpha1.BuildkitExpose
+		svc    corev1.Service
+		want   string
+	}{
+		"cluster IP": {
+			want: "",
+		},
+		"node port": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeNodePort, Hostname: "nodes.example.com"},
+			svc:    corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 1234, NodePort: 31234}}}},
+			want:   "tcp://nodes.example.com:31234",
+		},
+		"node port without hostname": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeNodePort},
+			svc:    corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 1234, NodePort: 31234}}}},
+			want:   "",
+		},
+		"load balancer pending": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			want:   "",
+		},
+		"load balancer hostname": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			svc: corev1.Service{Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}},
+			}}},
+			want: "tcp://lb.example.com:1234",
+		},
+		"load balancer IP": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			svc: corev1.Service{Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "203.0.113.7"}},
+			}}},
+			want: "tcp://203.0.113.7:1234",
+		},
+		"TLS route": {
+			expose: &buildkitv1alpha1.BuildkitExpose{
+				Mode:     buildkitv1alpha1.ExposeTLSRoute,
+				Hostname: "buildkit.example.com",
+				Gateway:  &buildkitv1alpha1.GatewayReference{Name: "edge"},
+			},
+			want: "tcp://buildkit.example.com:443",
+		},
+		"TLS route listener port": {
+			expose: &buildkitv1alpha1.BuildkitExpose{
+				Mode:     buildkitv1alpha1.ExposeTLSRoute,
+				Hostname: "buildkit.example.com",
+				Gateway:  &buildkitv1alpha1.GatewayReference{Name: "edge", Port: 8443},
+			},
+			want: "tcp://buildkit.example.com:8443",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			svc := tc.svc
+			svc.Name, svc.Namespace = "bk", "ci"
+			c := fake.NewClientBuilder().WithObjects(&svc).WithStatusSubresource(&svc).Build()
+			if err := c.Status().Update(context.Background(), &svc); err != nil {
+				t.Fatal(err)
+			}
+			b := &Buildkit{Name: "bk", Namespace: "ci", Expose: tc.expose, Client: c}
+			got, err := b.Endpoint(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("Endpoint() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// peer is a NetworkPolicy peer flattened for comparison.
+type peer struct {
+	namespaces []string
+	pods       string
+	cidr       string
+}
+
+func TestNetworkPolicyPeers(t *testing.T) {
+	router := peer{namespaces: []string{"ci"}, pods: "service=buildkit-router"}
+	for name, tc := range map[string]struct {
+		b    Buildkit
+		want []peer
+	}{
+		"router only": {
+			b:    Buildkit{Access: &buildkitv1alpha1.BuildkitAccess{}},
+			want: []peer{router},
+		},
+		"router namespace": {
+			b: Buildkit{Access: &buildkitv1alpha1.BuildkitAccess{RouterNamespace: "routing"}},
+			want: []peer{
+				{namespaces: []string{"routing"}, pods: "service=buildkit-router"},
+			},
+		},
+		"access": {
+			b: Buildkit{Access: &buildkitv1alpha1.BuildkitAccess{
+				Namespaces:   []string{"dev", "prod"},
+				PodSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{"role": "client"}}},
+			}},
+			want: []peer{
+				router,
+				{namespaces: []string{"dev", "prod"}},
+				{pods: "role=client"},
+			},
+		},
+		"linked agents": {
+			b: Buildkit{
+				Access:          &buildkitv1alpha1.BuildkitAccess{},
+				AgentNamespaces: []string{"agents"},
+			},
+			want: []peer{
+				router,
+				{namespaces: []string{"agents"}, pods: LinkLabel + "=bk"},
+				{namespaces: []string{"agents"}, pods: JobLabel},
+			},
+		},
+		"source ranges": {
+			b: Buildkit{
+				Access: &buildkitv1alpha1.BuildkitAccess{},
+				Expose: &buildkitv1alpha1.BuildkitExpose{
+					Mode:         buildkitv1alpha1.ExposeLoadBalancer,
+					SourceRanges: []string{"10.0.0.0/8"},
+				},
+			},
+			want: []peer{router, {cidr: "10.0.0.0/8"}},
+		},
+		"node port source ranges": {
+			b: Buildkit{
+				Access: &buildkitv1alpha1.BuildkitAccess{},
+				Expose: &buildkitv1alpha1.BuildkitExpose{
+					Mode:         buildkitv1alpha1.ExposeNodePort,
+					SourceRanges: []string{"192.168.0.0/16"},
+				},
+			},
+			want: []peer{router, {cidr: "192.168.0.0/16"}},
+		},
+		"gateway for TLSRoute": {
+			b: Buildkit{
+				Access: &buildkitv1alpha1.BuildkitAccess{},
+				Expose: &buildkitv1alpha1.BuildkitExpose{
+					Mode:         buildkitv1alpha1.ExposeTLSRoute,
+					SourceRanges: []string{"10.0.0.0/8"},
+					Gateway:      &buildkitv1alpha1.GatewayReference{Name: "public", Namespace: "gateways"},
+				},
+			},
+			want: []peer{router, {namespaces: []string{"gateways"}, pods: GatewayNameLabel + "=public"}},
+		},
+		"gateway pods": {
+			b: Buildkit{
+				Access: &buildkitv1alpha1.BuildkitAccess{},
+				Expose: &buildkitv1alpha1.BuildkitExpose{
+					Mode: buildkitv1alpha1.ExposeTLSRoute,
+					Gateway: &buildkitv1alpha1.GatewayReference{
+						Name:         "public",
+						PodNamespace: "envoy-gateway-system",
+						PodSelector:  &metav1.LabelSelector{MatchLabels: map[string]string{"app": "envoy"}},
+					},
+				},
+			},
+			want: []peer{router, {namespaces: []string{"envoy-gateway-system"}, pods: "app=envoy"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.b.Name, tc.b.Namespace = "bk", "ci"
+			np, err := tc.b.networkPolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []peer{}
+			for _, from := range np.Spec.Ingress[0].From {
+				p := peer{}
+				if from.NamespaceSelector != nil {
+					if len(from.NamespaceSelector.MatchLabels) > 0 || len(from.NamespaceSelector.MatchExpressions) != 1 {
+						t.Fatalf("namespace selector does not name namespaces: %+v", from.NamespaceSelector)
+					}
+					p.namespaces = from.NamespaceSelector.MatchExpressions[0].Values
+				}
+				if from.PodSelector != nil {
+					p.pods = metav1.FormatLabelSelector(from.PodSelector)
+				}
+				if from.IPBlock != nil {
+					p.cidr = from.IPBlock.CIDR
+				}
+				got = append(got, p)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("peers = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAccessExposeModes(t *testing.T) {
+	for name, tc := range map[string]struct {
+		expose  *buildkitv1alpha1.BuildkitExpose
+		policy  corev1.ServiceExternalTrafficPolicy
+		invalid bool
+	}{
+		"cluster IP": {},
+		"node port": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeNodePort, SourceRanges: []string{"10.0.0.0/8"}},
+			policy: corev1.ServiceExternalTrafficPolicyLocal,
+		},
+		"node port without source ranges": {
+			expose:  &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeNodePort},
+			policy:  corev1.ServiceExternalTrafficPolicyLocal,
+			invalid: true,
+		},
+		"load balancer": {
+			expose: &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer, SourceRanges: []string{"10.0.0.0/8"}},
+			policy: corev1.ServiceExternalTrafficPolicyLocal,
+		},
+		"load balancer without source ranges": {
+			expose:  &buildkitv1alpha1.BuildkitExpose{Mode: buildkitv1alpha1.ExposeLoadBalancer},
+			policy:  corev1.ServiceExternalTrafficPolicyLocal,
+			invalid: true,
+		},
+		"TLS route": {
+			expose: &buildkitv1alpha1.BuildkitExpose{
+				Mode:     buildkitv1alpha1.ExposeTLSRoute,
+				Hostname: "buildkit.example.com",
+				Gateway:  &buildkitv1alpha1.GatewayReference{Name: "public"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := &Buildkit{Name: "bk", Namespace: "ci", Access: &buildkitv1alpha1.BuildkitAccess{}, Expose: tc.expose}
+			svc, err := b.service()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.Spec.ExternalTrafficPolicy != tc.policy {
+				t.Errorf("external traffic policy = %q, want %q", svc.Spec.ExternalTrafficPolicy, tc.policy)
+			}
+			if _, err := b.Manifests(); (err != nil) != tc.invalid {
+				t.Errorf("Manifests() error = %v, invalid %v", err, tc.invalid)
+			}
+
+			b.Access = nil
+			if svc, _ := b.service(); svc.Spec.ExternalTrafficPolicy != "" {
+				t.Errorf("external traffic policy set without access: %q", svc.Spec.ExternalTrafficPolicy)
+			}
+			if _, err := b.Manifests(); err != nil {
+				t.Errorf("Manifests() without access: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	caCertKey = "ca.pem"
+	caKeyKey  = "ca-key.pem"
+
+	// hostsAnnotation records the SANs of the issued server certificate.
+	hostsAnnotation = "thecops.dev/hosts"
+
+	// RenewBefore is how long before they expire leaf certificates are
+	// reissued.
+	RenewBefore = 30 * 24 * time.Hour
+)
+
+// leafValidity is the lifetime of the server and client certificates.
+var leafValidity = 365 * 24 * time.Hour
+
+// authority is the per Buildkit CA that signs the buildkitd server
+// certificate and the client certificates of linked agents.
+type authority struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// CASecretName is the name of the Secret holding the CA of the Buildkit.
+func (b *Buildkit) CASecretName() string {
+	return b.Name + "-ca"
+}
+
+// authority loads the CA of the Buildkit, creating it when create is set.
+func (b *Buildkit) authority(ctx context.Context, create bool) (*authority, error) {
+	secret := &corev1.Secret{}
+	err := b.Client.Get(ctx, types.NamespacedName{
+		Name:      b.CASecretName(),
+		Namespace: b.Namespace,
+	}, secret)
+	if err == nil {
+		return parseAuthority(secret.Data)
+	}
+	if !errors.IsNotFound(err) || !create {
+		return nil, err
+	}
+
+	ca, keyPEM, err := newAuthority(b.Name)
+	if err != nil {
+		return nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.CASecretName(),
+			Namespace: b.Namespace,
+			Labels: map[string]string{
+				"app": b.Name,
+			},
+			Annotations: map[string]string{},
+		},
+		Data: map[string][]byte{
+			caCertKey: ca.certPEM,
+			caKeyKey:  keyPEM,
+		},
+	}
+	if err := b.Client.Create(ctx, secret); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// IssueClientCert signs a client certificate for commonName with the CA of
+// the named Buildkit. The returned data uses the buildctl --tlsdir layout.
+func IssueClientCert(ctx context.Context, c client.Client, name, namespace, commonName string) (map[string][]byte, error) {
+	b := &Buildkit{Name: name, Namespace: namespace, Client: c}
+	ca, err := b.authority(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := ca.issue(commonName, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"ca.pem":   ca.certPEM,
+		"cert.pem": certPEM,
+		"key.pem":  keyPEM,
+	}, nil
+}
+
+// CACert returns the PEM encoded CA certificate of the named Buildkit.
+func CACert(ctx context.Context, c client.Client, name, namespace string) ([]byte, error) {
+	b := &Buildkit{Name: name, Namespace: namespace, Client: c}
+	ca, err := b.authority(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return ca.certPEM, nil
+}
+
+func newAuthority(name string) (*authority, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: fmt.Sprintf("%s buildkit CA", name),
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0), // Valid for 10 years
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &authority{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+func parseAuthority(data map[string][]byte) (*authority, error) {
+	certBlock, _ := pem.Decode(data[caCertKey])
+	keyBlock, _ := pem.Decode(data[caKeyKey])
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("CA secret is missing %s or %s", caCertKey, caKeyKey)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &authority{cert: cert, key: key, certPEM: data[caCertKey]}, nil
+}
+
+// RenewalTime returns when the PEM encoded certificate is due for renewal.
+// A certificate that does not parse is due right away.
+func RenewalTime(certPEM []byte) time.Time {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter.Add(-RenewBefore)
+}
+
+// issue signs a leaf certificate valid for leafValidity for the given hosts.
+func (a *authority) issue(commonName string, hosts []string, usage x509.ExtKeyUsage) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(leafValidity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,111 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAuthorityIssuesVerifiableCertificates(t *testing.T) {
+	ca, keyPEM, err := newAuthority("bk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = parseAuthority(map[string][]byte{caCertKey: ca.certPEM, caKeyKey: keyPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	b := &Buildkit{Name: "bk", Namespace: "ci"}
+	serverPEM, _, err := ca.issue(b.Name, b.Hosts(), x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := parseCert(t, serverPEM)
+	if _, err := server.Verify(x509.VerifyOptions{Roots: roots, DNSName: "bk.ci.svc"}); err != nil {
+		t.Errorf("server certificate does not verify: %v", err)
+	}
+
+	clientPEM, _, err := ca.issue("agent.ci", nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := parseCert(t, clientPEM)
+	if _, err := client.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("client certificate does not verify: %v", err)
+	}
+}
+
+func TestServerCertificateRenewal(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	b := New(&buildkitv1alpha1.Buildkit{ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "ci"}}, c)
+	serverCert := func() []byte {
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Name: "bk", Namespace: "ci"}, secret); err != nil {
+			t.Fatal(err)
+		}
+		return secret.Data["cert.pem"]
+	}
+
+	// A certificate issued for less than RenewBefore is due right away.
+	defer func(v time.Duration) { leafValidity = v }(leafValidity)
+	leafValidity = 10 * 24 * time.Hour
+	renewAt, err := b.CreateOrUpdateSecret(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewAt.Before(time.Now()) {
+		t.Errorf("certificate expiring in 10 days is due at %v", renewAt)
+	}
+	expiring := serverCert()
+
+	leafValidity = 365 * 24 * time.Hour
+	renewAt, err = b.CreateOrUpdateSecret(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := serverCert()
+	if bytes.Equal(renewed, expiring) {
+		t.Fatal("expiring certificate was not reissued")
+	}
+	if want := parseCert(t, renewed).NotAfter.Add(-RenewBefore); !renewAt.Equal(want) {
+		t.Errorf("renewal at %v, want %v", renewAt, want)
+	}
+
+	if _, err := b.CreateOrUpdateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverCert(), renewed) {
+		t.Error("certificate not due for renewal was reissued")
+	}
+}
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
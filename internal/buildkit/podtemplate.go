@@ -0,0 +1,148 @@
+package buildkit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// mergePodTemplate strategically merges override onto base and then restores
+// the fields the operator owns: the selector labels and annotations, the
+// certs and state volumes, the image, command, args, ports, mounts, probes and
+// security context of the named container and the security settings of the
+// pod, so a template cannot weaken the rootful or rootless profile.
+// Containers added by the template may not be privileged unless the named
+// container is.
+func mergePodTemplate(base corev1.PodTemplateSpec, override *corev1.PodTemplateSpec, container string) (corev1.PodTemplateSpec, error) {
+	if override == nil {
+		return base, nil
+	}
+
+	original, err := json.Marshal(base)
+	if err != nil {
+		return base, err
+	}
+	patch, err := patchFor(override)
+	if err != nil {
+		return base, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return base, err
+	}
+	out := corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(merged, &out); err != nil {
+		return base, err
+	}
+
+	if out.Labels == nil {
+		out.Labels = map[string]string{}
+	}
+	for k, v := range base.Labels {
+		out.Labels[k] = v
+	}
+	if len(base.Annotations) > 0 && out.Annotations == nil {
+		out.Annotations = map[string]string{}
+	}
+	for k, v := range base.Annotations {
+		out.Annotations[k] = v
+	}
+	out.Spec.SecurityContext = base.Spec.SecurityContext
+	out.Spec.HostUsers = base.Spec.HostUsers
+	out.Spec.HostNetwork = base.Spec.HostNetwork
+	out.Spec.HostPID = base.Spec.HostPID
+	out.Spec.HostIPC = base.Spec.HostIPC
+
+	owned := map[string]corev1.Volume{}
+	for _, v := range base.Spec.Volumes {
+		owned[v.Name] = v
+	}
+	for i, v := range out.Spec.Volumes {
+		if o, ok := owned[v.Name]; ok {
+			out.Spec.Volumes[i] = o
+		}
+	}
+
+	for _, c := range base.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		for i := range out.Spec.Containers {
+			if out.Spec.Containers[i].Name != container {
+				continue
+			}
+			out.Spec.Containers[i].Image = c.Image
+			out.Spec.Containers[i].Command = c.Command
+			out.Spec.Containers[i].Args = c.Args
+			out.Spec.Containers[i].Ports = c.Ports
+			out.Spec.Containers[i].VolumeMounts = ownedMounts(c.VolumeMounts, out.Spec.Containers[i].VolumeMounts)
+			out.Spec.Containers[i].SecurityContext = c.SecurityContext
+			out.Spec.Containers[i].LivenessProbe = c.LivenessProbe
+			out.Spec.Containers[i].ReadinessProbe = c.ReadinessProbe
+		}
+		if !privileged(c.SecurityContext) {
+			for _, added := range append(append([]corev1.Container{}, out.Spec.InitContainers...), out.Spec.Containers...) {
+				if added.Name != container && privileged(added.SecurityContext) {
+					return base, fmt.Errorf("pod_template container %q may not be privileged", added.Name)
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func privileged(sc *corev1.SecurityContext) bool {
+	return sc != nil && sc.Privileged != nil && *sc.Privileged
+}
+
+// ownedMounts keeps the operator mounts as generated and appends any extra
+// mounts from the override.
+func ownedMounts(owned, merged []corev1.VolumeMount) []corev1.VolumeMount {
+	names := map[string]bool{}
+	mounts := append([]corev1.VolumeMount{}, owned...)
+	for _, m := range owned {
+		names[m.Name] = true
+	}
+	for _, m := range merged {
+		if !names[m.Name] {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts
+}
+
+// patchFor serializes override as a strategic merge patch. Fields that are
+// null in the serialized form, such as an unset containers list, would
+// delete the generated values, so they are dropped.
+func patchFor(override *corev1.PodTemplateSpec) ([]byte, error) {
+	raw, err := json.Marshal(override)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, err
+	}
+	dropNulls(patch)
+	return json.Marshal(patch)
+}
+
+func dropNulls(m map[string]interface{}) {
+	for k, v := range m {
+		switch val := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			dropNulls(val)
+		case []interface{}:
+			for _, item := range val {
+				if child, ok := item.(map[string]interface{}); ok {
+					dropNulls(child)
+				}
+			}
+		}
+	}
+}
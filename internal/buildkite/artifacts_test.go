@@ -0,0 +1,86 @@
+package buildkite
+
+import (
+	"strings"
+	"testing"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestArtifactsConfig(t *testing.T) {
+	instance := &buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			Secret:          "agent-token",
+			PluginAllowlist: []string{"^docker#"},
+			Artifacts: &buildkitv1alpha1.BuildkiteArtifacts{
+				Bucket:            "artifacts",
+				Prefix:            "/ci/",
+				Region:            "us-east-1",
+				Endpoint:          "http://minio.storage.svc:9000",
+				PathStyle:         true,
+				CredentialsSecret: "minio-credentials",
+			},
+		},
+	}
+	config, _, err := New(instance, nil).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := agentConfig{}
+	if err := yaml.Unmarshal([]byte(config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, e := range cfg.DefaultCommandParams.Env {
+		env[e.Name] = e.Value
+		if e.ValueFrom != nil {
+			env[e.Name] = e.ValueFrom.SecretKeyRef.Name + "/" + e.ValueFrom.SecretKeyRef.Key
+		}
+	}
+	want := map[string]string{
+		"BUILDKITE_ALLOWED_PLUGINS":             "^docker#",
+		"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION": "s3://artifacts/ci",
+		"BUILDKITE_S3_DEFAULT_REGION":           "us-east-1",
+		"BUILDKITE_S3_ENDPOINT":                 "http://minio.storage.svc:9000",
+		"BUILDKITE_S3_FORCE_PATH_STYLE":         "true",
+		"BUILDKITE_S3_ACCESS_KEY_ID":            "minio-credentials/AWS_ACCESS_KEY_ID",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY":        "minio-credentials/AWS_SECRET_ACCESS_KEY",
+	}
+	for name, value := range want {
+		if env[name] != value {
+			t.Errorf("%s: got %q, want %q", name, env[name], value)
+		}
+	}
+	if len(env) != len(want) {
+		t.Errorf("unexpected env %v", env)
+	}
+	if n := strings.Count(config, "BUILDKITE_S3_ENDPOINT"); n != 1 {
+		t.Errorf("the artifact env belongs to the command containers only, got it %d times:\n%s", n, config)
+	}
+
+	if got := ArtifactUploadDestination(&buildkitv1alpha1.BuildkiteArtifacts{Bucket: "b"}); got != "s3://b" {
+		t.Errorf("destination without prefix: %q", got)
+	}
+}
+
+func TestArtifactsValidation(t *testing.T) {
+	for _, a := range []buildkitv1alpha1.BuildkiteArtifacts{
+		{},
+		{Bucket: "artifacts/ci"},
+		{Bucket: "artifacts", Endpoint: "minio:9000"},
+		{Bucket: "artifacts", Endpoint: "ftp://minio:9000"},
+	} {
+		a := a
+		instance := &buildkitv1alpha1.Buildkite{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+			Spec:       buildkitv1alpha1.BuildkiteSpec{Secret: "agent-token", Artifacts: &a},
+		}
+		if _, _, err := New(instance, nil).config(); err == nil {
+			t.Errorf("%+v: expected an error", a)
+		}
+	}
+}
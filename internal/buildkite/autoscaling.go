@@ -0,0 +1,249 @@
+package buildkite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+)
+
+const (
+	// DefaultAutoscalingCoolDown delays lowering the capacity after a change.
+	DefaultAutoscalingCoolDown = 5 * time.Minute
+
+	// DefaultAutoscalingInterval is how often the agent metrics are read.
+	DefaultAutoscalingInterval = 30 * time.Second
+
+	// warmPoolImage is the container the warm pool pods idle in once the
+	// job images are pulled.
+	warmPoolImage = "registry.k8s.io/pause:3.9"
+
+	// warmPoolToolsImage provides the static no-op binary the job images run
+	// once pulled, they may have no shell, e.g. distroless ones. Busybox
+	// runs the applet named by its file name.
+	warmPoolToolsImage = "busybox:1.36-musl"
+
+	warmPoolToolsDir = "/warm"
+)
+
+// AutoscalingTarget returns what the autoscaler scales.
+func AutoscalingTarget(a *buildkitv1alpha1.BuildkiteAutoscaling) string {
+	if a.Target == "" {
+		return buildkitv1alpha1.AutoscalingMaxInFlight
+	}
+	return a.Target
+}
+
+// AutoscalingInterval returns how often the agent metrics are read.
+func AutoscalingInterval(a *buildkitv1alpha1.BuildkiteAutoscaling) time.Duration {
+	if a.Interval.Duration > 0 {
+		return a.Interval.Duration
+	}
+	return DefaultAutoscalingInterval
+}
+
+func autoscalingCoolDown(a *buildkitv1alpha1.BuildkiteAutoscaling) time.Duration {
+	if a.CoolDown.Duration > 0 {
+		return a.CoolDown.Duration
+	}
+	return DefaultAutoscalingCoolDown
+}
+
+// minCapacity is the lower bound of the capacity. max_in_flight 0 means
+// unlimited, so it never goes below 1.
+func minCapacity(a *buildkitv1alpha1.BuildkiteAutoscaling) int32 {
+	if a.Min < 1 && AutoscalingTarget(a) == buildkitv1alpha1.AutoscalingMaxInFlight {
+		return 1
+	}
+	return a.Min
+}
+
+func validateAutoscaling(a *buildkitv1alpha1.BuildkiteAutoscaling) error {
+	if a == nil {
+		return nil
+	}
+	switch AutoscalingTarget(a) {
+	case buildkitv1alpha1.AutoscalingMaxInFlight, buildkitv1alpha1.AutoscalingWarmPool:
+	default:
+		return fmt.Errorf("autoscaling target %q is not max_in_flight or warm_pool", a.Target)
+	}
+	if a.Max < 1 {
+		return fmt.Errorf("autoscaling max must be at least 1, got %d", a.Max)
+	}
+	if a.Min < 0 || a.Min > a.Max {
+		return fmt.Errorf("autoscaling min must be between 0 and max %d, got %d", a.Max, a.Min)
+	}
+	return nil
+}
+
+// DesiredCapacity returns the capacity the queue jobs call for, within the
+// bounds. max_in_flight covers the scheduled and running jobs, the warm pool
+// only the scheduled ones since running jobs already have their pod.
+func DesiredCapacity(a *buildkitv1alpha1.BuildkiteAutoscaling, jobs agentmetrics.QueueJobs) int32 {
+	desired := jobs.Scheduled
+	if AutoscalingTarget(a) == buildkitv1alpha1.AutoscalingMaxInFlight {
+		desired += jobs.Running
+	}
+	if low := minCapacity(a); desired < low {
+		desired = low
+	}
+	if desired > a.Max {
+		desired = a.Max
+	}
+	return desired
+}
+
+// Scale returns the capacity to apply for desired given the last decision in
+// status. The capacity is raised at once but only lowered once the cool-down
+// since the last change has passed. changed reports whether it differs from
+// status.
+func Scale(a *buildkitv1alpha1.BuildkiteAutoscaling, status *buildkitv1alpha1.BuildkiteAutoscalingStatus, desired int32, now time.Time) (capacity int32, changed bool) {
+	if status == nil {
+		return desired, true
+	}
+	current := status.Desired
+	if desired < current && status.LastScaleTime != nil && now.Sub(status.LastScaleTime.Time) < autoscalingCoolDown(a) {
+		desired = current
+	}
+	return desired, desired != current
+}
+
+// capacity is the capacity applied to the target: the last decision of the
+// autoscaler, or the lower bound until it made one.
+func (b *Buildkite) capacity() int32 {
+	if b.AutoscalingStatus != nil {
+		return b.AutoscalingStatus.Desired
+	}
+	return minCapacity(b.Autoscaling)
+}
+
+func (b *Buildkite) warmPoolEnabled() bool {
+	return b.Autoscaling != nil && AutoscalingTarget(b.Autoscaling) == buildkitv1alpha1.AutoscalingWarmPool
+}
+
+func (b *Buildkite) warmPoolName() string {
+	return b.Name + "-warm-pool"
+}
+
+// warmPool is a Deployment of idle pods whose init containers pull the job
+// images, so that job pods start without waiting for the pull.
+func (b *Buildkite) warmPool() *appsv1.Deployment {
+	labels := map[string]string{
+		"app":     b.Name,
+		"service": "buildkite-warm-pool",
+	}
+
+	images := b.Autoscaling.WarmPoolImages
+	if len(images) == 0 && b.Agent.Image != "" {
+		images = []string{b.Agent.Image}
+	}
+
+	var t, f = true, false
+	sc := corev1.SecurityContext{
+		AllowPrivilegeEscalation: &f,
+		RunAsNonRoot:             &t,
+		RunAsUser:                &[]int64{65532}[0],
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1m"),
+			corev1.ResourceMemory: resource.MustParse("8Mi"),
+		},
+	}
+
+	tools := []corev1.VolumeMount{{Name: "warm", MountPath: warmPoolToolsDir}}
+	initContainers := make([]corev1.Container, 0, len(images)+1)
+	initContainers = append(initContainers, corev1.Container{
+		Name:            "tools",
+		Image:           warmPoolToolsImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"cp", "/bin/true", warmPoolToolsDir + "/true"},
+		Resources:       resources,
+		SecurityContext: &sc,
+		VolumeMounts:    tools,
+	})
+	for i, image := range images {
+		initContainers = append(initContainers, corev1.Container{
+			Name:            fmt.Sprintf("pull-%d", i),
+			Image:           image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{warmPoolToolsDir + "/true"},
+			Resources:       resources,
+			SecurityContext: &sc,
+			VolumeMounts:    tools,
+		})
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.warmPoolName(),
+			Namespace: b.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &[]int32{b.capacity()}[0],
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					AutomountServiceAccountToken: &f,
+					InitContainers:               initContainers,
+					Volumes: []corev1.Volume{{
+						Name:         "warm",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+					}},
+					Containers: []corev1.Container{
+						{
+							Name:            "idle",
+							Image:           warmPoolImage,
+							Resources:       resources,
+							SecurityContext: &sc,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// CreateOrUpdateWarmPool applies the warm pool Deployment when the autoscaler
+// targets it and removes it otherwise.
+func (b *Buildkite) CreateOrUpdateWarmPool(ctx context.Context) error {
+	key := types.NamespacedName{Name: b.warmPoolName(), Namespace: b.Namespace}
+	if !b.warmPoolEnabled() {
+		existing := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+		if err := b.Client.Delete(ctx, existing); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	deployment := b.warmPool()
+	err := b.Client.Get(ctx, key, &appsv1.Deployment{})
+	if errors.IsNotFound(err) {
+		return b.Client.Create(ctx, deployment)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Client.Update(ctx, deployment)
+}
@@ -0,0 +1,130 @@
+package buildkite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDesiredCapacity(t *testing.T) {
+	jobs := agentmetrics.QueueJobs{Scheduled: 3, Running: 4}
+	cases := []struct {
+		autoscaling buildkitv1alpha1.BuildkiteAutoscaling
+		jobs        agentmetrics.QueueJobs
+		want        int32
+	}{
+		{buildkitv1alpha1.BuildkiteAutoscaling{Max: 10}, jobs, 7},
+		{buildkitv1alpha1.BuildkiteAutoscaling{Max: 5}, jobs, 5},
+		{buildkitv1alpha1.BuildkiteAutoscaling{Max: 5}, agentmetrics.QueueJobs{}, 1},
+		{buildkitv1alpha1.BuildkiteAutoscaling{Target: "warm_pool", Max: 10}, jobs, 3},
+		{buildkitv1alpha1.BuildkiteAutoscaling{Target: "warm_pool", Max: 10}, agentmetrics.QueueJobs{}, 0},
+		{buildkitv1alpha1.BuildkiteAutoscaling{Target: "warm_pool", Min: 2, Max: 10}, agentmetrics.QueueJobs{}, 2},
+	}
+	for i, c := range cases {
+		if got := DesiredCapacity(&c.autoscaling, c.jobs); got != c.want {
+			t.Errorf("case %d: got %d, want %d", i, got, c.want)
+		}
+	}
+}
+
+func TestScaleCoolDown(t *testing.T) {
+	a := &buildkitv1alpha1.BuildkiteAutoscaling{Max: 10, CoolDown: metav1.Duration{Duration: 5 * time.Minute}}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	if got, changed := Scale(a, nil, 4, now); got != 4 || !changed {
+		t.Errorf("first decision: got %d %v", got, changed)
+	}
+
+	scaled := metav1.NewTime(now.Add(-time.Minute))
+	status := &buildkitv1alpha1.BuildkiteAutoscalingStatus{Desired: 4, LastScaleTime: &scaled}
+	if got, changed := Scale(a, status, 8, now); got != 8 || !changed {
+		t.Errorf("scale up must not wait: got %d %v", got, changed)
+	}
+	if got, changed := Scale(a, status, 2, now); got != 4 || changed {
+		t.Errorf("scale down within the cool-down: got %d %v", got, changed)
+	}
+	if got, changed := Scale(a, status, 2, now.Add(5*time.Minute)); got != 2 || !changed {
+		t.Errorf("scale down after the cool-down: got %d %v", got, changed)
+	}
+}
+
+func TestAutoscalingMaxInFlight(t *testing.T) {
+	instance := &buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			Secret:      "agent-token",
+			Agent:       buildkitv1alpha1.BuildkiteAgentConfig{MaxInFlight: 50},
+			Autoscaling: &buildkitv1alpha1.BuildkiteAutoscaling{Min: 2, Max: 10},
+		},
+	}
+	config, _, err := New(instance, nil).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "max-in-flight: 2\n") {
+		t.Errorf("expected the lower bound before the first decision:\n%s", config)
+	}
+
+	instance.Status.Autoscaling = &buildkitv1alpha1.BuildkiteAutoscalingStatus{Desired: 7}
+	config, _, err = New(instance, nil).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "max-in-flight: 7\n") {
+		t.Errorf("expected the decided capacity:\n%s", config)
+	}
+
+	instance.Spec.Autoscaling.Min = 11
+	if _, _, err := New(instance, nil).config(); err == nil {
+		t.Error("min above max must be rejected")
+	}
+}
+
+func TestAutoscalingWarmPool(t *testing.T) {
+	instance := &buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			Secret:      "agent-token",
+			Agent:       buildkitv1alpha1.BuildkiteAgentConfig{Image: "buildkite/agent:3", MaxInFlight: 50},
+			Autoscaling: &buildkitv1alpha1.BuildkiteAutoscaling{Target: "warm_pool", Max: 10},
+		},
+		Status: buildkitv1alpha1.BuildkiteStatus{
+			Autoscaling: &buildkitv1alpha1.BuildkiteAutoscalingStatus{Desired: 3},
+		},
+	}
+	objects, err := New(instance, nil).Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, ok := objects[len(objects)-1].(*appsv1.Deployment)
+	if !ok || pool.Name != "agent-warm-pool" {
+		t.Fatalf("expected the warm pool last, got %T %s", objects[len(objects)-1], objects[len(objects)-1].GetName())
+	}
+	if *pool.Spec.Replicas != 3 {
+		t.Errorf("warm pool replicas: got %d", *pool.Spec.Replicas)
+	}
+	pulls := pool.Spec.Template.Spec.InitContainers
+	if len(pulls) != 2 || pulls[1].Image != "buildkite/agent:3" {
+		t.Fatalf("warm pool must pull the agent image, got %+v", pulls)
+	}
+	// The job image may have no shell, it runs the binary copied by the
+	// first init container.
+	if !reflect.DeepEqual(pulls[1].Command, []string{"/warm/true"}) || pulls[0].VolumeMounts[0].MountPath != "/warm" {
+		t.Errorf("job image must run the copied no-op, got %v", pulls[1].Command)
+	}
+
+	config, _, err := New(instance, nil).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "max-in-flight: 50\n") {
+		t.Errorf("the warm pool must leave max_in_flight alone:\n%s", config)
+	}
+}
@@ -2,6 +2,9 @@ package buildkite
 
 import (
 	"context"
+	"fmt"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
 
 	rbacv1 "k8s.io/api/rbac/v1"
 
@@ -14,16 +17,133 @@ import (
 )
 
 type Buildkite struct {
-	Name         string
-	Namespace    string
-	Labels       map[string]string
-	Image        string
-	Secret       string
-	NodeSelector map[string]string
-	Resource     corev1.ResourceRequirements
+	Name          string
+	Namespace     string
+	Labels        map[string]string
+	Image         string
+	Secret        string
+	GitSecret     string
+	GitKnownHosts []string
+	NodeSelector  map[string]string
+	Resource      corev1.ResourceRequirements
+	Agent         buildkitv1alpha1.BuildkiteAgentConfig
+	BuildkitRef   *buildkitv1alpha1.BuildkitReference
+	RBAC          buildkitv1alpha1.BuildkiteRBAC
+	// Autoscaling and AutoscalingStatus drive max_in_flight or the warm pool
+	Autoscaling       *buildkitv1alpha1.BuildkiteAutoscaling
+	AutoscalingStatus *buildkitv1alpha1.BuildkiteAutoscalingStatus
+	ManagedToken      *buildkitv1alpha1.BuildkiteManagedToken
+	// AgentTokenID is the managed agent token the controller pods run with
+	AgentTokenID    string
+	Hooks           *buildkitv1alpha1.BuildkiteHooks
+	PluginAllowlist []string
+	Pools           []buildkitv1alpha1.BuildkitePool
+	JobTemplate     *buildkitv1alpha1.BuildkiteJobTemplate
+	Artifacts       *buildkitv1alpha1.BuildkiteArtifacts
+	// ClusterScopeAllowed lets RBAC.ClusterScoped grant the rules through a
+	// ClusterRole, it is decided by the operator and not the resource
+	ClusterScopeAllowed bool
+	// pool is the pool rendered by a Buildkite returned from Stacks
+	pool *buildkitv1alpha1.BuildkitePool
 	client.Client
 }
 
+// New builds a Buildkite from the given custom resource. With autoscaling
+// of max_in_flight, the capacity decided by the autoscaler replaces
+// agent.max_in_flight, and a managed token replaces agent.token_secret.
+func New(instance *buildkitv1alpha1.Buildkite, c client.Client) *Buildkite {
+	b := &Buildkite{
+		Name:              instance.Name,
+		Namespace:         instance.Namespace,
+		Labels:            map[string]string{},
+		NodeSelector:      map[string]string{},
+		Image:             instance.Spec.Image,
+		Secret:            instance.Spec.Secret,
+		GitSecret:         instance.Spec.GitSecret,
+		GitKnownHosts:     instance.Spec.GitKnownHosts,
+		Resource:          instance.Spec.Resources,
+		Agent:             instance.Spec.Agent,
+		BuildkitRef:       instance.Spec.BuildkitRef,
+		RBAC:              instance.Spec.RBAC,
+		Autoscaling:       instance.Spec.Autoscaling,
+		AutoscalingStatus: instance.Status.Autoscaling,
+		Hooks:             instance.Spec.Hooks,
+		PluginAllowlist:   instance.Spec.PluginAllowlist,
+		Pools:             instance.Spec.Pools,
+		JobTemplate:       instance.Spec.JobTemplate,
+		Artifacts:         instance.Spec.Artifacts,
+		Client:            c,
+	}
+	if b.Autoscaling != nil && AutoscalingTarget(b.Autoscaling) == buildkitv1alpha1.AutoscalingMaxInFlight {
+		b.Agent.MaxInFlight = int(b.capacity())
+	}
+	if instance.Spec.ManagedToken != nil {
+		b.ManagedToken = instance.Spec.ManagedToken
+		b.Agent.TokenSecret = ManagedTokenSecret(instance.Name)
+		if instance.Status.AgentToken != nil {
+			b.AgentTokenID = instance.Status.AgentToken.ID
+		}
+	}
+	return b
+}
+
+// Manifests returns every child object of the Buildkite, in the order the
+// controller applies them, without talking to the cluster.
+func (b *Buildkite) Manifests() ([]client.Object, error) {
+	if err := b.checkExtraRules(); err != nil {
+		return nil, err
+	}
+	stacks := b.Stacks()
+	objects := []client.Object{}
+	for _, stack := range stacks {
+		cm, err := stack.configmap()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, cm)
+	}
+	sa, err := b.sa()
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, sa)
+	if len(b.hooks()) > 0 {
+		objects = append(objects, b.hooksConfigMap())
+	}
+	if b.RBAC.ClusterScoped {
+		role, err := b.clusterRole()
+		if err != nil {
+			return nil, err
+		}
+		rb, err := b.clusterRoleBinding()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, role, rb)
+	} else {
+		role, err := b.role()
+		if err != nil {
+			return nil, err
+		}
+		rb, err := b.rolebinding()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, role, rb)
+	}
+	for _, stack := range stacks {
+		deployment, err := stack.deployment()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, deployment)
+	}
+	if b.warmPoolEnabled() {
+		objects = append(objects, b.warmPool())
+	}
+	return objects, nil
+}
+
 func (b *Buildkite) sa() (*corev1.ServiceAccount, error) {
 	labels := map[string]string{
 		"app":     b.Name,
@@ -53,16 +173,104 @@ func (b *Buildkite) role() (*rbacv1.Role, error) {
 			Labels:      labels,
 			Annotations: map[string]string{},
 		},
-		Rules: []rbacv1.PolicyRule{
-			{
-				APIGroups: []string{"batch"},
-				Resources: []string{"job"},
-				Verbs:     []string{"get", "list", "update", "delete", "watch", "create"},
+		Rules: b.rules(),
+	}, nil
+}
+
+// rules are the permissions the agent stack controller needs to launch and
+// follow job pods, followed by the configured extra rules.
+func (b *Buildkite) rules() []rbacv1.PolicyRule {
+	rules := []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{"batch"},
+			Resources: []string{"jobs"},
+			Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"get", "list", "watch", "update", "patch", "delete"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods/log"},
+			Verbs:     []string{"get"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get", "list", "watch"},
+		},
+		{
+			APIGroups: []string{"", "events.k8s.io"},
+			Resources: []string{"events"},
+			Verbs:     []string{"get", "list", "watch", "create", "patch"},
+		},
+	}
+	return append(rules, b.RBAC.ExtraRules...)
+}
+
+// envFrom passes spec.secret to the controller as environment, followed by
+// the managed agent token Secret so its BUILDKITE_AGENT_TOKEN wins.
+func (b *Buildkite) envFrom() []corev1.EnvFromSource {
+	env := []corev1.EnvFromSource{}
+	for _, name := range []string{b.Secret, b.managedTokenSecretName()} {
+		if name == "" {
+			continue
+		}
+		env = append(env, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
 			},
+		})
+	}
+	return env
+}
+
+// clusterRBACName is the name of the ClusterRole and ClusterRoleBinding,
+// which are cluster scoped and so carry the namespace.
+func (b *Buildkite) clusterRBACName() string {
+	return b.Namespace + "-" + b.Name
+}
+
+func (b *Buildkite) clusterRole() (*rbacv1.ClusterRole, error) {
+	labels := map[string]string{
+		"app":     b.Name,
+		"service": "buildkite",
+	}
+
+	return &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        b.clusterRBACName(),
+			Labels:      labels,
+			Annotations: map[string]string{},
+		},
+		Rules: b.rules(),
+	}, nil
+}
+
+func (b *Buildkite) clusterRoleBinding() (*rbacv1.ClusterRoleBinding, error) {
+	labels := map[string]string{
+		"app":     b.Name,
+		"service": "buildkite",
+	}
+
+	return &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        b.clusterRBACName(),
+			Labels:      labels,
+			Annotations: map[string]string{},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     b.clusterRBACName(),
+		},
+		Subjects: []rbacv1.Subject{
 			{
-				APIGroups: []string{""},
-				Resources: []string{"pods"},
-				Verbs:     []string{"get", "list", "update", "delete", "watch", "create"},
+				Kind:      "ServiceAccount",
+				Namespace: b.Namespace,
+				Name:      b.Name,
 			},
 		},
 	}, nil
@@ -97,32 +305,36 @@ func (b *Buildkite) rolebinding() (*rbacv1.RoleBinding, error) {
 }
 
 func (b *Buildkite) configmap() (*corev1.ConfigMap, error) {
-	labels := map[string]string{
-		"app":     b.Name,
-		"service": "buildkite",
+	config, _, err := b.config()
+	if err != nil {
+		return nil, err
+	}
+	labels := b.stackLabels()
+
+	data := map[string]string{
+		configFile: config,
+	}
+	if knownHosts := b.knownHosts(); knownHosts != "" {
+		data[knownHostsKey] = knownHosts
 	}
 
 	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        b.Name,
+			Name:        b.stackName(),
 			Namespace:   b.Namespace,
 			Labels:      labels,
 			Annotations: map[string]string{},
 		},
-		Data: map[string]string{
-			"config.yaml": `
-namespace: default
-agent-token-secret: ssssss
-			`,
-		},
+		Data: data,
 	}, nil
 }
 
 func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
-	labels := map[string]string{
-		"app":     b.Name,
-		"service": "buildkite",
+	_, hash, err := b.config()
+	if err != nil {
+		return nil, err
 	}
+	labels := b.stackLabels()
 
 	var bl bool = true
 
@@ -142,7 +354,7 @@ func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
 
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      b.Name,
+			Name:      b.stackName(),
 			Namespace: b.Namespace,
 			Labels:    labels,
 		},
@@ -154,9 +366,12 @@ func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
+					Annotations: map[string]string{
+						ConfigHashAnnotation: hash,
+					},
 				},
 				Spec: corev1.PodSpec{
-					ServiceAccountName: "",
+					ServiceAccountName: b.Name,
 					NodeSelector:       map[string]string{},
 					Containers: []corev1.Container{
 						{
@@ -166,26 +381,17 @@ func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									Name:      "config",
-									MountPath: "/etc/config",
-									SubPath:   "config.yaml",
+									MountPath: configDir,
 									ReadOnly:  true,
 								},
 							},
 							Env: []corev1.EnvVar{
 								{
 									Name:  "CONFIG",
-									Value: "/etc/config.yaml",
-								},
-							},
-							EnvFrom: []corev1.EnvFromSource{
-								{
-									SecretRef: &corev1.SecretEnvSource{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: b.Secret,
-										},
-									},
+									Value: configDir + "/" + configFile,
 								},
 							},
+							EnvFrom:         b.envFrom(),
 							Resources:       b.Resource,
 							SecurityContext: &sc,
 						},
@@ -196,7 +402,7 @@ func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
 							VolumeSource: corev1.VolumeSource{
 								ConfigMap: &corev1.ConfigMapVolumeSource{
 									LocalObjectReference: corev1.LocalObjectReference{
-										Name: b.Name,
+										Name: b.stackName(),
 									},
 								},
 							},
@@ -206,6 +412,9 @@ func (b *Buildkite) deployment() (*appsv1.Deployment, error) {
 			},
 		},
 	}
+	if b.AgentTokenID != "" {
+		deployment.Spec.Template.Annotations[AgentTokenAnnotation] = b.AgentTokenID
+	}
 	return deployment, nil
 }
 
@@ -217,7 +426,7 @@ func (b *Buildkite) CreateOrUpdateDeployment(ctx context.Context) error {
 	}
 
 	err = b.Client.Get(ctx, types.NamespacedName{
-		Name:      b.Name,
+		Name:      b.stackName(),
 		Namespace: b.Namespace,
 	}, &appsv1.Deployment{})
 
@@ -245,7 +454,7 @@ func (b *Buildkite) CreateOrUpdateConfigMap(ctx context.Context) error {
 	}
 
 	err = b.Client.Get(ctx, types.NamespacedName{
-		Name:      b.Name,
+		Name:      b.stackName(),
 		Namespace: b.Namespace,
 	}, &corev1.ConfigMap{})
 
@@ -348,3 +557,109 @@ func (b *Buildkite) CreateOrUpdateServiceAccount(ctx context.Context) error {
 	}
 	return nil
 }
+
+func (b *Buildkite) CreateOrUpdateClusterRole(ctx context.Context) error {
+
+	role, err := b.clusterRole()
+	if err != nil {
+		return err
+	}
+
+	err = b.Client.Get(ctx, types.NamespacedName{
+		Name: b.clusterRBACName(),
+	}, &rbacv1.ClusterRole{})
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+
+			if err := b.Client.Create(ctx, role); err != nil {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	if err := b.Client.Update(ctx, role); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *Buildkite) CreateOrUpdateClusterRoleBinding(ctx context.Context) error {
+
+	rb, err := b.clusterRoleBinding()
+	if err != nil {
+		return err
+	}
+
+	err = b.Client.Get(ctx, types.NamespacedName{
+		Name: b.clusterRBACName(),
+	}, &rbacv1.ClusterRoleBinding{})
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+
+			if err := b.Client.Create(ctx, rb); err != nil {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	if err := b.Client.Update(ctx, rb); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateOrUpdateRBAC grants the controller ServiceAccount its rules, through
+// a Role or a ClusterRole, and removes the bindings of the other scope. A
+// cluster scoped Buildkite without ClusterScopeAllowed loses its ClusterRole
+// and gets ErrClusterScopeNotAllowed.
+func (b *Buildkite) CreateOrUpdateRBAC(ctx context.Context) error {
+	if err := b.checkExtraRules(); err != nil {
+		return err
+	}
+	namespaced := []client.Object{
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: b.Name, Namespace: b.Namespace}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: b.Name, Namespace: b.Namespace}},
+	}
+	cluster := []client.Object{
+		&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: b.clusterRBACName()}},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: b.clusterRBACName()}},
+	}
+
+	if b.RBAC.ClusterScoped && !b.ClusterScopeAllowed {
+		for _, obj := range cluster {
+			if err := b.Client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		return fmt.Errorf("buildkite %s/%s: %w", b.Namespace, b.Name, ErrClusterScopeNotAllowed)
+	}
+
+	stale := cluster
+	if b.RBAC.ClusterScoped {
+		if err := b.CreateOrUpdateClusterRole(ctx); err != nil {
+			return err
+		}
+		if err := b.CreateOrUpdateClusterRoleBinding(ctx); err != nil {
+			return err
+		}
+		stale = namespaced
+	} else {
+		if err := b.CreateOrUpdateRole(ctx); err != nil {
+			return err
+		}
+		if err := b.CreateOrUpdateRoleBinding(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range stale {
+		if err := b.Client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,793 @@
+package buildkite
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics/agentmetricstest"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// baseInstance is the Buildkite the table-driven cases start from. Each case
+// only sets the fields it exercises.
+func baseInstance() *buildkitv1alpha1.Buildkite {
+	return &buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci", Generation: 2},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			Secret: "agent-token",
+			Agent:  buildkitv1alpha1.BuildkiteAgentConfig{Queue: "kubernetes"},
+		},
+	}
+}
+
+func sharedHooksRef() *corev1.ConfigMapKeySelector {
+	return &corev1.ConfigMapKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "shared-hooks"},
+		Key:                  "pre-command.sh",
+	}
+}
+
+// testPools declares a limited lint pool and an unlimited build pool pinned
+// to large nodes.
+func testPools() []buildkitv1alpha1.BuildkitePool {
+	return []buildkitv1alpha1.BuildkitePool{
+		{Name: "lint", Queue: "lint", MaxInFlight: 20},
+		{
+			Name:         "build",
+			Queue:        "build",
+			Tags:         []string{"size=large"},
+			NodeSelector: map[string]string{"node.kubernetes.io/instance-type": "c6i.8xlarge"},
+			Tolerations:  []corev1.Toleration{{Key: "dedicated", Value: "build", Effect: corev1.TaintEffectNoSchedule}},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("8")},
+			},
+		},
+	}
+}
+
+// testJobTemplate adds a sidecar, an init container and a mounted Secret to
+// job pods.
+func testJobTemplate() *buildkitv1alpha1.BuildkiteJobTemplate {
+	deadline := int64(3600)
+	nonRoot := true
+	return &buildkitv1alpha1.BuildkiteJobTemplate{
+		Sidecars:       []corev1.Container{{Name: "dind", Image: "docker:dind"}},
+		InitContainers: []corev1.Container{{Name: "warm-cache", Image: "busybox"}},
+		Volumes: []corev1.Volume{{
+			Name:         "docker-config",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "docker-config"}},
+		}},
+		VolumeMounts:    []corev1.VolumeMount{{Name: "docker-config", MountPath: "/root/.docker"}},
+		SecurityContext: &corev1.PodSecurityContext{RunAsNonRoot: &nonRoot},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		},
+		ActiveDeadlineSeconds: &deadline,
+		TTLAfterFinished:      metav1.Duration{Duration: 30 * time.Minute},
+		ServiceAccountName:    "build-jobs",
+	}
+}
+
+func TestStackConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(*buildkitv1alpha1.Buildkite)
+		// stack picks the agent stack to render, by index in Stacks().
+		stack  int
+		want   []string
+		absent []string
+		// once must appear exactly once.
+		once []string
+	}{
+		{
+			name: "hooks and plugin allowlist",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.Hooks = &buildkitv1alpha1.BuildkiteHooks{
+					Environment: &buildkitv1alpha1.BuildkiteHook{Script: "#!/bin/sh\nexport CI=true\n"},
+					PreCommand:  &buildkitv1alpha1.BuildkiteHook{ConfigMapRef: sharedHooksRef()},
+				}
+				b.Spec.PluginAllowlist = []string{`^docker#v5\.`, `^github\.com/acme/`}
+			},
+			want: []string{
+				"hooks-path: /buildkite/hooks\n",
+				"name: agent-hooks\n",
+				"name: shared-hooks\n",
+				"key: pre-command.sh\n",
+				"path: pre-command\n",
+				"path: environment\n",
+				"defaultMode: 493\n",
+				"name: BUILDKITE_ALLOWED_PLUGINS\n",
+				`value: ^docker#v5\.,^github\.com/acme/`,
+				"default-command-params:\n",
+				"prohibit-kubernetes-plugin: true\n",
+			},
+		},
+		{
+			name: "lint pool",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.Agent.MaxInFlight = 3
+				b.Spec.Pools = testPools()
+			},
+			want:   []string{"- queue=lint\n", "max-in-flight: 20\n"},
+			absent: []string{"pod-spec-patch"},
+		},
+		{
+			name: "build pool",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.Agent.MaxInFlight = 3
+				b.Spec.Pools = testPools()
+			},
+			stack: 1,
+			want: []string{
+				"- queue=build\n",
+				"- size=large\n",
+				"node.kubernetes.io/instance-type: c6i.8xlarge\n",
+				"key: dedicated\n",
+				"name: container-0\n",
+				"cpu: \"8\"\n",
+			},
+			absent: []string{"max-in-flight"},
+		},
+		{
+			name: "job template",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.BuildkitRef = &buildkitv1alpha1.BuildkitReference{Name: "builder"}
+				b.Spec.JobTemplate = testJobTemplate()
+			},
+			want: []string{
+				"job-ttl: 30m0s\n",
+				"activeDeadlineSeconds: 3600\n",
+				"serviceAccountName: build-jobs\n",
+				"runAsNonRoot: true\n",
+				"name: dind\n",
+				"name: warm-cache\n",
+				"secretName: docker-config\n",
+				"mountPath: /root/.docker\n",
+				"memory: 1Gi\n",
+			},
+			once: []string{"name: container-0\n"},
+		},
+		{
+			name: "pool resources override the job template",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.JobTemplate = testJobTemplate()
+				b.Spec.Pools = []buildkitv1alpha1.BuildkitePool{{
+					Name:      "large",
+					Queue:     "large",
+					Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("16Gi")}},
+				}}
+			},
+			want:   []string{"memory: 16Gi\n"},
+			absent: []string{"memory: 1Gi\n"},
+		},
+		{
+			name:   "no hooks",
+			mutate: func(*buildkitv1alpha1.Buildkite) {},
+			absent: []string{"agent-config", "BUILDKITE_ALLOWED_PLUGINS", "prohibit-kubernetes-plugin"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			instance := baseInstance()
+			tc.mutate(instance)
+			config, _, err := New(instance, nil).Stacks()[tc.stack].config()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("missing %q in:\n%s", want, config)
+				}
+			}
+			for _, absent := range tc.absent {
+				if strings.Contains(config, absent) {
+					t.Errorf("unexpected %q in:\n%s", absent, config)
+				}
+			}
+			for _, once := range tc.once {
+				if n := strings.Count(config, once); n != 1 {
+					t.Errorf("%q appears %d times in:\n%s", once, n, config)
+				}
+			}
+		})
+	}
+}
+
+func TestSpecValidation(t *testing.T) {
+	cases := map[string]func(*buildkitv1alpha1.Buildkite){
+		"hook with script and ref": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Hooks = &buildkitv1alpha1.BuildkiteHooks{
+				PreCommand: &buildkitv1alpha1.BuildkiteHook{Script: "true", ConfigMapRef: sharedHooksRef()},
+			}
+		},
+		"hook without script or ref": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Hooks = &buildkitv1alpha1.BuildkiteHooks{PostCommand: &buildkitv1alpha1.BuildkiteHook{}}
+		},
+		"hook ref without key": func(b *buildkitv1alpha1.Buildkite) {
+			ref := sharedHooksRef()
+			ref.Key = ""
+			b.Spec.Hooks = &buildkitv1alpha1.BuildkiteHooks{PreCommand: &buildkitv1alpha1.BuildkiteHook{ConfigMapRef: ref}}
+		},
+		"bad plugin pattern": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.PluginAllowlist = []string{`^docker#v5\.`, "docker("}
+		},
+		"comma in plugin pattern": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.PluginAllowlist = []string{"a,b"}
+		},
+		"bad pool name": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[0].Name = "Lint_Jobs"
+		},
+		"duplicate pool name": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[1].Name = "lint"
+		},
+		"pool without queue": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[0].Queue = ""
+		},
+		"duplicate pool queue": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[1].Queue = "lint"
+		},
+		"queue tag in pool": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[1].Tags = []string{"queue=other"}
+		},
+		"negative pool max in flight": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Pools[0].MaxInFlight = -1
+		},
+		"pools with autoscaling": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.Pools = testPools()
+			b.Spec.Autoscaling = &buildkitv1alpha1.BuildkiteAutoscaling{Max: 5}
+		},
+		"reserved sidecar": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.Sidecars[0].Name = "agent"
+			b.Spec.JobTemplate = tmpl
+		},
+		"step sidecar": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.Sidecars[0].Name = "container-1"
+			b.Spec.JobTemplate = tmpl
+		},
+		"reserved init container": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.InitContainers[0].Name = "copy-agent"
+			b.Spec.JobTemplate = tmpl
+		},
+		"duplicate job container": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.InitContainers[0].Name = "dind"
+			b.Spec.JobTemplate = tmpl
+		},
+		"sidecar without image": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.Sidecars[0].Image = ""
+			b.Spec.JobTemplate = tmpl
+		},
+		"reserved job volume": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.Volumes[0].Name = "workspace"
+			tmpl.VolumeMounts[0].Name = "workspace"
+			b.Spec.JobTemplate = tmpl
+		},
+		"job mount without volume": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.VolumeMounts[0].Name = "missing"
+			b.Spec.JobTemplate = tmpl
+		},
+		"reserved job mount path": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.VolumeMounts[0].MountPath = "/buildkit/certs/"
+			b.Spec.JobTemplate = tmpl
+		},
+		"parent of a reserved mount path": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			tmpl.VolumeMounts[0].MountPath = "/buildkite"
+			b.Spec.JobTemplate = tmpl
+		},
+		"zero active deadline": func(b *buildkitv1alpha1.Buildkite) {
+			tmpl := testJobTemplate()
+			zero := int64(0)
+			tmpl.ActiveDeadlineSeconds = &zero
+			b.Spec.JobTemplate = tmpl
+		},
+		"job template and agent job ttl": func(b *buildkitv1alpha1.Buildkite) {
+			b.Spec.JobTemplate = testJobTemplate()
+			b.Spec.Agent.JobTTL = metav1.Duration{Duration: time.Hour}
+		},
+	}
+	for name, mutate := range cases {
+		instance := baseInstance()
+		mutate(instance)
+		if _, err := New(instance, nil).Manifests(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHooksConfigMap(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	key := types.NamespacedName{Name: "agent-hooks", Namespace: "ci"}
+
+	instance := baseInstance()
+	instance.Spec.Hooks = &buildkitv1alpha1.BuildkiteHooks{
+		Environment: &buildkitv1alpha1.BuildkiteHook{Script: "#!/bin/sh\nexport CI=true\n"},
+		PreCommand:  &buildkitv1alpha1.BuildkiteHook{ConfigMapRef: sharedHooksRef()},
+	}
+	if err := New(instance, c).CreateOrUpdateHooksConfigMap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, key, cm); err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 1 || cm.Data["environment"] == "" {
+		t.Errorf("expected only the inline hook, got %v", cm.Data)
+	}
+
+	instance.Spec.Hooks.Environment.Script = "#!/bin/sh\n"
+	if err := New(instance, c).CreateOrUpdateHooksConfigMap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, cm); err != nil || cm.Data["environment"] != "#!/bin/sh\n" {
+		t.Errorf("expected the updated hook, got %v %v", cm.Data, err)
+	}
+
+	instance.Spec.Hooks = nil
+	if err := New(instance, c).CreateOrUpdateHooksConfigMap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, cm); err == nil {
+		t.Error("expected the hooks ConfigMap to be removed")
+	}
+}
+
+func TestPoolsManifests(t *testing.T) {
+	instance := baseInstance()
+	instance.Spec.Pools = testPools()
+	objects, err := New(instance, nil).Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployments := map[string]*appsv1.Deployment{}
+	configMaps := map[string]bool{}
+	serviceAccounts := 0
+	for _, obj := range objects {
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			deployments[o.Name] = o
+		case *corev1.ConfigMap:
+			configMaps[o.Name] = true
+		case *corev1.ServiceAccount:
+			serviceAccounts++
+		}
+	}
+	for _, name := range []string{"agent-pool-lint", "agent-pool-build"} {
+		d := deployments[name]
+		if d == nil || !configMaps[name] {
+			t.Fatalf("missing the ConfigMap or Deployment %s", name)
+		}
+		if d.Spec.Template.Spec.ServiceAccountName != "agent" {
+			t.Errorf("%s must share the ServiceAccount, got %q", name, d.Spec.Template.Spec.ServiceAccountName)
+		}
+		if d.Spec.Template.Spec.Volumes[0].ConfigMap.Name != name {
+			t.Errorf("%s mounts %q", name, d.Spec.Template.Spec.Volumes[0].ConfigMap.Name)
+		}
+	}
+	if len(deployments) != 2 || deployments["agent"] != nil || configMaps["agent"] {
+		t.Errorf("unexpected single controller objects: %v %v", deployments, configMaps)
+	}
+	if serviceAccounts != 1 {
+		t.Errorf("expected one shared ServiceAccount, got %d", serviceAccounts)
+	}
+	lint, build := deployments["agent-pool-lint"], deployments["agent-pool-build"]
+	if lint.Spec.Selector.MatchLabels[PoolLabel] != "lint" || build.Spec.Selector.MatchLabels[PoolLabel] != "build" {
+		t.Errorf("pool selectors must not overlap: %v %v", lint.Spec.Selector.MatchLabels, build.Spec.Selector.MatchLabels)
+	}
+}
+
+func TestPoolsLifecycle(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	exists := func(obj client.Object, name string) bool {
+		return c.Get(ctx, types.NamespacedName{Name: name, Namespace: "ci"}, obj) == nil
+	}
+	apply := func(instance *buildkitv1alpha1.Buildkite) *Buildkite {
+		bk := New(instance, c)
+		for _, stack := range bk.Stacks() {
+			if err := stack.CreateOrUpdateConfigMap(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := stack.CreateOrUpdateDeployment(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bk.DeleteStalePools(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return bk
+	}
+
+	apply(baseInstance())
+	if !exists(&appsv1.Deployment{}, "agent") {
+		t.Fatal("expected the single controller")
+	}
+
+	pooled := baseInstance()
+	pooled.Spec.Pools = testPools()
+	bk := apply(pooled)
+	if exists(&appsv1.Deployment{}, "agent") || exists(&corev1.ConfigMap{}, "agent") {
+		t.Error("the single controller must be removed once pools are declared")
+	}
+	for _, name := range []string{"agent-pool-lint", "agent-pool-build"} {
+		if !exists(&appsv1.Deployment{}, name) || !exists(&corev1.ConfigMap{}, name) {
+			t.Errorf("missing pool %s", name)
+		}
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "agent-pool-lint", Namespace: "ci"}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: deployment.Generation, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1, ReadyReplicas: 1}
+	if err := c.Status().Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := bk.PoolStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []buildkitv1alpha1.BuildkitePoolStatus{
+		{Name: "lint", Queue: "lint", Deployment: "agent-pool-lint", ReadyReplicas: 1, Ready: true},
+		{Name: "build", Queue: "build", Deployment: "agent-pool-build"},
+	}
+	if len(statuses) != len(want) || statuses[0] != want[0] || statuses[1] != want[1] {
+		t.Errorf("got %+v, want %+v", statuses, want)
+	}
+
+	pooled.Spec.Pools = pooled.Spec.Pools[:1]
+	apply(pooled)
+	if exists(&appsv1.Deployment{}, "agent-pool-build") || exists(&corev1.ConfigMap{}, "agent-pool-build") {
+		t.Error("the removed pool must be deleted")
+	}
+	if !exists(&appsv1.Deployment{}, "agent-pool-lint") {
+		t.Error("the remaining pool must be kept")
+	}
+}
+
+func statusObjects(token string) []client.Object {
+	completed := metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	earlier := metav1.NewTime(completed.Add(-time.Hour))
+	jobPod := func(name, queue string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", Labels: map[string]string{QueueLabel: queue}},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+	job := func(name string, succeeded int32, at *metav1.Time) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", Labels: map[string]string{QueueLabel: "kubernetes"}},
+			Status:     batchv1.JobStatus{Succeeded: succeeded, CompletionTime: at},
+		}
+	}
+	return []client.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-token", Namespace: "ci"},
+			Data:       map[string][]byte{"token": []byte(token)},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+			Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1, ReadyReplicas: 1},
+		},
+		jobPod("running-1", "kubernetes", corev1.PodRunning),
+		jobPod("running-2", "kubernetes", corev1.PodRunning),
+		jobPod("pending", "kubernetes", corev1.PodPending),
+		jobPod("done", "kubernetes", corev1.PodSucceeded),
+		jobPod("other-queue", "gpu", corev1.PodRunning),
+		job("succeeded", 1, &completed),
+		job("older", 1, &earlier),
+		job("failed", 0, nil),
+	}
+}
+
+func newStatusClient(t *testing.T, objects ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+func conditionReason(status *buildkitv1alpha1.BuildkiteStatus, conditionType string) (metav1.ConditionStatus, string) {
+	c := meta.FindStatusCondition(status.Conditions, conditionType)
+	if c == nil {
+		return "", ""
+	}
+	return c.Status, c.Reason
+}
+
+func TestObserveStatus(t *testing.T) {
+	ctx := context.Background()
+	server := agentmetricstest.NewServer()
+	defer server.Close()
+	server.SetAgents("kubernetes", 2, 3)
+	server.SetAgents("gpu", 1, 0)
+
+	c := newStatusClient(t, statusObjects(agentmetricstest.Token)...)
+	status, err := ObserveStatus(ctx, c, baseInstance(), server.Factory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ReadyReplicas != 1 || status.RunningJobs != 2 || status.PendingJobs != 1 {
+		t.Errorf("unexpected counts: %+v", status)
+	}
+	if status.ConnectedAgents == nil || *status.ConnectedAgents != 5 {
+		t.Errorf("expected 5 connected agents, got %v", status.ConnectedAgents)
+	}
+	if status.LastSuccessfulJob == nil || !status.LastSuccessfulJob.Equal(&metav1.Time{Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}) {
+		t.Errorf("unexpected last successful job %v", status.LastSuccessfulJob)
+	}
+	for conditionType, want := range map[string]string{
+		buildkitv1alpha1.ConditionConfigValid: "Valid",
+		buildkitv1alpha1.ConditionTokenValid:  "Verified",
+		buildkitv1alpha1.ConditionReady:       "Available",
+	} {
+		if s, reason := conditionReason(status, conditionType); s != metav1.ConditionTrue || reason != want {
+			t.Errorf("%s: got %s %s, want True %s", conditionType, s, reason, want)
+		}
+	}
+	if c := meta.FindStatusCondition(status.Conditions, buildkitv1alpha1.ConditionReady); c.ObservedGeneration != 2 {
+		t.Errorf("expected the observed generation, got %d", c.ObservedGeneration)
+	}
+
+	// The last successful job outlives its Job.
+	instance := baseInstance()
+	instance.Status = *status
+	status, err = ObserveStatus(ctx, newStatusClient(t), instance, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastSuccessfulJob == nil {
+		t.Error("the last successful job must be kept")
+	}
+	if status.ConnectedAgents != nil || status.RunningJobs != 0 {
+		t.Errorf("unexpected counts without metrics and pods: %+v", status)
+	}
+}
+
+func TestObserveStatusNotReady(t *testing.T) {
+	ctx := context.Background()
+	server := agentmetricstest.NewServer()
+	defer server.Close()
+
+	cases := []struct {
+		name      string
+		mutate    func(*buildkitv1alpha1.Buildkite)
+		objects   []client.Object
+		condition string
+		status    metav1.ConditionStatus
+		reason    string
+		ready     string
+	}{
+		{
+			name:      "rejected token",
+			objects:   statusObjects("revoked"),
+			condition: buildkitv1alpha1.ConditionTokenValid,
+			status:    metav1.ConditionFalse,
+			reason:    "Unauthorized",
+			ready:     "TokenInvalid",
+		},
+		{
+			name:      "missing secret",
+			objects:   statusObjects(agentmetricstest.Token)[1:],
+			condition: buildkitv1alpha1.ConditionTokenValid,
+			status:    metav1.ConditionFalse,
+			reason:    "SecretNotFound",
+			ready:     "TokenInvalid",
+		},
+		{
+			name: "invalid config",
+			mutate: func(b *buildkitv1alpha1.Buildkite) {
+				b.Spec.Agent.Tags = []string{"no-value"}
+			},
+			objects:   statusObjects(agentmetricstest.Token),
+			condition: buildkitv1alpha1.ConditionConfigValid,
+			status:    metav1.ConditionFalse,
+			reason:    "Invalid",
+			ready:     "ConfigInvalid",
+		},
+		{
+			name:      "controller missing",
+			objects:   append(statusObjects(agentmetricstest.Token)[:1], statusObjects(agentmetricstest.Token)[2:]...),
+			condition: buildkitv1alpha1.ConditionTokenValid,
+			status:    metav1.ConditionTrue,
+			reason:    "Verified",
+			ready:     "ControllerUnavailable",
+		},
+	}
+	for _, tc := range cases {
+		instance := baseInstance()
+		if tc.mutate != nil {
+			tc.mutate(instance)
+		}
+		status, err := ObserveStatus(ctx, newStatusClient(t, tc.objects...), instance, server.Factory())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if s, reason := conditionReason(status, tc.condition); s != tc.status || reason != tc.reason {
+			t.Errorf("%s: %s is %s %s, want %s %s", tc.name, tc.condition, s, reason, tc.status, tc.reason)
+		}
+		if s, reason := conditionReason(status, buildkitv1alpha1.ConditionReady); s != metav1.ConditionFalse || reason != tc.ready {
+			t.Errorf("%s: Ready is %s %s, want False %s", tc.name, s, reason, tc.ready)
+		}
+	}
+}
+
+func TestObserveStatusMetricsUnavailable(t *testing.T) {
+	server := agentmetricstest.NewServer()
+	server.Close()
+
+	status, err := ObserveStatus(context.Background(), newStatusClient(t, statusObjects(agentmetricstest.Token)...), baseInstance(), server.Factory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, reason := conditionReason(status, buildkitv1alpha1.ConditionTokenValid); s != metav1.ConditionUnknown || reason != "MetricsUnavailable" {
+		t.Errorf("TokenValid is %s %s", s, reason)
+	}
+	if s, _ := conditionReason(status, buildkitv1alpha1.ConditionReady); s != metav1.ConditionTrue {
+		t.Errorf("an unreachable metrics API must not make the Buildkite unready, got %s", s)
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	extra := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}
+	b := &Buildkite{
+		Name:      "agent",
+		Namespace: "ci",
+		Secret:    "agent-token",
+		RBAC:      buildkitv1alpha1.BuildkiteRBAC{ExtraRules: []rbacv1.PolicyRule{extra}},
+	}
+
+	role, err := b.role()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role.Rules[0].Resources[0] != "jobs" {
+		t.Errorf("first rule should cover jobs, got %v", role.Rules[0].Resources)
+	}
+	if last := role.Rules[len(role.Rules)-1]; last.Resources[0] != "configmaps" {
+		t.Errorf("extra rule not appended, got %v", last)
+	}
+
+	objects, err := b.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := objects[len(objects)-1].(*appsv1.Deployment)
+	if deployment.Spec.Template.Spec.ServiceAccountName != "agent" {
+		t.Errorf("deployment does not use the ServiceAccount: %q", deployment.Spec.Template.Spec.ServiceAccountName)
+	}
+
+	b.RBAC.ClusterScoped = true
+	objects, err = b.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects[2].(*rbacv1.ClusterRole); !ok {
+		t.Errorf("expected a ClusterRole in cluster scope, got %T", objects[2])
+	}
+	if crb := objects[3].(*rbacv1.ClusterRoleBinding); crb.Name != "ci-agent" || crb.Subjects[0].Namespace != "ci" {
+		t.Errorf("unexpected ClusterRoleBinding %+v", crb)
+	}
+}
+
+func TestExtraRulesRejected(t *testing.T) {
+	cases := map[string]struct {
+		rule          rbacv1.PolicyRule
+		clusterScoped bool
+		rejected      bool
+	}{
+		"configmaps": {
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}},
+		},
+		"wildcard verb": {
+			rule:     rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"*"}},
+			rejected: true,
+		},
+		"wildcard resource": {
+			rule:     rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"*"}, Verbs: []string{"get"}},
+			rejected: true,
+		},
+		"wildcard subresource": {
+			rule:     rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/*"}, Verbs: []string{"get"}},
+			rejected: true,
+		},
+		"wildcard group": {
+			rule:     rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"jobs"}, Verbs: []string{"get"}},
+			rejected: true,
+		},
+		"rbac": {
+			rule:     rbacv1.PolicyRule{APIGroups: []string{"rbac.authorization.k8s.io"}, Resources: []string{"rolebindings"}, Verbs: []string{"create"}},
+			rejected: true,
+		},
+		"namespaced secrets": {
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"create"}},
+		},
+		"cluster wide secrets": {
+			rule:          rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"create"}},
+			clusterScoped: true,
+			rejected:      true,
+		},
+	}
+	for name, c := range cases {
+		b := &Buildkite{
+			Name:      "agent",
+			Namespace: "ci",
+			Secret:    "agent-token",
+			RBAC:      buildkitv1alpha1.BuildkiteRBAC{ExtraRules: []rbacv1.PolicyRule{c.rule}, ClusterScoped: c.clusterScoped},
+		}
+		_, err := b.Manifests()
+		if rejected := errors.Is(err, ErrRuleNotAllowed); rejected != c.rejected {
+			t.Errorf("%s: got %v, want rejected %v", name, err, c.rejected)
+		}
+	}
+}
+
+func TestClusterScopeNeedsOperatorAllowance(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	b := &Buildkite{
+		Name:      "agent",
+		Namespace: "ci",
+		RBAC:      buildkitv1alpha1.BuildkiteRBAC{ClusterScoped: true},
+		Client:    c,
+	}
+	clusterRole := func() error {
+		return c.Get(ctx, types.NamespacedName{Name: "ci-agent"}, &rbacv1.ClusterRole{})
+	}
+
+	b.ClusterScopeAllowed = true
+	if err := b.CreateOrUpdateRBAC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := clusterRole(); err != nil {
+		t.Fatalf("allowed cluster scope got no ClusterRole: %v", err)
+	}
+
+	b.ClusterScopeAllowed = false
+	if err := b.CreateOrUpdateRBAC(ctx); !errors.Is(err, ErrClusterScopeNotAllowed) {
+		t.Fatalf("cluster scope without allowance: got %v", err)
+	}
+	if err := clusterRole(); !apierrors.IsNotFound(err) {
+		t.Errorf("ClusterRole kept once cluster scope is no longer allowed: %v", err)
+	}
+}
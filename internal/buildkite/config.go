@@ -0,0 +1,173 @@
+package buildkite
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configDir  = "/etc/config"
+	configFile = "config.yaml"
+
+	// ConfigHashAnnotation rolls the controller pods when config.yaml changes.
+	ConfigHashAnnotation = "thecops.dev/config-hash"
+)
+
+// agentConfig is the config.yaml read by the agent stack controller.
+type agentConfig struct {
+	Namespace             string          `json:"namespace"`
+	AgentTokenSecret      string          `json:"agent-token-secret"`
+	Image                 string          `json:"image,omitempty"`
+	MaxInFlight           int             `json:"max-in-flight,omitempty"`
+	JobTTL                string          `json:"job-ttl,omitempty"`
+	Tags                  []string        `json:"tags,omitempty"`
+	DefaultCheckoutParams *checkoutParams `json:"default-checkout-params,omitempty"`
+	DefaultCommandParams  *commandParams  `json:"default-command-params,omitempty"`
+	PodSpecPatch          *corev1.PodSpec `json:"pod-spec-patch,omitempty"`
+	AgentConfig           *agentSettings  `json:"agent-config,omitempty"`
+	// ProhibitKubernetesPlugin refuses jobs using the kubernetes plugin,
+	// which could rewrite the job pod and drop the plugin allowlist.
+	ProhibitKubernetesPlugin bool `json:"prohibit-kubernetes-plugin,omitempty"`
+}
+
+type checkoutParams struct {
+	CleanFlags   string          `json:"cleanFlags,omitempty"`
+	CloneFlags   string          `json:"cloneFlags,omitempty"`
+	FetchFlags   string          `json:"fetchFlags,omitempty"`
+	NoSubmodules bool            `json:"noSubmodules,omitempty"`
+	Env          []corev1.EnvVar `json:"env,omitempty"`
+}
+
+type commandParams struct {
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// agentSettings configure the agent in job pods.
+type agentSettings struct {
+	HooksPath   string         `json:"hooks-path,omitempty"`
+	HooksVolume *corev1.Volume `json:"hooksVolume,omitempty"`
+}
+
+func (b *Buildkite) agentConfig() agentConfig {
+	cfg := agentConfig{
+		Namespace:        b.Namespace,
+		AgentTokenSecret: b.Agent.TokenSecret,
+		Image:            b.Agent.Image,
+		MaxInFlight:      b.Agent.MaxInFlight,
+	}
+	if cfg.AgentTokenSecret == "" {
+		cfg.AgentTokenSecret = b.Secret
+	}
+	if b.Agent.JobTTL.Duration > 0 {
+		cfg.JobTTL = b.Agent.JobTTL.Duration.String()
+	}
+	if t := b.JobTemplate; t != nil && t.TTLAfterFinished.Duration > 0 {
+		cfg.JobTTL = t.TTLAfterFinished.Duration.String()
+	}
+	if b.Agent.Queue != "" {
+		cfg.Tags = append(cfg.Tags, "queue="+b.Agent.Queue)
+	}
+	cfg.Tags = append(cfg.Tags, b.Agent.Tags...)
+	if c := b.Agent.Checkout; c != nil {
+		cfg.DefaultCheckoutParams = &checkoutParams{
+			CleanFlags:   c.CleanFlags,
+			CloneFlags:   c.CloneFlags,
+			FetchFlags:   c.FetchFlags,
+			NoSubmodules: c.NoSubmodules,
+		}
+	}
+	if env := b.pluginEnv(); env != nil {
+		// Plugins are checked out with the repository and run with the
+		// command, both must refuse the ones not allowed.
+		if cfg.DefaultCheckoutParams == nil {
+			cfg.DefaultCheckoutParams = &checkoutParams{}
+		}
+		cfg.DefaultCheckoutParams.Env = env
+		cfg.ProhibitKubernetesPlugin = true
+	}
+	if env := append(b.pluginEnv(), b.artifactEnv()...); len(env) > 0 {
+		cfg.DefaultCommandParams = &commandParams{Env: env}
+	}
+	if volume := b.hooksVolume(); volume != nil {
+		cfg.AgentConfig = &agentSettings{HooksPath: hooksDir, HooksVolume: volume}
+	}
+	cfg.PodSpecPatch = b.podSpecPatch()
+	return cfg
+}
+
+func validateAgentConfig(agent buildkitv1alpha1.BuildkiteAgentConfig, cfg agentConfig) error {
+	if cfg.AgentTokenSecret == "" {
+		return fmt.Errorf("agent token secret is required, set spec.secret or spec.agent.token_secret")
+	}
+	if cfg.MaxInFlight < 0 {
+		return fmt.Errorf("agent max_in_flight must not be negative, got %d", cfg.MaxInFlight)
+	}
+	if agent.JobTTL.Duration < 0 {
+		return fmt.Errorf("agent job_ttl must not be negative, got %s", agent.JobTTL.Duration)
+	}
+	for _, tag := range agent.Tags {
+		key, _, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("agent tag %q is not in key=value form", tag)
+		}
+		if key == "queue" && agent.Queue != "" {
+			return fmt.Errorf("agent tag %q conflicts with spec.agent.queue", tag)
+		}
+	}
+	return nil
+}
+
+// config renders and validates config.yaml, returning it with its hash.
+func (b *Buildkite) config() (string, string, error) {
+	cfg := b.agentConfig()
+	if err := validateAgentConfig(b.Agent, cfg); err != nil {
+		return "", "", err
+	}
+	if err := validateAutoscaling(b.Autoscaling); err != nil {
+		return "", "", err
+	}
+	if err := validateManagedToken(b.ManagedToken); err != nil {
+		return "", "", err
+	}
+	if err := validateHooks(b.hooks(), b.PluginAllowlist); err != nil {
+		return "", "", err
+	}
+	if err := validatePools(b.Pools, b.Autoscaling); err != nil {
+		return "", "", err
+	}
+	if err := validateJobTemplate(b.JobTemplate, b.Agent); err != nil {
+		return "", "", err
+	}
+	if err := validateArtifacts(b.Artifacts); err != nil {
+		return "", "", err
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(out)
+	return string(out), hex.EncodeToString(sum[:]), nil
+}
+
+// DefaultQueue is the queue agents listen on without a queue tag.
+const DefaultQueue = "default"
+
+// Queue returns the queue the agents of the stack listen on.
+func Queue(agent buildkitv1alpha1.BuildkiteAgentConfig) string {
+	if agent.Queue != "" {
+		return agent.Queue
+	}
+	for _, tag := range agent.Tags {
+		if key, value, ok := strings.Cut(tag, "="); ok && key == "queue" {
+			return value
+		}
+	}
+	return DefaultQueue
+}
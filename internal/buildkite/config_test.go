@@ -0,0 +1,58 @@
+package buildkite
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConfig(t *testing.T) {
+	b := &Buildkite{
+		Name:      "agent",
+		Namespace: "ci",
+		Secret:    "agent-token",
+		Agent: buildkitv1alpha1.BuildkiteAgentConfig{
+			Queue:       "builders",
+			Tags:        []string{"arch=arm64"},
+			MaxInFlight: 10,
+			JobTTL:      metav1.Duration{Duration: 10 * time.Minute},
+			Checkout:    &buildkitv1alpha1.BuildkiteCheckoutConfig{CloneFlags: "--depth=1"},
+		},
+	}
+	config, _, err := b.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"namespace: ci\n",
+		"agent-token-secret: agent-token\n",
+		"max-in-flight: 10\n",
+		"job-ttl: 10m0s\n",
+		"- queue=builders\n",
+		"- arch=arm64\n",
+		"cloneFlags: --depth=1\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config.yaml is missing %q:\n%s", want, config)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	cases := map[string]Buildkite{
+		"missing token": {Namespace: "ci"},
+		"negative max":  {Namespace: "ci", Secret: "s", Agent: buildkitv1alpha1.BuildkiteAgentConfig{MaxInFlight: -1}},
+		"bad tag":       {Namespace: "ci", Secret: "s", Agent: buildkitv1alpha1.BuildkiteAgentConfig{Tags: []string{"arm64"}}},
+		"queue twice":   {Namespace: "ci", Secret: "s", Agent: buildkitv1alpha1.BuildkiteAgentConfig{Queue: "a", Tags: []string{"queue=b"}}},
+	}
+	for name, b := range cases {
+		b := b
+		if _, _, err := b.config(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package buildkite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// GitSSHKey is the Secret key holding a private SSH key, as in
+	// kubernetes.io/ssh-auth Secrets.
+	GitSSHKey = "ssh-privatekey"
+	// GitCredentialsKey is the Secret key holding a git credential store
+	// file with HTTPS tokens.
+	GitCredentialsKey = ".git-credentials"
+
+	knownHostsKey = "known_hosts"
+
+	gitSecretDir  = "/etc/git-secret"
+	knownHostsDir = "/etc/git-known-hosts"
+
+	// checkoutContainer is the name of the container that clones the
+	// repository in job pods.
+	checkoutContainer = "checkout"
+)
+
+// GitCredentialsKind inspects the git Secret and returns "ssh" or "https"
+// depending on the keys it holds.
+func GitCredentialsKind(secret *corev1.Secret) (string, error) {
+	if len(secret.Data[GitSSHKey]) > 0 {
+		return "ssh", nil
+	}
+	if len(secret.Data[GitCredentialsKey]) > 0 {
+		return "https", nil
+	}
+	return "", fmt.Errorf("secret %s has neither a %s nor a %s key", secret.Name, GitSSHKey, GitCredentialsKey)
+}
+
+// ErrKnownHostsMissing is returned for SSH credentials without known hosts.
+// Checkouts never trust an unknown host key, so they would all fail.
+var ErrKnownHostsMissing = errors.New("ssh credentials need git_known_hosts")
+
+// CheckGitCredentials returns the kind of credentials held by the git Secret
+// like GitCredentialsKind, and ErrKnownHostsMissing for an SSH key without
+// knownHosts.
+func CheckGitCredentials(secret *corev1.Secret, knownHosts []string) (string, error) {
+	kind, err := GitCredentialsKind(secret)
+	if err != nil {
+		return "", err
+	}
+	if kind == "ssh" && len(knownHosts) == 0 {
+		return kind, fmt.Errorf("secret %s holds an SSH key: %w", secret.Name, ErrKnownHostsMissing)
+	}
+	return kind, nil
+}
+
+func (b *Buildkite) knownHosts() string {
+	if len(b.GitKnownHosts) == 0 {
+		return ""
+	}
+	return strings.Join(b.GitKnownHosts, "\n") + "\n"
+}
+
+// gitPodSpecPatch mounts the git Secret into the checkout container of job
+// pods. Both key kinds are optional so the same patch works for SSH keys and
+// HTTPS credentials. SSH runs in batch mode with strict host key checking,
+// so an unknown host fails the checkout instead of waiting on a prompt.
+func (b *Buildkite) gitPodSpecPatch() *corev1.PodSpec {
+	if b.GitSecret == "" {
+		return nil
+	}
+
+	optional := true
+	keyMode := int32(0400)
+	sshCommand := fmt.Sprintf("ssh -i %s/%s -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes", gitSecretDir, GitSSHKey)
+
+	volumes := []corev1.Volume{
+		{
+			Name: "git-secret",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  b.GitSecret,
+					DefaultMode: &keyMode,
+					Optional:    &optional,
+					Items: []corev1.KeyToPath{
+						{Key: GitSSHKey, Path: GitSSHKey},
+						{Key: GitCredentialsKey, Path: GitCredentialsKey},
+					},
+				},
+			},
+		},
+	}
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "git-secret",
+			MountPath: gitSecretDir,
+			ReadOnly:  true,
+		},
+	}
+
+	if b.knownHosts() != "" {
+		sshCommand += fmt.Sprintf(" -o UserKnownHostsFile=%s/%s", knownHostsDir, knownHostsKey)
+		volumes = append(volumes, corev1.Volume{
+			Name: "git-known-hosts",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: b.stackName(),
+					},
+					Items: []corev1.KeyToPath{
+						{Key: knownHostsKey, Path: knownHostsKey},
+					},
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "git-known-hosts",
+			MountPath: knownHostsDir,
+			ReadOnly:  true,
+		})
+	}
+
+	return &corev1.PodSpec{
+		Volumes: volumes,
+		Containers: []corev1.Container{
+			{
+				Name:         checkoutContainer,
+				VolumeMounts: mounts,
+				Env: []corev1.EnvVar{
+					{Name: "GIT_SSH_COMMAND", Value: sshCommand},
+					{Name: "GIT_CONFIG_COUNT", Value: "1"},
+					{Name: "GIT_CONFIG_KEY_0", Value: "credential.helper"},
+					{Name: "GIT_CONFIG_VALUE_0", Value: fmt.Sprintf("store --file=%s/%s", gitSecretDir, GitCredentialsKey)},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package buildkite
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGitCredentialsKind(t *testing.T) {
+	cases := map[string]struct {
+		data map[string][]byte
+		want string
+	}{
+		"ssh":   {data: map[string][]byte{GitSSHKey: []byte("key")}, want: "ssh"},
+		"https": {data: map[string][]byte{GitCredentialsKey: []byte("https://x:y@github.com")}, want: "https"},
+		"empty": {data: map[string][]byte{"token": []byte("t")}},
+	}
+	for name, c := range cases {
+		got, err := GitCredentialsKind(&corev1.Secret{Data: c.data})
+		if got != c.want || (c.want == "") != (err != nil) {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, c.want)
+		}
+	}
+}
+
+func TestCheckGitCredentials(t *testing.T) {
+	key := &corev1.Secret{Data: map[string][]byte{GitSSHKey: []byte("key")}}
+	if _, err := CheckGitCredentials(key, nil); !errors.Is(err, ErrKnownHostsMissing) {
+		t.Errorf("ssh key without known hosts: got %v", err)
+	}
+	if kind, err := CheckGitCredentials(key, []string{"github.com ssh-ed25519 AAAA"}); kind != "ssh" || err != nil {
+		t.Errorf("ssh key with known hosts: got %q, %v", kind, err)
+	}
+	https := &corev1.Secret{Data: map[string][]byte{GitCredentialsKey: []byte("https://x:y@github.com")}}
+	if kind, err := CheckGitCredentials(https, nil); kind != "https" || err != nil {
+		t.Errorf("https credentials: got %q, %v", kind, err)
+	}
+}
+
+func TestGitPodSpecPatchWithoutKnownHosts(t *testing.T) {
+	b := &Buildkite{Name: "agent", Namespace: "ci", GitSecret: "git"}
+	patch := b.gitPodSpecPatch()
+	env := patch.Containers[0].Env[0]
+	if env.Name != "GIT_SSH_COMMAND" || !strings.Contains(env.Value, "BatchMode=yes") || !strings.Contains(env.Value, "StrictHostKeyChecking=yes") {
+		t.Errorf("no host key policy set: %+v", env)
+	}
+	if strings.Contains(env.Value, "UserKnownHostsFile") || len(patch.Volumes) != 1 {
+		t.Errorf("known hosts mounted without any: %+v", patch)
+	}
+}
+
+func TestGitPodSpecPatch(t *testing.T) {
+	b := &Buildkite{
+		Name:          "agent",
+		Namespace:     "ci",
+		Secret:        "agent-token",
+		GitSecret:     "git",
+		GitKnownHosts: []string{"github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"},
+	}
+	config, _, err := b.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"pod-spec-patch:", "secretName: git", "StrictHostKeyChecking=yes", "name: checkout"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config.yaml is missing %q:\n%s", want, config)
+		}
+	}
+	cm, err := b.configmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cm.Data[knownHostsKey], "github.com ") {
+		t.Errorf("known_hosts not rendered: %q", cm.Data[knownHostsKey])
+	}
+}
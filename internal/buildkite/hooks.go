@@ -0,0 +1,164 @@
+package buildkite
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+const (
+	// hooksDir is the hooks path of the agent in job pods.
+	hooksDir = "/buildkite/hooks"
+
+	// allowedPluginsEnv is read by the agent bootstrap, plugins not matching
+	// one of its comma separated regular expressions are refused.
+	allowedPluginsEnv = "BUILDKITE_ALLOWED_PLUGINS"
+)
+
+// hook is a hook of the spec with the file name the agent looks for.
+type hook struct {
+	file string
+	spec *buildkitv1alpha1.BuildkiteHook
+}
+
+func (b *Buildkite) hooks() []hook {
+	if b.Hooks == nil {
+		return nil
+	}
+	all := []hook{
+		{"environment", b.Hooks.Environment},
+		{"pre-checkout", b.Hooks.PreCheckout},
+		{"pre-command", b.Hooks.PreCommand},
+		{"post-command", b.Hooks.PostCommand},
+	}
+	hooks := []hook{}
+	for _, h := range all {
+		if h.spec != nil {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+func (b *Buildkite) hooksConfigMapName() string {
+	return b.Name + "-hooks"
+}
+
+func validateHooks(hooks []hook, allowlist []string) error {
+	for _, h := range hooks {
+		inline, ref := h.spec.Script != "", h.spec.ConfigMapRef != nil
+		if inline == ref {
+			return fmt.Errorf("hook %s needs exactly one of script and config_map_ref", h.file)
+		}
+		if ref && (h.spec.ConfigMapRef.Name == "" || h.spec.ConfigMapRef.Key == "") {
+			return fmt.Errorf("hook %s config_map_ref needs a name and a key", h.file)
+		}
+	}
+	for _, pattern := range allowlist {
+		if strings.Contains(pattern, ",") {
+			return fmt.Errorf("plugin allowlist entry %q must not contain a comma", pattern)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("plugin allowlist entry %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// hooksConfigMap holds the inline hook scripts. It is rendered even without
+// inline hooks so the hooks volume always has a source.
+func (b *Buildkite) hooksConfigMap() *corev1.ConfigMap {
+	data := map[string]string{}
+	for _, h := range b.hooks() {
+		if h.spec.Script != "" {
+			data[h.file] = h.spec.Script
+		}
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.hooksConfigMapName(),
+			Namespace: b.Namespace,
+			Labels: map[string]string{
+				"app":     b.Name,
+				"service": "buildkite",
+			},
+			Annotations: map[string]string{},
+		},
+		Data: data,
+	}
+}
+
+// hooksVolume projects the inline hooks and the referenced ConfigMap keys
+// into one executable directory.
+func (b *Buildkite) hooksVolume() *corev1.Volume {
+	hooks := b.hooks()
+	if len(hooks) == 0 {
+		return nil
+	}
+	mode := int32(0755)
+	inline := corev1.ConfigMapProjection{
+		LocalObjectReference: corev1.LocalObjectReference{Name: b.hooksConfigMapName()},
+	}
+	sources := []corev1.VolumeProjection{}
+	for _, h := range hooks {
+		if ref := h.spec.ConfigMapRef; ref != nil {
+			sources = append(sources, corev1.VolumeProjection{
+				ConfigMap: &corev1.ConfigMapProjection{
+					LocalObjectReference: ref.LocalObjectReference,
+					Items:                []corev1.KeyToPath{{Key: ref.Key, Path: h.file}},
+					Optional:             ref.Optional,
+				},
+			})
+			continue
+		}
+		inline.Items = append(inline.Items, corev1.KeyToPath{Key: h.file, Path: h.file})
+	}
+	if len(inline.Items) > 0 {
+		sources = append([]corev1.VolumeProjection{{ConfigMap: &inline}}, sources...)
+	}
+	return &corev1.Volume{
+		Name: "buildkite-hooks",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources:     sources,
+				DefaultMode: &mode,
+			},
+		},
+	}
+}
+
+// pluginEnv passes the plugin allowlist to the agent bootstrap.
+func (b *Buildkite) pluginEnv() []corev1.EnvVar {
+	if len(b.PluginAllowlist) == 0 {
+		return nil
+	}
+	return []corev1.EnvVar{{Name: allowedPluginsEnv, Value: strings.Join(b.PluginAllowlist, ",")}}
+}
+
+// CreateOrUpdateHooksConfigMap applies the inline hooks, or removes the
+// ConfigMap when the Buildkite has no hooks.
+func (b *Buildkite) CreateOrUpdateHooksConfigMap(ctx context.Context) error {
+	cm := b.hooksConfigMap()
+	if len(b.hooks()) == 0 {
+		if err := b.Client.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	err := b.Client.Get(ctx, types.NamespacedName{Name: cm.Name, Namespace: cm.Namespace}, &corev1.ConfigMap{})
+	if errors.IsNotFound(err) {
+		return b.Client.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Client.Update(ctx, cm)
+}
@@ -0,0 +1,113 @@
+package buildkite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Names the agent stack controller gives to the containers and volumes of
+// job pods. Container names are also reserved by prefix, one per step.
+var (
+	reservedContainers        = []string{"agent", checkoutContainer, "copy-agent"}
+	reservedContainerPrefixes = []string{"container-", "imagecheck-"}
+	reservedVolumes           = []string{"workspace", "git-secret", "git-known-hosts", "buildkit-client", "buildkite-hooks"}
+	reservedMountPaths        = []string{"/workspace", gitSecretDir, knownHostsDir, buildkitCertsDir, hooksDir}
+)
+
+func validateJobTemplate(t *buildkitv1alpha1.BuildkiteJobTemplate, agent buildkitv1alpha1.BuildkiteAgentConfig) error {
+	if t == nil {
+		return nil
+	}
+	containers := map[string]bool{}
+	for _, c := range append(append([]corev1.Container{}, t.Sidecars...), t.InitContainers...) {
+		if c.Name == "" || c.Image == "" {
+			return fmt.Errorf("job template containers need a name and an image")
+		}
+		if reservedContainer(c.Name) {
+			return fmt.Errorf("job template container name %q is reserved by the controller", c.Name)
+		}
+		if containers[c.Name] {
+			return fmt.Errorf("job template container %q is declared twice", c.Name)
+		}
+		containers[c.Name] = true
+	}
+	volumes := map[string]bool{}
+	for _, v := range t.Volumes {
+		if contains(reservedVolumes, v.Name) {
+			return fmt.Errorf("job template volume name %q is reserved by the controller", v.Name)
+		}
+		volumes[v.Name] = true
+	}
+	for _, m := range t.VolumeMounts {
+		if !volumes[m.Name] {
+			return fmt.Errorf("job template volume mount %q has no volume", m.Name)
+		}
+		for _, reserved := range reservedMountPaths {
+			p := path.Clean(m.MountPath)
+			if p == reserved || strings.HasPrefix(p, reserved+"/") || strings.HasPrefix(reserved, p+"/") {
+				return fmt.Errorf("job template mount path %s overlaps %s used by the controller", m.MountPath, reserved)
+			}
+		}
+	}
+	if t.ActiveDeadlineSeconds != nil && *t.ActiveDeadlineSeconds <= 0 {
+		return fmt.Errorf("job template active_deadline_seconds must be positive, got %d", *t.ActiveDeadlineSeconds)
+	}
+	if t.TTLAfterFinished.Duration < 0 {
+		return fmt.Errorf("job template ttl_after_finished must not be negative, got %s", t.TTLAfterFinished.Duration)
+	}
+	if t.TTLAfterFinished.Duration > 0 && agent.JobTTL.Duration > 0 {
+		return fmt.Errorf("job template ttl_after_finished conflicts with agent.job_ttl")
+	}
+	return nil
+}
+
+func reservedContainer(name string) bool {
+	if contains(reservedContainers, name) {
+		return true
+	}
+	for _, prefix := range reservedContainerPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jobTemplatePodSpecPatch renders the job template. The volume mounts and
+// resources apply to the command container, sidecars are added as is.
+func (b *Buildkite) jobTemplatePodSpecPatch() *corev1.PodSpec {
+	t := b.JobTemplate
+	if t == nil {
+		return nil
+	}
+	patch := &corev1.PodSpec{
+		InitContainers:        t.InitContainers,
+		Volumes:               t.Volumes,
+		SecurityContext:       t.SecurityContext,
+		ActiveDeadlineSeconds: t.ActiveDeadlineSeconds,
+		ServiceAccountName:    t.ServiceAccountName,
+	}
+	if len(t.VolumeMounts) > 0 || len(t.Resources.Limits) > 0 || len(t.Resources.Requests) > 0 {
+		patch.Containers = append(patch.Containers, corev1.Container{
+			Name:         commandContainer,
+			VolumeMounts: t.VolumeMounts,
+			Resources:    t.Resources,
+		})
+	}
+	patch.Containers = append(patch.Containers, t.Sidecars...)
+	return patch
+}
@@ -0,0 +1,196 @@
+package buildkite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkit"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	buildkitCertsDir = "/buildkit/certs"
+
+	// commandContainer is the name of the container running the first step
+	// command in job pods.
+	commandContainer = "container-0"
+)
+
+// BuildkitNamespacedName returns the Buildkit the agents are linked to.
+func (b *Buildkite) BuildkitNamespacedName() types.NamespacedName {
+	if b.BuildkitRef == nil {
+		return types.NamespacedName{}
+	}
+	namespace := b.BuildkitRef.Namespace
+	if namespace == "" {
+		namespace = b.Namespace
+	}
+	return types.NamespacedName{Name: b.BuildkitRef.Name, Namespace: namespace}
+}
+
+// BuildkitClientSecretName is the Secret holding the client certificate
+// mounted into job pods.
+func (b *Buildkite) BuildkitClientSecretName() string {
+	return b.Name + "-buildkit-client"
+}
+
+func (b *Buildkite) buildkitPodSpecPatch() *corev1.PodSpec {
+	if b.BuildkitRef == nil {
+		return nil
+	}
+	ref := b.BuildkitNamespacedName()
+
+	return &corev1.PodSpec{
+		Volumes: []corev1.Volume{
+			{
+				Name: "buildkit-client",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: b.BuildkitClientSecretName(),
+					},
+				},
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name: commandContainer,
+				Env: []corev1.EnvVar{
+					{Name: "BUILDKIT_HOST", Value: fmt.Sprintf("tcp://%s.%s.svc:1234", ref.Name, ref.Namespace)},
+					{Name: "BUILDKIT_TLS_DIR", Value: buildkitCertsDir},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "buildkit-client",
+						MountPath: buildkitCertsDir,
+						ReadOnly:  true,
+					},
+				},
+			},
+		},
+	}
+}
+
+// podSpecPatch combines the job pod patches of the Buildkite, later ones
+// taking precedence. Containers patched several times are merged so each
+// name appears once.
+func (b *Buildkite) podSpecPatch() *corev1.PodSpec {
+	var patch *corev1.PodSpec
+	for _, p := range []*corev1.PodSpec{b.jobTemplatePodSpecPatch(), b.gitPodSpecPatch(), b.buildkitPodSpecPatch(), b.poolPodSpecPatch()} {
+		if p == nil {
+			continue
+		}
+		if patch == nil {
+			patch = &corev1.PodSpec{}
+		}
+		patch.InitContainers = append(patch.InitContainers, p.InitContainers...)
+		patch.Volumes = append(patch.Volumes, p.Volumes...)
+		patch.Tolerations = append(patch.Tolerations, p.Tolerations...)
+		if len(p.NodeSelector) > 0 {
+			patch.NodeSelector = p.NodeSelector
+		}
+		if p.SecurityContext != nil {
+			patch.SecurityContext = p.SecurityContext
+		}
+		if p.ActiveDeadlineSeconds != nil {
+			patch.ActiveDeadlineSeconds = p.ActiveDeadlineSeconds
+		}
+		if p.ServiceAccountName != "" {
+			patch.ServiceAccountName = p.ServiceAccountName
+		}
+		for _, c := range p.Containers {
+			patch.Containers = mergeContainer(patch.Containers, c)
+		}
+	}
+	return patch
+}
+
+func mergeContainer(containers []corev1.Container, c corev1.Container) []corev1.Container {
+	for i := range containers {
+		if containers[i].Name != c.Name {
+			continue
+		}
+		containers[i].Env = append(containers[i].Env, c.Env...)
+		containers[i].VolumeMounts = append(containers[i].VolumeMounts, c.VolumeMounts...)
+		if len(c.Resources.Limits) > 0 || len(c.Resources.Requests) > 0 {
+			containers[i].Resources = c.Resources
+		}
+		return containers
+	}
+	return append(containers, c)
+}
+
+// CreateOrUpdateBuildkitClientSecret issues the client certificate of the
+// linked Buildkit. The certificate is only reissued when the CA changes or
+// it is due for renewal, and the time it is due is returned. When the
+// Buildkit does not allow links from the namespace of the stack, any
+// certificate issued before is deleted and ErrLinkNotAllowed returned.
+func (b *Buildkite) CreateOrUpdateBuildkitClientSecret(ctx context.Context, builder *buildkitv1alpha1.Buildkit) (time.Time, error) {
+	ref := b.BuildkitNamespacedName()
+	if !buildkit.LinkAllowed(builder, b.Namespace) {
+		if err := b.DeleteBuildkitClientSecret(ctx); err != nil {
+			return time.Time{}, err
+		}
+		return time.Time{}, fmt.Errorf("buildkit %s: %w", ref, buildkit.ErrLinkNotAllowed)
+	}
+	ca, err := buildkit.CACert(ctx, b.Client, ref.Name, ref.Namespace)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	existing := &corev1.Secret{}
+	err = b.Client.Get(ctx, types.NamespacedName{
+		Name:      b.BuildkitClientSecretName(),
+		Namespace: b.Namespace,
+	}, existing)
+	if err == nil && bytes.Equal(existing.Data["ca.pem"], ca) && time.Now().Before(buildkit.RenewalTime(existing.Data["cert.pem"])) {
+		return buildkit.RenewalTime(existing.Data["cert.pem"]), nil
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return time.Time{}, err
+	}
+
+	data, issueErr := buildkit.IssueClientCert(ctx, b.Client, ref.Name, ref.Namespace, fmt.Sprintf("%s.%s", b.Name, b.Namespace))
+	if issueErr != nil {
+		return time.Time{}, issueErr
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.BuildkitClientSecretName(),
+			Namespace: b.Namespace,
+			Labels: map[string]string{
+				"app":              b.Name,
+				"service":          "buildkite",
+				buildkit.LinkLabel: ref.Name,
+			},
+			Annotations: map[string]string{},
+		},
+		Data: data,
+	}
+	if errors.IsNotFound(err) {
+		err = b.Client.Create(ctx, secret)
+	} else {
+		err = b.Client.Update(ctx, secret)
+	}
+	return buildkit.RenewalTime(data["cert.pem"]), err
+}
+
+// DeleteBuildkitClientSecret removes the client certificate of the stack.
+func (b *Buildkite) DeleteBuildkitClientSecret(ctx context.Context) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.BuildkitClientSecretName(),
+			Namespace: b.Namespace,
+		},
+	}
+	if err := b.Client.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
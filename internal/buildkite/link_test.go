@@ -0,0 +1,151 @@
+package buildkite
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkit"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBuildkitClientSecretNeedsAllowedNamespace(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	builder := &buildkitv1alpha1.Buildkit{ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "build"}}
+	if _, err := buildkit.New(builder, c).CreateOrUpdateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stack := func(namespace string) *Buildkite {
+		return New(&buildkitv1alpha1.Buildkite{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: namespace},
+			Spec: buildkitv1alpha1.BuildkiteSpec{
+				BuildkitRef: &buildkitv1alpha1.BuildkitReference{Name: "bk", Namespace: "build"},
+			},
+		}, c)
+	}
+	clientSecret := func(b *Buildkite) error {
+		return c.Get(ctx, types.NamespacedName{Name: b.BuildkitClientSecretName(), Namespace: b.Namespace}, &corev1.Secret{})
+	}
+
+	other := stack("other")
+	if _, err := other.CreateOrUpdateBuildkitClientSecret(ctx, builder); !errors.Is(err, buildkit.ErrLinkNotAllowed) {
+		t.Fatalf("unlisted namespace: got %v", err)
+	}
+	if err := clientSecret(other); !apierrors.IsNotFound(err) {
+		t.Errorf("unlisted namespace got a client certificate: %v", err)
+	}
+
+	builder.Spec.Access = &buildkitv1alpha1.BuildkitAccess{LinkNamespaces: []string{"other"}}
+	if _, err := other.CreateOrUpdateBuildkitClientSecret(ctx, builder); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSecret(other); err != nil {
+		t.Errorf("listed namespace got no client certificate: %v", err)
+	}
+
+	builder.Spec.Access.LinkNamespaces = nil
+	if _, err := other.CreateOrUpdateBuildkitClientSecret(ctx, builder); !errors.Is(err, buildkit.ErrLinkNotAllowed) {
+		t.Fatalf("delisted namespace: got %v", err)
+	}
+	if err := clientSecret(other); !apierrors.IsNotFound(err) {
+		t.Errorf("client certificate of a delisted namespace was kept: %v", err)
+	}
+
+	local := stack("build")
+	if _, err := local.CreateOrUpdateBuildkitClientSecret(ctx, builder); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSecret(local); err != nil {
+		t.Errorf("stack in the Buildkit namespace got no client certificate: %v", err)
+	}
+}
+
+func TestBuildkitClientSecretRenewal(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	builder := &buildkitv1alpha1.Buildkit{ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "ci"}}
+	if _, err := buildkit.New(builder, c).CreateOrUpdateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b := New(&buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			BuildkitRef: &buildkitv1alpha1.BuildkitReference{Name: "bk"},
+		},
+	}, c)
+	key := types.NamespacedName{Name: b.BuildkitClientSecretName(), Namespace: "ci"}
+
+	renewAt, err := b.CreateOrUpdateBuildkitClientSecret(ctx, builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(renewAt); until < 300*24*time.Hour {
+		t.Errorf("new client certificate is due in %v", until)
+	}
+	again, err := b.CreateOrUpdateBuildkitClientSecret(ctx, builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(renewAt) {
+		t.Errorf("client certificate not due for renewal was reissued")
+	}
+
+	// Swap in a certificate expiring within RenewBefore.
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, key, secret); err != nil {
+		t.Fatal(err)
+	}
+	expiring := expiringCert(t, 10*24*time.Hour)
+	secret.Data["cert.pem"] = expiring
+	if err := c.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	renewAt, err = b.CreateOrUpdateBuildkitClientSecret(ctx, builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, secret); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret.Data["cert.pem"], expiring) {
+		t.Fatal("expiring client certificate was not reissued")
+	}
+	if !renewAt.Equal(buildkit.RenewalTime(secret.Data["cert.pem"])) || !renewAt.After(time.Now()) {
+		t.Errorf("renewed client certificate is due at %v", renewAt)
+	}
+}
+
+func expiringCert(t *testing.T, validity time.Duration) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,199 @@
+package buildkite
+
+import (
+	"context"
+	"fmt"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PoolLabel carries the pool name on the ConfigMap and Deployment of a pool.
+const PoolLabel = "thecops.dev/pool"
+
+// Stacks returns one Buildkite per pool, each rendering its own ConfigMap
+// and controller Deployment, or the Buildkite itself without pools.
+func (b *Buildkite) Stacks() []*Buildkite {
+	if len(b.Pools) == 0 {
+		return []*Buildkite{b}
+	}
+	stacks := make([]*Buildkite, 0, len(b.Pools))
+	for i := range b.Pools {
+		pool := &b.Pools[i]
+		stack := *b
+		stack.pool = pool
+		stack.Agent.Queue = pool.Queue
+		stack.Agent.Tags = pool.Tags
+		stack.Agent.MaxInFlight = pool.MaxInFlight
+		stacks = append(stacks, &stack)
+	}
+	return stacks
+}
+
+// stackName names the ConfigMap and Deployment of the stack.
+func (b *Buildkite) stackName() string {
+	if b.pool == nil {
+		return b.Name
+	}
+	return PoolName(b.Name, b.pool.Name)
+}
+
+// PoolName is the name of the ConfigMap and Deployment of a pool.
+func PoolName(name, pool string) string {
+	return name + "-pool-" + pool
+}
+
+// stackLabels select the controller pods of the stack. Pools use their own
+// service so that their selectors never overlap.
+func (b *Buildkite) stackLabels() map[string]string {
+	if b.pool == nil {
+		return map[string]string{
+			"app":     b.Name,
+			"service": "buildkite",
+		}
+	}
+	return map[string]string{
+		"app":     b.Name,
+		"service": "buildkite-pool",
+		PoolLabel: b.pool.Name,
+	}
+}
+
+func validatePools(pools []buildkitv1alpha1.BuildkitePool, autoscaling *buildkitv1alpha1.BuildkiteAutoscaling) error {
+	if len(pools) > 0 && autoscaling != nil {
+		return fmt.Errorf("autoscaling is not supported with pools")
+	}
+	names := map[string]bool{}
+	queues := map[string]bool{}
+	for _, pool := range pools {
+		if errs := validation.IsDNS1123Label(pool.Name); len(errs) > 0 {
+			return fmt.Errorf("pool name %q: %s", pool.Name, errs[0])
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("pool %q is declared twice", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.Queue == "" {
+			return fmt.Errorf("pool %s needs a queue", pool.Name)
+		}
+		if queues[pool.Queue] {
+			return fmt.Errorf("queue %q is served by several pools", pool.Queue)
+		}
+		queues[pool.Queue] = true
+		if pool.MaxInFlight < 0 {
+			return fmt.Errorf("pool %s max_in_flight must not be negative, got %d", pool.Name, pool.MaxInFlight)
+		}
+	}
+	return nil
+}
+
+// poolPodSpecPatch places the job pods of the pool and sets the default
+// resources of their command container.
+func (b *Buildkite) poolPodSpecPatch() *corev1.PodSpec {
+	if b.pool == nil {
+		return nil
+	}
+	p := b.pool
+	if len(p.NodeSelector) == 0 && len(p.Tolerations) == 0 && len(p.Resources.Limits) == 0 && len(p.Resources.Requests) == 0 {
+		return nil
+	}
+	patch := &corev1.PodSpec{
+		NodeSelector: p.NodeSelector,
+		Tolerations:  p.Tolerations,
+	}
+	if len(p.Resources.Limits) > 0 || len(p.Resources.Requests) > 0 {
+		patch.Containers = []corev1.Container{{Name: commandContainer, Resources: p.Resources}}
+	}
+	return patch
+}
+
+// DeleteStalePools removes the ConfigMaps and Deployments of removed pools,
+// and of the single controller once pools are declared.
+func (b *Buildkite) DeleteStalePools(ctx context.Context) error {
+	current := map[string]bool{}
+	for _, pool := range b.Pools {
+		current[pool.Name] = true
+	}
+	selector := client.MatchingLabels{"app": b.Name, "service": "buildkite-pool"}
+
+	stale := []client.Object{}
+	deployments := &appsv1.DeploymentList{}
+	if err := b.Client.List(ctx, deployments, client.InNamespace(b.Namespace), selector); err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		if !current[deployments.Items[i].Labels[PoolLabel]] {
+			stale = append(stale, &deployments.Items[i])
+		}
+	}
+	configMaps := &corev1.ConfigMapList{}
+	if err := b.Client.List(ctx, configMaps, client.InNamespace(b.Namespace), selector); err != nil {
+		return err
+	}
+	for i := range configMaps.Items {
+		if !current[configMaps.Items[i].Labels[PoolLabel]] {
+			stale = append(stale, &configMaps.Items[i])
+		}
+	}
+	if len(b.Pools) > 0 {
+		stale = append(stale,
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: b.Name, Namespace: b.Namespace}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: b.Name, Namespace: b.Namespace}},
+		)
+	}
+
+	for _, obj := range stale {
+		if err := b.Client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// PoolStatus reports the controller Deployment of each pool, nil without
+// pools.
+func (b *Buildkite) PoolStatus(ctx context.Context) ([]buildkitv1alpha1.BuildkitePoolStatus, error) {
+	if len(b.Pools) == 0 {
+		return nil, nil
+	}
+	statuses := []buildkitv1alpha1.BuildkitePoolStatus{}
+	for _, stack := range b.Stacks() {
+		status := buildkitv1alpha1.BuildkitePoolStatus{
+			Name:       stack.pool.Name,
+			Queue:      stack.pool.Queue,
+			Deployment: stack.stackName(),
+		}
+		deployment := &appsv1.Deployment{}
+		err := b.Client.Get(ctx, types.NamespacedName{Name: stack.stackName(), Namespace: b.Namespace}, deployment)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			status.ReadyReplicas = deployment.Status.ReadyReplicas
+			status.Ready = deploymentAvailable(deployment)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// deploymentAvailable reports whether every replica of the current
+// generation is available.
+func deploymentAvailable(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	s := deployment.Status
+	return s.ObservedGeneration >= deployment.Generation &&
+		s.Replicas == replicas &&
+		s.UpdatedReplicas == replicas &&
+		s.AvailableReplicas == replicas
+}
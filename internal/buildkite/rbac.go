@@ -0,0 +1,39 @@
+package buildkite
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+var (
+	// ErrRuleNotAllowed is returned for extra rules the operator refuses to
+	// grant: wildcards, RBAC objects, and Secrets across the cluster.
+	ErrRuleNotAllowed = errors.New("rule not allowed in rbac.extra_rules")
+
+	// ErrClusterScopeNotAllowed is returned for a cluster scoped Buildkite in
+	// a namespace the operator does not allow cluster scope for.
+	ErrClusterScopeNotAllowed = errors.New("rbac.cluster_scoped is not allowed in this namespace")
+)
+
+// checkExtraRules rejects the extra rules that would let the agent stack
+// controller take over the cluster.
+func (b *Buildkite) checkExtraRules() error {
+	for i, rule := range b.RBAC.ExtraRules {
+		for _, values := range [][]string{rule.Verbs, rule.APIGroups, rule.Resources, rule.NonResourceURLs} {
+			if slices.ContainsFunc(values, func(v string) bool { return strings.Contains(v, "*") }) {
+				return fmt.Errorf("extra_rules[%d] uses a wildcard: %w", i, ErrRuleNotAllowed)
+			}
+		}
+		if slices.Contains(rule.APIGroups, rbacv1.GroupName) {
+			return fmt.Errorf("extra_rules[%d] covers %s: %w", i, rbacv1.GroupName, ErrRuleNotAllowed)
+		}
+		if b.RBAC.ClusterScoped && slices.Contains(rule.Resources, "secrets") {
+			return fmt.Errorf("extra_rules[%d] covers secrets in every namespace: %w", i, ErrRuleNotAllowed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package buildkite
+
+import (
+	"context"
+	"fmt"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkiteapi"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ObserveStatus returns the status of the Buildkite as observed in the
+// cluster and, when metrics is not nil, in the agent metrics API: the
+// Ready, TokenValid and ConfigValid conditions, the controller replicas, the
+// connected agents and the job pods. Other status fields are kept.
+func ObserveStatus(ctx context.Context, c client.Client, instance *buildkitv1alpha1.Buildkite, metrics agentmetrics.Factory) (*buildkitv1alpha1.BuildkiteStatus, error) {
+	status := instance.Status.DeepCopy()
+	b := New(instance, c)
+
+	config := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionConfigValid,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Valid",
+		Message:            "config.yaml rendered",
+		ObservedGeneration: instance.Generation,
+	}
+	if _, err := b.Manifests(); err != nil {
+		config.Status = metav1.ConditionFalse
+		config.Reason = "Invalid"
+		config.Message = err.Error()
+	}
+
+	token, agents, err := b.checkAgentToken(ctx, instance, metrics)
+	if err != nil {
+		return nil, err
+	}
+	token.ObservedGeneration = instance.Generation
+	status.ConnectedAgents = agents
+
+	available, err := b.ObserveControllers(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.ObserveJobs(ctx, status); err != nil {
+		return nil, err
+	}
+
+	ready := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Available",
+		Message:            fmt.Sprintf("%d controller replicas ready", status.ReadyReplicas),
+		ObservedGeneration: instance.Generation,
+	}
+	switch {
+	case config.Status != metav1.ConditionTrue:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "ConfigInvalid", config.Message
+	case token.Status == metav1.ConditionFalse:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "TokenInvalid", token.Message
+	case !available:
+		ready.Status, ready.Reason = metav1.ConditionFalse, "ControllerUnavailable"
+	}
+	for _, condition := range []metav1.Condition{config, token, ready} {
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+	return status, nil
+}
+
+// checkAgentToken reads the agent token and, with metrics, checks that
+// Buildkite accepts it and counts the agents connected to the queues. The
+// condition is Unknown when the metrics API cannot be reached.
+func (b *Buildkite) checkAgentToken(ctx context.Context, instance *buildkitv1alpha1.Buildkite, metrics agentmetrics.Factory) (metav1.Condition, *int32, error) {
+	condition := metav1.Condition{Type: buildkitv1alpha1.ConditionTokenValid, Status: metav1.ConditionFalse}
+	name := AgentTokenSecret(instance)
+	if name == "" {
+		condition.Reason = "SecretNotSet"
+		condition.Message = "agent token secret is required, set spec.secret or spec.agent.token_secret"
+		return condition, nil, nil
+	}
+	secret := &corev1.Secret{}
+	err := b.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: b.Namespace}, secret)
+	if errors.IsNotFound(err) {
+		condition.Reason = "SecretNotFound"
+		condition.Message = fmt.Sprintf("secret %s not found", name)
+		return condition, nil, nil
+	}
+	if err != nil {
+		return condition, nil, err
+	}
+	token, err := AgentToken(secret)
+	if err != nil {
+		condition.Reason = "TokenNotFound"
+		condition.Message = err.Error()
+		return condition, nil, nil
+	}
+	if metrics == nil {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "SecretFound"
+		condition.Message = fmt.Sprintf("agent token found in secret %s", name)
+		return condition, nil, nil
+	}
+
+	m, err := metrics(token).Metrics(ctx)
+	switch {
+	case buildkiteapi.IsUnauthorized(err):
+		condition.Reason = "Unauthorized"
+		condition.Message = fmt.Sprintf("buildkite rejected the agent token of secret %s", name)
+		return condition, nil, nil
+	case err != nil:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "MetricsUnavailable"
+		condition.Message = err.Error()
+		return condition, nil, nil
+	}
+	agents := ConnectedAgents(m, b.Queues())
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "Verified"
+	condition.Message = fmt.Sprintf("buildkite accepted the agent token of secret %s", name)
+	return condition, &agents, nil
+}
+
+// QueueLabel is set by the agent stack controller on the Jobs and Pods it
+// launches, from the queue tag rendered into config.yaml.
+const QueueLabel = "tag.buildkite.com/queue"
+
+// Queues returns the queues served by the Buildkite, one per pool.
+func (b *Buildkite) Queues() []string {
+	queues := []string{}
+	for _, stack := range b.Stacks() {
+		queues = append(queues, Queue(stack.Agent))
+	}
+	return queues
+}
+
+// ObserveControllers records the ready controller replicas and the state of
+// each pool. It returns whether every controller is available.
+func (b *Buildkite) ObserveControllers(ctx context.Context, status *buildkitv1alpha1.BuildkiteStatus) (bool, error) {
+	available := true
+	status.ReadyReplicas = 0
+	for _, stack := range b.Stacks() {
+		deployment := &appsv1.Deployment{}
+		err := b.Client.Get(ctx, types.NamespacedName{Name: stack.stackName(), Namespace: b.Namespace}, deployment)
+		if errors.IsNotFound(err) {
+			available = false
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		status.ReadyReplicas += deployment.Status.ReadyReplicas
+		available = available && deploymentAvailable(deployment)
+	}
+	pools, err := b.PoolStatus(ctx)
+	if err != nil {
+		return false, err
+	}
+	status.Pools = pools
+	return available, nil
+}
+
+// ObserveJobs counts the running and pending job pods of the queues and
+// records the last successful job. The latter is kept once its Job is gone.
+func (b *Buildkite) ObserveJobs(ctx context.Context, status *buildkitv1alpha1.BuildkiteStatus) error {
+	queue, err := labels.NewRequirement(QueueLabel, selection.In, b.Queues())
+	if err != nil {
+		return err
+	}
+	opts := []client.ListOption{
+		client.InNamespace(b.Namespace),
+		client.MatchingLabelsSelector{Selector: labels.NewSelector().Add(*queue)},
+	}
+
+	pods := &corev1.PodList{}
+	if err := b.Client.List(ctx, pods, opts...); err != nil {
+		return err
+	}
+	status.RunningJobs, status.PendingJobs = 0, 0
+	for _, pod := range pods.Items {
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			status.RunningJobs++
+		case corev1.PodPending:
+			status.PendingJobs++
+		}
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := b.Client.List(ctx, jobs, opts...); err != nil {
+		return err
+	}
+	for _, job := range jobs.Items {
+		completed := job.Status.CompletionTime
+		if job.Status.Succeeded == 0 || completed == nil {
+			continue
+		}
+		if status.LastSuccessfulJob == nil || completed.After(status.LastSuccessfulJob.Time) {
+			status.LastSuccessfulJob = completed.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// ConnectedAgents counts the agents connected to the given queues.
+func ConnectedAgents(m *agentmetrics.Metrics, queues []string) int32 {
+	var total int32
+	for _, queue := range queues {
+		total += m.Agents.Queues[queue].Total
+	}
+	return total
+}
@@ -0,0 +1,285 @@
+package buildkite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkiteapi"
+)
+
+const (
+	// AgentTokenAnnotation carries the ID of the managed agent token on the
+	// controller pods, so that a rotation rolls them.
+	AgentTokenAnnotation = "thecops.dev/agent-token-id"
+
+	// DefaultRevocationGracePeriod is how long replaced agent tokens stay
+	// valid when managed_token.revocation_grace_period is unset.
+	DefaultRevocationGracePeriod = time.Hour
+)
+
+// ManagedTokenSecret is the name of the Secret holding the managed agent
+// token of a Buildkite.
+func ManagedTokenSecret(name string) string {
+	return name + "-agent-token"
+}
+
+// managedTokenSecretName is the Secret of the managed agent token, empty
+// when the token is not managed.
+func (b *Buildkite) managedTokenSecretName() string {
+	if b.ManagedToken == nil {
+		return ""
+	}
+	return ManagedTokenSecret(b.Name)
+}
+
+// AgentTokenSecret returns the name of the Secret holding the agent token.
+func AgentTokenSecret(instance *buildkitv1alpha1.Buildkite) string {
+	if instance.Spec.ManagedToken != nil {
+		return ManagedTokenSecret(instance.Name)
+	}
+	if instance.Spec.Agent.TokenSecret != "" {
+		return instance.Spec.Agent.TokenSecret
+	}
+	return instance.Spec.Secret
+}
+
+// AgentToken returns the agent token of the Secret, stored under "token" or
+// under BUILDKITE_AGENT_TOKEN for Secrets also passed as environment.
+func AgentToken(secret *corev1.Secret) (string, error) {
+	for _, key := range []string{"token", "BUILDKITE_AGENT_TOKEN"} {
+		if token := string(secret.Data[key]); token != "" {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("secret %s has no token or BUILDKITE_AGENT_TOKEN key", secret.Name)
+}
+
+func validateManagedToken(m *buildkitv1alpha1.BuildkiteManagedToken) error {
+	switch {
+	case m == nil:
+		return nil
+	case m.Organization == "":
+		return fmt.Errorf("managed_token.organization is required")
+	case m.ClusterID == "":
+		return fmt.Errorf("managed_token.cluster_id is required")
+	case m.APITokenSecret.Name == "":
+		return fmt.Errorf("managed_token.api_token_secret is required")
+	case m.RotationPeriod.Duration < 0:
+		return fmt.Errorf("managed_token.rotation_period must not be negative, got %s", m.RotationPeriod.Duration)
+	}
+	return nil
+}
+
+// AgentTokenRotation reports whether a new managed token is needed and why:
+// there is none yet, the rotate annotation changed or the rotation period
+// elapsed.
+func AgentTokenRotation(instance *buildkitv1alpha1.Buildkite, now time.Time) (reason string, due bool) {
+	current := instance.Status.AgentToken
+	switch {
+	case current == nil || current.ID == "":
+		return "Created", true
+	case instance.Annotations[buildkitv1alpha1.RotateAgentTokenAnnotation] != current.RotationRequest:
+		return "RotationRequested", true
+	}
+	period := instance.Spec.ManagedToken.RotationPeriod.Duration
+	if period > 0 && !now.Before(current.CreatedAt.Add(period)) {
+		return "RotationPeriodElapsed", true
+	}
+	return "", false
+}
+
+// NextAgentToken creates a cluster agent token for the Buildkite. The token
+// it replaces, if any, is queued for revocation in the returned status.
+func NextAgentToken(ctx context.Context, api buildkiteapi.Client, instance *buildkitv1alpha1.Buildkite, now time.Time) (*buildkitv1alpha1.BuildkiteAgentTokenStatus, string, error) {
+	m := instance.Spec.ManagedToken
+	orgID, err := api.OrganizationID(ctx, m.Organization)
+	if err != nil {
+		return nil, "", err
+	}
+	description := fmt.Sprintf("%s/%s, managed by cops", instance.Namespace, instance.Name)
+	token, err := api.CreateClusterAgentToken(ctx, orgID, m.ClusterID, description)
+	if err != nil {
+		return nil, "", err
+	}
+
+	status := &buildkitv1alpha1.BuildkiteAgentTokenStatus{
+		ID:              token.ID,
+		CreatedAt:       metav1.NewTime(now),
+		RotationRequest: instance.Annotations[buildkitv1alpha1.RotateAgentTokenAnnotation],
+	}
+	if current := instance.Status.AgentToken; current != nil {
+		status.Revoking = append(status.Revoking, current.Revoking...)
+		if current.ID != "" {
+			status.Revoking = append(status.Revoking, current.ID)
+		}
+	}
+	return status, token.Token, nil
+}
+
+// DiscardAgentToken revokes a token returned by NextAgentToken whose status
+// could not be recorded. Nothing else knows its ID, it would stay valid.
+func DiscardAgentToken(ctx context.Context, api buildkiteapi.Client, instance *buildkitv1alpha1.Buildkite, id string) error {
+	orgID, err := api.OrganizationID(ctx, instance.Spec.ManagedToken.Organization)
+	if err != nil {
+		return err
+	}
+	return api.RevokeClusterAgentToken(ctx, orgID, id)
+}
+
+func (b *Buildkite) agentTokenSecret(token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ManagedTokenSecret(b.Name),
+			Namespace: b.Namespace,
+			Labels: map[string]string{
+				"app":     b.Name,
+				"service": "buildkite",
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"token":                 []byte(token),
+			"BUILDKITE_AGENT_TOKEN": []byte(token),
+		},
+	}
+}
+
+// ManagedTokenSecretExists reports whether the Secret of the managed agent
+// token exists.
+func (b *Buildkite) ManagedTokenSecretExists(ctx context.Context) (bool, error) {
+	key := types.NamespacedName{Name: ManagedTokenSecret(b.Name), Namespace: b.Namespace}
+	err := b.Client.Get(ctx, key, &corev1.Secret{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateOrUpdateAgentTokenSecret stores the managed agent token.
+func (b *Buildkite) CreateOrUpdateAgentTokenSecret(ctx context.Context, token string) error {
+	secret := b.agentTokenSecret(token)
+	err := b.Client.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, &corev1.Secret{})
+	if errors.IsNotFound(err) {
+		return b.Client.Create(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Client.Update(ctx, secret)
+}
+
+// DeploymentRolledOut reports whether every controller pod, of every pool,
+// runs with the current managed agent token.
+func (b *Buildkite) DeploymentRolledOut(ctx context.Context) (bool, error) {
+	for _, stack := range b.Stacks() {
+		deployment := &appsv1.Deployment{}
+		err := b.Client.Get(ctx, types.NamespacedName{Name: stack.stackName(), Namespace: b.Namespace}, deployment)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if deployment.Spec.Template.Annotations[AgentTokenAnnotation] != b.AgentTokenID || !deploymentAvailable(deployment) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// AgentTokenRevocation returns when the tokens replaced by the current one
+// may be revoked at the earliest, the grace period after its creation.
+func AgentTokenRevocation(instance *buildkitv1alpha1.Buildkite) time.Time {
+	m, current := instance.Spec.ManagedToken, instance.Status.AgentToken
+	if m == nil || current == nil {
+		return time.Time{}
+	}
+	grace := m.RevocationGracePeriod.Duration
+	if grace <= 0 {
+		grace = DefaultRevocationGracePeriod
+	}
+	return current.CreatedAt.Add(grace)
+}
+
+// AgentsUseCurrentToken reads the agent metrics with the current managed
+// token and reports whether agents are connected to the queues of the
+// Buildkite. Queues without scheduled or running jobs need no agent.
+func (b *Buildkite) AgentsUseCurrentToken(ctx context.Context, metrics agentmetrics.Factory) (bool, error) {
+	secret := &corev1.Secret{}
+	if err := b.Client.Get(ctx, types.NamespacedName{Name: ManagedTokenSecret(b.Name), Namespace: b.Namespace}, secret); err != nil {
+		return false, err
+	}
+	token, err := AgentToken(secret)
+	if err != nil {
+		return false, err
+	}
+	m, err := metrics(token).Metrics(ctx)
+	if buildkiteapi.IsUnauthorized(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ConnectedAgents(m, b.Queues()) > 0 {
+		return true, nil
+	}
+	for _, queue := range b.Queues() {
+		if jobs := m.Queue(queue); jobs.Scheduled+jobs.Running > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RevokeAgentTokens revokes the replaced tokens in status once the controller
+// rolled out with the current one, the revocation grace period elapsed and
+// agents connect with the current token. It returns false while tokens are
+// left.
+func (b *Buildkite) RevokeAgentTokens(ctx context.Context, api buildkiteapi.Client, metrics agentmetrics.Factory, instance *buildkitv1alpha1.Buildkite, now time.Time) (bool, error) {
+	status := instance.Status.AgentToken
+	if status == nil || len(status.Revoking) == 0 {
+		return true, nil
+	}
+	rolledOut, err := b.DeploymentRolledOut(ctx)
+	if err != nil || !rolledOut {
+		return false, err
+	}
+	if now.Before(AgentTokenRevocation(instance)) {
+		return false, nil
+	}
+	inUse, err := b.AgentsUseCurrentToken(ctx, metrics)
+	if err != nil || !inUse {
+		return false, err
+	}
+	orgID, err := api.OrganizationID(ctx, instance.Spec.ManagedToken.Organization)
+	if err != nil {
+		return false, err
+	}
+	for len(status.Revoking) > 0 {
+		if err := api.RevokeClusterAgentToken(ctx, orgID, status.Revoking[0]); err != nil && !buildkiteapi.IsNotFound(err) {
+			return false, err
+		}
+		status.Revoking = status.Revoking[1:]
+	}
+	status.Revoking = nil
+	return true, nil
+}
+
+// NextAgentTokenRotation returns when the managed token is due for rotation.
+// ok is false when it is not rotated on a schedule.
+func NextAgentTokenRotation(instance *buildkitv1alpha1.Buildkite) (next time.Time, ok bool) {
+	m, current := instance.Spec.ManagedToken, instance.Status.AgentToken
+	if m == nil || current == nil || m.RotationPeriod.Duration <= 0 {
+		return time.Time{}, false
+	}
+	return current.CreatedAt.Add(m.RotationPeriod.Duration), true
+}
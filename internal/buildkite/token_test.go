@@ -0,0 +1,179 @@
+package buildkite
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/agentmetrics/agentmetricstest"
+	"cops/internal/buildkiteapi/buildkiteapitest"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAgentTokenRotation(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	instance := &buildkitv1alpha1.Buildkite{
+		Spec: buildkitv1alpha1.BuildkiteSpec{ManagedToken: &buildkitv1alpha1.BuildkiteManagedToken{
+			RotationPeriod: metav1.Duration{Duration: 24 * time.Hour},
+		}},
+	}
+	if reason, due := AgentTokenRotation(instance, now); !due || reason != "Created" {
+		t.Errorf("no token yet: got %q %v", reason, due)
+	}
+
+	instance.Status.AgentToken = &buildkitv1alpha1.BuildkiteAgentTokenStatus{ID: "t1", CreatedAt: metav1.NewTime(now.Add(-time.Hour))}
+	if _, due := AgentTokenRotation(instance, now); due {
+		t.Error("fresh token must not be rotated")
+	}
+	if _, due := AgentTokenRotation(instance, now.Add(23*time.Hour)); !due {
+		t.Error("token past the rotation period must be rotated")
+	}
+
+	instance.Annotations = map[string]string{buildkitv1alpha1.RotateAgentTokenAnnotation: "2024-05-01"}
+	if reason, due := AgentTokenRotation(instance, now); !due || reason != "RotationRequested" {
+		t.Errorf("annotation change: got %q %v", reason, due)
+	}
+}
+
+// TestAgentTokenLifecycle creates a token, rotates it and revokes the old
+// one once the controller rolled out, against the fake GraphQL API.
+func TestAgentTokenLifecycle(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	api := server.Client()
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	instance := &buildkitv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+		Spec: buildkitv1alpha1.BuildkiteSpec{
+			Secret: "buildkite",
+			ManagedToken: &buildkitv1alpha1.BuildkiteManagedToken{
+				Organization:   "acme",
+				ClusterID:      "cluster-1",
+				APITokenSecret: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "api"}},
+			},
+		},
+	}
+
+	// apply stores a new token and applies the controller Deployment like the
+	// reconciler does.
+	apply := func() *Buildkite {
+		t.Helper()
+		status, token, err := NextAgentToken(ctx, api, instance, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instance.Status.AgentToken = status
+		bk := New(instance, c)
+		if err := bk.CreateOrUpdateAgentTokenSecret(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+		if err := bk.CreateOrUpdateDeployment(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return bk
+	}
+
+	bk := apply()
+	first := instance.Status.AgentToken.ID
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "agent-agent-token", Namespace: "ci"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := AgentToken(secret); token != server.AgentTokens()[0].Token {
+		t.Errorf("secret holds %q", token)
+	}
+	config, _, _ := bk.config()
+	if want := "agent-token-secret: agent-agent-token\n"; !strings.Contains(config, want) {
+		t.Errorf("config.yaml is missing %q:\n%s", want, config)
+	}
+
+	bk = apply()
+	if got := instance.Status.AgentToken.Revoking; len(got) != 1 || got[0] != first {
+		t.Fatalf("replaced token must be queued for revocation, got %v", got)
+	}
+	metricsServer := agentmetricstest.NewServer()
+	defer metricsServer.Close()
+	// The fake metrics API only accepts its own token.
+	metrics := func(string) agentmetrics.Client { return metricsServer.Client() }
+	later := now.Add(DefaultRevocationGracePeriod)
+
+	if done, err := bk.RevokeAgentTokens(ctx, api, metrics, instance, later); err != nil || done {
+		t.Fatalf("revoked before the rollout: %v %v", done, err)
+	}
+	if n := len(server.AgentTokens()); n != 2 {
+		t.Errorf("expected both tokens active during the rollout, got %d", n)
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "agent", Namespace: "ci"}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if got := deployment.Spec.Template.Annotations[AgentTokenAnnotation]; got != instance.Status.AgentToken.ID {
+		t.Errorf("controller pods must roll with the new token, annotation %q", got)
+	}
+	envFrom := deployment.Spec.Template.Spec.Containers[0].EnvFrom
+	if last := envFrom[len(envFrom)-1].SecretRef; last == nil || last.Name != "agent-agent-token" {
+		t.Errorf("controller must read the managed token Secret, got %+v", envFrom)
+	}
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: deployment.Generation, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if err := c.Status().Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	if done, err := bk.RevokeAgentTokens(ctx, api, metrics, instance, now); err != nil || done {
+		t.Fatalf("revoked within the grace period: %v %v", done, err)
+	}
+
+	queue := bk.Queues()[0]
+	metricsServer.SetQueue(queue, 2, 0)
+	if done, err := bk.RevokeAgentTokens(ctx, api, metrics, instance, later); err != nil || done {
+		t.Fatalf("revoked while no agent connects with the new token: %v %v", done, err)
+	}
+	if n := len(server.AgentTokens()); n != 2 {
+		t.Errorf("expected both tokens active until agents connect, got %d", n)
+	}
+
+	metricsServer.SetAgents(queue, 1, 0)
+	if done, err := bk.RevokeAgentTokens(ctx, api, metrics, instance, later); err != nil || !done {
+		t.Fatalf("revoke once agents connect: %v %v", done, err)
+	}
+	tokens := server.AgentTokens()
+	if len(tokens) != 1 || tokens[0].ID != instance.Status.AgentToken.ID {
+		t.Errorf("only the current token must stay active, got %+v", tokens)
+	}
+}
+
+func TestRevocationGracePeriod(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	instance := &buildkitv1alpha1.Buildkite{
+		Spec: buildkitv1alpha1.BuildkiteSpec{ManagedToken: &buildkitv1alpha1.BuildkiteManagedToken{}},
+		Status: buildkitv1alpha1.BuildkiteStatus{
+			AgentToken: &buildkitv1alpha1.BuildkiteAgentTokenStatus{ID: "t2", CreatedAt: metav1.NewTime(created)},
+		},
+	}
+	if got := AgentTokenRevocation(instance); !got.Equal(created.Add(DefaultRevocationGracePeriod)) {
+		t.Errorf("default grace period: got %v", got)
+	}
+	instance.Spec.ManagedToken.RevocationGracePeriod = metav1.Duration{Duration: 6 * time.Hour}
+	if got := AgentTokenRevocation(instance); !got.Equal(created.Add(6 * time.Hour)) {
+		t.Errorf("configured grace period: got %v", got)
+	}
+}
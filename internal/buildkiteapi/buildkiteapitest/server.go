@@ -0,0 +1,634 @@
+// Package buildkiteapitest provides an in-memory Buildkite REST API for tests.
+// The schedule and team operations of the GraphQL API are served at /graphql.
+package buildkiteapitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cops/internal/buildkiteapi"
+)
+
+// Token is the API token accepted by the fake server.
+const Token = "test-token"
+
+// Server is a fake Buildkite REST API backed by httptest.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	pipelines map[string]*buildkiteapi.Pipeline
+	builds    map[string][]*buildkiteapi.Build
+	schedules map[string][]*buildkiteapi.Schedule
+	fields    map[string]map[string]interface{}
+	teams     map[string][]buildkiteapi.PipelineTeam
+	tokens    []*agentToken
+	requests  []string
+	nextID    int
+}
+
+type agentToken struct {
+	buildkiteapi.AgentToken
+	orgID     string
+	clusterID string
+	revoked   bool
+}
+
+// NewServer starts a fake Buildkite REST API. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		pipelines: map[string]*buildkiteapi.Pipeline{},
+		builds:    map[string][]*buildkiteapi.Build{},
+		schedules: map[string][]*buildkiteapi.Schedule{},
+		fields:    map[string]map[string]interface{}{},
+		teams:     map[string][]buildkiteapi.PipelineTeam{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/organizations/", s.serve)
+	mux.HandleFunc("/graphql", s.serveGraphQL)
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+// Client returns a Client for the fake server.
+func (s *Server) Client() buildkiteapi.Client {
+	return buildkiteapi.New(s.URL, Token)
+}
+
+// Factory returns a Factory for the fake server.
+func (s *Server) Factory() buildkiteapi.Factory {
+	return buildkiteapi.NewFactory(s.URL)
+}
+
+// Pipeline returns a copy of a stored pipeline, or nil.
+func (s *Server) Pipeline(org, slug string) *buildkiteapi.Pipeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pipelines[org+"/"+slug]
+	if !ok {
+		return nil
+	}
+	cp := *p
+	return &cp
+}
+
+// PutPipeline stores a pipeline as if it was created outside the operator.
+func (s *Server) PutPipeline(org string, p buildkiteapi.Pipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	if p.ID == "" {
+		p.ID = fmt.Sprintf("pipeline-%d", s.nextID)
+	}
+	s.decorate(org, &p)
+	s.pipelines[org+"/"+p.Slug] = &p
+}
+
+// SetPipelineFields sets fields of a pipeline buildkiteapi.Pipeline has no
+// field for, e.g. "visibility". They are served along with the pipeline.
+func (s *Server) SetPipelineFields(org, slug string, fields map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fields[org+"/"+slug] = fields
+}
+
+// PutPipelineTeam gives a team access to a pipeline.
+func (s *Server) PutPipelineTeam(org, slug, team, accessLevel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.teams[org+"/"+slug] = append(s.teams[org+"/"+slug], buildkiteapi.PipelineTeam{Team: team, AccessLevel: accessLevel})
+}
+
+// Build returns a copy of a build of a pipeline, or nil.
+func (s *Server) Build(org, slug string, number int64) *buildkiteapi.Build {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.build(org, slug, number)
+	if b == nil {
+		return nil
+	}
+	cp := *b
+	return &cp
+}
+
+// UpdateBuild changes a stored build, e.g. to move it to another state.
+func (s *Server) UpdateBuild(org, slug string, number int64, update func(*buildkiteapi.Build)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := s.build(org, slug, number); b != nil {
+		update(b)
+	}
+}
+
+func (s *Server) build(org, slug string, number int64) *buildkiteapi.Build {
+	builds := s.builds[org+"/"+slug]
+	if number < 1 || number > int64(len(builds)) {
+		return nil
+	}
+	return builds[number-1]
+}
+
+// Schedules returns copies of the schedules of a pipeline.
+func (s *Server) Schedules(org, slug string) []buildkiteapi.Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := []buildkiteapi.Schedule{}
+	for _, sc := range s.schedules[org+"/"+slug] {
+		schedules = append(schedules, *sc)
+	}
+	return schedules
+}
+
+// PutSchedule stores a schedule as if it was created in the Buildkite UI.
+func (s *Server) PutSchedule(org, slug string, sc buildkiteapi.Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	if sc.ID == "" {
+		sc.ID = fmt.Sprintf("schedule-%d", s.nextID)
+	}
+	s.schedules[org+"/"+slug] = append(s.schedules[org+"/"+slug], &sc)
+}
+
+// AgentTokens returns the cluster agent tokens that are not revoked, with
+// their value.
+func (s *Server) AgentTokens() []buildkiteapi.AgentToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := []buildkiteapi.AgentToken{}
+	for _, t := range s.tokens {
+		if !t.revoked {
+			tokens = append(tokens, t.AgentToken)
+		}
+	}
+	return tokens
+}
+
+// OrganizationID is the GraphQL ID the fake server reports for an organization.
+func OrganizationID(org string) string {
+	return "graphql-org-" + org
+}
+
+// Requests returns the requests served so far, as "METHOD /path".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+Token {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Authentication required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var pipelinePath = regexp.MustCompile(`^/v2/organizations/([^/]+)/pipelines(?:/([^/]+))?(/archive)?$`)
+
+// pipelineRequestFields are the settings buildkiteapi.PipelineRequest has a
+// field for.
+var pipelineRequestFields = map[string]bool{
+	"name":                 true,
+	"repository":           true,
+	"description":          true,
+	"default_branch":       true,
+	"branch_configuration": true,
+	"configuration":        true,
+	"provider_settings":    true,
+}
+
+var buildPath = regexp.MustCompile(`^/v2/organizations/([^/]+)/pipelines/([^/]+)/builds(?:/([0-9]+))?$`)
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if m := buildPath.FindStringSubmatch(r.URL.Path); m != nil {
+		s.serveBuilds(w, r, m[1], m[2], m[3])
+		return
+	}
+	m := pipelinePath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+		return
+	}
+	org, slug, archive := m[1], m[2], m[3] != ""
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case slug == "" && r.Method == http.MethodGet:
+		s.listPipelines(w, r, org)
+	case slug == "" && r.Method == http.MethodPost:
+		req := buildkiteapi.PipelineRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if req.Name == "" || req.Repository == "" {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Validation Failed"})
+			return
+		}
+		p := &buildkiteapi.Pipeline{Slug: Slugify(req.Name)}
+		if _, ok := s.pipelines[org+"/"+p.Slug]; ok {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Slug has already been taken"})
+			return
+		}
+		s.nextID++
+		p.ID = fmt.Sprintf("pipeline-%d", s.nextID)
+		apply(p, &req)
+		s.decorate(org, p)
+		s.pipelines[org+"/"+p.Slug] = p
+		writeJSON(w, http.StatusCreated, p)
+	case slug != "":
+		p, ok := s.pipelines[org+"/"+slug]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		switch {
+		case archive && r.Method == http.MethodPost:
+			p.ArchivedAt = time.Now().UTC().Format(time.RFC3339)
+			writeJSON(w, http.StatusOK, p)
+		case r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, s.pipelineJSON(org, p))
+		case r.Method == http.MethodDelete && !archive:
+			delete(s.pipelines, org+"/"+slug)
+			delete(s.builds, org+"/"+slug)
+			delete(s.schedules, org+"/"+slug)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPatch:
+			raw := map[string]json.RawMessage{}
+			if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+			req := buildkiteapi.PipelineRequest{}
+			data, _ := json.Marshal(raw)
+			if err := json.Unmarshal(data, &req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+			apply(p, &req)
+			// Like Buildkite, any other setting sent replaces the stored one.
+			for k, v := range raw {
+				if pipelineRequestFields[k] {
+					continue
+				}
+				if s.fields[org+"/"+slug] == nil {
+					s.fields[org+"/"+slug] = map[string]interface{}{}
+				}
+				var value interface{}
+				_ = json.Unmarshal(v, &value)
+				s.fields[org+"/"+slug][k] = value
+			}
+			writeJSON(w, http.StatusOK, s.pipelineJSON(org, p))
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method Not Allowed"})
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method Not Allowed"})
+	}
+}
+
+// listPipelines serves a page of the pipelines of org, sorted by slug.
+func (s *Server) listPipelines(w http.ResponseWriter, r *http.Request, org string) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 30
+	}
+	slugs := []string{}
+	for key, p := range s.pipelines {
+		if strings.HasPrefix(key, org+"/") {
+			slugs = append(slugs, p.Slug)
+		}
+	}
+	sort.Strings(slugs)
+	out := []map[string]interface{}{}
+	for i := (page - 1) * perPage; i < len(slugs) && i < page*perPage; i++ {
+		out = append(out, s.pipelineJSON(org, s.pipelines[org+"/"+slugs[i]]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// pipelineJSON returns the pipeline with the fields set by SetPipelineFields.
+func (s *Server) pipelineJSON(org string, p *buildkiteapi.Pipeline) map[string]interface{} {
+	out := map[string]interface{}{}
+	data, _ := json.Marshal(p)
+	_ = json.Unmarshal(data, &out)
+	for k, v := range s.fields[org+"/"+p.Slug] {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *Server) serveBuilds(w http.ResponseWriter, r *http.Request, org, slug, number string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pipelines[org+"/"+slug]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+		return
+	}
+
+	switch {
+	case number == "" && r.Method == http.MethodPost:
+		req := buildkiteapi.BuildRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if req.Commit == "" || req.Branch == "" {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Validation Failed"})
+			return
+		}
+		s.nextID++
+		now := time.Now().UTC().Truncate(time.Second)
+		n := int64(len(s.builds[org+"/"+slug]) + 1)
+		b := &buildkiteapi.Build{
+			ID:        fmt.Sprintf("build-%d", s.nextID),
+			Number:    n,
+			State:     buildkiteapi.BuildStateScheduled,
+			WebURL:    fmt.Sprintf("https://buildkite.com/%s/%s/builds/%d", org, slug, n),
+			Commit:    req.Commit,
+			Branch:    req.Branch,
+			Message:   req.Message,
+			Env:       req.Env,
+			MetaData:  req.MetaData,
+			CreatedAt: &now,
+			Jobs: []buildkiteapi.Job{{
+				ID:    fmt.Sprintf("job-%d", s.nextID),
+				Type:  "script",
+				Name:  "build",
+				State: buildkiteapi.BuildStateScheduled,
+			}},
+		}
+		s.builds[org+"/"+slug] = append(s.builds[org+"/"+slug], b)
+		writeJSON(w, http.StatusCreated, b)
+	case number == "" && r.Method == http.MethodGet:
+		// Newest first, filtered on meta_data[key]=value like Buildkite.
+		out := []*buildkiteapi.Build{}
+		builds := s.builds[org+"/"+slug]
+		for i := len(builds) - 1; i >= 0; i-- {
+			if matchMetaData(builds[i], r.URL.Query()) {
+				out = append(out, builds[i])
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	case number != "" && r.Method == http.MethodGet:
+		n, _ := strconv.ParseInt(number, 10, 64)
+		b := s.build(org, slug, n)
+		if b == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method Not Allowed"})
+	}
+}
+
+// matchMetaData reports whether the build carries every meta_data[key] of
+// the query.
+func matchMetaData(b *buildkiteapi.Build, query url.Values) bool {
+	for param, values := range query {
+		key, ok := strings.CutPrefix(param, "meta_data[")
+		if !ok {
+			continue
+		}
+		if b.MetaData[strings.TrimSuffix(key, "]")] != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) decorate(org string, p *buildkiteapi.Pipeline) {
+	p.URL = fmt.Sprintf("%s/v2/organizations/%s/pipelines/%s", s.URL, org, p.Slug)
+	p.WebURL = fmt.Sprintf("https://buildkite.com/%s/%s", org, p.Slug)
+	p.GraphQLID = "graphql-" + p.ID
+}
+
+type graphQLRequest struct {
+	OperationName string `json:"operationName"`
+	Variables     struct {
+		Slug  string `json:"slug"`
+		Input struct {
+			ID             string `json:"id"`
+			PipelineID     string `json:"pipelineID"`
+			OrganizationID string `json:"organizationId"`
+			ClusterID      string `json:"clusterId"`
+			Description    string `json:"description"`
+			Label          string `json:"label"`
+			Cronline       string `json:"cronline"`
+			Branch         string `json:"branch"`
+			Commit         string `json:"commit"`
+			Message        string `json:"message"`
+			Env            string `json:"env"`
+			Enabled        bool   `json:"enabled"`
+		} `json:"input"`
+	} `json:"variables"`
+}
+
+// serveGraphQL serves the schedule operations sent by the client, keyed by
+// operation name. Like the real API, errors are reported with status 200.
+func (s *Server) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	req := graphQLRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	in := req.Variables.Input
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.OperationName {
+	case "PipelineSchedules":
+		if _, ok := s.pipelines[req.Variables.Slug]; !ok {
+			writeData(w, map[string]interface{}{"pipeline": nil})
+			return
+		}
+		edges := []map[string]interface{}{}
+		for _, sc := range s.schedules[req.Variables.Slug] {
+			edges = append(edges, map[string]interface{}{"node": sc})
+		}
+		writeData(w, map[string]interface{}{"pipeline": map[string]interface{}{
+			"schedules": map[string]interface{}{"edges": edges},
+		}})
+	case "PipelineTeams":
+		if _, ok := s.pipelines[req.Variables.Slug]; !ok {
+			writeData(w, map[string]interface{}{"pipeline": nil})
+			return
+		}
+		edges := []map[string]interface{}{}
+		for _, t := range s.teams[req.Variables.Slug] {
+			edges = append(edges, map[string]interface{}{"node": map[string]interface{}{
+				"accessLevel": t.AccessLevel,
+				"team":        map[string]string{"slug": t.Team},
+			}})
+		}
+		writeData(w, map[string]interface{}{"pipeline": map[string]interface{}{
+			"teams": map[string]interface{}{"edges": edges},
+		}})
+	case "PipelineScheduleCreate":
+		key := ""
+		for k, p := range s.pipelines {
+			if p.GraphQLID == in.PipelineID {
+				key = k
+			}
+		}
+		if key == "" {
+			writeErrors(w, "No pipeline found")
+			return
+		}
+		s.nextID++
+		sc := &buildkiteapi.Schedule{ID: fmt.Sprintf("schedule-%d", s.nextID)}
+		applySchedule(sc, req)
+		s.schedules[key] = append(s.schedules[key], sc)
+		writeData(w, map[string]interface{}{"pipelineScheduleCreate": map[string]interface{}{
+			"pipelineScheduleEdge": map[string]interface{}{"node": sc},
+		}})
+	case "PipelineScheduleUpdate":
+		sc := s.schedule(in.ID)
+		if sc == nil {
+			writeErrors(w, "No schedule found")
+			return
+		}
+		applySchedule(sc, req)
+		writeData(w, map[string]interface{}{"pipelineScheduleUpdate": map[string]interface{}{"pipelineSchedule": sc}})
+	case "PipelineScheduleDelete":
+		for k, schedules := range s.schedules {
+			for i, sc := range schedules {
+				if sc.ID == in.ID {
+					s.schedules[k] = append(schedules[:i:i], schedules[i+1:]...)
+					writeData(w, map[string]interface{}{"pipelineScheduleDelete": map[string]string{"deletedPipelineScheduleID": in.ID}})
+					return
+				}
+			}
+		}
+		writeErrors(w, "No schedule found")
+	case "Organization":
+		writeData(w, map[string]interface{}{"organization": map[string]string{"id": OrganizationID(req.Variables.Slug)}})
+	case "ClusterAgentTokenCreate":
+		if in.ClusterID == "" || in.OrganizationID == "" {
+			writeErrors(w, "organizationId and clusterId are required")
+			return
+		}
+		s.nextID++
+		t := &agentToken{
+			AgentToken: buildkiteapi.AgentToken{
+				ID:          fmt.Sprintf("agent-token-%d", s.nextID),
+				UUID:        fmt.Sprintf("uuid-%d", s.nextID),
+				Description: in.Description,
+				Token:       fmt.Sprintf("bkct_%d", s.nextID),
+			},
+			orgID:     in.OrganizationID,
+			clusterID: in.ClusterID,
+		}
+		s.tokens = append(s.tokens, t)
+		writeData(w, map[string]interface{}{"clusterAgentTokenCreate": map[string]interface{}{
+			"tokenValue":            t.Token,
+			"clusterAgentTokenEdge": map[string]interface{}{"node": t.AgentToken},
+		}})
+	case "ClusterAgentTokenRevoke":
+		for _, t := range s.tokens {
+			if t.ID == in.ID && t.orgID == in.OrganizationID && !t.revoked {
+				t.revoked = true
+				writeData(w, map[string]interface{}{"clusterAgentTokenRevoke": map[string]string{"deletedClusterAgentTokenId": t.ID}})
+				return
+			}
+		}
+		writeErrors(w, "Cluster agent token not found")
+	default:
+		writeErrors(w, fmt.Sprintf("unknown operation %q", req.OperationName))
+	}
+}
+
+func (s *Server) schedule(id string) *buildkiteapi.Schedule {
+	for _, schedules := range s.schedules {
+		for _, sc := range schedules {
+			if sc.ID == id {
+				return sc
+			}
+		}
+	}
+	return nil
+}
+
+// applySchedule stores a create or update input. The next build is due an
+// hour from now for every enabled schedule, the fake does not parse cron.
+func applySchedule(sc *buildkiteapi.Schedule, req graphQLRequest) {
+	in := req.Variables.Input
+	sc.Label = in.Label
+	sc.Cronline = in.Cronline
+	sc.Branch = in.Branch
+	sc.Commit = in.Commit
+	sc.Message = in.Message
+	sc.Env = nil
+	if in.Env != "" {
+		sc.Env = strings.Split(in.Env, "\n")
+	}
+	sc.Enabled = in.Enabled
+	sc.NextBuildAt = nil
+	if sc.Enabled {
+		next := time.Now().UTC().Truncate(time.Second).Add(time.Hour)
+		sc.NextBuildAt = &next
+	}
+}
+
+func apply(p *buildkiteapi.Pipeline, req *buildkiteapi.PipelineRequest) {
+	if req.Name != "" {
+		p.Name = req.Name
+	}
+	if req.Repository != "" {
+		p.Repository = req.Repository
+	}
+	p.Description = req.Description
+	p.DefaultBranch = req.DefaultBranch
+	p.BranchConfiguration = req.BranchConfiguration
+	if req.Configuration != "" {
+		p.Configuration = req.Configuration
+	}
+	if req.ProviderSettings != nil {
+		p.Provider = &buildkiteapi.Provider{ID: "github", Settings: req.ProviderSettings}
+	}
+}
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify derives a pipeline slug from its name the way Buildkite does.
+func Slugify(name string) string {
+	return strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+func writeErrors(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": nil, "errors": []map[string]string{{"message": message}}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,304 @@
+package buildkiteapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the base URL of the Buildkite REST API.
+const DefaultURL = "https://api.buildkite.com"
+
+// ErrNotFound is returned when the Buildkite API answers 404.
+var ErrNotFound = errors.New("buildkite: not found")
+
+// IsNotFound reports whether err is a 404 from the Buildkite API.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// ErrUnauthorized is returned when the Buildkite API rejects the token.
+var ErrUnauthorized = errors.New("buildkite: unauthorized")
+
+// IsUnauthorized reports whether err is a 401 or 403 from the Buildkite API.
+func IsUnauthorized(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
+
+// Client is the part of the Buildkite REST API used by the operator.
+type Client interface {
+	GetPipeline(ctx context.Context, org, slug string) (*Pipeline, error)
+	CreatePipeline(ctx context.Context, org string, pipeline *PipelineRequest) (*Pipeline, error)
+	UpdatePipeline(ctx context.Context, org, slug string, pipeline *PipelineRequest) (*Pipeline, error)
+	ArchivePipeline(ctx context.Context, org, slug string) error
+	// DeletePipeline deletes the pipeline with all its builds.
+	DeletePipeline(ctx context.Context, org, slug string) error
+	// ListPipelines returns all pipelines of the organization, archived
+	// ones included.
+	ListPipelines(ctx context.Context, org string) ([]Pipeline, error)
+	// ListPipelineTeams goes through the GraphQL API.
+	ListPipelineTeams(ctx context.Context, org, pipeline string) ([]PipelineTeam, error)
+
+	CreateBuild(ctx context.Context, org, pipeline string, build *BuildRequest) (*Build, error)
+	GetBuild(ctx context.Context, org, pipeline string, number int64) (*Build, error)
+	// FindBuild returns the latest build whose meta-data key is set to
+	// value, or ErrNotFound.
+	FindBuild(ctx context.Context, org, pipeline, key, value string) (*Build, error)
+
+	// Schedules go through the GraphQL API, pipelineID is the GraphQL ID of
+	// the pipeline.
+	ListSchedules(ctx context.Context, org, pipeline string) ([]Schedule, error)
+	CreateSchedule(ctx context.Context, pipelineID string, schedule *ScheduleRequest) (*Schedule, error)
+	UpdateSchedule(ctx context.Context, id string, schedule *ScheduleRequest) (*Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+
+	// Cluster agent tokens go through the GraphQL API too, orgID is the
+	// GraphQL ID of the organization.
+	OrganizationID(ctx context.Context, org string) (string, error)
+	CreateClusterAgentToken(ctx context.Context, orgID, clusterID, description string) (*AgentToken, error)
+	RevokeClusterAgentToken(ctx context.Context, orgID, id string) error
+}
+
+// Factory builds a Client authenticated with the given API token.
+type Factory func(token string) Client
+
+// APIError is a non successful response of the Buildkite API.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("buildkite: %d %s", e.StatusCode, e.Message)
+}
+
+// Unwrap maps 404 responses to ErrNotFound, 401 and 403 responses to
+// ErrUnauthorized.
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+type httpClient struct {
+	baseURL    string
+	graphQLURL string
+	token      string
+	http       *http.Client
+}
+
+// New returns a Client talking to the Buildkite REST API at baseURL. The
+// GraphQL API is expected at baseURL/graphql unless baseURL is DefaultURL.
+func New(baseURL, token string) Client {
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	graphQLURL := baseURL + "/graphql"
+	if baseURL == DefaultURL {
+		graphQLURL = DefaultGraphQLURL
+	}
+	return &httpClient{
+		baseURL:    baseURL,
+		graphQLURL: graphQLURL,
+		token:      token,
+		http:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// NewFactory returns a Factory for the Buildkite REST API at baseURL.
+func NewFactory(baseURL string) Factory {
+	return func(token string) Client {
+		return New(baseURL, token)
+	}
+}
+
+func (c *httpClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return c.doURL(ctx, method, c.baseURL+path, in, out)
+}
+
+func (c *httpClient) doURL(ctx context.Context, method, target string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: msg.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func pipelinePath(org, slug string) string {
+	return fmt.Sprintf("/v2/organizations/%s/pipelines/%s", url.PathEscape(org), url.PathEscape(slug))
+}
+
+func (c *httpClient) GetPipeline(ctx context.Context, org, slug string) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	if err := c.do(ctx, http.MethodGet, pipelinePath(org, slug), nil, pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (c *httpClient) CreatePipeline(ctx context.Context, org string, in *PipelineRequest) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	path := fmt.Sprintf("/v2/organizations/%s/pipelines", url.PathEscape(org))
+	if err := c.do(ctx, http.MethodPost, path, in, pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (c *httpClient) UpdatePipeline(ctx context.Context, org, slug string, in *PipelineRequest) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	if err := c.do(ctx, http.MethodPatch, pipelinePath(org, slug), in, pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (c *httpClient) ArchivePipeline(ctx context.Context, org, slug string) error {
+	return c.do(ctx, http.MethodPost, pipelinePath(org, slug)+"/archive", nil, nil)
+}
+
+func (c *httpClient) DeletePipeline(ctx context.Context, org, slug string) error {
+	return c.do(ctx, http.MethodDelete, pipelinePath(org, slug), nil, nil)
+}
+
+// pipelinesPerPage is the largest page the REST API serves.
+const pipelinesPerPage = 100
+
+func (c *httpClient) ListPipelines(ctx context.Context, org string) ([]Pipeline, error) {
+	pipelines := []Pipeline{}
+	for page := 1; ; page++ {
+		raw := []json.RawMessage{}
+		path := fmt.Sprintf("/v2/organizations/%s/pipelines?page=%d&per_page=%d", url.PathEscape(org), page, pipelinesPerPage)
+		if err := c.do(ctx, http.MethodGet, path, nil, &raw); err != nil {
+			return nil, err
+		}
+		for _, data := range raw {
+			p, err := decodePipeline(data)
+			if err != nil {
+				return nil, err
+			}
+			pipelines = append(pipelines, *p)
+		}
+		if len(raw) < pipelinesPerPage {
+			return pipelines, nil
+		}
+	}
+}
+
+// decodePipeline decodes a pipeline and keeps the fields Pipeline has no
+// field for in Extra.
+func decodePipeline(data []byte) (*Pipeline, error) {
+	p := &Pipeline{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	provider, _ := fields["provider"].(map[string]interface{})
+	for _, name := range jsonFields(Pipeline{}) {
+		delete(fields, name)
+	}
+	if settings, ok := provider["settings"].(map[string]interface{}); ok {
+		for _, name := range jsonFields(ProviderSettings{}) {
+			delete(settings, name)
+		}
+		if len(settings) > 0 {
+			fields["provider_settings"] = settings
+		}
+	}
+	if len(fields) > 0 {
+		p.Extra = fields
+	}
+	return p, nil
+}
+
+// jsonFields returns the JSON names of the fields of the struct v.
+func jsonFields(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (c *httpClient) CreateBuild(ctx context.Context, org, pipeline string, in *BuildRequest) (*Build, error) {
+	build := &Build{}
+	if err := c.do(ctx, http.MethodPost, pipelinePath(org, pipeline)+"/builds", in, build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (c *httpClient) FindBuild(ctx context.Context, org, pipeline, key, value string) (*Build, error) {
+	builds := []Build{}
+	query := url.Values{"meta_data[" + key + "]": {value}, "per_page": {"1"}}
+	path := fmt.Sprintf("%s/builds?%s", pipelinePath(org, pipeline), query.Encode())
+	if err := c.do(ctx, http.MethodGet, path, nil, &builds); err != nil {
+		return nil, err
+	}
+	if len(builds) == 0 {
+		return nil, fmt.Errorf("build with meta-data %s=%s: %w", key, value, ErrNotFound)
+	}
+	return &builds[0], nil
+}
+
+func (c *httpClient) GetBuild(ctx context.Context, org, pipeline string, number int64) (*Build, error) {
+	build := &Build{}
+	path := fmt.Sprintf("%s/builds/%d", pipelinePath(org, pipeline), number)
+	if err := c.do(ctx, http.MethodGet, path, nil, build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
@@ -0,0 +1,217 @@
+package buildkiteapi_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cops/internal/buildkiteapi"
+	"cops/internal/buildkiteapi/buildkiteapitest"
+)
+
+func TestPipelineLifecycle(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	api := server.Client()
+	ctx := context.Background()
+
+	if _, err := api.GetPipeline(ctx, "acme", "web"); !buildkiteapi.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	created, err := api.CreatePipeline(ctx, "acme", &buildkiteapi.PipelineRequest{
+		Name:          "Web",
+		Repository:    "git@github.com:acme/web.git",
+		Configuration: "steps:\n  - command: make\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Slug != "web" || created.ID == "" || created.WebURL == "" {
+		t.Fatalf("unexpected pipeline %+v", created)
+	}
+
+	updated, err := api.UpdatePipeline(ctx, "acme", "web", &buildkiteapi.PipelineRequest{DefaultBranch: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.DefaultBranch != "main" {
+		t.Errorf("default branch not updated: %+v", updated)
+	}
+
+	if err := api.ArchivePipeline(ctx, "acme", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Pipeline("acme", "web").ArchivedAt == "" {
+		t.Error("pipeline was not archived")
+	}
+
+	if err := api.DeletePipeline(ctx, "acme", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Pipeline("acme", "web") != nil {
+		t.Error("pipeline was not deleted")
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+
+	_, err := buildkiteapi.New(server.URL, "wrong").GetPipeline(context.Background(), "acme", "web")
+	apiErr, ok := err.(*buildkiteapi.APIError)
+	if !ok || apiErr.StatusCode != 401 {
+		t.Fatalf("expected a 401 APIError, got %v", err)
+	}
+}
+
+func TestBuildLifecycle(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	server.PutPipeline("acme", buildkiteapi.Pipeline{Name: "Web", Slug: "web"})
+	api := server.Client()
+	ctx := context.Background()
+
+	created, err := api.CreateBuild(ctx, "acme", "web", &buildkiteapi.BuildRequest{
+		Commit:   "HEAD",
+		Branch:   "main",
+		MetaData: map[string]string{"release": "1.2.3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Number != 1 || created.State != buildkiteapi.BuildStateScheduled {
+		t.Fatalf("unexpected build %+v", created)
+	}
+
+	server.UpdateBuild("acme", "web", 1, func(b *buildkiteapi.Build) {
+		b.State = buildkiteapi.BuildStatePassed
+	})
+	got, err := api.GetBuild(ctx, "acme", "web", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !buildkiteapi.BuildFinished(got.State) || got.MetaData["release"] != "1.2.3" {
+		t.Errorf("unexpected build %+v", got)
+	}
+
+	if _, err := api.GetBuild(ctx, "acme", "web", 2); !buildkiteapi.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestScheduleLifecycle(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	api := server.Client()
+	ctx := context.Background()
+
+	if _, err := api.ListSchedules(ctx, "acme", "web"); !buildkiteapi.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	server.PutPipeline("acme", buildkiteapi.Pipeline{Name: "Web", Slug: "web", Repository: "git@github.com:acme/web.git"})
+	p := server.Pipeline("acme", "web")
+
+	created, err := api.CreateSchedule(ctx, p.GraphQLID, &buildkiteapi.ScheduleRequest{
+		Label:    "nightly",
+		Cronline: "@daily",
+		Branch:   "main",
+		Env:      []string{"A=1", "B=2"},
+		Enabled:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.NextBuildAt == nil || len(created.Env) != 2 {
+		t.Fatalf("unexpected schedule %+v", created)
+	}
+
+	updated, err := api.UpdateSchedule(ctx, created.ID, &buildkiteapi.ScheduleRequest{Label: "nightly", Cronline: "0 2 * * *"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Cronline != "0 2 * * *" || updated.Enabled || updated.NextBuildAt != nil {
+		t.Errorf("schedule not updated: %+v", updated)
+	}
+
+	schedules, err := api.ListSchedules(ctx, "acme", "web")
+	if err != nil || len(schedules) != 1 {
+		t.Fatalf("list: %v %+v", err, schedules)
+	}
+	if err := api.DeleteSchedule(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.DeleteSchedule(ctx, created.ID); err == nil {
+		t.Error("deleting a missing schedule must fail")
+	}
+	if n := len(server.Schedules("acme", "web")); n != 0 {
+		t.Errorf("expected no schedules, got %d", n)
+	}
+}
+
+func TestClusterAgentTokenLifecycle(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	api := server.Client()
+	ctx := context.Background()
+
+	orgID, err := api.OrganizationID(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := api.CreateClusterAgentToken(ctx, orgID, "cluster-1", "agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.ID == "" || token.Token == "" {
+		t.Fatalf("unexpected token %+v", token)
+	}
+	if tokens := server.AgentTokens(); len(tokens) != 1 || tokens[0].Token != token.Token {
+		t.Errorf("token not stored: %+v", tokens)
+	}
+
+	if err := api.RevokeClusterAgentToken(ctx, orgID, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.RevokeClusterAgentToken(ctx, orgID, token.ID); !buildkiteapi.IsNotFound(err) {
+		t.Errorf("revoking twice: expected not found, got %v", err)
+	}
+	if n := len(server.AgentTokens()); n != 0 {
+		t.Errorf("expected no active tokens, got %d", n)
+	}
+}
+
+func TestListPipelines(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	for i := 0; i < 105; i++ {
+		server.PutPipeline("acme", buildkiteapi.Pipeline{Slug: fmt.Sprintf("p%03d", i), Name: "p", Repository: "r"})
+	}
+	server.PutPipeline("other", buildkiteapi.Pipeline{Slug: "web", Name: "web", Repository: "r"})
+	server.SetPipelineFields("acme", "p000", map[string]interface{}{"visibility": "private"})
+	server.PutPipelineTeam("acme", "p000", "platform", "MANAGE_BUILD_AND_READ")
+	api := server.Client()
+	ctx := context.Background()
+
+	pipelines, err := api.ListPipelines(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipelines) != 105 {
+		t.Fatalf("expected 105 pipelines over two pages, got %d", len(pipelines))
+	}
+	if extra := pipelines[0].Extra; len(extra) != 1 || extra["visibility"] != "private" {
+		t.Errorf("unknown fields not kept: %v", extra)
+	}
+
+	teams, err := api.ListPipelineTeams(ctx, "acme", "p000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 1 || teams[0].Team != "platform" || teams[0].AccessLevel != "MANAGE_BUILD_AND_READ" {
+		t.Errorf("unexpected teams %+v", teams)
+	}
+	if _, err := api.ListPipelineTeams(ctx, "acme", "missing"); !buildkiteapi.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
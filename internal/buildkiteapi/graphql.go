@@ -0,0 +1,254 @@
+package buildkiteapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultGraphQLURL is the Buildkite GraphQL API. Schedules are only
+// available there.
+const DefaultGraphQLURL = "https://graphql.buildkite.com/v1"
+
+// GraphQLError is a response of the GraphQL API carrying errors.
+type GraphQLError struct {
+	Messages []string
+}
+
+func (e *GraphQLError) Error() string {
+	return "buildkite: " + strings.Join(e.Messages, "; ")
+}
+
+// Unwrap maps "not found" errors to ErrNotFound, GraphQL reports them with
+// status 200.
+func (e *GraphQLError) Unwrap() error {
+	for _, m := range e.Messages {
+		if strings.Contains(strings.ToLower(m), "not found") {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+type graphQLRequest struct {
+	OperationName string                 `json:"operationName"`
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphql runs an operation against the GraphQL API and decodes its data
+// into out.
+func (c *httpClient) graphql(ctx context.Context, operation, query string, variables map[string]interface{}, out interface{}) error {
+	resp := graphQLResponse{}
+	in := graphQLRequest{OperationName: operation, Query: query, Variables: variables}
+	if err := c.doURL(ctx, http.MethodPost, c.graphQLURL, &in, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		err := &GraphQLError{}
+		for _, e := range resp.Errors {
+			err.Messages = append(err.Messages, e.Message)
+		}
+		return err
+	}
+	return json.Unmarshal(resp.Data, out)
+}
+
+const scheduleFields = `id label cronline branch commit message env enabled nextBuildAt`
+
+const listSchedulesQuery = `query PipelineSchedules($slug: ID!) {
+  pipeline(slug: $slug) {
+    schedules(first: 100) { edges { node { ` + scheduleFields + ` } } }
+  }
+}`
+
+const createScheduleMutation = `mutation PipelineScheduleCreate($input: PipelineScheduleCreateInput!) {
+  pipelineScheduleCreate(input: $input) { pipelineScheduleEdge { node { ` + scheduleFields + ` } } }
+}`
+
+const updateScheduleMutation = `mutation PipelineScheduleUpdate($input: PipelineScheduleUpdateInput!) {
+  pipelineScheduleUpdate(input: $input) { pipelineSchedule { ` + scheduleFields + ` } }
+}`
+
+const deleteScheduleMutation = `mutation PipelineScheduleDelete($input: PipelineScheduleDeleteInput!) {
+  pipelineScheduleDelete(input: $input) { deletedPipelineScheduleID }
+}`
+
+func (c *httpClient) ListSchedules(ctx context.Context, org, pipeline string) ([]Schedule, error) {
+	out := struct {
+		Pipeline *struct {
+			Schedules struct {
+				Edges []struct {
+					Node Schedule `json:"node"`
+				} `json:"edges"`
+			} `json:"schedules"`
+		} `json:"pipeline"`
+	}{}
+	vars := map[string]interface{}{"slug": org + "/" + pipeline}
+	if err := c.graphql(ctx, "PipelineSchedules", listSchedulesQuery, vars, &out); err != nil {
+		return nil, err
+	}
+	if out.Pipeline == nil {
+		return nil, fmt.Errorf("pipeline %s/%s: %w", org, pipeline, ErrNotFound)
+	}
+	schedules := make([]Schedule, 0, len(out.Pipeline.Schedules.Edges))
+	for _, e := range out.Pipeline.Schedules.Edges {
+		schedules = append(schedules, e.Node)
+	}
+	return schedules, nil
+}
+
+const listPipelineTeamsQuery = `query PipelineTeams($slug: ID!) {
+  pipeline(slug: $slug) {
+    teams(first: 100) { edges { node { accessLevel team { slug } } } }
+  }
+}`
+
+func (c *httpClient) ListPipelineTeams(ctx context.Context, org, pipeline string) ([]PipelineTeam, error) {
+	out := struct {
+		Pipeline *struct {
+			Teams struct {
+				Edges []struct {
+					Node struct {
+						AccessLevel string `json:"accessLevel"`
+						Team        struct {
+							Slug string `json:"slug"`
+						} `json:"team"`
+					} `json:"node"`
+				} `json:"edges"`
+			} `json:"teams"`
+		} `json:"pipeline"`
+	}{}
+	vars := map[string]interface{}{"slug": org + "/" + pipeline}
+	if err := c.graphql(ctx, "PipelineTeams", listPipelineTeamsQuery, vars, &out); err != nil {
+		return nil, err
+	}
+	if out.Pipeline == nil {
+		return nil, fmt.Errorf("pipeline %s/%s: %w", org, pipeline, ErrNotFound)
+	}
+	teams := make([]PipelineTeam, 0, len(out.Pipeline.Teams.Edges))
+	for _, e := range out.Pipeline.Teams.Edges {
+		teams = append(teams, PipelineTeam{Team: e.Node.Team.Slug, AccessLevel: e.Node.AccessLevel})
+	}
+	return teams, nil
+}
+
+func (c *httpClient) CreateSchedule(ctx context.Context, pipelineID string, in *ScheduleRequest) (*Schedule, error) {
+	out := struct {
+		Create struct {
+			Edge struct {
+				Node Schedule `json:"node"`
+			} `json:"pipelineScheduleEdge"`
+		} `json:"pipelineScheduleCreate"`
+	}{}
+	input := in.input()
+	input["pipelineID"] = pipelineID
+	vars := map[string]interface{}{"input": input}
+	if err := c.graphql(ctx, "PipelineScheduleCreate", createScheduleMutation, vars, &out); err != nil {
+		return nil, err
+	}
+	return &out.Create.Edge.Node, nil
+}
+
+func (c *httpClient) UpdateSchedule(ctx context.Context, id string, in *ScheduleRequest) (*Schedule, error) {
+	out := struct {
+		Update struct {
+			Schedule Schedule `json:"pipelineSchedule"`
+		} `json:"pipelineScheduleUpdate"`
+	}{}
+	input := in.input()
+	input["id"] = id
+	vars := map[string]interface{}{"input": input}
+	if err := c.graphql(ctx, "PipelineScheduleUpdate", updateScheduleMutation, vars, &out); err != nil {
+		return nil, err
+	}
+	return &out.Update.Schedule, nil
+}
+
+func (c *httpClient) DeleteSchedule(ctx context.Context, id string) error {
+	out := struct{}{}
+	vars := map[string]interface{}{"input": map[string]interface{}{"id": id}}
+	return c.graphql(ctx, "PipelineScheduleDelete", deleteScheduleMutation, vars, &out)
+}
+
+const organizationQuery = `query Organization($slug: ID!) {
+  organization(slug: $slug) { id }
+}`
+
+const createAgentTokenMutation = `mutation ClusterAgentTokenCreate($input: ClusterAgentTokenCreateInput!) {
+  clusterAgentTokenCreate(input: $input) {
+    tokenValue
+    clusterAgentTokenEdge { node { id uuid description } }
+  }
+}`
+
+const revokeAgentTokenMutation = `mutation ClusterAgentTokenRevoke($input: ClusterAgentTokenRevokeInput!) {
+  clusterAgentTokenRevoke(input: $input) { deletedClusterAgentTokenId }
+}`
+
+func (c *httpClient) OrganizationID(ctx context.Context, org string) (string, error) {
+	out := struct {
+		Organization *struct {
+			ID string `json:"id"`
+		} `json:"organization"`
+	}{}
+	vars := map[string]interface{}{"slug": org}
+	if err := c.graphql(ctx, "Organization", organizationQuery, vars, &out); err != nil {
+		return "", err
+	}
+	if out.Organization == nil {
+		return "", fmt.Errorf("organization %s: %w", org, ErrNotFound)
+	}
+	return out.Organization.ID, nil
+}
+
+func (c *httpClient) CreateClusterAgentToken(ctx context.Context, orgID, clusterID, description string) (*AgentToken, error) {
+	out := struct {
+		Create struct {
+			TokenValue string `json:"tokenValue"`
+			Edge       struct {
+				Node AgentToken `json:"node"`
+			} `json:"clusterAgentTokenEdge"`
+		} `json:"clusterAgentTokenCreate"`
+	}{}
+	vars := map[string]interface{}{"input": map[string]interface{}{
+		"organizationId": orgID,
+		"clusterId":      clusterID,
+		"description":    description,
+	}}
+	if err := c.graphql(ctx, "ClusterAgentTokenCreate", createAgentTokenMutation, vars, &out); err != nil {
+		return nil, err
+	}
+	token := out.Create.Edge.Node
+	token.Token = out.Create.TokenValue
+	return &token, nil
+}
+
+func (c *httpClient) RevokeClusterAgentToken(ctx context.Context, orgID, id string) error {
+	out := struct{}{}
+	vars := map[string]interface{}{"input": map[string]interface{}{"organizationId": orgID, "id": id}}
+	return c.graphql(ctx, "ClusterAgentTokenRevoke", revokeAgentTokenMutation, vars, &out)
+}
+
+// input is the GraphQL input of the create and update mutations. The API
+// takes env as newline separated KEY=VALUE pairs.
+func (r *ScheduleRequest) input() map[string]interface{} {
+	return map[string]interface{}{
+		"label":    r.Label,
+		"cronline": r.Cronline,
+		"branch":   r.Branch,
+		"commit":   r.Commit,
+		"message":  r.Message,
+		"env":      strings.Join(r.Env, "\n"),
+		"enabled":  r.Enabled,
+	}
+}
@@ -0,0 +1,167 @@
+package buildkiteapi
+
+import "time"
+
+// Pipeline is a Buildkite pipeline as returned by the REST API.
+type Pipeline struct {
+	ID                  string    `json:"id"`
+	GraphQLID           string    `json:"graphql_id,omitempty"`
+	URL                 string    `json:"url,omitempty"`
+	WebURL              string    `json:"web_url,omitempty"`
+	Name                string    `json:"name"`
+	Slug                string    `json:"slug"`
+	Description         string    `json:"description,omitempty"`
+	Repository          string    `json:"repository"`
+	DefaultBranch       string    `json:"default_branch,omitempty"`
+	BranchConfiguration string    `json:"branch_configuration,omitempty"`
+	Configuration       string    `json:"configuration,omitempty"`
+	Provider            *Provider `json:"provider,omitempty"`
+	ArchivedAt          string    `json:"archived_at,omitempty"`
+
+	// Extra holds the fields of the response Pipeline has no field for,
+	// and the unknown provider settings under "provider_settings". Only
+	// ListPipelines fills it.
+	Extra map[string]interface{} `json:"-"`
+}
+
+// Provider is the source code provider of a pipeline.
+type Provider struct {
+	ID       string            `json:"id,omitempty"`
+	Settings *ProviderSettings `json:"settings,omitempty"`
+}
+
+// ProviderSettings control which source events trigger builds.
+type ProviderSettings struct {
+	TriggerMode         string `json:"trigger_mode,omitempty"`
+	BuildPullRequests   *bool  `json:"build_pull_requests,omitempty"`
+	BuildBranches       *bool  `json:"build_branches,omitempty"`
+	BuildTags           *bool  `json:"build_tags,omitempty"`
+	PublishCommitStatus *bool  `json:"publish_commit_status,omitempty"`
+	FilterEnabled       *bool  `json:"filter_enabled,omitempty"`
+	FilterCondition     string `json:"filter_condition,omitempty"`
+}
+
+// PipelineRequest is the body of the create and update pipeline calls.
+// Description is always sent, so it can be cleared.
+type PipelineRequest struct {
+	Name                string            `json:"name,omitempty"`
+	Repository          string            `json:"repository,omitempty"`
+	Description         string            `json:"description"`
+	DefaultBranch       string            `json:"default_branch,omitempty"`
+	BranchConfiguration string            `json:"branch_configuration,omitempty"`
+	Configuration       string            `json:"configuration,omitempty"`
+	ProviderSettings    *ProviderSettings `json:"provider_settings,omitempty"`
+}
+
+// Build is a Buildkite build as returned by the REST API.
+type Build struct {
+	ID          string            `json:"id"`
+	Number      int64             `json:"number"`
+	State       string            `json:"state"`
+	WebURL      string            `json:"web_url,omitempty"`
+	Commit      string            `json:"commit,omitempty"`
+	Branch      string            `json:"branch,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	MetaData    map[string]string `json:"meta_data,omitempty"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty"`
+	ScheduledAt *time.Time        `json:"scheduled_at,omitempty"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Jobs        []Job             `json:"jobs,omitempty"`
+}
+
+// Job is a job of a build. Wait and block steps are jobs too.
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Name       string     `json:"name,omitempty"`
+	State      string     `json:"state,omitempty"`
+	WebURL     string     `json:"web_url,omitempty"`
+	ExitStatus *int32     `json:"exit_status,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// BuildRequest is the body of the create build call.
+type BuildRequest struct {
+	Commit   string            `json:"commit"`
+	Branch   string            `json:"branch"`
+	Message  string            `json:"message,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	MetaData map[string]string `json:"meta_data,omitempty"`
+}
+
+// Build states reported by Buildkite.
+const (
+	BuildStateScheduled = "scheduled"
+	BuildStateRunning   = "running"
+	BuildStatePassed    = "passed"
+	BuildStateFailed    = "failed"
+	BuildStateBlocked   = "blocked"
+	BuildStateCanceled  = "canceled"
+	BuildStateSkipped   = "skipped"
+	BuildStateNotRun    = "not_run"
+)
+
+// BuildFinished reports whether a build in state will not change anymore.
+func BuildFinished(state string) bool {
+	switch state {
+	case BuildStatePassed, BuildStateFailed, BuildStateCanceled, BuildStateSkipped, BuildStateNotRun:
+		return true
+	}
+	return false
+}
+
+// Agent is a Buildkite agent as returned by the REST API and webhooks.
+type Agent struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name,omitempty"`
+	ConnectionState string     `json:"connection_state,omitempty"`
+	Hostname        string     `json:"hostname,omitempty"`
+	Version         string     `json:"version,omitempty"`
+	MetaData        []string   `json:"meta_data,omitempty"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	Job             *Job       `json:"job,omitempty"`
+}
+
+// Schedule is a pipeline schedule as returned by the GraphQL API.
+type Schedule struct {
+	ID          string     `json:"id"`
+	Label       string     `json:"label"`
+	Cronline    string     `json:"cronline"`
+	Branch      string     `json:"branch,omitempty"`
+	Commit      string     `json:"commit,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	Env         []string   `json:"env,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	NextBuildAt *time.Time `json:"nextBuildAt,omitempty"`
+}
+
+// ScheduleRequest is the input of the create and update schedule mutations.
+// Env holds KEY=VALUE pairs.
+type ScheduleRequest struct {
+	Label    string
+	Cronline string
+	Branch   string
+	Commit   string
+	Message  string
+	Env      []string
+	Enabled  bool
+}
+
+// PipelineTeam is a team with access to a pipeline, as returned by the
+// GraphQL API.
+type PipelineTeam struct {
+	Team        string `json:"team"`
+	AccessLevel string `json:"accessLevel"`
+}
+
+// AgentToken is a cluster agent token. Token is only known right after the
+// token was created.
+type AgentToken struct {
+	ID          string `json:"id"`
+	UUID        string `json:"uuid,omitempty"`
+	Description string `json:"description,omitempty"`
+	Token       string `json:"-"`
+}
@@ -0,0 +1,241 @@
+package buildkitewebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/build"
+	"cops/internal/buildkite"
+	"cops/internal/buildkiteapi"
+)
+
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitebuilds,verbs=get;list;watch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitebuilds/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelines,verbs=get;list;watch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Field indexes the receiver lists resources with, so an event does not go
+// through every object of the cluster.
+const (
+	// buildIDField indexes BuildkiteBuilds and BuildkitePipelines by the ID
+	// Buildkite gave them
+	buildIDField = "status.id"
+	// queueField indexes Buildkites by the queue of their agents
+	queueField = "spec.agent.queue"
+)
+
+type index struct {
+	obj     client.Object
+	field   string
+	extract client.IndexerFunc
+}
+
+var indexes = []index{
+	{&copsv1alpha1.BuildkiteBuild{}, buildIDField, func(obj client.Object) []string {
+		return nonEmpty(obj.(*copsv1alpha1.BuildkiteBuild).Status.ID)
+	}},
+	{&copsv1alpha1.BuildkitePipeline{}, buildIDField, func(obj client.Object) []string {
+		return nonEmpty(obj.(*copsv1alpha1.BuildkitePipeline).Status.ID)
+	}},
+	{&copsv1alpha1.Buildkite{}, queueField, func(obj client.Object) []string {
+		return []string{buildkite.Queue(obj.(*copsv1alpha1.Buildkite).Spec.Agent)}
+	}},
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// SetupIndexes registers the field indexes the receiver lists with. It must
+// be called before the manager starts.
+func SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	for _, ix := range indexes {
+		if err := indexer.IndexField(ctx, ix.obj, ix.field, ix.extract); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Event is the body of a Buildkite webhook.
+type Event struct {
+	Event    string                 `json:"event"`
+	Build    *buildkiteapi.Build    `json:"build,omitempty"`
+	Job      *buildkiteapi.Job      `json:"job,omitempty"`
+	Pipeline *buildkiteapi.Pipeline `json:"pipeline,omitempty"`
+	Agent    *buildkiteapi.Agent    `json:"agent,omitempty"`
+}
+
+// Handle applies an event: build.* and job.* update the matching
+// BuildkiteBuild and record events on it and on its BuildkitePipeline,
+// agent.* record events on the Buildkites serving the agent queue. Other
+// events, such as ping, are ignored.
+func (r *Receiver) Handle(ctx context.Context, ev *Event) error {
+	kind, action, _ := strings.Cut(ev.Event, ".")
+	switch kind {
+	case "build":
+		if ev.Build == nil {
+			return fmt.Errorf("%s event without a build", ev.Event)
+		}
+		return r.handleBuild(ctx, ev, action)
+	case "job":
+		if ev.Build == nil || ev.Job == nil {
+			return fmt.Errorf("%s event without a build or job", ev.Event)
+		}
+		return r.handleJob(ctx, ev, action)
+	case "agent":
+		if ev.Agent == nil {
+			return fmt.Errorf("%s event without an agent", ev.Event)
+		}
+		return r.handleAgent(ctx, ev, action)
+	}
+	return nil
+}
+
+func (r *Receiver) handleBuild(ctx context.Context, ev *Event, action string) error {
+	eventType, reason := corev1.EventTypeNormal, "Build"+camel(action)
+	if ev.Build.State == buildkiteapi.BuildStateFailed || action == "failing" {
+		eventType = corev1.EventTypeWarning
+	}
+	message := fmt.Sprintf("Build #%d %s", ev.Build.Number, ev.Build.State)
+
+	err := r.updateBuilds(ctx, ev.Build.ID, func(b *copsv1alpha1.BuildkiteBuild) bool {
+		// Webhooks can arrive out of order, never move a finished build back.
+		if build.Finished(b) && !buildkiteapi.BuildFinished(ev.Build.State) {
+			return false
+		}
+		jobs := b.Status.Jobs
+		build.SetStatus(&b.Status, ev.Build)
+		if len(ev.Build.Jobs) == 0 {
+			b.Status.Jobs = jobs
+		}
+		return true
+	}, eventType, reason, message)
+	if err != nil {
+		return err
+	}
+	return r.recordPipeline(ctx, ev, eventType, reason, message)
+}
+
+func (r *Receiver) handleJob(ctx context.Context, ev *Event, action string) error {
+	eventType, reason := corev1.EventTypeNormal, "Job"+camel(action)
+	if exit := ev.Job.ExitStatus; exit != nil && *exit != 0 {
+		eventType = corev1.EventTypeWarning
+	}
+	name := ev.Job.Name
+	if name == "" {
+		name = ev.Job.ID
+	}
+	message := fmt.Sprintf("Job %s of build #%d %s", name, ev.Build.Number, ev.Job.State)
+	if exit := ev.Job.ExitStatus; exit != nil {
+		message += fmt.Sprintf(" with exit status %d", *exit)
+	}
+
+	return r.updateBuilds(ctx, ev.Build.ID, func(b *copsv1alpha1.BuildkiteBuild) bool {
+		job := build.JobStatus(ev.Job)
+		replaced := false
+		for i := range b.Status.Jobs {
+			if b.Status.Jobs[i].ID == job.ID {
+				b.Status.Jobs[i] = job
+				replaced = true
+			}
+		}
+		if !replaced {
+			b.Status.Jobs = append(b.Status.Jobs, job)
+		}
+		return true
+	}, eventType, reason, message)
+}
+
+func (r *Receiver) handleAgent(ctx context.Context, ev *Event, action string) error {
+	queue := buildkite.DefaultQueue
+	for _, tag := range ev.Agent.MetaData {
+		if k, v, ok := strings.Cut(tag, "="); ok && k == "queue" {
+			queue = v
+		}
+	}
+	eventType, reason := corev1.EventTypeNormal, "Agent"+camel(action)
+	if action == "lost" {
+		eventType = corev1.EventTypeWarning
+	}
+	message := fmt.Sprintf("Agent %s %s", ev.Agent.Name, strings.ReplaceAll(action, "_", " "))
+
+	list := copsv1alpha1.BuildkiteList{}
+	if err := r.client.List(ctx, &list, client.MatchingFields{queueField: queue}); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		r.recorder.Event(&list.Items[i], eventType, reason, message)
+	}
+	return nil
+}
+
+// updateBuilds applies update to the BuildkiteBuilds tracking the build with
+// id, writes their status when update returns true and records the event on
+// the builds that changed.
+func (r *Receiver) updateBuilds(ctx context.Context, id string, update func(*copsv1alpha1.BuildkiteBuild) bool, eventType, reason, message string) error {
+	list := copsv1alpha1.BuildkiteBuildList{}
+	if err := r.client.List(ctx, &list, client.MatchingFields{buildIDField: id}); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		key := client.ObjectKeyFromObject(&list.Items[i])
+		b := &copsv1alpha1.BuildkiteBuild{}
+		changed := false
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := r.client.Get(ctx, key, b); err != nil {
+				return err
+			}
+			if changed = update(b); !changed {
+				return nil
+			}
+			return r.client.Status().Update(ctx, b)
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if changed {
+			r.recorder.Event(b, eventType, reason, message)
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) recordPipeline(ctx context.Context, ev *Event, eventType, reason, message string) error {
+	if ev.Pipeline == nil {
+		return nil
+	}
+	list := copsv1alpha1.BuildkitePipelineList{}
+	if err := r.client.List(ctx, &list, client.MatchingFields{buildIDField: ev.Pipeline.ID}); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		r.recorder.Event(&list.Items[i], eventType, reason, message)
+	}
+	return nil
+}
+
+// camel turns an event action such as "connection_lost" into "ConnectionLost".
+func camel(action string) string {
+	parts := strings.Split(action, "_")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,302 @@
+// Package buildkitewebhook receives Buildkite webhooks and maps them onto the
+// status and events of the operator resources, so builds do not have to be
+// polled from the REST API.
+package buildkitewebhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Path is where the receiver is served.
+const Path = "/buildkite/events"
+
+const (
+	tokenHeader     = "X-Buildkite-Token"
+	signatureHeader = "X-Buildkite-Signature"
+	eventHeader     = "X-Buildkite-Event"
+
+	defaultTolerance = 5 * time.Minute
+	defaultQueueSize = 100
+	defaultWorkers   = 2
+	maxBodySize      = 1 << 20
+)
+
+// Options configures the Receiver. One of Token or SigningSecret is required.
+type Options struct {
+	// BindAddress is the address the receiver listens on
+	BindAddress string
+	// Token is compared with the X-Buildkite-Token header
+	Token string
+	// SigningSecret verifies the X-Buildkite-Signature header
+	SigningSecret string
+	// Tolerance is how old a signed request, or how recent a duplicate,
+	// may be. 5 minutes by default.
+	Tolerance time.Duration
+	// QueueSize bounds the events waiting to be processed. Requests are
+	// rejected with 503 once it is full.
+	QueueSize int
+	// Workers is the number of events processed concurrently
+	Workers int
+}
+
+// Receiver is an http.Handler and a manager Runnable accepting Buildkite
+// webhooks. Events are verified, deduplicated and queued, then applied by a
+// fixed number of workers so bursts do not overload the API server.
+type Receiver struct {
+	client   client.Client
+	recorder record.EventRecorder
+	opts     Options
+	queue    chan *Event
+	seen     *replayCache
+	now      func() time.Time
+}
+
+// New returns a Receiver updating resources with c and recording events with
+// recorder.
+func New(c client.Client, recorder record.EventRecorder, opts Options) (*Receiver, error) {
+	if opts.Token == "" && opts.SigningSecret == "" {
+		return nil, errors.New("buildkite webhook token or signing secret is required")
+	}
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = defaultTolerance
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	return &Receiver{
+		client:   c,
+		recorder: recorder,
+		opts:     opts,
+		queue:    make(chan *Event, opts.QueueSize),
+		seen:     newReplayCache(opts.Tolerance, 10*opts.QueueSize),
+		now:      time.Now,
+	}, nil
+}
+
+// NeedLeaderElection is false: every replica behind the Service accepts
+// webhooks.
+func (r *Receiver) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the receiver on BindAddress and processes queued events until
+// ctx is done.
+func (r *Receiver) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("buildkite-webhook")
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, r)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	listener, err := net.Listen("tcp", r.opts.BindAddress)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		logger.Info("serving Buildkite webhooks", "address", listener.Addr().String(), "path", Path)
+		errc <- server.Serve(listener)
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = server.Shutdown(shutdownCtx)
+	case err = <-errc:
+	}
+	wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (r *Receiver) work(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("buildkite-webhook")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-r.queue:
+			if err := r.Handle(ctx, ev); err != nil {
+				logger.Error(err, "unable to apply Buildkite webhook", "event", ev.Event)
+			}
+		}
+	}
+}
+
+// ServeHTTP verifies and queues a webhook.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key, err := r.verify(req.Header, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !r.seen.add(key, r.now()) {
+		// Already accepted, tell the sender it went through.
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	ev := &Event{}
+	if err := json.Unmarshal(body, ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ev.Event == "" {
+		ev.Event = req.Header.Get(eventHeader)
+	}
+
+	select {
+	case r.queue <- ev:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		// Forget the delivery so a retry is not taken for a replay.
+		r.seen.remove(key)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many pending events", http.StatusServiceUnavailable)
+	}
+}
+
+// verify authenticates the request and returns the key used to detect
+// replays: the signature when signed, a digest of the body otherwise.
+func (r *Receiver) verify(header http.Header, body []byte) (string, error) {
+	if r.opts.SigningSecret != "" {
+		if sig := header.Get(signatureHeader); sig != "" {
+			return r.verifySignature(sig, body)
+		}
+		if r.opts.Token == "" {
+			return "", errors.New("missing " + signatureHeader)
+		}
+	}
+	token := header.Get(tokenHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.opts.Token)) != 1 {
+		return "", errors.New("invalid " + tokenHeader)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifySignature checks a "timestamp=<unix>,signature=<hex>" header, the
+// HMAC-SHA256 of "<timestamp>.<body>", and rejects stale timestamps.
+func (r *Receiver) verifySignature(header string, body []byte) (string, error) {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "timestamp":
+			timestamp = v
+		case "signature":
+			signature = v
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return "", errors.New("malformed " + signatureHeader)
+	}
+
+	mac := hmac.New(sha256.New, []byte(r.opts.SigningSecret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return "", errors.New("invalid " + signatureHeader)
+	}
+
+	age := r.now().Sub(time.Unix(unix, 0))
+	if age > r.opts.Tolerance || age < -r.opts.Tolerance {
+		return "", fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+	}
+	return signature, nil
+}
+
+// replayCache remembers accepted deliveries for the tolerance window. It
+// holds at most size keys, dropping the oldest first.
+type replayCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[string]time.Time
+	order  []replayEntry
+}
+
+type replayEntry struct {
+	key string
+	at  time.Time
+}
+
+func newReplayCache(window time.Duration, size int) *replayCache {
+	return &replayCache{window: window, size: size, seen: map[string]time.Time{}}
+}
+
+// add records key and reports whether it was new.
+func (c *replayCache) add(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) > 0 && (now.Sub(c.order[0].at) > c.window || len(c.order) >= c.size) {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		if c.seen[oldest.key].Equal(oldest.at) {
+			delete(c.seen, oldest.key)
+		}
+	}
+
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = now
+	c.order = append(c.order, replayEntry{key: key, at: now})
+	return true
+}
+
+func (c *replayCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, key)
+}
@@ -0,0 +1,177 @@
+package buildkitewebhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+const secret = "s3cr3t"
+
+var now = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func newReceiver(t *testing.T, opts Options, objs ...client.Object) (*Receiver, *record.FakeRecorder) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := copsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	builder := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&copsv1alpha1.BuildkiteBuild{})
+	for _, ix := range indexes {
+		builder = builder.WithIndex(ix.obj, ix.field, ix.extract)
+	}
+	c := builder.Build()
+	recorder := record.NewFakeRecorder(10)
+	r, err := New(c, recorder, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return now }
+	return r, recorder
+}
+
+func signedRequest(body string, at time.Time) *http.Request {
+	ts := fmt.Sprint(at.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + body))
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(body))
+	req.Header.Set(signatureHeader, "timestamp="+ts+",signature="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func serve(r *Receiver, req *http.Request) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestServeHTTPSignature(t *testing.T) {
+	r, _ := newReceiver(t, Options{SigningSecret: secret})
+	body := `{"event":"ping"}`
+
+	if code := serve(r, signedRequest(body, now)); code != http.StatusAccepted {
+		t.Fatalf("signed request: got %d", code)
+	}
+	if code := serve(r, signedRequest(body, now)); code != http.StatusAccepted || len(r.queue) != 1 {
+		t.Errorf("replay must be acknowledged without queueing, got %d with %d queued", code, len(r.queue))
+	}
+	if code := serve(r, signedRequest(body, now.Add(-10*time.Minute))); code != http.StatusUnauthorized {
+		t.Errorf("stale signature: got %d", code)
+	}
+
+	req := signedRequest(body, now)
+	req.Header.Set(signatureHeader, strings.Replace(req.Header.Get(signatureHeader), "signature=", "signature=00", 1))
+	if code := serve(r, req); code != http.StatusUnauthorized {
+		t.Errorf("bad signature: got %d", code)
+	}
+}
+
+func TestServeHTTPToken(t *testing.T) {
+	r, _ := newReceiver(t, Options{Token: "token", QueueSize: 1})
+
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(`{"event":"ping"}`))
+	req.Header.Set(tokenHeader, "wrong")
+	if code := serve(r, req); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", code)
+	}
+
+	for i, want := range []int{http.StatusAccepted, http.StatusServiceUnavailable} {
+		req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(fmt.Sprintf(`{"event":"ping","n":%d}`, i)))
+		req.Header.Set(tokenHeader, "token")
+		if code := serve(r, req); code != want {
+			t.Errorf("request %d: got %d, want %d", i, code, want)
+		}
+	}
+}
+
+func TestHandleBuildAndJobEvents(t *testing.T) {
+	tracked := &copsv1alpha1.BuildkiteBuild{
+		ObjectMeta: metav1.ObjectMeta{Name: "release", Namespace: "ci"},
+		Status:     copsv1alpha1.BuildkiteBuildStatus{ID: "b1", Number: 3, State: "scheduled"},
+	}
+	r, recorder := newReceiver(t, Options{Token: "token"}, tracked)
+	ctx := context.Background()
+	exit := int32(0)
+
+	events := []*Event{
+		{Event: "job.finished", Build: &buildkiteapi.Build{ID: "b1", Number: 3}, Job: &buildkiteapi.Job{ID: "j1", Name: "test", State: "passed", ExitStatus: &exit}},
+		{Event: "build.finished", Build: &buildkiteapi.Build{ID: "b1", Number: 3, State: "passed"}},
+		{Event: "build.running", Build: &buildkiteapi.Build{ID: "b1", Number: 3, State: "running"}},
+	}
+	for _, ev := range events {
+		if err := r.Handle(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := &copsv1alpha1.BuildkiteBuild{}
+	if err := r.client.Get(ctx, client.ObjectKeyFromObject(tracked), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.State != "passed" {
+		t.Errorf("late build.running must not reopen the build, state %q", got.Status.State)
+	}
+	if len(got.Status.Jobs) != 1 || got.Status.Jobs[0].State != "passed" {
+		t.Errorf("job not recorded: %+v", got.Status.Jobs)
+	}
+	if n := len(recorder.Events); n != 2 {
+		t.Errorf("expected 2 events, got %d", n)
+	}
+}
+
+func TestHandlePipelineAndAgentEvents(t *testing.T) {
+	web := &copsv1alpha1.BuildkitePipeline{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "ci"},
+		Status:     copsv1alpha1.BuildkitePipelineStatus{ID: "p1"},
+	}
+	api := &copsv1alpha1.BuildkitePipeline{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "ci"},
+		Status:     copsv1alpha1.BuildkitePipelineStatus{ID: "p2"},
+	}
+	builders := &copsv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "builders", Namespace: "ci"},
+		Spec:       copsv1alpha1.BuildkiteSpec{Agent: copsv1alpha1.BuildkiteAgentConfig{Queue: "builders"}},
+	}
+	other := &copsv1alpha1.Buildkite{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ci"},
+	}
+	r, recorder := newReceiver(t, Options{Token: "token"}, web, api, builders, other)
+	ctx := context.Background()
+
+	events := []*Event{
+		{Event: "build.scheduled", Build: &buildkiteapi.Build{ID: "b9", Number: 1, State: "scheduled"}, Pipeline: &buildkiteapi.Pipeline{ID: "p1"}},
+		{Event: "agent.connected", Agent: &buildkiteapi.Agent{Name: "agent-1", MetaData: []string{"queue=builders"}}},
+	}
+	for _, ev := range events {
+		if err := r.Handle(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(recorder.Events); n != 2 {
+		t.Fatalf("expected one event on the pipeline and one on the Buildkite, got %d", n)
+	}
+	for _, want := range []string{"BuildScheduled Build #1 scheduled", "AgentConnected Agent agent-1 connected"} {
+		if got := <-recorder.Events; !strings.Contains(got, want) {
+			t.Errorf("got event %q, want %q", got, want)
+		}
+	}
+}
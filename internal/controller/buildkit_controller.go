@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	buildkitv1alpha1 "cops/api/v1alpha1"
 	"cops/internal/buildkit"
@@ -40,11 +41,16 @@ type BuildkitReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	HashRing *hashring.HashRing
+	// APIReader lists the buildkitd pods, the cache only holds job pods
+	APIReader client.Reader
 }
 
-// +kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkits,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkits/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkits/finalizers,verbs=update
+// +kubebuilder:rbac:groups=thecops.dev,resources=buildkits,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=thecops.dev,resources=buildkits/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=thecops.dev,resources=buildkits/finalizers,verbs=update
+// +kubebuilder:rbac:groups=thecops.dev,resources=buildkites,verbs=get;list;watch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=tlsroutes,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -70,22 +76,15 @@ func (r *BuildkitReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	}
 
 	// Create a buildkit object
-	bk := buildkit.Buildkit{
-		Name:         req.Name,
-		Namespace:    req.Namespace,
-		Labels:       map[string]string{},
-		NodeSelector: map[string]string{},
-		Cloud:        instance.Spec.CloudProvider,
-		Arch:         instance.Spec.Arch,
-		Rootless:     instance.Spec.Rootless,
-		Image:        instance.Spec.Image,
-		MaxReplica:   instance.Spec.MaxReplica,
-		Resource:     instance.Spec.Resources,
-		Client:       r.Client,
+	bk := buildkit.New(&instance, r.Client)
+	bk.AgentNamespaces, err = agentNamespaces(ctx, r.Client, &instance)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
 	podList := &corev1.PodList{}
 
-	if err := r.List(context.Background(), podList, &client.ListOptions{
+	if err := r.APIReader.List(ctx, podList, &client.ListOptions{
+		Namespace: instance.Namespace,
 		LabelSelector: labels.SelectorFromSet(labels.Set{
 			"app": instance.Name,
 		}),
@@ -107,7 +106,24 @@ func (r *BuildkitReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{}, err
 	}
 
-	if err := bk.CreateOrUpdateSecret(ctx); err != nil {
+	renewAt, err := bk.CreateOrUpdateSecret(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if instance.Spec.Access != nil {
+		if err := bk.CreateOrUpdateNetworkPolicy(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err := bk.DeleteNetworkPolicy(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if bk.ExposeMode() == buildkitv1alpha1.ExposeTLSRoute {
+		if err := bk.CreateOrUpdateTLSRoute(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err := bk.DeleteTLSRoute(ctx); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -118,19 +134,30 @@ func (r *BuildkitReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	if err := bk.CreateOrUpdateHorizontalPodAutoscalerionBudget(ctx); err != nil {
 		return ctrl.Result{}, err
 	}
+	endpoint, err := bk.Endpoint(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	instance.Status.Status = true
 	instance.Status.State = "Available"
-	if err := r.Update(ctx, &instance); err != nil {
+	instance.Status.Endpoint = endpoint
+	if err := r.Status().Update(ctx, &instance); err != nil {
 		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, nil
+	// Come back in time to renew the server certificate.
+	return ctrl.Result{RequeueAfter: time.Until(renewAt)}, nil
 
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *BuildkitReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.HashRing = hashring.New([]string{})
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&buildkitv1alpha1.Buildkit{}).
+		Watches(&buildkitv1alpha1.Buildkite{}, buildkitForBuildkite).
 		Complete(r)
 }
@@ -18,16 +18,19 @@ package controller
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	buildkitv1alpha1 "cops-buildkit/api/v1alpha1"
+	buildkitv1alpha1 "cops/api/v1alpha1"
 )
 
 var _ = Describe("Buildkit Controller", func() {
@@ -69,8 +72,9 @@ var _ = Describe("Buildkit Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &BuildkitReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				APIReader: k8sClient,
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -82,3 +86,31 @@ var _ = Describe("Buildkit Controller", func() {
 		})
 	})
 })
+
+func TestBuildkitForBuildkiteMovedRef(t *testing.T) {
+	stack := func(ref *buildkitv1alpha1.BuildkitReference) *buildkitv1alpha1.Buildkite {
+		return &buildkitv1alpha1.Buildkite{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+			Spec:       buildkitv1alpha1.BuildkiteSpec{BuildkitRef: ref},
+		}
+	}
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+
+	buildkitForBuildkite.Update(context.Background(), event.UpdateEvent{
+		ObjectOld: stack(&buildkitv1alpha1.BuildkitReference{Name: "old", Namespace: "builders"}),
+		ObjectNew: stack(&buildkitv1alpha1.BuildkitReference{Name: "new"}),
+	}, q)
+
+	got := map[types.NamespacedName]bool{}
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		got[item.(reconcile.Request).NamespacedName] = true
+		q.Done(item)
+	}
+	for _, want := range []types.NamespacedName{{Name: "old", Namespace: "builders"}, {Name: "new", Namespace: "ci"}} {
+		if !got[want] {
+			t.Errorf("%s not enqueued, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkite"
+)
+
+// BuildkiteAutoscalerReconciler reads the job counts of the queue of a
+// Buildkite from the agent metrics API and records the capacity they call
+// for in status. The BuildkiteReconciler applies it to max_in_flight or the
+// warm pool.
+type BuildkiteAutoscalerReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// NewMetricsClient builds the agent metrics client from the agent token
+	NewMetricsClient agentmetrics.Factory
+	// Now returns the current time, time.Now by default
+	Now func() time.Time
+}
+
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites,verbs=get;list;watch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile polls the metrics every autoscaling interval. Status is only
+// written when the job counts or the capacity change.
+func (r *BuildkiteAutoscalerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	instance := buildkitv1alpha1.Buildkite{}
+
+	err := r.Get(ctx, req.NamespacedName, &instance)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	autoscaling := instance.Spec.Autoscaling
+	if autoscaling == nil || !instance.DeletionTimestamp.IsZero() {
+		if instance.Status.Autoscaling == nil && meta.FindStatusCondition(instance.Status.Conditions, buildkitv1alpha1.ConditionAgentMetrics) == nil {
+			return ctrl.Result{}, nil
+		}
+		instance.Status.Autoscaling = nil
+		meta.RemoveStatusCondition(&instance.Status.Conditions, buildkitv1alpha1.ConditionAgentMetrics)
+		return ctrl.Result{}, r.Status().Update(ctx, &instance)
+	}
+	interval := buildkite.AutoscalingInterval(autoscaling)
+
+	metrics, err := r.metrics(ctx, &instance)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: interval}, r.setAgentMetrics(ctx, &instance, "MetricsUnavailable", err)
+	}
+
+	now := time.Now()
+	if r.Now != nil {
+		now = r.Now()
+	}
+	queue := buildkite.Queue(instance.Spec.Agent)
+	jobs := metrics.Queue(queue)
+	capacity, changed := buildkite.Scale(autoscaling, instance.Status.Autoscaling, buildkite.DesiredCapacity(autoscaling, jobs), now)
+
+	status := &buildkitv1alpha1.BuildkiteAutoscalingStatus{
+		Queue:         queue,
+		ScheduledJobs: jobs.Scheduled,
+		RunningJobs:   jobs.Running,
+		Desired:       capacity,
+	}
+	if previous := instance.Status.Autoscaling; previous != nil {
+		status.LastScaleTime = previous.LastScaleTime
+	}
+	if changed {
+		logger.Info("scaling agents", "queue", queue, "target", buildkite.AutoscalingTarget(autoscaling), "capacity", capacity, "scheduled", jobs.Scheduled, "running", jobs.Running)
+		scaled := metav1.NewTime(now)
+		status.LastScaleTime = &scaled
+	}
+
+	condition := meta.FindStatusCondition(instance.Status.Conditions, buildkitv1alpha1.ConditionAgentMetrics)
+	if !changed && condition != nil && condition.Status == metav1.ConditionTrue && *status == *instance.Status.Autoscaling {
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+	instance.Status.Autoscaling = status
+	return ctrl.Result{RequeueAfter: interval}, r.setAgentMetrics(ctx, &instance, "MetricsRead", nil)
+}
+
+// metrics reads the agent metrics with the agent token of the Buildkite.
+func (r *BuildkiteAutoscalerReconciler) metrics(ctx context.Context, instance *buildkitv1alpha1.Buildkite) (*agentmetrics.Metrics, error) {
+	name := buildkite.AgentTokenSecret(instance)
+	if name == "" {
+		return nil, fmt.Errorf("agent token secret is required, set spec.secret or spec.agent.token_secret")
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, secret); err != nil {
+		return nil, err
+	}
+	token, err := buildkite.AgentToken(secret)
+	if err != nil {
+		return nil, err
+	}
+	factory := r.NewMetricsClient
+	if factory == nil {
+		factory = agentmetrics.NewFactory(agentmetrics.DefaultURL)
+	}
+	return factory(token).Metrics(ctx)
+}
+
+// setAgentMetrics records whether the metrics could be read and returns cause
+// so it can be handed back to the manager for a retry.
+func (r *BuildkiteAutoscalerReconciler) setAgentMetrics(ctx context.Context, instance *buildkitv1alpha1.Buildkite, reason string, cause error) error {
+	condition := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionAgentMetrics,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            fmt.Sprintf("reading the jobs of queue %s", buildkite.Queue(instance.Spec.Agent)),
+		ObservedGeneration: instance.Generation,
+	}
+	if cause != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = cause.Error()
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, instance); err != nil {
+		return err
+	}
+	return cause
+}
+
+// SetupWithManager sets up the controller with the Manager. Only spec changes
+// trigger it, status updates would poll the metrics in a loop.
+func (r *BuildkiteAutoscalerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("buildkite-autoscaler").
+		For(&buildkitv1alpha1.Buildkite{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
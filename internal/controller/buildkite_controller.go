@@ -18,26 +18,61 @@ package controller
 
 import (
 	"context"
+	goerrors "errors"
+	"fmt"
+	"slices"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkit"
 	"cops/internal/buildkite"
+	"cops/internal/buildkiteapi"
 )
 
 // BuildkiteReconciler reconciles a Buildkite object
 type BuildkiteReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// NewBuildkiteClient builds the Buildkite API client managing agent tokens
+	NewBuildkiteClient buildkiteapi.Factory
+	// NewMetricsClient reads the agent metrics, with the new token, before
+	// replaced managed tokens are revoked
+	NewMetricsClient agentmetrics.Factory
+	// ClusterScopedNamespaces are the namespaces whose Buildkites may set
+	// rbac.cluster_scoped
+	ClusterScopedNamespaces []string
 }
 
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkites,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkites/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkites/finalizers,verbs=update
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkits,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps;serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings;clusterroles;clusterrolebindings,verbs=get;list;watch;create;update;patch;delete;bind
+
+// The operator cannot escalate, it holds the default rules it grants the
+// agent stack controllers.
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups="";events.k8s.io,resources=events,verbs=get;list;watch;create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -64,23 +99,21 @@ func (r *BuildkiteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
-	// Create a buildkit object
-	bk := buildkite.Buildkite{
-		Name:         req.Name,
-		Namespace:    req.Namespace,
-		Labels:       map[string]string{},
-		NodeSelector: map[string]string{},
-		Image:        instance.Spec.Image,
-		Secret:       instance.Spec.Secret,
-		Resource:     instance.Spec.Resources,
-		Client:       r.Client,
-	}
-
-	if err := bk.CreateOrUpdateConfigMap(ctx); err != nil {
+	if err := r.syncAgentToken(ctx, &instance); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if err := bk.CreateOrUpdateDeployment(ctx); err != nil {
+	// Create a buildkit object
+	bk := buildkite.New(&instance, r.Client)
+	bk.ClusterScopeAllowed = slices.Contains(r.ClusterScopedNamespaces, instance.Namespace)
+
+	for _, stack := range bk.Stacks() {
+		if err := stack.CreateOrUpdateConfigMap(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := bk.CreateOrUpdateHooksConfigMap(ctx); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -88,19 +121,286 @@ func (r *BuildkiteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
-	if err := bk.CreateOrUpdateRole(ctx); err != nil {
+	if err := bk.CreateOrUpdateRBAC(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for _, stack := range bk.Stacks() {
+		if err := stack.CreateOrUpdateDeployment(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := bk.DeleteStalePools(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := bk.CreateOrUpdateWarmPool(ctx); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if err := bk.CreateOrUpdateRoleBinding(ctx); err != nil {
+	if err := r.setGitCredentialsCondition(ctx, &instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	linked, renewAt, err := r.bindBuildkit(ctx, &instance, bk)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	revoked, err := r.revokeAgentTokens(ctx, &instance, bk)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, nil
+	if err := r.Status().Update(ctx, &instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	if !revoked {
+		// The controller is still rolling out with the new token, or the
+		// replaced ones are in their grace period.
+		requeue := time.Until(buildkite.AgentTokenRevocation(&instance))
+		if requeue < 15*time.Second {
+			requeue = 15 * time.Second
+		}
+		return ctrl.Result{RequeueAfter: requeue}, nil
+	}
+	if !linked {
+		// The Buildkit may not exist yet, check again later.
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+	// Come back for the next token rotation or client certificate renewal,
+	// whichever is first.
+	var requeue time.Duration
+	if !renewAt.IsZero() {
+		requeue = time.Until(renewAt)
+	}
+	if next, ok := buildkite.NextAgentTokenRotation(&instance); ok && (requeue == 0 || time.Until(next) < requeue) {
+		requeue = time.Until(next)
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// syncAgentToken creates the managed agent token, or replaces it when a
+// rotation is due or its Secret is gone. The new token is recorded in status
+// before it is stored so that it is revoked even if storing it fails.
+func (r *BuildkiteReconciler) syncAgentToken(ctx context.Context, instance *buildkitv1alpha1.Buildkite) error {
+	if instance.Spec.ManagedToken == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, buildkitv1alpha1.ConditionAgentToken)
+		return nil
+	}
+	bk := buildkite.New(instance, r.Client)
+	reason, due := buildkite.AgentTokenRotation(instance, time.Now())
+	if !due {
+		exists, err := bk.ManagedTokenSecretExists(ctx)
+		if err != nil {
+			return err
+		}
+		reason, due = "SecretNotFound", !exists
+	}
+	if !due {
+		return nil
+	}
+
+	api, err := buildkiteClientFor(ctx, r.Client, r.NewBuildkiteClient, instance.Namespace, instance.Spec.ManagedToken.APITokenSecret)
+	if err != nil {
+		return r.setAgentToken(ctx, instance, "TokenUnavailable", err)
+	}
+	status, token, err := buildkite.NextAgentToken(ctx, api, instance, time.Now())
+	if err != nil {
+		return r.setAgentToken(ctx, instance, "APIError", err)
+	}
+	instance.Status.AgentToken = status
+	if err := r.setAgentToken(ctx, instance, reason, nil); err != nil {
+		if revokeErr := buildkite.DiscardAgentToken(ctx, api, instance, status.ID); revokeErr != nil {
+			return goerrors.Join(err, fmt.Errorf("revoking unrecorded agent token %s: %w", status.ID, revokeErr))
+		}
+		return err
+	}
+	return buildkite.New(instance, r.Client).CreateOrUpdateAgentTokenSecret(ctx, token)
+}
+
+// revokeAgentTokens revokes the tokens replaced by a rotation once the
+// controller runs with the new one and agents connect with it. It returns
+// false while some are left.
+func (r *BuildkiteReconciler) revokeAgentTokens(ctx context.Context, instance *buildkitv1alpha1.Buildkite, bk *buildkite.Buildkite) (bool, error) {
+	if instance.Spec.ManagedToken == nil || instance.Status.AgentToken == nil || len(instance.Status.AgentToken.Revoking) == 0 {
+		return true, nil
+	}
+	api, err := buildkiteClientFor(ctx, r.Client, r.NewBuildkiteClient, instance.Namespace, instance.Spec.ManagedToken.APITokenSecret)
+	if err != nil {
+		return false, err
+	}
+	metrics := r.NewMetricsClient
+	if metrics == nil {
+		metrics = agentmetrics.NewFactory(agentmetrics.DefaultURL)
+	}
+	return bk.RevokeAgentTokens(ctx, api, metrics, instance, time.Now())
+}
+
+// setAgentToken records the state of the managed agent token and returns
+// cause so it can be handed back to the manager for a retry. The write is
+// retried on conflicts, a lost token ID would leave the token unrevoked.
+func (r *BuildkiteReconciler) setAgentToken(ctx context.Context, instance *buildkitv1alpha1.Buildkite, reason string, cause error) error {
+	condition := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionAgentToken,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		ObservedGeneration: instance.Generation,
+	}
+	if cause != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = cause.Error()
+	} else {
+		condition.Message = fmt.Sprintf("using agent token %s from secret %s", instance.Status.AgentToken.ID, buildkite.ManagedTokenSecret(instance.Name))
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	if err := updateStatus(ctx, r.Client, instance); err != nil {
+		return err
+	}
+	return cause
+}
+
+// bindBuildkit issues the client certificate of the linked Buildkit and
+// reports the binding in the status. It returns false while the Buildkit is
+// missing or not ready, and when bound the time the client certificate is
+// due for renewal.
+func (r *BuildkiteReconciler) bindBuildkit(ctx context.Context, instance *buildkitv1alpha1.Buildkite, bk *buildkite.Buildkite) (bool, time.Time, error) {
+	if instance.Spec.BuildkitRef == nil {
+		instance.Status.Buildkit = ""
+		instance.Status.BuildkitReady = false
+		meta.RemoveStatusCondition(&instance.Status.Conditions, buildkitv1alpha1.ConditionBuildkitReady)
+		return true, time.Time{}, nil
+	}
+
+	ref := bk.BuildkitNamespacedName()
+	instance.Status.Buildkit = ref.String()
+	condition := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionBuildkitReady,
+		ObservedGeneration: instance.Generation,
+	}
+
+	var renewAt time.Time
+	builder := &buildkitv1alpha1.Buildkit{}
+	err := r.Get(ctx, ref, builder)
+	switch {
+	case errors.IsNotFound(err):
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "BuildkitNotFound"
+		condition.Message = fmt.Sprintf("buildkit %s not found", ref)
+	case err != nil:
+		return false, time.Time{}, err
+	case !builder.Status.Status:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "BuildkitNotReady"
+		condition.Message = fmt.Sprintf("buildkit %s is %q", ref, builder.Status.State)
+	default:
+		renewAt, err = bk.CreateOrUpdateBuildkitClientSecret(ctx, builder)
+		switch {
+		case goerrors.Is(err, buildkit.ErrLinkNotAllowed):
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "LinkNotAllowed"
+			condition.Message = fmt.Sprintf("buildkit %s does not list namespace %s in access.link_namespaces", ref, instance.Namespace)
+		case err != nil:
+			return false, time.Time{}, err
+		default:
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "Bound"
+			condition.Message = fmt.Sprintf("bound to buildkit %s", ref)
+		}
+	}
+	instance.Status.BuildkitReady = condition.Status == metav1.ConditionTrue
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	return instance.Status.BuildkitReady, renewAt, nil
+}
+
+// setGitCredentialsCondition reports whether the git Secret exists and holds
+// usable credentials.
+func (r *BuildkiteReconciler) setGitCredentialsCondition(ctx context.Context, instance *buildkitv1alpha1.Buildkite) error {
+	if instance.Spec.GitSecret == "" {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, buildkitv1alpha1.ConditionGitCredentials)
+		return nil
+	}
+
+	condition := metav1.Condition{
+		Type:               buildkitv1alpha1.ConditionGitCredentials,
+		ObservedGeneration: instance.Generation,
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.GitSecret, Namespace: instance.Namespace}, secret)
+	switch {
+	case errors.IsNotFound(err):
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "SecretNotFound"
+		condition.Message = fmt.Sprintf("secret %s not found", instance.Spec.GitSecret)
+	case err != nil:
+		return err
+	default:
+		kind, err := buildkite.CheckGitCredentials(secret, instance.Spec.GitKnownHosts)
+		switch {
+		case goerrors.Is(err, buildkite.ErrKnownHostsMissing):
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "KnownHostsMissing"
+			condition.Message = err.Error()
+		case err != nil:
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "InvalidKeys"
+			condition.Message = err.Error()
+		default:
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "CredentialsFound"
+			condition.Message = fmt.Sprintf("using %s credentials from secret %s", kind, instance.Spec.GitSecret)
+		}
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	return nil
+}
+
+// gitSecretField indexes Buildkites by their git_secret, so a Secret event
+// only looks up the stacks using it.
+const gitSecretField = "spec.git_secret"
+
+func gitSecretIndex(obj client.Object) []string {
+	if name := obj.(*buildkitv1alpha1.Buildkite).Spec.GitSecret; name != "" {
+		return []string{name}
+	}
+	return nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// SetupWithManager sets up the controller with the Manager. Only the metadata
+// of Secrets is cached for the git_secret watch; the Secrets themselves are
+// read from the API server, see the client options in cmd/main.go.
 func (r *BuildkiteReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &buildkitv1alpha1.Buildkite{}, gitSecretField, gitSecretIndex); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&buildkitv1alpha1.Buildkite{}).
+		Watches(&buildkitv1alpha1.Buildkit{}, handler.EnqueueRequestsFromMapFunc(buildkitesForBuildkit(mgr.GetClient()))).
+		WatchesMetadata(&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(buildkitesForGitSecret(mgr.GetClient())),
+			builder.WithPredicates(usedAsGitSecret(mgr.GetClient())),
+		).
 		Complete(r)
 }
+
+// buildkitesForGitSecret maps a Secret to the Buildkite stacks of its
+// namespace using it as git_secret, to keep GitCredentialsReady current.
+func buildkitesForGitSecret(c client.Client) func(context.Context, client.Object) []reconcile.Request {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		list := &buildkitv1alpha1.BuildkiteList{}
+		if err := c.List(ctx, list, client.InNamespace(obj.GetNamespace()), client.MatchingFields{gitSecretField: obj.GetName()}); err != nil {
+			return nil
+		}
+		requests := []reconcile.Request{}
+		for _, bk := range list.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&bk)})
+		}
+		return requests
+	}
+}
+
+// usedAsGitSecret only passes Secrets some Buildkite names as git_secret.
+func usedAsGitSecret(c client.Client) predicate.Predicate {
+	buildkites := buildkitesForGitSecret(c)
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return len(buildkites(context.Background(), obj)) > 0
+	})
+}
@@ -18,16 +18,26 @@ package controller
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	buildkitv1alpha1 "cops-buildkit/api/v1alpha1"
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi/buildkiteapitest"
 )
 
 var _ = Describe("Buildkite Controller", func() {
@@ -82,3 +92,117 @@ var _ = Describe("Buildkite Controller", func() {
 		})
 	})
 })
+
+func TestSyncAgentTokenStatusWrite(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := buildkitv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	resource := schema.GroupResource{Group: buildkitv1alpha1.GroupVersion.Group, Resource: "buildkites"}
+
+	for name, tc := range map[string]struct {
+		failures []error
+		recorded bool
+	}{
+		"conflict is retried": {
+			failures: []error{errors.NewConflict(resource, "agent", nil)},
+			recorded: true,
+		},
+		"failure revokes the token": {
+			failures: []error{errors.NewServiceUnavailable("etcd is down")},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := buildkiteapitest.NewServer()
+			defer server.Close()
+			instance := &buildkitv1alpha1.Buildkite{
+				ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+				Spec: buildkitv1alpha1.BuildkiteSpec{
+					ManagedToken: &buildkitv1alpha1.BuildkiteManagedToken{
+						Organization:   "acme",
+						ClusterID:      "cluster-1",
+						APITokenSecret: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "api"}},
+					},
+				},
+			}
+			failures := tc.failures
+			c := fake.NewClientBuilder().WithScheme(scheme).
+				WithObjects(instance, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "ci"},
+					Data:       map[string][]byte{"token": []byte(buildkiteapitest.Token)},
+				}).
+				WithStatusSubresource(instance).
+				WithInterceptorFuncs(interceptor.Funcs{
+					SubResourceUpdate: func(ctx context.Context, c client.Client, sub string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+						if len(failures) > 0 {
+							err := failures[0]
+							failures = failures[1:]
+							return err
+						}
+						return c.SubResource(sub).Update(ctx, obj, opts...)
+					},
+				}).
+				Build()
+			r := &BuildkiteReconciler{Client: c, Scheme: scheme, NewBuildkiteClient: server.Factory()}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+				t.Fatal(err)
+			}
+
+			err := r.syncAgentToken(ctx, instance)
+			if tc.recorded != (err == nil) {
+				t.Fatalf("syncAgentToken() = %v", err)
+			}
+			stored := &buildkitv1alpha1.Buildkite{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(instance), stored); err != nil {
+				t.Fatal(err)
+			}
+			tokens := server.AgentTokens()
+			if tc.recorded {
+				if stored.Status.AgentToken == nil || len(tokens) != 1 || tokens[0].ID != stored.Status.AgentToken.ID {
+					t.Errorf("token not recorded: status %+v, tokens %+v", stored.Status.AgentToken, tokens)
+				}
+			} else if len(tokens) != 0 {
+				t.Errorf("unrecorded tokens left valid: %+v", tokens)
+			}
+		})
+	}
+}
+
+func TestGitSecretWatch(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := buildkitv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(
+			&buildkitv1alpha1.Buildkite{
+				ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "ci"},
+				Spec:       buildkitv1alpha1.BuildkiteSpec{GitSecret: "git"},
+			},
+			&buildkitv1alpha1.Buildkite{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "ci"}},
+		).
+		WithIndex(&buildkitv1alpha1.Buildkite{}, gitSecretField, gitSecretIndex).
+		Build()
+	secret := func(namespace, name string) client.Object {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+
+	used := usedAsGitSecret(c)
+	for _, s := range []client.Object{secret("ci", "other"), secret("prod", "git")} {
+		if used.Generic(event.GenericEvent{Object: s}) {
+			t.Errorf("secret %s/%s is no git_secret and must be filtered", s.GetNamespace(), s.GetName())
+		}
+	}
+	if !used.Generic(event.GenericEvent{Object: secret("ci", "git")}) {
+		t.Error("git_secret filtered out")
+	}
+	requests := buildkitesForGitSecret(c)(ctx, secret("ci", "git"))
+	if len(requests) != 1 || requests[0].Name != "agent" {
+		t.Errorf("got requests %v, want only ci/agent", requests)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/agentmetrics"
+	"cops/internal/buildkite"
+)
+
+// statusRefresh is how often the connected agents are read again, they
+// change without any event in the cluster.
+const statusRefresh = time.Minute
+
+// BuildkiteStatusReconciler reports the health of a Buildkite: its
+// conditions, controller replicas, connected agents and job pods. It watches
+// the controller Deployments and the Jobs and Pods of the queues.
+type BuildkiteStatusReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// NewMetricsClient builds the agent metrics client verifying the agent
+	// token and counting the connected agents. Nil leaves them out.
+	NewMetricsClient agentmetrics.Factory
+
+	// metrics caches the agent metrics for statusRefresh, job pod events
+	// would otherwise call the API on every pod change.
+	metrics *agentmetrics.Cache
+}
+
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites,verbs=get;list;watch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkites/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=secrets;pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+
+// Reconcile observes the Buildkite and writes its status when it changed.
+func (r *BuildkiteStatusReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	instance := buildkitv1alpha1.Buildkite{}
+
+	err := r.Get(ctx, req.NamespacedName, &instance)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+	if !instance.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	var metrics agentmetrics.Factory
+	if r.metrics != nil {
+		metrics = r.metrics.Factory
+	}
+	status, err := buildkite.ObserveStatus(ctx, r.Client, &instance, metrics)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !equality.Semantic.DeepEqual(status, &instance.Status) {
+		instance.Status = *status
+		if err := r.Status().Update(ctx, &instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if r.NewMetricsClient != nil {
+		return ctrl.Result{RequeueAfter: statusRefresh}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// buildkiteForController maps a controller Deployment to its Buildkite.
+func buildkiteForController(_ context.Context, obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if service := labels["service"]; service != "buildkite" && service != "buildkite-pool" {
+		return nil
+	}
+	if labels["app"] == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: labels["app"]}}}
+}
+
+// buildkitesForQueue maps a job Pod or Job to the Buildkites serving its
+// queue in its namespace.
+func buildkitesForQueue(c client.Client) func(context.Context, client.Object) []reconcile.Request {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		queue, ok := obj.GetLabels()[buildkite.QueueLabel]
+		if !ok {
+			return nil
+		}
+		list := &buildkitv1alpha1.BuildkiteList{}
+		if err := c.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+			return nil
+		}
+		requests := []reconcile.Request{}
+		for i := range list.Items {
+			for _, q := range buildkite.New(&list.Items[i], nil).Queues() {
+				if q == queue {
+					requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager. Only spec changes
+// of the Buildkite trigger it, its own status updates would loop. The cache
+// only holds the Jobs and Pods carrying the queue label, see JobCacheOptions.
+func (r *BuildkiteStatusReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.NewMetricsClient != nil {
+		r.metrics = agentmetrics.NewCache(r.NewMetricsClient, statusRefresh)
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("buildkite-status").
+		For(&buildkitv1alpha1.Buildkite{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&appsv1.Deployment{}, handler.EnqueueRequestsFromMapFunc(buildkiteForController)).
+		Watches(&batchv1.Job{}, handler.EnqueueRequestsFromMapFunc(buildkitesForQueue(mgr.GetClient()))).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(buildkitesForQueue(mgr.GetClient()))).
+		Complete(r)
+}
+
+// JobCacheOptions restrict the cached Jobs and Pods to the job pods of the
+// agent stacks, the only ones the operator reads through the cache. Other
+// pods are read with the API reader.
+func JobCacheOptions() (map[client.Object]cache.ByObject, error) {
+	queue, err := labels.NewRequirement(buildkite.QueueLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	selector := labels.NewSelector().Add(*queue)
+	return map[client.Object]cache.ByObject{
+		&corev1.Pod{}:  {Label: selector},
+		&batchv1.Job{}: {Label: selector},
+	}, nil
+}
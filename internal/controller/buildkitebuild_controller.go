@@ -0,0 +1,174 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/build"
+	"cops/internal/buildkiteapi"
+	"cops/internal/pipeline"
+)
+
+// defaultPollInterval is how often an unfinished build is refreshed from Buildkite.
+const defaultPollInterval = 15 * time.Second
+
+// BuildkiteBuildReconciler reconciles a BuildkiteBuild object
+type BuildkiteBuildReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// NewBuildkiteClient builds the Buildkite API client from the API token
+	NewBuildkiteClient buildkiteapi.Factory
+	// PollInterval is how often unfinished builds are refreshed
+	PollInterval time.Duration
+}
+
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitebuilds,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitebuilds/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelines,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile creates the build in Buildkite once, then mirrors its state into
+// the status until it finishes. The creation is keyed on the resource UID so
+// a retry never creates a second build.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.17.3/pkg/reconcile
+func (r *BuildkiteBuildReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	_ = log.FromContext(ctx)
+	instance := copsv1alpha1.BuildkiteBuild{}
+
+	err := r.Get(ctx, req.NamespacedName, &instance)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if build.Finished(&instance) || !instance.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	parent := copsv1alpha1.BuildkitePipeline{}
+	err = r.Get(ctx, types.NamespacedName{Name: instance.Spec.PipelineRef.Name, Namespace: instance.Namespace}, &parent)
+	if errors.IsNotFound(err) {
+		return r.waitForPipeline(ctx, &instance, "PipelineNotFound", fmt.Sprintf("BuildkitePipeline %s not found", instance.Spec.PipelineRef.Name))
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if parent.Status.ID == "" {
+		return r.waitForPipeline(ctx, &instance, "PipelineNotSynced", fmt.Sprintf("BuildkitePipeline %s is not synced to Buildkite yet", parent.Name))
+	}
+
+	api, err := buildkiteClientFor(ctx, r.Client, r.NewBuildkiteClient, parent.Namespace, parent.Spec.TokenSecret)
+	if err != nil {
+		return ctrl.Result{}, r.setCreated(ctx, &instance, metav1.ConditionFalse, "TokenUnavailable", err.Error(), err)
+	}
+
+	org, slug := parent.Spec.Organization, pipeline.Slug(&parent)
+	if instance.Status.Number == 0 {
+		// The key is stored before the build is created so that, should the
+		// status below be lost, the next attempt finds the build.
+		if instance.Status.CreationKey == "" {
+			instance.Status.CreationKey = string(instance.UID)
+			if err := updateStatus(ctx, r.Client, &instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		remote, err := build.Create(ctx, api, org, slug, &instance, &parent)
+		if err != nil {
+			return ctrl.Result{}, r.setCreated(ctx, &instance, metav1.ConditionFalse, "APIError", err.Error(), err)
+		}
+		build.SetStatus(&instance.Status, remote)
+		if err := r.setCreated(ctx, &instance, metav1.ConditionTrue, "Created", "build created in Buildkite", nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: r.pollInterval()}, nil
+	}
+
+	remote, err := api.GetBuild(ctx, org, slug, instance.Status.Number)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	build.SetStatus(&instance.Status, remote)
+	if err := r.Status().Update(ctx, &instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	if build.Finished(&instance) {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.pollInterval()}, nil
+}
+
+// waitForPipeline reports why the build cannot be created yet and checks
+// again later, the pipeline is not watched.
+func (r *BuildkiteBuildReconciler) waitForPipeline(ctx context.Context, instance *copsv1alpha1.BuildkiteBuild, reason, message string) (ctrl.Result, error) {
+	if err := r.setCreated(ctx, instance, metav1.ConditionFalse, reason, message, nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: time.Minute}, nil
+}
+
+// setCreated records the Created condition and returns cause so it can be
+// handed back to the manager for a retry.
+func (r *BuildkiteBuildReconciler) setCreated(ctx context.Context, instance *copsv1alpha1.BuildkiteBuild, status metav1.ConditionStatus, reason, message string, cause error) error {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               copsv1alpha1.ConditionBuildCreated,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+	if err := updateStatus(ctx, r.Client, instance); err != nil {
+		return err
+	}
+	return cause
+}
+
+func (r *BuildkiteBuildReconciler) pollInterval() time.Duration {
+	if r.PollInterval > 0 {
+		return r.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// SetupWithManager sets up the controller with the Manager. Status updates,
+// its own and the webhook receiver's, do not trigger it: unfinished builds
+// are polled with RequeueAfter.
+func (r *BuildkiteBuildReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&copsv1alpha1.BuildkiteBuild{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/build"
+)
+
+// BuildkiteBuildTTLReconciler deletes finished BuildkiteBuilds once their
+// ttl_seconds_after_finished has passed, like the Job TTL controller.
+type BuildkiteBuildTTLReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Now returns the current time, time.Now by default
+	Now func() time.Time
+}
+
+// Reconcile deletes the build when it expired and requeues it for its expiry
+// otherwise.
+func (r *BuildkiteBuildTTLReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	instance := copsv1alpha1.BuildkiteBuild{}
+
+	err := r.Get(ctx, req.NamespacedName, &instance)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	expiry, ok := build.Expiry(&instance)
+	if !ok || !instance.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	if r.Now != nil {
+		now = r.Now()
+	}
+	if remaining := expiry.Sub(now); remaining > 0 {
+		return ctrl.Result{RequeueAfter: remaining}, nil
+	}
+
+	logger.Info("deleting expired build", "state", instance.Status.State, "finished", instance.Status.FinishedAt)
+	policy := client.PropagationPolicy("Background")
+	err = r.Delete(ctx, &instance, client.Preconditions{UID: &instance.UID}, policy)
+	return ctrl.Result{}, client.IgnoreNotFound(err)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BuildkiteBuildTTLReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("buildkitebuild-ttl").
+		For(&copsv1alpha1.BuildkiteBuild{}).
+		Complete(r)
+}
@@ -18,45 +18,493 @@ package controller
 
 import (
 	"context"
+	goerrors "errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+	"cops/internal/pipeline"
 )
 
+// minScheduleRefresh bounds how often the next build times of schedules are
+// refreshed. Buildkite moves them forward shortly after the scheduled build.
+const minScheduleRefresh = time.Minute
+
+// driftRefresh is how often pipelines are compared with Buildkite to catch
+// changes made there, e.g. in the UI.
+const driftRefresh = 5 * time.Minute
+
+// pipelineDrift counts the changes found in Buildkite that differ from the spec.
+var pipelineDrift = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cops_buildkitepipeline_drift_total",
+	Help: "Number of times a pipeline in Buildkite was found to differ from its BuildkitePipeline",
+}, []string{"namespace", "name"})
+
+func init() {
+	metrics.Registry.MustRegister(pipelineDrift)
+}
+
+// pipelineFinalizer archives the pipeline in Buildkite before the resource goes away.
+const pipelineFinalizer = "thecops.dev/buildkite-pipeline"
+
 // BuildkitePipelineReconciler reconciles a BuildkitePipeline object
 type BuildkitePipelineReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// NewBuildkiteClient builds the Buildkite API client from the API token
+	NewBuildkiteClient buildkiteapi.Factory
+	// Recorder records an event when the pipeline drifted in Buildkite or
+	// could not be released on deletion
+	Recorder record.EventRecorder
+	// ClusterID identifies the cluster in the ownership marker of the
+	// pipelines, so two clusters never manage the same pipeline
+	ClusterID string
 }
 
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkitepipelines,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkitepipelines/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=cops.thecops.dev,resources=buildkitepipelines/finalizers,verbs=update
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelines,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelines/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelines/finalizers,verbs=update
+//+kubebuilder:rbac:groups=thecops.dev,resources=buildkitepipelinetemplates,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the BuildkitePipeline object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// Reconcile creates or updates the pipeline and its schedules in Buildkite
+// from the spec and archives, deletes or releases it when the resource is
+// deleted, as the deletion policy says. Pipelines that exist already are only
+// adopted as the adoption policy says, and never when another resource owns
+// them. Pipelines with schedules are reconciled again when a scheduled build
+// is due, to report the next one. Steps rendered from a template are applied
+// again whenever the template renders other steps. Every pipeline is compared
+// with Buildkite periodically and changes made there are overwritten or
+// reported, as the drift policy says.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.17.3/pkg/reconcile
 func (r *BuildkitePipelineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
+	instance := copsv1alpha1.BuildkitePipeline{}
+
+	err := r.Get(ctx, req.NamespacedName, &instance)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if !instance.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.finalize(ctx, &instance)
+	}
+
+	// Objects admitted without the webhook would otherwise fail in Buildkite
+	// on every attempt, e.g. on a bad cronline.
+	if _, errs := instance.ValidateSpec(); len(errs) > 0 {
+		return ctrl.Result{}, r.setSynced(ctx, &instance, "InvalidSpec", errs.ToAggregate())
+	}
+
+	api, err := buildkiteClientFor(ctx, r.Client, r.NewBuildkiteClient, instance.Namespace, instance.Spec.TokenSecret)
+	if err != nil {
+		return ctrl.Result{}, r.setSynced(ctx, &instance, "TokenUnavailable", err)
+	}
+
+	if controllerutil.AddFinalizer(&instance, pipelineFinalizer) {
+		if err := r.Update(ctx, &instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	stepsHash := ""
+	if instance.Spec.TemplateRef != nil {
+		reason, err := r.renderSteps(ctx, &instance)
+		if err != nil {
+			return ctrl.Result{}, r.setSynced(ctx, &instance, reason, err)
+		}
+		stepsHash = pipeline.StepsHash(instance.Spec.Steps)
+	}
+
+	now := time.Now()
+	upToDate := instance.Status.ID != "" &&
+		instance.Status.ObservedGeneration == instance.Generation &&
+		instance.Status.StepsHash == stepsHash
+	next, scheduled := pipeline.NextScheduledBuild(&instance.Status)
+	if upToDate && (!scheduled || next.After(now)) && !driftCheckDue(&instance, now) {
+		return ctrl.Result{RequeueAfter: refresh(&instance, now)}, nil
+	}
+
+	var remote *buildkiteapi.Pipeline
+	if upToDate {
+		remote, err = api.GetPipeline(ctx, instance.Spec.Organization, pipeline.Slug(&instance))
+		if err == nil {
+			remote, err = r.checkDrift(ctx, api, &instance, remote)
+		}
+	} else {
+		remote, err = r.apply(ctx, api, &instance)
+		if err == nil {
+			setDrifted(&instance, metav1.ConditionFalse, "Applied", "pipeline was applied from the spec")
+		}
+	}
+	if err != nil {
+		return ctrl.Result{}, r.setSynced(ctx, &instance, syncReason(err), err)
+	}
+
+	instance.Status.ID = remote.ID
+	instance.Status.Slug = remote.Slug
+	instance.Status.WebURL = remote.WebURL
+	if err := r.syncSchedules(ctx, api, &instance, remote.GraphQLID); err != nil {
+		return ctrl.Result{}, r.setSynced(ctx, &instance, "APIError", err)
+	}
+	instance.Status.ObservedGeneration = instance.Generation
+	instance.Status.StepsHash = stepsHash
+	instance.Status.DriftCheckedAt = &metav1.Time{Time: now}
+	return ctrl.Result{RequeueAfter: refresh(&instance, now)}, r.setSynced(ctx, &instance, "Synced", nil)
+}
+
+// renderSteps renders the steps of the template the pipeline references into
+// its spec, in memory only: they are applied like inline steps. On failure it
+// returns the reason for the Synced condition.
+func (r *BuildkitePipelineReconciler) renderSteps(ctx context.Context, instance *copsv1alpha1.BuildkitePipeline) (string, error) {
+	ref := instance.Spec.TemplateRef
+	tmpl := &copsv1alpha1.BuildkitePipelineTemplate{}
+	if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: instance.Namespace}, tmpl); err != nil {
+		return "TemplateNotFound", err
+	}
+	steps, err := pipeline.Render(tmpl, ref.Values)
+	if err != nil {
+		return "TemplateInvalid", err
+	}
+	instance.Spec.Steps = steps
+	return "", nil
+}
+
+// pipelinesForTemplate maps a template to the pipelines referencing it, so
+// they are rendered again when it changes.
+func pipelinesForTemplate(c client.Client) func(context.Context, client.Object) []reconcile.Request {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		list := &copsv1alpha1.BuildkitePipelineList{}
+		if err := c.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+			return nil
+		}
+		requests := []reconcile.Request{}
+		for i := range list.Items {
+			if ref := list.Items[i].Spec.TemplateRef; ref != nil && ref.Name == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+			}
+		}
+		return requests
+	}
+}
+
+// checkDrift compares the pipeline in Buildkite with the spec. Under the
+// Enforce policy a drifted pipeline is updated from the spec, under Observe it
+// is only reported. Either way the Drifted condition lists the fields.
+func (r *BuildkitePipelineReconciler) checkDrift(ctx context.Context, api buildkiteapi.Client, instance *copsv1alpha1.BuildkitePipeline, remote *buildkiteapi.Pipeline) (*buildkiteapi.Pipeline, error) {
+	// A pipeline adopted by another resource or replaced in the meantime is
+	// only taken over again as the adoption policy says.
+	if err := pipeline.CheckAdoption(remote, instance, r.owner(instance)); err != nil {
+		return nil, err
+	}
+	body := r.request(instance)
+	diff := pipeline.Diff(remote, body)
+	if len(diff) == 0 {
+		setDrifted(instance, metav1.ConditionFalse, "InSync", "pipeline matches the spec in Buildkite")
+		return remote, nil
+	}
+
+	message := "pipeline differs from the spec in Buildkite: " + strings.Join(diff, "; ")
+	if instance.Spec.DriftPolicy == copsv1alpha1.DriftPolicyObserve {
+		// The drift is only new, and counted, when the fields changed since
+		// the last check.
+		previous := meta.FindStatusCondition(instance.Status.Conditions, copsv1alpha1.ConditionPipelineDrifted)
+		if previous == nil || previous.Status != metav1.ConditionTrue || previous.Message != message {
+			r.recordDrift(instance, "Drifted", message)
+		}
+		setDrifted(instance, metav1.ConditionTrue, "Observed", message)
+		return remote, nil
+	}
+
+	remote, err := api.UpdatePipeline(ctx, instance.Spec.Organization, pipeline.Slug(instance), body)
+	if err != nil {
+		setDrifted(instance, metav1.ConditionTrue, "EnforceFailed", message)
+		return nil, err
+	}
+	r.recordDrift(instance, "DriftCorrected", message+", overwritten")
+	setDrifted(instance, metav1.ConditionFalse, "Enforced", message+", overwritten")
+	return remote, nil
+}
+
+// recordDrift counts a drift of the pipeline and records it as an event.
+func (r *BuildkitePipelineReconciler) recordDrift(instance *copsv1alpha1.BuildkitePipeline, reason, message string) {
+	pipelineDrift.WithLabelValues(instance.Namespace, instance.Name).Inc()
+	r.event(instance, corev1.EventTypeWarning, reason, message)
+}
 
-	// TODO(user): your logic here
+// event records an event on the pipeline when a recorder is set.
+func (r *BuildkitePipelineReconciler) event(instance *copsv1alpha1.BuildkitePipeline, eventType, reason, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(instance, eventType, reason, message)
+	}
+}
+
+func setDrifted(instance *copsv1alpha1.BuildkitePipeline, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               copsv1alpha1.ConditionPipelineDrifted,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+}
+
+// driftCheckDue reports whether the pipeline is due to be compared with Buildkite.
+func driftCheckDue(instance *copsv1alpha1.BuildkitePipeline, now time.Time) bool {
+	checked := instance.Status.DriftCheckedAt
+	return checked == nil || now.Sub(checked.Time) >= driftRefresh
+}
+
+// refresh returns when the pipeline is reconciled again: when the next build
+// times in status go stale or the next drift check is due, whichever is first.
+func refresh(instance *copsv1alpha1.BuildkitePipeline, now time.Time) time.Duration {
+	after := driftRefresh
+	if checked := instance.Status.DriftCheckedAt; checked != nil {
+		after = checked.Add(driftRefresh).Sub(now)
+	}
+	if schedules := scheduleRefresh(instance, now); schedules > 0 && schedules < after {
+		after = schedules
+	}
+	if after < minScheduleRefresh {
+		return minScheduleRefresh
+	}
+	return after
+}
+
+// syncSchedules creates and updates the declared schedules, matched by label,
+// and deletes the schedules the operator created that are no longer declared.
+// Schedules created in Buildkite directly are left alone unless a declared
+// schedule has the same label, which adopts them.
+func (r *BuildkitePipelineReconciler) syncSchedules(ctx context.Context, api buildkiteapi.Client, instance *copsv1alpha1.BuildkitePipeline, pipelineID string) error {
+	if len(instance.Spec.Schedules) == 0 && len(instance.Status.Schedules) == 0 {
+		return nil
+	}
+	existing, err := api.ListSchedules(ctx, instance.Spec.Organization, pipeline.Slug(instance))
+	if err != nil {
+		return err
+	}
+	byLabel := map[string]*buildkiteapi.Schedule{}
+	for i := range existing {
+		byLabel[existing[i].Label] = &existing[i]
+	}
+
+	declared := map[string]bool{}
+	statuses := []copsv1alpha1.PipelineScheduleStatus{}
+	for i := range instance.Spec.Schedules {
+		s := &instance.Spec.Schedules[i]
+		declared[s.Label] = true
+		body := pipeline.ScheduleRequest(instance, s)
+		remote := byLabel[s.Label]
+		switch {
+		case remote == nil:
+			remote, err = api.CreateSchedule(ctx, pipelineID, body)
+		case !pipeline.ScheduleUpToDate(remote, body):
+			remote, err = api.UpdateSchedule(ctx, remote.ID, body)
+		}
+		if err != nil {
+			return fmt.Errorf("schedule %q: %w", s.Label, err)
+		}
+		statuses = append(statuses, pipeline.ScheduleStatus(remote))
+	}
+
+	managed := map[string]bool{}
+	for _, s := range instance.Status.Schedules {
+		managed[s.ID] = true
+	}
+	for _, s := range existing {
+		if managed[s.ID] && !declared[s.Label] {
+			if err := api.DeleteSchedule(ctx, s.ID); err != nil {
+				return fmt.Errorf("schedule %q: %w", s.Label, err)
+			}
+		}
+	}
+	instance.Status.Schedules = statuses
+	return nil
+}
+
+// scheduleRefresh returns when the next build times in status go stale, or
+// zero when no schedule has a next build.
+func scheduleRefresh(instance *copsv1alpha1.BuildkitePipeline, now time.Time) time.Duration {
+	next, ok := pipeline.NextScheduledBuild(&instance.Status)
+	if !ok {
+		return 0
+	}
+	if after := next.Sub(now); after > minScheduleRefresh {
+		return after
+	}
+	return minScheduleRefresh
+}
+
+// apply creates the pipeline when it does not exist yet and updates it
+// otherwise, when the resource may manage it.
+func (r *BuildkitePipelineReconciler) apply(ctx context.Context, api buildkiteapi.Client, instance *copsv1alpha1.BuildkitePipeline) (*buildkiteapi.Pipeline, error) {
+	org := instance.Spec.Organization
+	slug := pipeline.Slug(instance)
+	body := r.request(instance)
+
+	remote, err := api.GetPipeline(ctx, org, slug)
+	if buildkiteapi.IsNotFound(err) {
+		return api.CreatePipeline(ctx, org, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := pipeline.CheckAdoption(remote, instance, r.owner(instance)); err != nil {
+		return nil, err
+	}
+	return api.UpdatePipeline(ctx, org, slug, body)
+}
+
+// finalize releases the pipeline in Buildkite and drops the finalizer. When
+// the token Secret or the pipeline in Buildkite is gone, e.g. because the
+// namespace is being deleted, there is nothing left to release: the finalizer
+// is dropped all the same and an event says so.
+func (r *BuildkitePipelineReconciler) finalize(ctx context.Context, instance *copsv1alpha1.BuildkitePipeline) error {
+	if !controllerutil.ContainsFinalizer(instance, pipelineFinalizer) {
+		return nil
+	}
+	api, err := buildkiteClientFor(ctx, r.Client, r.NewBuildkiteClient, instance.Namespace, instance.Spec.TokenSecret)
+	switch {
+	case errors.IsNotFound(err):
+		r.event(instance, corev1.EventTypeWarning, "TokenSecretNotFound",
+			fmt.Sprintf("secret %s is gone, pipeline %s/%s is left as it is in Buildkite", instance.Spec.TokenSecret.Name, instance.Spec.Organization, pipeline.Slug(instance)))
+	case err != nil:
+		return err
+	default:
+		err := r.release(ctx, api, instance)
+		switch {
+		case buildkiteapi.IsNotFound(err):
+			r.event(instance, corev1.EventTypeNormal, "PipelineNotFound",
+				fmt.Sprintf("pipeline %s/%s no longer exists in Buildkite", instance.Spec.Organization, pipeline.Slug(instance)))
+		case err != nil:
+			return err
+		}
+	}
+	controllerutil.RemoveFinalizer(instance, pipelineFinalizer)
+	return r.Update(ctx, instance)
+}
+
+// release carries out the deletion policy on the pipeline in Buildkite, as
+// long as the resource owns it.
+func (r *BuildkitePipelineReconciler) release(ctx context.Context, api buildkiteapi.Client, instance *copsv1alpha1.BuildkitePipeline) error {
+	org := instance.Spec.Organization
+	slug := pipeline.Slug(instance)
+	remote, err := api.GetPipeline(ctx, org, slug)
+	if err != nil {
+		return err
+	}
+	if !pipeline.Owns(remote, instance, r.owner(instance)) {
+		return nil
+	}
+	switch instance.Spec.DeletionPolicy {
+	case copsv1alpha1.DeletionPolicyRetain:
+		// Dropping the marker lets another resource adopt the pipeline.
+		description, _ := pipeline.SplitOwner(remote.Description)
+		_, err = api.UpdatePipeline(ctx, org, slug, &buildkiteapi.PipelineRequest{Description: description})
+		return err
+	case copsv1alpha1.DeletionPolicyDelete:
+		return api.DeletePipeline(ctx, org, slug)
+	default:
+		return api.ArchivePipeline(ctx, org, slug)
+	}
+}
+
+// owner identifies the resource in the ownership marker of the pipeline.
+func (r *BuildkitePipelineReconciler) owner(instance *copsv1alpha1.BuildkitePipeline) string {
+	return pipeline.Owner(r.ClusterID, instance)
+}
+
+// request builds the create and update body, marked as owned by the resource.
+func (r *BuildkitePipelineReconciler) request(instance *copsv1alpha1.BuildkitePipeline) *buildkiteapi.PipelineRequest {
+	body := pipeline.Request(instance)
+	body.Description = pipeline.WithOwner(body.Description, r.owner(instance))
+	return body
+}
+
+// syncReason is the Synced condition reason for an error applying the pipeline.
+func syncReason(err error) string {
+	switch {
+	case goerrors.Is(err, pipeline.ErrOwnedElsewhere):
+		return "OwnedElsewhere"
+	case goerrors.Is(err, pipeline.ErrAdoptionRefused):
+		return "AdoptionRefused"
+	}
+	return "APIError"
+}
+
+// setSynced records the outcome of the reconcile in the Synced condition and
+// returns cause so it can be handed back to the manager for a retry.
+func (r *BuildkitePipelineReconciler) setSynced(ctx context.Context, instance *copsv1alpha1.BuildkitePipeline, reason string, cause error) error {
+	condition := metav1.Condition{
+		Type:               copsv1alpha1.ConditionPipelineSynced,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            "pipeline is up to date in Buildkite",
+		ObservedGeneration: instance.Generation,
+	}
+	if cause != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = cause.Error()
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, instance); err != nil {
+		return err
+	}
+	return cause
+}
 
-	return ctrl.Result{}, nil
+// buildkiteClientFor reads the API token referenced by selector and returns
+// a Buildkite API client using it.
+func buildkiteClientFor(ctx context.Context, c client.Client, factory buildkiteapi.Factory, namespace string, selector corev1.SecretKeySelector) (buildkiteapi.Client, error) {
+	if factory == nil {
+		factory = buildkiteapi.NewFactory(buildkiteapi.DefaultURL)
+	}
+	key := selector.Key
+	if key == "" {
+		key = "token"
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: selector.Name, Namespace: namespace}, secret); err != nil {
+		return nil, err
+	}
+	token := string(secret.Data[key])
+	if token == "" {
+		return nil, fmt.Errorf("secret %s has no %q key", selector.Name, key)
+	}
+	return factory(token), nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *BuildkitePipelineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&copsv1alpha1.BuildkitePipeline{}).
+		Watches(&copsv1alpha1.BuildkitePipelineTemplate{}, handler.EnqueueRequestsFromMapFunc(pipelinesForTemplate(mgr.GetClient()))).
 		Complete(r)
 }
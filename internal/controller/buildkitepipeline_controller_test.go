@@ -18,16 +18,23 @@ package controller
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	copsv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi/buildkiteapitest"
 )
 
 var _ = Describe("BuildkitePipeline Controller", func() {
@@ -82,3 +89,49 @@ var _ = Describe("BuildkitePipeline Controller", func() {
 		})
 	})
 })
+
+func TestBuildkitePipelineInvalidSchedule(t *testing.T) {
+	ctx := context.Background()
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := copsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	instance := &copsv1alpha1.BuildkitePipeline{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "ci"},
+		Spec: copsv1alpha1.BuildkitePipelineSpec{
+			Organization: "acme",
+			Repository:   "git@github.com:acme/web.git",
+			TokenSecret: corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "buildkite"},
+			},
+			Schedules: []copsv1alpha1.PipelineSchedule{{Label: "nightly", Cron: "0 25 * * *"}},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(instance, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "buildkite", Namespace: "ci"},
+			Data:       map[string][]byte{"token": []byte(buildkiteapitest.Token)},
+		}).
+		WithStatusSubresource(instance).
+		Build()
+	r := &BuildkitePipelineReconciler{Client: c, Scheme: scheme, NewBuildkiteClient: server.Factory()}
+
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "ci"}}); err == nil {
+		t.Error("expected the invalid cronline to fail the reconcile")
+	}
+	if requests := server.Requests(); len(requests) != 0 {
+		t.Errorf("sent %v for an invalid spec", requests)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Name: "web", Namespace: "ci"}, instance); err != nil {
+		t.Fatal(err)
+	}
+	synced := meta.FindStatusCondition(instance.Status.Conditions, copsv1alpha1.ConditionPipelineSynced)
+	if synced == nil || synced.Status != metav1.ConditionFalse || synced.Reason != "InvalidSpec" {
+		t.Errorf("Synced = %+v, want False InvalidSpec", synced)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkit"
+)
+
+// buildkitRefOf returns the Buildkit a Buildkite is linked to, or an empty
+// name when it is not linked.
+func buildkitRefOf(bk *buildkitv1alpha1.Buildkite) types.NamespacedName {
+	if bk.Spec.BuildkitRef == nil {
+		return types.NamespacedName{}
+	}
+	namespace := bk.Spec.BuildkitRef.Namespace
+	if namespace == "" {
+		namespace = bk.Namespace
+	}
+	return types.NamespacedName{Name: bk.Spec.BuildkitRef.Name, Namespace: namespace}
+}
+
+// referencingBuildkites lists the Buildkite stacks naming the Buildkit in
+// buildkit_ref, whether the Buildkit allows the link or not.
+func referencingBuildkites(ctx context.Context, c client.Client, name types.NamespacedName) ([]buildkitv1alpha1.Buildkite, error) {
+	list := &buildkitv1alpha1.BuildkiteList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	referencing := []buildkitv1alpha1.Buildkite{}
+	for _, bk := range list.Items {
+		if buildkitRefOf(&bk) == name {
+			referencing = append(referencing, bk)
+		}
+	}
+	return referencing, nil
+}
+
+// linkedBuildkites lists the Buildkite stacks linked to the Buildkit, that
+// is referencing it from a namespace it allows links from.
+func linkedBuildkites(ctx context.Context, c client.Client, builder *buildkitv1alpha1.Buildkit) ([]buildkitv1alpha1.Buildkite, error) {
+	referencing, err := referencingBuildkites(ctx, c, client.ObjectKeyFromObject(builder))
+	if err != nil {
+		return nil, err
+	}
+	linked := []buildkitv1alpha1.Buildkite{}
+	for _, bk := range referencing {
+		if buildkit.LinkAllowed(builder, bk.Namespace) {
+			linked = append(linked, bk)
+		}
+	}
+	return linked, nil
+}
+
+// agentNamespaces returns the sorted namespaces of the Buildkite stacks
+// linked to the Buildkit.
+func agentNamespaces(ctx context.Context, c client.Client, builder *buildkitv1alpha1.Buildkit) ([]string, error) {
+	linked, err := linkedBuildkites(ctx, c, builder)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, bk := range linked {
+		if !seen[bk.Namespace] {
+			seen[bk.Namespace] = true
+			namespaces = append(namespaces, bk.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// buildkitForBuildkite enqueues the Buildkit a Buildkite links to. On an
+// update it enqueues the previous Buildkit too, so a Buildkit the stack moved
+// away from drops it from its agent namespaces.
+var buildkitForBuildkite = handler.Funcs{
+	CreateFunc: func(_ context.Context, e event.CreateEvent, q workqueue.RateLimitingInterface) {
+		enqueueBuildkitRef(q, e.Object)
+	},
+	UpdateFunc: func(_ context.Context, e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+		enqueueBuildkitRef(q, e.ObjectOld)
+		enqueueBuildkitRef(q, e.ObjectNew)
+	},
+	DeleteFunc: func(_ context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+		enqueueBuildkitRef(q, e.Object)
+	},
+	GenericFunc: func(_ context.Context, e event.GenericEvent, q workqueue.RateLimitingInterface) {
+		enqueueBuildkitRef(q, e.Object)
+	},
+}
+
+func enqueueBuildkitRef(q workqueue.RateLimitingInterface, obj client.Object) {
+	bk, ok := obj.(*buildkitv1alpha1.Buildkite)
+	if !ok || bk.Spec.BuildkitRef == nil {
+		return
+	}
+	q.Add(reconcile.Request{NamespacedName: buildkitRefOf(bk)})
+}
+
+// buildkitesForBuildkit maps a Buildkit to the Buildkite stacks referencing
+// it, so they also notice when a link is allowed or refused.
+func buildkitesForBuildkit(c client.Client) func(context.Context, client.Object) []reconcile.Request {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		referencing, err := referencingBuildkites(ctx, c, client.ObjectKeyFromObject(obj))
+		if err != nil {
+			return nil
+		}
+		requests := []reconcile.Request{}
+		for _, bk := range referencing {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&bk)})
+		}
+		return requests
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// updateStatus writes the status of obj and retries on conflicts against the
+// latest resource version, the status computed by the caller wins. It is
+// used where losing the write would repeat a call with side effects.
+func updateStatus(ctx context.Context, c client.Client, obj client.Object) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := c.Status().Update(ctx, obj)
+		if !errors.IsConflict(err) {
+			return err
+		}
+		latest := obj.DeepCopyObject().(client.Object)
+		if getErr := c.Get(ctx, client.ObjectKeyFromObject(obj), latest); getErr != nil {
+			return getErr
+		}
+		obj.SetResourceVersion(latest.GetResourceVersion())
+		return err
+	})
+}
@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+// UnmanagedAnnotation keeps, as JSON, the settings of an imported pipeline
+// the spec cannot express, e.g. team access or visibility. The operator does
+// not manage them: they stay as they are in Buildkite.
+const UnmanagedAnnotation = "thecops.dev/unmanaged"
+
+// OwnerAnnotation records the resource managing an imported pipeline. The
+// pipeline is only adopted once that resource releases it.
+const OwnerAnnotation = "thecops.dev/imported-owner"
+
+// readOnlyFields are reported with a pipeline but are not settings of it.
+var readOnlyFields = []string{
+	"badge_url",
+	"builds_url",
+	"created_at",
+	"created_by",
+	"running_builds_count",
+	"running_jobs_count",
+	"scheduled_builds_count",
+	"scheduled_jobs_count",
+	"waiting_jobs_count",
+}
+
+// ImportOptions configure the resources written by Import.
+type ImportOptions struct {
+	// Namespace of the resources, left empty when not set
+	Namespace string
+	// TokenSecret holds the Buildkite API token used by the operator
+	TokenSecret corev1.SecretKeySelector
+}
+
+// Import reads the pipelines of org from Buildkite, with their schedules and
+// team access, and returns a BuildkitePipeline for each one, sorted by slug.
+// Archived pipelines are skipped.
+func Import(ctx context.Context, api buildkiteapi.Client, org string, opts ImportOptions) ([]buildkitv1alpha1.BuildkitePipeline, error) {
+	remotes, err := api.ListPipelines(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Slug < remotes[j].Slug })
+
+	pipelines := []buildkitv1alpha1.BuildkitePipeline{}
+	for i := range remotes {
+		remote := &remotes[i]
+		if remote.ArchivedAt != "" {
+			continue
+		}
+		schedules, err := api.ListSchedules(ctx, org, remote.Slug)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", remote.Slug, err)
+		}
+		teams, err := api.ListPipelineTeams(ctx, org, remote.Slug)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", remote.Slug, err)
+		}
+		p, err := FromRemote(org, remote, schedules, teams, opts)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", remote.Slug, err)
+		}
+		pipelines = append(pipelines, *p)
+	}
+	return pipelines, nil
+}
+
+// FromRemote builds the BuildkitePipeline declaring a pipeline read from
+// Buildkite. What the spec cannot express is kept in UnmanagedAnnotation.
+// The resource adopts the pipeline unless another resource manages it.
+func FromRemote(org string, remote *buildkiteapi.Pipeline, schedules []buildkiteapi.Schedule, teams []buildkiteapi.PipelineTeam, opts ImportOptions) (*buildkitv1alpha1.BuildkitePipeline, error) {
+	description, owner := SplitOwner(remote.Description)
+	p := &buildkitv1alpha1.BuildkitePipeline{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: buildkitv1alpha1.GroupVersion.String(),
+			Kind:       "BuildkitePipeline",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: remote.Slug, Namespace: opts.Namespace},
+		Spec: buildkitv1alpha1.BuildkitePipelineSpec{
+			Organization:        org,
+			Slug:                remote.Slug,
+			Name:                remote.Name,
+			Description:         description,
+			Repository:          remote.Repository,
+			DefaultBranch:       remote.DefaultBranch,
+			BranchConfiguration: remote.BranchConfiguration,
+			Steps:               remote.Configuration,
+			AdoptionPolicy:      buildkitv1alpha1.AdoptionPolicyAdopt,
+			TokenSecret:         opts.TokenSecret,
+		},
+	}
+	if owner != "" {
+		p.Annotations = map[string]string{OwnerAnnotation: owner}
+	}
+	if file, ok := uploadedFile(remote.Configuration); ok {
+		p.Spec.Steps = ""
+		if file != DefaultPipelineFile {
+			p.Spec.PipelineFile = file
+		}
+	}
+	if remote.Provider != nil && remote.Provider.Settings != nil {
+		s := remote.Provider.Settings
+		p.Spec.ProviderSettings = &buildkitv1alpha1.PipelineProviderSettings{
+			TriggerMode:         s.TriggerMode,
+			BuildPullRequests:   s.BuildPullRequests,
+			BuildBranches:       s.BuildBranches,
+			BuildTags:           s.BuildTags,
+			PublishCommitStatus: s.PublishCommitStatus,
+			FilterEnabled:       s.FilterEnabled,
+			FilterCondition:     s.FilterCondition,
+		}
+	}
+	for i := range schedules {
+		p.Spec.Schedules = append(p.Spec.Schedules, importSchedule(p, &schedules[i]))
+	}
+
+	unmanaged := map[string]interface{}{}
+	for k, v := range remote.Extra {
+		unmanaged[k] = v
+	}
+	for _, name := range readOnlyFields {
+		delete(unmanaged, name)
+	}
+	if len(teams) > 0 {
+		unmanaged["teams"] = teams
+	}
+	if len(unmanaged) > 0 {
+		data, err := json.Marshal(unmanaged)
+		if err != nil {
+			return nil, err
+		}
+		if p.Annotations == nil {
+			p.Annotations = map[string]string{}
+		}
+		p.Annotations[UnmanagedAnnotation] = string(data)
+	}
+	return p, nil
+}
+
+// uploadedFile returns the file uploaded when configuration is the single
+// upload step Configuration writes for a pipeline file.
+func uploadedFile(configuration string) (string, bool) {
+	fields := strings.Fields(configuration)
+	if len(fields) == 0 {
+		return "", false
+	}
+	file := fields[len(fields)-1]
+	spec := buildkitv1alpha1.BuildkitePipelineSpec{PipelineFile: file}
+	return file, strings.TrimSpace(configuration) == strings.TrimSpace(Configuration(&spec))
+}
+
+// importSchedule is the inverse of ScheduleRequest, defaults are left out.
+func importSchedule(p *buildkitv1alpha1.BuildkitePipeline, s *buildkiteapi.Schedule) buildkitv1alpha1.PipelineSchedule {
+	schedule := buildkitv1alpha1.PipelineSchedule{
+		Label:   s.Label,
+		Cron:    s.Cronline,
+		Branch:  s.Branch,
+		Commit:  s.Commit,
+		Message: s.Message,
+	}
+	if schedule.Branch == p.Spec.DefaultBranch {
+		schedule.Branch = ""
+	}
+	if schedule.Commit == DefaultScheduleCommit {
+		schedule.Commit = ""
+	}
+	for _, kv := range s.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			if schedule.Env == nil {
+				schedule.Env = map[string]string{}
+			}
+			schedule.Env[k] = v
+		}
+	}
+	if !s.Enabled {
+		disabled := false
+		schedule.Enabled = &disabled
+	}
+	return schedule
+}
+
+// Manifest renders an imported pipeline as YAML, without status, headed by a
+// comment naming the pipeline in Buildkite and the unmanaged settings.
+func Manifest(p *buildkitv1alpha1.BuildkitePipeline) ([]byte, error) {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "status")
+	if metadata, ok := doc["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("# Imported from Buildkite pipeline %s/%s.\n", p.Spec.Organization, p.Spec.Slug)
+	if _, ok := p.Annotations[UnmanagedAnnotation]; ok {
+		header += "# The " + UnmanagedAnnotation + " annotation lists the settings the spec cannot\n" +
+			"# express. The operator leaves them as they are in Buildkite.\n"
+	}
+	if owner, ok := p.Annotations[OwnerAnnotation]; ok {
+		header += "# The pipeline is managed by " + owner + ", it is only adopted once released.\n"
+	}
+	return append([]byte(header), out...), nil
+}
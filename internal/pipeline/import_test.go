@@ -0,0 +1,203 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+	"cops/internal/buildkiteapi/buildkiteapitest"
+)
+
+func TestImport(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	yes := true
+	uploaded := buildkitv1alpha1.BuildkitePipelineSpec{PipelineFile: ".buildkite/deploy.yml"}
+	server.PutPipeline("acme", buildkiteapi.Pipeline{
+		Name:          "Web",
+		Slug:          "web",
+		Repository:    "git@github.com:acme/web.git",
+		DefaultBranch: "main",
+		Configuration: Configuration(&uploaded),
+		Provider: &buildkiteapi.Provider{ID: "github", Settings: &buildkiteapi.ProviderSettings{
+			TriggerMode:       "code",
+			BuildPullRequests: &yes,
+		}},
+	})
+	server.SetPipelineFields("acme", "web", map[string]interface{}{
+		"visibility": "private",
+		"badge_url":  "https://badge.buildkite.com/web.svg",
+	})
+	server.PutPipelineTeam("acme", "web", "platform", "MANAGE_BUILD_AND_READ")
+	server.PutSchedule("acme", "web", buildkiteapi.Schedule{
+		Label:    "Nightly",
+		Cronline: "@daily",
+		Branch:   "main",
+		Commit:   "HEAD",
+		Env:      []string{"NIGHTLY=true"},
+	})
+	server.PutPipeline("acme", buildkiteapi.Pipeline{
+		Name:          "API",
+		Slug:          "api",
+		Description:   WithOwner("Public API", "prod/ci/api"),
+		Repository:    "git@github.com:acme/api.git",
+		Configuration: "steps:\n  - command: make test\n",
+	})
+	server.PutPipeline("acme", buildkiteapi.Pipeline{Name: "Old", Slug: "old", Repository: "r", ArchivedAt: "2024-01-01T00:00:00Z"})
+
+	opts := ImportOptions{
+		Namespace: "ci",
+		TokenSecret: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "buildkite-api-token"},
+			Key:                  "token",
+		},
+	}
+	pipelines, err := Import(context.Background(), server.Client(), "acme", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipelines) != 2 || pipelines[0].Name != "api" || pipelines[1].Name != "web" {
+		t.Fatalf("expected api and web, got %+v", pipelines)
+	}
+
+	api := pipelines[0]
+	if api.Spec.Steps != "steps:\n  - command: make test\n" || api.Spec.PipelineFile != "" {
+		t.Errorf("inline steps not imported: %+v", api.Spec)
+	}
+	if api.Spec.Description != "Public API" || api.Annotations[OwnerAnnotation] != "prod/ci/api" {
+		t.Errorf("owner marker not split off: %q, %v", api.Spec.Description, api.Annotations)
+	}
+	if _, ok := api.Annotations[UnmanagedAnnotation]; ok {
+		t.Errorf("unexpected annotations %v", api.Annotations)
+	}
+
+	web := pipelines[1]
+	if web.Namespace != "ci" || web.Spec.Organization != "acme" || web.Spec.Slug != "web" || web.Spec.TokenSecret.Name != "buildkite-api-token" {
+		t.Errorf("unexpected pipeline %+v", web)
+	}
+	if web.Spec.AdoptionPolicy != buildkitv1alpha1.AdoptionPolicyAdopt {
+		t.Errorf("imported pipeline is not adopted: %q", web.Spec.AdoptionPolicy)
+	}
+	if web.Spec.Steps != "" || web.Spec.PipelineFile != ".buildkite/deploy.yml" {
+		t.Errorf("upload step not imported as the pipeline file: %+v", web.Spec)
+	}
+	if s := web.Spec.ProviderSettings; s == nil || s.TriggerMode != "code" || s.BuildPullRequests == nil || !*s.BuildPullRequests {
+		t.Errorf("provider settings not imported: %+v", s)
+	}
+	if len(web.Spec.Schedules) != 1 {
+		t.Fatalf("expected a schedule, got %+v", web.Spec.Schedules)
+	}
+	s := web.Spec.Schedules[0]
+	if s.Branch != "" || s.Commit != "" || s.Env["NIGHTLY"] != "true" || s.Enabled == nil || *s.Enabled {
+		t.Errorf("unexpected schedule %+v", s)
+	}
+	if req := ScheduleRequest(&web, &s); !ScheduleUpToDate(&server.Schedules("acme", "web")[0], req) {
+		t.Error("imported schedule does not match Buildkite")
+	}
+	if diff := Diff(server.Pipeline("acme", "web"), Request(&web)); len(diff) != 0 {
+		t.Errorf("imported pipeline drifts from Buildkite: %v", diff)
+	}
+
+	unmanaged := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(web.Annotations[UnmanagedAnnotation]), &unmanaged); err != nil {
+		t.Fatal(err)
+	}
+	if unmanaged["visibility"] != "private" || unmanaged["teams"] == nil || unmanaged["badge_url"] != nil {
+		t.Errorf("unexpected unmanaged settings %v", unmanaged)
+	}
+
+	manifest, err := Manifest(&web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(manifest), "# Imported from Buildkite pipeline acme/web.\n") {
+		t.Errorf("manifest has no header:\n%s", manifest)
+	}
+	if strings.Contains(string(manifest), "status:") || strings.Contains(string(manifest), "creationTimestamp") {
+		t.Errorf("manifest carries status:\n%s", manifest)
+	}
+	decoded := buildkitv1alpha1.BuildkitePipeline{}
+	if err := yaml.Unmarshal(manifest, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Kind != "BuildkitePipeline" || decoded.Spec.PipelineFile != web.Spec.PipelineFile {
+		t.Errorf("manifest does not round trip: %+v", decoded)
+	}
+	if _, errs := decoded.ValidateSpec(); len(errs) != 0 {
+		t.Errorf("imported pipeline is not valid: %v", errs)
+	}
+}
+
+// TestApplyImportedPipeline applies an imported pipeline like the operator
+// does after adoption. Only the managed settings are sent, so team access
+// and visibility stay as they are in Buildkite.
+func TestApplyImportedPipeline(t *testing.T) {
+	server := buildkiteapitest.NewServer()
+	defer server.Close()
+	ctx := context.Background()
+	api := server.Client()
+	server.PutPipeline("acme", buildkiteapi.Pipeline{
+		Name:          "Web",
+		Slug:          "web",
+		Repository:    "git@github.com:acme/web.git",
+		DefaultBranch: "main",
+		Configuration: "steps:\n  - command: make test\n",
+	})
+	server.SetPipelineFields("acme", "web", map[string]interface{}{"visibility": "private"})
+	server.PutPipelineTeam("acme", "web", "platform", "MANAGE_BUILD_AND_READ")
+
+	pipelines, err := Import(ctx, api, "acme", ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := pipelines[0]
+	if !strings.Contains(web.Annotations[UnmanagedAnnotation], `"visibility":"private"`) {
+		t.Fatalf("visibility not imported: %v", web.Annotations)
+	}
+	web.Spec.Description = "Storefront"
+
+	req := Request(&web)
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]interface{}{}
+	if err := json.Unmarshal(data, &sent); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"visibility", "teams", "team_uuids"} {
+		if _, ok := sent[key]; ok {
+			t.Errorf("update sends the unmanaged %q setting: %s", key, data)
+		}
+	}
+
+	if _, err := api.UpdatePipeline(ctx, "acme", "web", req); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Pipeline("acme", "web").Description; got != "Storefront" {
+		t.Errorf("managed setting not applied: %q", got)
+	}
+	reimported, err := Import(ctx, api, "acme", ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reimported[0].Annotations[UnmanagedAnnotation], web.Annotations[UnmanagedAnnotation]; got != want {
+		t.Errorf("unmanaged settings changed by the update: %s, want %s", got, want)
+	}
+	teams, err := api.ListPipelineTeams(ctx, "acme", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 1 || teams[0].Team != "platform" || teams[0].AccessLevel != "MANAGE_BUILD_AND_READ" {
+		t.Errorf("team access changed by the update: %+v", teams)
+	}
+	if diff := Diff(server.Pipeline("acme", "web"), Request(&web)); len(diff) != 0 {
+		t.Errorf("applied pipeline drifts from the spec: %v", diff)
+	}
+}
@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+var (
+	// ErrOwnedElsewhere is returned for pipelines another resource, possibly
+	// in another cluster, manages.
+	ErrOwnedElsewhere = errors.New("pipeline is managed elsewhere")
+	// ErrAdoptionRefused is returned for existing pipelines no resource
+	// manages when the adoption policy is Fail.
+	ErrAdoptionRefused = errors.New("pipeline already exists in Buildkite")
+)
+
+// ownerMarker ends the description of the pipelines the operator manages.
+var ownerMarker = regexp.MustCompile(`\s*\[managed by cops: ([^\]]+)\]$`)
+
+// Owner identifies the resource managing the pipeline across clusters.
+func Owner(cluster string, p *buildkitv1alpha1.BuildkitePipeline) string {
+	owner := p.Namespace + "/" + p.Name
+	if cluster != "" {
+		owner = cluster + "/" + owner
+	}
+	return owner
+}
+
+// WithOwner appends the ownership marker of owner to a description.
+func WithOwner(description, owner string) string {
+	marker := "[managed by cops: " + owner + "]"
+	if description == "" {
+		return marker
+	}
+	return description + " " + marker
+}
+
+// SplitOwner splits the ownership marker off a description. owner is empty
+// when the description has no marker.
+func SplitOwner(description string) (rest, owner string) {
+	m := ownerMarker.FindStringSubmatchIndex(description)
+	if m == nil {
+		return description, ""
+	}
+	return description[:m[0]], description[m[2]:m[3]]
+}
+
+// Owns reports whether owner manages the pipeline in Buildkite: its marker
+// names owner, or it has no marker and is the pipeline recorded in status,
+// e.g. created before markers were written.
+func Owns(remote *buildkiteapi.Pipeline, p *buildkitv1alpha1.BuildkitePipeline, owner string) bool {
+	_, current := SplitOwner(remote.Description)
+	if current != "" {
+		return current == owner
+	}
+	return p.Status.ID != "" && p.Status.ID == remote.ID
+}
+
+// CheckAdoption returns an error unless the resource may manage the
+// pipeline in Buildkite: it owns it already, or the pipeline has no owner
+// and the adoption policy is Adopt.
+func CheckAdoption(remote *buildkiteapi.Pipeline, p *buildkitv1alpha1.BuildkitePipeline, owner string) error {
+	if Owns(remote, p, owner) {
+		return nil
+	}
+	if _, current := SplitOwner(remote.Description); current != "" {
+		return fmt.Errorf("%w: %s", ErrOwnedElsewhere, current)
+	}
+	if p.Spec.AdoptionPolicy == buildkitv1alpha1.AdoptionPolicyAdopt {
+		return nil
+	}
+	return fmt.Errorf("%w, set spec.adoption_policy to Adopt to manage it", ErrAdoptionRefused)
+}
@@ -0,0 +1,60 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+func TestOwnerMarker(t *testing.T) {
+	for _, description := range []string{"", "Web frontend", "Uses [brackets] inside"} {
+		marked := WithOwner(description, "prod/ci/web")
+		rest, owner := SplitOwner(marked)
+		if rest != description || owner != "prod/ci/web" {
+			t.Errorf("%q: split into %q and %q", marked, rest, owner)
+		}
+	}
+	if rest, owner := SplitOwner("Web frontend"); rest != "Web frontend" || owner != "" {
+		t.Errorf("description without marker split into %q and %q", rest, owner)
+	}
+}
+
+func TestCheckAdoption(t *testing.T) {
+	p := &buildkitv1alpha1.BuildkitePipeline{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "ci"}}
+	owner := Owner("prod", p)
+	if owner != "prod/ci/web" {
+		t.Fatalf("unexpected owner %q", owner)
+	}
+
+	for name, tc := range map[string]struct {
+		description string
+		statusID    string
+		policy      buildkitv1alpha1.AdoptionPolicy
+		owns        bool
+		want        error
+	}{
+		"owned":                 {description: WithOwner("Web", owner), owns: true},
+		"owned elsewhere":       {description: WithOwner("Web", "staging/ci/web"), policy: buildkitv1alpha1.AdoptionPolicyAdopt, want: ErrOwnedElsewhere},
+		"created before marker": {description: "Web", statusID: "pipeline-1", owns: true},
+		"unowned, fail":         {description: "Web", want: ErrAdoptionRefused},
+		"unowned, adopt":        {description: "Web", policy: buildkitv1alpha1.AdoptionPolicyAdopt},
+		"other pipeline":        {statusID: "pipeline-2", want: ErrAdoptionRefused},
+	} {
+		t.Run(name, func(t *testing.T) {
+			remote := &buildkiteapi.Pipeline{ID: "pipeline-1", Description: tc.description}
+			p.Status.ID = tc.statusID
+			p.Spec.AdoptionPolicy = tc.policy
+			if owns := Owns(remote, p, owner); owns != tc.owns {
+				t.Errorf("expected owns %t, got %t", tc.owns, owns)
+			}
+			err := CheckAdoption(remote, p, owner)
+			if (tc.want == nil) != (err == nil) || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
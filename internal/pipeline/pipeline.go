@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+// DefaultPipelineFile is uploaded when a pipeline declares no inline steps.
+const DefaultPipelineFile = ".buildkite/pipeline.yml"
+
+// Slug returns the Buildkite slug of the pipeline. Once created, the slug
+// reported by Buildkite wins.
+func Slug(p *buildkitv1alpha1.BuildkitePipeline) string {
+	if p.Status.Slug != "" {
+		return p.Status.Slug
+	}
+	if p.Spec.Slug != "" {
+		return p.Spec.Slug
+	}
+	return p.Name
+}
+
+// Name returns the display name of the pipeline.
+func Name(p *buildkitv1alpha1.BuildkitePipeline) string {
+	if p.Spec.Name != "" {
+		return p.Spec.Name
+	}
+	if p.Spec.Slug != "" {
+		return p.Spec.Slug
+	}
+	return p.Name
+}
+
+// Configuration returns the pipeline YAML stored in Buildkite: the inline
+// steps, or a single step uploading the pipeline file from the repository.
+func Configuration(spec *buildkitv1alpha1.BuildkitePipelineSpec) string {
+	if spec.Steps != "" {
+		return spec.Steps
+	}
+	file := spec.PipelineFile
+	if file == "" {
+		file = DefaultPipelineFile
+	}
+	return fmt.Sprintf("steps:\n  - label: \":pipeline: Upload\"\n    command: buildkite-agent pipeline upload %s\n", file)
+}
+
+// Request builds the create and update body for the pipeline.
+func Request(p *buildkitv1alpha1.BuildkitePipeline) *buildkiteapi.PipelineRequest {
+	req := &buildkiteapi.PipelineRequest{
+		Name:                Name(p),
+		Repository:          p.Spec.Repository,
+		Description:         p.Spec.Description,
+		DefaultBranch:       p.Spec.DefaultBranch,
+		BranchConfiguration: p.Spec.BranchConfiguration,
+		Configuration:       Configuration(&p.Spec),
+	}
+	if s := p.Spec.ProviderSettings; s != nil {
+		req.ProviderSettings = &buildkiteapi.ProviderSettings{
+			TriggerMode:         s.TriggerMode,
+			BuildPullRequests:   s.BuildPullRequests,
+			BuildBranches:       s.BuildBranches,
+			BuildTags:           s.BuildTags,
+			PublishCommitStatus: s.PublishCommitStatus,
+			FilterEnabled:       s.FilterEnabled,
+			FilterCondition:     s.FilterCondition,
+		}
+	}
+	return req
+}
+
+// Diff lists the fields of the pipeline in Buildkite that differ from want,
+// one "field: ..." entry per field. Fields want leaves empty are not managed
+// by the operator and never differ.
+func Diff(remote *buildkiteapi.Pipeline, want *buildkiteapi.PipelineRequest) []string {
+	var diff []string
+	str := func(field, got, want string) {
+		if want != "" && got != want {
+			diff = append(diff, fmt.Sprintf("%s: %q, want %q", field, got, want))
+		}
+	}
+	str("name", remote.Name, want.Name)
+	str("repository", remote.Repository, want.Repository)
+	str("description", remote.Description, want.Description)
+	str("default_branch", remote.DefaultBranch, want.DefaultBranch)
+	str("branch_configuration", remote.BranchConfiguration, want.BranchConfiguration)
+	if strings.TrimSpace(remote.Configuration) != strings.TrimSpace(want.Configuration) {
+		// The steps are too long to quote in a condition.
+		diff = append(diff, "configuration: steps changed")
+	}
+
+	w := want.ProviderSettings
+	if w == nil {
+		return diff
+	}
+	got := &buildkiteapi.ProviderSettings{}
+	if remote.Provider != nil && remote.Provider.Settings != nil {
+		got = remote.Provider.Settings
+	}
+	boolean := func(field string, got, want *bool) {
+		if want != nil && (got == nil || *got != *want) {
+			diff = append(diff, fmt.Sprintf("provider_settings.%s: %s, want %t", field, formatBool(got), *want))
+		}
+	}
+	str("provider_settings.trigger_mode", got.TriggerMode, w.TriggerMode)
+	boolean("build_pull_requests", got.BuildPullRequests, w.BuildPullRequests)
+	boolean("build_branches", got.BuildBranches, w.BuildBranches)
+	boolean("build_tags", got.BuildTags, w.BuildTags)
+	boolean("publish_commit_status", got.PublishCommitStatus, w.PublishCommitStatus)
+	boolean("filter_enabled", got.FilterEnabled, w.FilterEnabled)
+	str("provider_settings.filter_condition", got.FilterCondition, w.FilterCondition)
+	return diff
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*b)
+}
+
+// DefaultScheduleCommit is built by schedules naming no commit.
+const DefaultScheduleCommit = "HEAD"
+
+// ScheduleRequest builds the create and update input for a schedule. The
+// branch defaults to the default branch of the pipeline and env is sorted so
+// requests compare equal across reconciles.
+func ScheduleRequest(p *buildkitv1alpha1.BuildkitePipeline, s *buildkitv1alpha1.PipelineSchedule) *buildkiteapi.ScheduleRequest {
+	req := &buildkiteapi.ScheduleRequest{
+		Label:    s.Label,
+		Cronline: s.Cron,
+		Branch:   s.Branch,
+		Commit:   s.Commit,
+		Message:  s.Message,
+		Enabled:  s.Enabled == nil || *s.Enabled,
+	}
+	if req.Branch == "" {
+		req.Branch = p.Spec.DefaultBranch
+	}
+	if req.Commit == "" {
+		req.Commit = DefaultScheduleCommit
+	}
+	for k, v := range s.Env {
+		req.Env = append(req.Env, k+"="+v)
+	}
+	sort.Strings(req.Env)
+	return req
+}
+
+// ScheduleUpToDate reports whether a schedule in Buildkite matches req.
+func ScheduleUpToDate(s *buildkiteapi.Schedule, req *buildkiteapi.ScheduleRequest) bool {
+	env := append([]string(nil), s.Env...)
+	sort.Strings(env)
+	if len(env) != len(req.Env) {
+		return false
+	}
+	for i := range env {
+		if env[i] != req.Env[i] {
+			return false
+		}
+	}
+	return s.Label == req.Label &&
+		s.Cronline == req.Cronline &&
+		s.Branch == req.Branch &&
+		s.Commit == req.Commit &&
+		s.Message == req.Message &&
+		s.Enabled == req.Enabled
+}
+
+// ScheduleStatus records a schedule created in Buildkite.
+func ScheduleStatus(s *buildkiteapi.Schedule) buildkitv1alpha1.PipelineScheduleStatus {
+	status := buildkitv1alpha1.PipelineScheduleStatus{Label: s.Label, ID: s.ID}
+	if s.NextBuildAt != nil {
+		next := metav1.NewTime(*s.NextBuildAt)
+		status.NextBuildAt = &next
+	}
+	return status
+}
+
+// NextScheduledBuild returns the earliest next build of the schedules in
+// status. ok is false when no schedule has a next build.
+func NextScheduledBuild(status *buildkitv1alpha1.BuildkitePipelineStatus) (next time.Time, ok bool) {
+	for _, s := range status.Schedules {
+		if s.NextBuildAt != nil && (!ok || s.NextBuildAt.Time.Before(next)) {
+			next, ok = s.NextBuildAt.Time, true
+		}
+	}
+	return next, ok
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkiteapi"
+)
+
+func TestScheduleRequest(t *testing.T) {
+	p := &buildkitv1alpha1.BuildkitePipeline{Spec: buildkitv1alpha1.BuildkitePipelineSpec{DefaultBranch: "main"}}
+	disabled := false
+	s := &buildkitv1alpha1.PipelineSchedule{
+		Label: "nightly",
+		Cron:  "@daily",
+		Env:   map[string]string{"B": "2", "A": "1"},
+	}
+
+	req := ScheduleRequest(p, s)
+	if req.Branch != "main" || req.Commit != DefaultScheduleCommit || !req.Enabled {
+		t.Errorf("defaults not applied: %+v", req)
+	}
+	if len(req.Env) != 2 || req.Env[0] != "A=1" || req.Env[1] != "B=2" {
+		t.Errorf("env not sorted: %v", req.Env)
+	}
+
+	remote := &buildkiteapi.Schedule{
+		ID:       "s1",
+		Label:    "nightly",
+		Cronline: "@daily",
+		Branch:   "main",
+		Commit:   "HEAD",
+		Env:      []string{"B=2", "A=1"},
+		Enabled:  true,
+	}
+	if !ScheduleUpToDate(remote, req) {
+		t.Error("matching schedule reported out of date")
+	}
+	s.Enabled = &disabled
+	if ScheduleUpToDate(remote, ScheduleRequest(p, s)) {
+		t.Error("disabled schedule reported up to date")
+	}
+}
+
+func TestNextScheduledBuild(t *testing.T) {
+	status := &buildkitv1alpha1.BuildkitePipelineStatus{}
+	if _, ok := NextScheduledBuild(status); ok {
+		t.Error("no schedules must have no next build")
+	}
+
+	early := time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+	for _, at := range []time.Time{late, early} {
+		sc := ScheduleStatus(&buildkiteapi.Schedule{ID: "s", Label: "l", NextBuildAt: &at})
+		status.Schedules = append(status.Schedules, sc)
+	}
+	status.Schedules = append(status.Schedules, buildkitv1alpha1.PipelineScheduleStatus{Label: "disabled"})
+
+	next, ok := NextScheduledBuild(status)
+	if !ok || !next.Equal(early) {
+		t.Errorf("got %v %v, want %v", next, ok, early)
+	}
+	if !status.Schedules[1].NextBuildAt.Equal(&metav1.Time{Time: early}) {
+		t.Errorf("next build not recorded: %+v", status.Schedules[1])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	yes, no := true, false
+	p := &buildkitv1alpha1.BuildkitePipeline{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: buildkitv1alpha1.BuildkitePipelineSpec{
+			Repository:       "git@github.com:acme/web.git",
+			DefaultBranch:    "main",
+			ProviderSettings: &buildkitv1alpha1.PipelineProviderSettings{BuildPullRequests: &yes},
+		},
+	}
+	want := Request(p)
+	remote := &buildkiteapi.Pipeline{
+		Name:          "web",
+		Slug:          "web",
+		Description:   "edited in the UI",
+		Repository:    "git@github.com:acme/web.git",
+		DefaultBranch: "main",
+		Configuration: want.Configuration + "\n",
+		Provider: &buildkiteapi.Provider{Settings: &buildkiteapi.ProviderSettings{
+			BuildPullRequests: &yes,
+			BuildTags:         &no,
+		}},
+	}
+	if diff := Diff(remote, want); len(diff) != 0 {
+		t.Errorf("unmanaged fields reported as drift: %v", diff)
+	}
+
+	remote.DefaultBranch = "master"
+	remote.Configuration = "steps: []"
+	remote.Provider.Settings.BuildPullRequests = &no
+	diff := Diff(remote, want)
+	expected := []string{
+		`default_branch: "master", want "main"`,
+		"configuration: steps changed",
+		"provider_settings.build_pull_requests: false, want true",
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, diff)
+	}
+	for i := range expected {
+		if diff[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], diff[i])
+		}
+	}
+
+	remote.Provider = nil
+	if diff := Diff(remote, want); diff[len(diff)-1] != "provider_settings.build_pull_requests: unset, want true" {
+		t.Errorf("missing provider settings not reported: %v", diff)
+	}
+}
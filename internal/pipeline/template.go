@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+// templateFuncs are available to the steps of templates besides the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// quote renders a value as a YAML string, JSON strings are valid YAML.
+	"quote": func(v interface{}) (string, error) {
+		out, err := json.Marshal(fmt.Sprint(v))
+		return string(out), err
+	},
+}
+
+// Render renders the steps of a template with values, which are checked
+// against the parameters of the template. The rendered steps are validated
+// like inline steps.
+func Render(t *buildkitv1alpha1.BuildkitePipelineTemplate, values map[string]string) (string, error) {
+	typed, err := templateValues(t.Spec.Parameters, values)
+	if err != nil {
+		return "", fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(t.Spec.Steps)
+	if err != nil {
+		return "", err
+	}
+	out := bytes.Buffer{}
+	if err := tmpl.Execute(&out, map[string]interface{}{"Values": typed}); err != nil {
+		return "", err
+	}
+	steps := out.String()
+	if errs := buildkitv1alpha1.ValidatePipelineSteps([]byte(steps), field.NewPath("steps")); len(errs) > 0 {
+		return "", fmt.Errorf("template %s renders invalid steps: %w", t.Name, errs.ToAggregate())
+	}
+	return steps, nil
+}
+
+// templateValues applies the defaults of the parameters to values and
+// converts them to the type of their parameter.
+func templateValues(params []buildkitv1alpha1.PipelineTemplateParameter, values map[string]string) (map[string]interface{}, error) {
+	typed := map[string]interface{}{}
+	for _, p := range params {
+		if _, ok := typed[p.Name]; ok {
+			return nil, fmt.Errorf("parameter %q is declared twice", p.Name)
+		}
+		value, ok := values[p.Name]
+		switch {
+		case ok:
+		case p.Default != nil:
+			value = *p.Default
+		default:
+			return nil, fmt.Errorf("parameter %q is required", p.Name)
+		}
+		if len(p.Enum) > 0 && !contains(p.Enum, value) {
+			return nil, fmt.Errorf("parameter %q must be one of %v, got %q", p.Name, p.Enum, value)
+		}
+		v, err := parseValue(p.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", p.Name, err)
+		}
+		typed[p.Name] = v
+	}
+	for name := range values {
+		if _, ok := typed[name]; !ok {
+			return nil, fmt.Errorf("no parameter %q", name)
+		}
+	}
+	return typed, nil
+}
+
+func parseValue(t buildkitv1alpha1.ParameterType, value string) (interface{}, error) {
+	switch t {
+	case "", buildkitv1alpha1.ParameterTypeString:
+		return value, nil
+	case buildkitv1alpha1.ParameterTypeInteger:
+		return strconv.ParseInt(value, 10, 64)
+	case buildkitv1alpha1.ParameterTypeBoolean:
+		return strconv.ParseBool(value)
+	}
+	return nil, fmt.Errorf("unknown type %q", t)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StepsHash identifies rendered steps, to tell when a template renders
+// other steps than the ones applied.
+func StepsHash(steps string) string {
+	sum := sha256.Sum256([]byte(steps))
+	return hex.EncodeToString(sum[:])
+}
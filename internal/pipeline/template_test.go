@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+)
+
+func serviceTemplate() *buildkitv1alpha1.BuildkitePipelineTemplate {
+	queue, parallelism, deploy := "default", "1", "false"
+	return &buildkitv1alpha1.BuildkitePipelineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "service"},
+		Spec: buildkitv1alpha1.BuildkitePipelineTemplateSpec{
+			Steps: `steps:
+  - label: Test {{ .Values.repo }}
+    command: make test
+    parallelism: {{ .Values.parallelism }}
+    agents:
+      queue: {{ quote .Values.queue }}
+{{- if .Values.deploy }}
+  - wait
+  - label: Deploy
+    command: make deploy
+{{- end }}
+`,
+			Parameters: []buildkitv1alpha1.PipelineTemplateParameter{
+				{Name: "repo"},
+				{Name: "queue", Default: &queue, Enum: []string{"default", "large"}},
+				{Name: "parallelism", Type: buildkitv1alpha1.ParameterTypeInteger, Default: &parallelism},
+				{Name: "deploy", Type: buildkitv1alpha1.ParameterTypeBoolean, Default: &deploy},
+			},
+		},
+	}
+}
+
+func TestRender(t *testing.T) {
+	tmpl := serviceTemplate()
+	steps, err := Render(tmpl, map[string]string{"repo": "web", "queue": "large", "deploy": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"label: Test web", "parallelism: 1", `queue: "large"`, "label: Deploy"} {
+		if !strings.Contains(steps, want) {
+			t.Errorf("rendered steps miss %q:\n%s", want, steps)
+		}
+	}
+
+	steps, err = Render(tmpl, map[string]string{"repo": "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(steps, `queue: "default"`) || strings.Contains(steps, "Deploy") {
+		t.Errorf("defaults not applied:\n%s", steps)
+	}
+	if StepsHash(steps) == StepsHash(steps+" ") {
+		t.Error("different steps hash the same")
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		values map[string]string
+		edit   func(*buildkitv1alpha1.BuildkitePipelineTemplate)
+		want   string
+	}{
+		"required": {
+			values: map[string]string{},
+			want:   `parameter "repo" is required`,
+		},
+		"unknown value": {
+			values: map[string]string{"repo": "web", "branch": "main"},
+			want:   `no parameter "branch"`,
+		},
+		"enum": {
+			values: map[string]string{"repo": "web", "queue": "gpu"},
+			want:   `parameter "queue" must be one of`,
+		},
+		"type": {
+			values: map[string]string{"repo": "web", "parallelism": "many"},
+			want:   `parameter "parallelism"`,
+		},
+		"missing value": {
+			values: map[string]string{"repo": "web"},
+			edit: func(t *buildkitv1alpha1.BuildkitePipelineTemplate) {
+				t.Spec.Steps = "steps:\n  - command: {{ .Values.branch }}\n"
+			},
+			want: `map has no entry for key "branch"`,
+		},
+		"invalid steps": {
+			values: map[string]string{"repo": "web"},
+			edit: func(t *buildkitv1alpha1.BuildkitePipelineTemplate) {
+				t.Spec.Steps = "steps:\n  - {command: a, key: a, depends_on: a}\n"
+			},
+			want: "renders invalid steps",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpl := serviceTemplate()
+			if tc.edit != nil {
+				tc.edit(tmpl)
+			}
+			_, err := Render(tmpl, tc.values)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
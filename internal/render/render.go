@@ -0,0 +1,104 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	buildkitv1alpha1 "cops/api/v1alpha1"
+	"cops/internal/buildkit"
+	"cops/internal/buildkite"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultNamespace = "default"
+
+// Objects decodes every custom resource document in r and returns the child
+// objects the operator would create for them. No cluster access is needed.
+func Objects(r io.Reader) ([]client.Object, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	objects := []client.Object{}
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		objs, err := objectsFor(doc)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, objs...)
+	}
+	return objects, nil
+}
+
+// Render writes the child manifests of every custom resource in r to w as a
+// multi-document YAML stream.
+func Render(r io.Reader, w io.Writer) error {
+	objects, err := Objects(r)
+	if err != nil {
+		return err
+	}
+	for i, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, clientgoscheme.Scheme)
+		if err != nil {
+			return err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectsFor(doc []byte) ([]client.Object, error) {
+	meta := metav1.TypeMeta{}
+	if err := yaml.Unmarshal(doc, &meta); err != nil {
+		return nil, err
+	}
+
+	switch meta.Kind {
+	case "Buildkit":
+		instance := buildkitv1alpha1.Buildkit{}
+		if err := yaml.Unmarshal(doc, &instance); err != nil {
+			return nil, err
+		}
+		if instance.Namespace == "" {
+			instance.Namespace = defaultNamespace
+		}
+		return buildkit.New(&instance, nil).Manifests()
+	case "Buildkite":
+		instance := buildkitv1alpha1.Buildkite{}
+		if err := yaml.Unmarshal(doc, &instance); err != nil {
+			return nil, err
+		}
+		if instance.Namespace == "" {
+			instance.Namespace = defaultNamespace
+		}
+		return buildkite.New(&instance, nil).Manifests()
+	}
+	return nil, fmt.Errorf("unsupported kind %q", meta.Kind)
+}
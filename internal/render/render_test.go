@@ -0,0 +1,106 @@
+package render
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+const crs = `apiVersion: thecops.dev/v1alpha1
+kind: Buildkit
+metadata:
+  name: bk
+spec:
+  image: moby/buildkit:latest
+  max_replica: 3
+---
+apiVersion: thecops.dev/v1alpha1
+kind: Buildkite
+metadata:
+  name: agent
+  namespace: ci
+spec:
+  image: ghcr.io/buildkite/agent-stack-k8s/controller
+  secret: agent-token
+`
+
+func TestRenderIsDeterministic(t *testing.T) {
+	first, second := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := Render(strings.NewReader(crs), first); err != nil {
+		t.Fatal(err)
+	}
+	if err := Render(strings.NewReader(crs), second); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Fatalf("render output differs between runs:\n%s\n---\n%s", first, second)
+	}
+}
+
+func TestObjectsKinds(t *testing.T) {
+	objects, err := Objects(strings.NewReader(crs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Deployment", "Service", "Secret", "HorizontalPodAutoscaler",
+		"ConfigMap", "ServiceAccount", "Role", "RoleBinding", "Deployment",
+	}
+	if len(objects) != len(want) {
+		t.Fatalf("got %d objects, want %d", len(objects), len(want))
+	}
+	for i, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, clientgoscheme.Scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gvk.Kind != want[i] {
+			t.Errorf("object %d: got kind %q, want %q", i, gvk.Kind, want[i])
+		}
+	}
+}
+
+func TestObjectsUnsupportedKind(t *testing.T) {
+	if _, err := Objects(strings.NewReader("kind: Pod\n")); err == nil {
+		t.Fatal("expected an error for an unsupported kind")
+	}
+}
+
+func TestRenderGolden(t *testing.T) {
+	for _, name := range []string{"rootful", "rootless"} {
+		t.Run(name, func(t *testing.T) {
+			in, err := os.Open(filepath.Join("testdata", name+".yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+
+			out := &bytes.Buffer{}
+			if err := Render(in, out); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", name+".golden.yaml")
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(want) {
+				t.Errorf("render output does not match %s, run go test -update to refresh it:\n%s", golden, out)
+			}
+		})
+	}
+}
@@ -19,14 +19,22 @@ package e2e
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
 
-	"cops-buildkit/test/utils"
+	"cops/test/utils"
 )
 
+// awsCLIImage talks to MinIO over the same S3 API the agent uses for
+// artifacts.
+const awsCLIImage = "amazon/aws-cli:2.15.40"
+
 const namespace = "cops-buildkit-system"
 
 var _ = Describe("controller", Ordered, func() {
@@ -37,6 +45,9 @@ var _ = Describe("controller", Ordered, func() {
 		By("installing the cert-manager")
 		Expect(utils.InstallCertManager()).To(Succeed())
 
+		By("installing MinIO")
+		Expect(utils.InstallMinIO()).To(Succeed())
+
 		By("creating manager namespace")
 		cmd := exec.Command("kubectl", "create", "ns", namespace)
 		_, _ = utils.Run(cmd)
@@ -49,6 +60,9 @@ var _ = Describe("controller", Ordered, func() {
 		By("uninstalling the cert-manager bundle")
 		utils.UninstallCertManager()
 
+		By("uninstalling MinIO")
+		utils.UninstallMinIO()
+
 		By("removing manager namespace")
 		cmd := exec.Command("kubectl", "delete", "ns", namespace)
 		_, _ = utils.Run(cmd)
@@ -118,5 +132,82 @@ var _ = Describe("controller", Ordered, func() {
 			EventuallyWithOffset(1, verifyControllerUp, time.Minute, time.Second).Should(Succeed())
 
 		})
+
+		It("should point job pods at the MinIO artifact bucket", func() {
+			By("creating a Buildkite with artifact storage")
+			cmd := exec.Command("kubectl", "apply", "-f", "test/e2e/testdata/buildkite_artifacts.yaml")
+			_, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("validating the rendered agent config")
+			verifyArtifactConfig := func() error {
+				cmd := exec.Command("kubectl", "get", "configmap", "artifacts",
+					"-o", "jsonpath={.data.config\\.yaml}",
+					"-n", namespace,
+				)
+				config, err := utils.Run(cmd)
+				if err != nil {
+					return err
+				}
+				for _, want := range []string{
+					"value: s3://artifacts/e2e",
+					"value: http://minio.minio.svc:9000",
+					"name: minio-credentials",
+				} {
+					if !strings.Contains(string(config), want) {
+						return fmt.Errorf("%q not in config.yaml:\n%s", want, config)
+					}
+				}
+				return nil
+			}
+			EventuallyWithOffset(1, verifyArtifactConfig, time.Minute, time.Second).Should(Succeed())
+
+			By("uploading an artifact with the rendered job environment")
+			cmd = exec.Command("kubectl", "get", "configmap", "artifacts",
+				"-o", "jsonpath={.data.config\\.yaml}",
+				"-n", namespace,
+			)
+			config, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			rendered := struct {
+				DefaultCommandParams struct {
+					Env []corev1.EnvVar `json:"env"`
+				} `json:"default-command-params"`
+			}{}
+			ExpectWithOffset(1, yaml.Unmarshal(config, &rendered)).To(Succeed())
+			upload := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "artifact-upload", Namespace: namespace},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:  "upload",
+					Image: awsCLIImage,
+					Env:   rendered.DefaultCommandParams.Env,
+					Command: []string{"sh", "-ec", `echo e2e > /tmp/e2e.txt
+export AWS_ACCESS_KEY_ID="$BUILDKITE_S3_ACCESS_KEY_ID"
+export AWS_SECRET_ACCESS_KEY="$BUILDKITE_S3_SECRET_ACCESS_KEY"
+export AWS_DEFAULT_REGION="$BUILDKITE_S3_DEFAULT_REGION"
+if [ "$BUILDKITE_S3_FORCE_PATH_STYLE" = true ]; then
+  aws configure set default.s3.addressing_style path
+fi
+aws --endpoint-url "$BUILDKITE_S3_ENDPOINT" s3 cp /tmp/e2e.txt "$BUILDKITE_ARTIFACT_UPLOAD_DESTINATION/e2e.txt"`},
+				}}},
+			}
+			ExpectWithOffset(1, utils.RunPod(upload)).To(Succeed())
+
+			By("finding the artifact in the MinIO bucket")
+			check := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "artifact-check", Namespace: "minio"},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:  "check",
+					Image: awsCLIImage,
+					EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "minio-credentials"},
+					}}},
+					Env: []corev1.EnvVar{{Name: "AWS_DEFAULT_REGION", Value: "us-east-1"}},
+					Args: []string{"--endpoint-url", "http://minio.minio.svc:9000",
+						"s3api", "head-object", "--bucket", "artifacts", "--key", "e2e/e2e.txt"},
+				}}},
+			}
+			ExpectWithOffset(1, utils.RunPod(check)).To(Succeed())
+		})
 	})
 })
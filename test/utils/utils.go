@@ -17,12 +17,15 @@ limitations under the License.
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 
 	. "github.com/onsi/ginkgo/v2" //nolint:golint,revive
+	corev1 "k8s.io/api/core/v1"
 )
 
 const (
@@ -32,6 +35,8 @@ const (
 
 	certmanagerVersion = "v1.14.4"
 	certmanagerURLTmpl = "https://github.com/jetstack/cert-manager/releases/download/%s/cert-manager.yaml"
+
+	minioManifest = "test/e2e/testdata/minio.yaml"
 )
 
 func warnError(err error) {
@@ -103,6 +108,63 @@ func InstallCertManager() error {
 	return err
 }
 
+// InstallMinIO installs a MinIO with an "artifacts" bucket, serving as the
+// S3 compatible artifact storage of the e2e tests.
+func InstallMinIO() error {
+	cmd := exec.Command("kubectl", "apply", "-f", minioManifest)
+	if _, err := Run(cmd); err != nil {
+		return err
+	}
+	cmd = exec.Command("kubectl", "wait", "job/minio-bucket",
+		"--for", "condition=Complete",
+		"--namespace", "minio",
+		"--timeout", "5m",
+	)
+	_, err := Run(cmd)
+	return err
+}
+
+// UninstallMinIO uninstalls the MinIO
+func UninstallMinIO() {
+	cmd := exec.Command("kubectl", "delete", "-f", minioManifest)
+	if _, err := Run(cmd); err != nil {
+		warnError(err)
+	}
+}
+
+// RunPod creates the pod and waits for it to succeed. On failure the error
+// carries its logs. The pod is deleted in both cases.
+func RunPod(pod *corev1.Pod) error {
+	pod.APIVersion, pod.Kind = "v1", "Pod"
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	manifest, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("kubectl", "apply", "-f", "-")
+	cmd.Stdin = bytes.NewReader(manifest)
+	if _, err := Run(cmd); err != nil {
+		return err
+	}
+	defer func() {
+		cmd := exec.Command("kubectl", "delete", "pod", pod.Name, "--namespace", pod.Namespace, "--wait=false")
+		if _, err := Run(cmd); err != nil {
+			warnError(err)
+		}
+	}()
+
+	cmd = exec.Command("kubectl", "wait", "pod/"+pod.Name,
+		"--for", "jsonpath={.status.phase}=Succeeded",
+		"--namespace", pod.Namespace,
+		"--timeout", "3m",
+	)
+	if _, err := Run(cmd); err != nil {
+		logs, _ := Run(exec.Command("kubectl", "logs", pod.Name, "--namespace", pod.Namespace))
+		return fmt.Errorf("pod %s did not succeed: %w\n%s", pod.Name, err, logs)
+	}
+	return nil
+}
+
 // LoadImageToKindCluster loads a local docker image to the kind cluster
 func LoadImageToKindClusterWithName(name string) error {
 	cluster := "kind"